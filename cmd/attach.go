@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"fmt"
+	"gitserve/internal/instance"
+	"gitserve/internal/termui"
+
+	"github.com/spf13/cobra"
+)
+
+var attachOptions struct {
+	DetachKeys string
+}
+
+var attachCmd = &cobra.Command{
+	Use:   "attach INSTANCE[/PROCESS]",
+	Short: "Connect your terminal to a detached instance started with --tty",
+	Long: `Connects your terminal to the PTY of a detached instance that was started with
+'gitserve run -d --tty', so you can use interactive dev servers and CLIs. The recent output
+is replayed first. Type the detach keys (ctrl-p,ctrl-q by default) to leave the instance
+running and return to your shell. Output keeps being recorded to the instance's log.
+
+Only one terminal can be attached at a time; attaching again takes over the session.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		instanceID := args[0]
+
+		detachKeys, err := instance.ParseDetachKeys(attachOptions.DetachKeys)
+		if err != nil {
+			return err
+		}
+
+		instanceStore, err := openInstanceStore()
+		if err != nil {
+			return err
+		}
+		storedInst, err := findInstance(instanceStore, instanceID)
+		if err != nil {
+			return err
+		}
+		instanceID = storedInst.ID
+		if len(storedInst.Processes) > 0 {
+			return fmt.Errorf("instance '%s' has several processes; attach to one of them as %s/<process>", instanceID, instanceID)
+		}
+		if storedInst.AttachSocket == "" {
+			return fmt.Errorf("instance '%s' was not started with a TTY (use 'gitserve run -d --tty')", instanceID)
+		}
+		switch storedInst.Status {
+		case "running", "restarting", "paused":
+		default:
+			return fmt.Errorf("instance '%s' is not running (current status: %s)", instanceID, storedInst.Status)
+		}
+
+		fmt.Printf("%sAttached to instance '%s'. Type %s to detach.%s\r\n",
+			termui.ColorGray, instanceID, attachOptions.DetachKeys, termui.ColorReset)
+		detached, err := instance.Attach(instance.AttachOptions{
+			SocketPath: storedInst.AttachSocket,
+			DetachKeys: detachKeys,
+		})
+		if err != nil {
+			return err
+		}
+		if detached {
+			fmt.Printf("\n%sDetached from instance '%s'; it keeps running.%s\n", termui.ColorGray, instanceID, termui.ColorReset)
+		} else {
+			fmt.Printf("\n%sInstance '%s' ended the session.%s\n", termui.ColorGray, instanceID, termui.ColorReset)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(attachCmd)
+	attachCmd.Flags().StringVar(&attachOptions.DetachKeys, "detach-keys", instance.DefaultDetachKeys, "Key sequence that detaches from the instance, e.g. ctrl-p,ctrl-q")
+}
@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"fmt"
+	"gitserve/internal/journal"
+	"gitserve/internal/models"
+	"gitserve/internal/storage"
+	"gitserve/internal/termui"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var eventsOptions struct {
+	ID     string
+	Since  string
+	Follow bool
+}
+
+// sinceLayouts are the absolute times --since accepts, in local time unless a zone is given.
+var sinceLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+var eventsCmd = &cobra.Command{
+	Use:   "events",
+	Short: "Show the journal of instance state changes",
+	Long: `Prints the event journal: every state change of every instance, oldest first, with the
+time, the instance, the event, who caused it and its details. Events are: created, cloned,
+setup_started, setup_finished, started, ready, signal_sent, exited, pruned and removed.
+
+The actor is the user and gitserve command that caused an event, or "supervisor" for what the
+supervisor of a detached instance records (starts, restarts and exits).
+
+Examples:
+  gitserve events                      # The whole journal
+  gitserve events --id 3f2c9a1e       # One instance and its processes
+  gitserve events --since 1h -f        # The last hour, then follow new events`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		filter := journal.Filter{}
+		if eventsOptions.ID != "" {
+			instanceID, err := eventInstanceID(eventsOptions.ID)
+			if err != nil {
+				return err
+			}
+			filter.InstanceID = instanceID
+		}
+		if eventsOptions.Since != "" {
+			since, err := parseSince(eventsOptions.Since, time.Now())
+			if err != nil {
+				return err
+			}
+			filter.Since = since
+		}
+
+		events := eventJournal()
+		if eventsOptions.Follow {
+			return events.Follow(filter, printEvent)
+		}
+		recorded, err := events.Query(filter)
+		if err != nil {
+			return err
+		}
+		if len(recorded) == 0 {
+			fmt.Println("No events recorded.")
+			return nil
+		}
+		for _, event := range recorded {
+			printEvent(event)
+		}
+		return nil
+	},
+}
+
+// eventInstanceID returns the ID of the instance ref refers to, looked up among the stored
+// instances and then in the run history, which still knows removed instances. A ref that
+// matches neither is used as it is.
+func eventInstanceID(ref string) (string, error) {
+	instanceStore, err := openInstanceStore()
+	if err != nil {
+		return "", err
+	}
+	inst, found, err := storage.ResolveInstance(instanceStore, ref)
+	if err != nil || found {
+		return inst.ID, err
+	}
+	runRef, process, isProcess := strings.Cut(ref, "/")
+	run, found, err := storage.ResolveRun(instanceStore, runRef)
+	if err != nil || !found {
+		return ref, err
+	}
+	if isProcess {
+		return run.ID + "/" + process, nil
+	}
+	return run.ID, nil
+}
+
+// parseSince parses a --since value: a duration before now (e.g. "90m") or a point in time.
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range sinceLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid --since value '%s' (expected a duration like 30m or a time like 2006-01-02 15:04)", value)
+}
+
+// printEvent prints one journal event on a line.
+func printEvent(event models.Event) {
+	keys := make([]string, 0, len(event.Details))
+	for key := range event.Details {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	details := make([]string, 0, len(keys))
+	for _, key := range keys {
+		value := event.Details[key]
+		if value == "" || strings.ContainsAny(value, " \t\"=") {
+			value = strconv.Quote(value)
+		}
+		details = append(details, key+"="+value)
+	}
+	line := fmt.Sprintf("%s  %s%s%s  %s%-14s%s  %s%s%s",
+		event.Time.Local().Format("2006-01-02 15:04:05"),
+		termui.ColorBold, event.InstanceID, termui.ColorReset,
+		eventColor(event), event.Type, termui.ColorReset,
+		termui.ColorGray, event.Actor, termui.ColorReset)
+	if len(details) > 0 {
+		line += "  " + strings.Join(details, " ")
+	}
+	fmt.Println(line)
+}
+
+// eventColor picks the color an event type is shown in; failures stand out in red.
+func eventColor(event models.Event) string {
+	switch event.Type {
+	case models.EventStarted, models.EventReady:
+		return termui.ColorGreen
+	case models.EventSignalSent:
+		return termui.ColorYellow
+	case models.EventSetupFinished:
+		if event.Details["result"] != "ok" {
+			return termui.ColorRed
+		}
+	case models.EventExited:
+		status := event.Details["status"]
+		if status == "stopped" || (status == "exited" && event.Details["exit_code"] == "0") {
+			return termui.ColorGray
+		}
+		return termui.ColorRed
+	case models.EventPruned, models.EventRemoved:
+		return termui.ColorGray
+	}
+	return termui.ColorCyan
+}
+
+func init() {
+	rootCmd.AddCommand(eventsCmd)
+	eventsCmd.Flags().StringVar(&eventsOptions.ID, "id", "", "Only show events of this instance (and its processes), by ID, ID prefix or name")
+	eventsCmd.Flags().StringVar(&eventsOptions.Since, "since", "", "Only show events since a duration ago (e.g. 30m) or a time (e.g. 2006-01-02 15:04)")
+	eventsCmd.Flags().BoolVarP(&eventsOptions.Follow, "follow", "f", false, "Keep printing new events as they are recorded, until Ctrl+C")
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"gitserve/internal/instance"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+var execCmd = &cobra.Command{
+	Use:   "exec INSTANCE -- COMMAND [ARGS...]",
+	Short: "Run a one-off command inside an instance's workspace and environment",
+	Long: `Runs a command in the workspace of an existing instance, with the same environment
+variables and port values the instance was started with. The command is attached to the
+terminal and gitserve exits with its exit code.
+
+Examples:
+  gitserve exec main-brave-otter -- npm run migrate
+  gitserve exec 3f2c -- sh -c 'echo $PORT'`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if cmd.ArgsLenAtDash() != 1 || len(args) < 2 {
+			return fmt.Errorf("usage: gitserve exec INSTANCE -- COMMAND [ARGS...]")
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		instanceID, command := args[0], args[1:]
+
+		instanceStore, err := openInstanceStore()
+		if err != nil {
+			return err
+		}
+		storedInst, err := findInstance(instanceStore, instanceID)
+		if err != nil {
+			return err
+		}
+		instanceID = storedInst.ID
+		if info, err := os.Stat(storedInst.Path); err != nil || !info.IsDir() {
+			return fmt.Errorf("workspace '%s' of instance '%s' no longer exists", storedInst.Path, instanceID)
+		}
+
+		// Commands in a sandboxed instance run in a sandbox of their own, set up the same way.
+		child, err := instance.NewExecutor(storedInst.Sandbox, "", 0).Command(storedInst.Path, instance.BuildEnv(storedInst.Env), command...)
+		if err != nil {
+			return err
+		}
+		child.Stdin = os.Stdin
+		child.Stdout = os.Stdout
+		child.Stderr = os.Stderr
+
+		// The child shares our process group, so Ctrl+C reaches it directly from the terminal.
+		// Catch the signals here only so gitserve outlives the child and can report its exit code.
+		signals := make(chan os.Signal, 4)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+		defer signal.Stop(signals)
+
+		if err := child.Start(); err != nil {
+			return fmt.Errorf("failed to start '%s': %w", command[0], err)
+		}
+		go func() {
+			for sig := range signals {
+				if sig == syscall.SIGTERM { // Not sent by the terminal, so pass it on
+					_ = child.Process.Signal(sig)
+				}
+			}
+		}()
+
+		if err := child.Wait(); err != nil {
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				code := exitErr.ExitCode()
+				if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+					code = 128 + int(status.Signal())
+				}
+				// Silence cobra's "Error:" line; the command's own output says what went wrong.
+				cmd.SilenceErrors = true
+				return &instance.ExitError{Code: code}
+			}
+			return err
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(execCmd)
+}
@@ -0,0 +1,553 @@
+package cmd
+
+import (
+	"fmt"
+	"gitserve/internal/instance"
+	"gitserve/internal/models"
+	"gitserve/internal/storage"
+	"gitserve/internal/termui"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var gcOptions struct {
+	Apply bool
+}
+
+// gcMinAge is how old a workspace, log file or run without a store record has to be before gc
+// touches it: a run that is still being set up has its workspace, hook log and run record
+// before its instance is saved, and foreground runs are never saved at all.
+const gcMinAge = 10 * time.Minute
+
+// gcFinding is an inconsistency gc found, and the fix --apply makes for it. A finding without
+// a fix needs a decision gc can't make, e.g. whether a process may be killed.
+type gcFinding struct {
+	problem string
+	subject string // Instance ID, run ID or path
+	detail  string
+	action  string // What --apply does, or what the user can do
+	reclaim int64  // Disk space the fix frees, in bytes
+	fix     func() error
+}
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Find and clean up orphaned workspaces, logs and store records",
+	Long: `Cross-references the workspaces in ~/.gitserve/workspaces, the logs in ~/.gitserve/logs,
+the instance store, the run history and the running processes, and reports every
+inconsistency:
+
+  orphaned workspace   A workspace no instance refers to, e.g. left by a crashed gitserve
+  orphaned logs        Log files of an instance that is no longer in the store
+  missing workspace    A stopped instance whose workspace was deleted by hand
+  stale status         An instance recorded as running whose process is gone or whose PID was reused
+  unfinished run       A run in the history that never recorded how it ended
+  stale workspace      A run in the history whose workspace is gone
+  workspace in use     An orphaned workspace a process is still running in
+
+By default gc only reports, along with how much disk space fixing would reclaim. With
+--apply it deletes the orphaned workspaces and logs, removes the records of instances whose
+workspace is gone and brings statuses up to date. Processes are never killed: a workspace a
+process still runs in is left alone, and so is one a failed run kept with --keep-on-failure.
+Workspaces and logs modified in the last ` + gcMinAge.String() + ` are skipped, as they may belong to a
+run that is still being set up.
+
+Examples:
+  gitserve gc            # Report what would be cleaned up
+  gitserve gc --apply    # Clean it up`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		instanceStore, err := openInstanceStore()
+		if err != nil {
+			return err
+		}
+		workspacesDir, err := gitserveSubDir("workspaces")
+		if err != nil {
+			return err
+		}
+		logsDir, err := gitserveSubDir("logs")
+		if err != nil {
+			return err
+		}
+
+		findings, err := findGarbage(instanceStore, workspacesDir, logsDir, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		if len(findings) == 0 {
+			fmt.Printf("%sNothing to clean up: the workspaces, logs, store and run history agree.%s\n", termui.ColorGreen, termui.ColorReset)
+			return nil
+		}
+
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "PROBLEM\tSUBJECT\tDETAIL\tACTION\tRECLAIM")
+		var reclaimable int64
+		fixable := 0
+		for _, finding := range findings {
+			size := "-"
+			if finding.reclaim > 0 {
+				size = formatBytes(uint64(finding.reclaim))
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", finding.problem, finding.subject, finding.detail, finding.action, size)
+			if finding.fix != nil {
+				fixable++
+				reclaimable += finding.reclaim
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+
+		if !gcOptions.Apply {
+			fmt.Printf("\n%d inconsistenc%s found, %d fixable; fixing would reclaim %s%s%s.\n",
+				len(findings), plural(len(findings), "y", "ies"), fixable, termui.ColorBold, formatBytes(uint64(reclaimable)), termui.ColorReset)
+			if fixable > 0 {
+				fmt.Println("Run 'gitserve gc --apply' to fix them.")
+			}
+			return nil
+		}
+
+		fmt.Println()
+		var reclaimed int64
+		failed := 0
+		for _, finding := range findings {
+			if finding.fix == nil {
+				continue
+			}
+			if err := finding.fix(); err != nil {
+				cmd.PrintErrf("%sFailed to fix %s %s: %v%s\n", termui.ColorRed, finding.problem, finding.subject, err, termui.ColorReset)
+				failed++
+				continue
+			}
+			reclaimed += finding.reclaim
+		}
+		fmt.Printf("%sFixed %d of %d inconsistenc%s, reclaimed %s%s%s%s.%s\n",
+			termui.ColorGreen, fixable-failed, len(findings), plural(len(findings), "y", "ies"),
+			termui.ColorBold, formatBytes(uint64(reclaimed)), termui.ColorReset, termui.ColorGreen, termui.ColorReset)
+		if failed > 0 {
+			return fmt.Errorf("failed to fix %d inconsistenc%s", failed, plural(failed, "y", "ies"))
+		}
+		return nil
+	},
+}
+
+// findGarbage compares the workspaces and logs on disk, the store, the run history and the
+// running processes, and returns what doesn't add up, in the order the fixes have to be made.
+func findGarbage(instanceStore storage.InstanceStore, workspacesDir string, logsDir string, now time.Time) ([]gcFinding, error) {
+	records, err := instanceStore.GetAllInstances()
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve instances: %w", err)
+	}
+	runs, err := instanceStore.FindRuns(storage.RunFilter{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve the run history: %w", err)
+	}
+	logFiles, err := listLogFiles(logsDir)
+	if err != nil {
+		return nil, err
+	}
+	workingDirs := instance.ProcessWorkingDirs()
+
+	var findings []gcFinding
+	recordIDs := make(map[string]bool, len(records))
+	recordedPaths := make(map[string]bool)
+	alive := make(map[string]bool)
+	for _, inst := range records {
+		recordIDs[inst.ID] = true
+		if inst.Parent == "" && inst.Path != "" {
+			recordedPaths[filepath.Clean(inst.Path)] = true
+		}
+		if !isLiveStatus(inst.Status) {
+			continue
+		}
+		// Without a PID yet, it is still being started. A restarting instance has no process
+		// while its supervisor backs off; it is only stale once the supervisor is gone too.
+		if inst.PID <= 0 || (inst.Status == "restarting" && isShimAlive(inst)) {
+			alive[inst.ID] = true
+			continue
+		}
+		state := probeProcess(inst)
+		if state == processAlive {
+			alive[inst.ID] = true
+			continue
+		}
+		findings = append(findings, staleStatusFinding(instanceStore, inst, state, now))
+	}
+
+	for _, inst := range records {
+		if inst.Parent != "" || inst.Path == "" {
+			continue
+		}
+		if _, err := os.Stat(inst.Path); !os.IsNotExist(err) {
+			continue
+		}
+		group := []storage.Instance{inst}
+		for _, other := range records {
+			if other.Parent == inst.ID {
+				group = append(group, other)
+			}
+		}
+		findings = append(findings, missingWorkspaceFinding(instanceStore, group, alive, logsDir))
+	}
+
+	workspaces, err := os.ReadDir(workspacesDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read workspaces directory %s: %w", workspacesDir, err)
+	}
+	for _, entry := range workspaces {
+		path := filepath.Join(workspacesDir, entry.Name())
+		if recordedPaths[path] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) < gcMinAge {
+			continue
+		}
+		run, hasRun := workspaceRun(runs, path)
+		if hasRun && run.WorkspaceKept && run.KeepOnFailure {
+			continue // Kept for inspection; history and rerun point at it
+		}
+		if pids := processesIn(workingDirs, path); len(pids) > 0 {
+			if hasRun && !models.IsTerminalStatus(run.Status) {
+				continue // A foreground run, which has no instance record
+			}
+			findings = append(findings, gcFinding{
+				problem: "workspace in use",
+				subject: path,
+				detail:  "no instance refers to it, but " + describePIDs(pids) + " still run(s) in it",
+				action:  "none: stop the process(es) first",
+			})
+			continue
+		}
+		size, _ := instance.DirSize(path)
+		findings = append(findings, gcFinding{
+			problem: "orphaned workspace",
+			subject: path,
+			detail:  describeOrphanedWorkspace(run, hasRun),
+			action:  "delete workspace",
+			reclaim: size,
+			fix: func() error {
+				if err := os.RemoveAll(path); err != nil {
+					return err
+				}
+				return markWorkspaceGone(instanceStore, runs, path)
+			},
+		})
+	}
+
+	knownLogs := make(map[string]bool, len(records))
+	for _, inst := range records {
+		knownLogs[instance.LogFileBase(inst.ID)] = true
+	}
+	owners := make([]string, 0, len(logFiles))
+	for owner := range logFiles {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	for _, owner := range owners {
+		files := logFiles[owner]
+		if knownLogs[owner] || files.newest.After(now.Add(-gcMinAge)) {
+			continue
+		}
+		findings = append(findings, gcFinding{
+			problem: "orphaned logs",
+			subject: owner,
+			detail:  fmt.Sprintf("%d file(s) of an instance that is no longer in the store", len(files.paths)),
+			action:  "delete logs",
+			reclaim: files.size,
+			fix:     func() error { return removePaths(files.paths) },
+		})
+	}
+
+	for _, run := range runs {
+		if recordIDs[run.ID] {
+			continue // Kept up to date with its instance
+		}
+		_, statErr := os.Stat(run.Workspace)
+		workspaceGone := run.Workspace == "" || os.IsNotExist(statErr)
+		switch {
+		case !models.IsTerminalStatus(run.Status) && now.Sub(run.StartTime) >= gcMinAge &&
+			(workspaceGone || len(processesIn(workingDirs, run.Workspace)) == 0):
+			findings = append(findings, unfinishedRunFinding(instanceStore, run, workspaceGone))
+		case run.WorkspaceKept && workspaceGone:
+			findings = append(findings, gcFinding{
+				problem: "stale workspace",
+				subject: run.ID,
+				detail:  "the run history lists its workspace as kept, but it is gone",
+				action:  "mark workspace removed",
+				fix: func() error {
+					_, err := instanceStore.ModifyRun(run.ID, func(stored *storage.RunRecord) { stored.WorkspaceKept = false })
+					return err
+				},
+			})
+		}
+	}
+	return findings, nil
+}
+
+// staleStatusFinding reports an instance recorded as live whose process is gone or whose PID
+// now belongs to another process; the fix records the status the instance commands would.
+func staleStatusFinding(instanceStore storage.InstanceStore, inst storage.Instance, state processState, now time.Time) gcFinding {
+	status := endedStatus(inst, state)
+	detail := fmt.Sprintf("recorded as %s, but PID %d is gone", inst.Status, inst.PID)
+	reason := "process not found"
+	if state == processReused {
+		detail = fmt.Sprintf("recorded as %s, but PID %d belongs to another process now", inst.Status, inst.PID)
+		reason = "PID belongs to another process"
+	}
+	return gcFinding{
+		problem: "stale status",
+		subject: inst.ID,
+		detail:  detail,
+		action:  "mark " + status,
+		fix: func() error {
+			_, err := instanceStore.ModifyInstance(inst.ID, func(stored *storage.Instance) {
+				if stored.Status != inst.Status || stored.PID != inst.PID {
+					return // Changed since gc looked
+				}
+				stored.Status = status
+				stored.StopTime = now
+				stored.PausedTime = time.Time{}
+			})
+			if err != nil {
+				return err
+			}
+			eventJournal().Record(inst.ID, models.EventExited, map[string]string{
+				"pid":    strconv.Itoa(inst.PID),
+				"status": status,
+				"reason": reason,
+			})
+			if inst.Parent != "" {
+				_, err = refreshGroupStatus(instanceStore, inst.Parent)
+			}
+			return err
+		},
+	}
+}
+
+// missingWorkspaceFinding reports an instance (with its processes, group[1:]) whose workspace
+// no longer exists. Unless one of its processes is still alive, the fix removes the instance
+// from the store along with its logs, like 'gitserve remove' would.
+func missingWorkspaceFinding(instanceStore storage.InstanceStore, group []storage.Instance, alive map[string]bool, logsDir string) gcFinding {
+	inst := group[0]
+	finding := gcFinding{
+		problem: "missing workspace",
+		subject: inst.ID,
+		detail:  fmt.Sprintf("%s instance, its workspace %s is gone", inst.Status, inst.Path),
+	}
+	for _, record := range group {
+		if alive[record.ID] {
+			finding.action = "none: stop it with 'gitserve remove " + inst.ID + "'"
+			return finding
+		}
+	}
+
+	paths, reclaim := recordLogFiles(logsDir, group)
+	finding.reclaim = reclaim
+	finding.action = "remove instance and logs"
+	finding.fix = func() error {
+		err := instanceStore.Transaction(func(tx storage.InstanceStore) error {
+			for _, record := range group {
+				if err := tx.DeleteInstance(record.ID); err != nil {
+					return fmt.Errorf("failed to delete '%s' from store: %w", record.ID, err)
+				}
+			}
+			_, err := tx.ModifyRun(inst.ID, func(run *storage.RunRecord) {
+				if !models.IsTerminalStatus(run.Status) {
+					run.Status = "removed"
+					run.EndTime = time.Now().UTC()
+				}
+				run.WorkspaceKept = false
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		eventJournal().Record(inst.ID, models.EventRemoved, map[string]string{
+			"status": inst.Status,
+			"reason": "workspace missing",
+		})
+		return removePaths(paths)
+	}
+	return finding
+}
+
+// unfinishedRunFinding reports a run that never recorded how it ended, because gitserve was
+// killed while running it in the foreground or setting it up. The fix records it as ended
+// when its workspace was last changed, as far as that is known.
+func unfinishedRunFinding(instanceStore storage.InstanceStore, run storage.RunRecord, workspaceGone bool) gcFinding {
+	endTime := run.StartTime
+	if info, err := os.Stat(run.Workspace); err == nil && info.ModTime().After(endTime) {
+		endTime = info.ModTime().UTC()
+	}
+	return gcFinding{
+		problem: "unfinished run",
+		subject: run.ID,
+		detail:  fmt.Sprintf("recorded as %s since %s, with nothing running", run.Status, run.StartTime.Local().Format("01-02 15:04:05")),
+		action:  "mark exited_or_not_found",
+		fix: func() error {
+			_, err := instanceStore.ModifyRun(run.ID, func(stored *storage.RunRecord) {
+				if stored.Status != run.Status {
+					return // Changed since gc looked
+				}
+				stored.Status = "exited_or_not_found"
+				stored.EndTime = endTime
+				stored.Error = "gitserve exited before the run ended"
+				if workspaceGone {
+					stored.WorkspaceKept = false
+				}
+			})
+			return err
+		},
+	}
+}
+
+// gcLogFiles are the files in the log directory that belong to one instance or process.
+type gcLogFiles struct {
+	paths  []string
+	size   int64
+	newest time.Time // Most recent modification
+}
+
+// listLogFiles returns the files gitserve keeps in the log directory, by the LogFileBase of
+// the instance they belong to. Files gitserve doesn't name are left out.
+func listLogFiles(logsDir string) (map[string]*gcLogFiles, error) {
+	files := make(map[string]*gcLogFiles)
+	entries, err := os.ReadDir(logsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return files, nil
+		}
+		return nil, fmt.Errorf("failed to read log directory %s: %w", logsDir, err)
+	}
+	for _, entry := range entries {
+		owner, ok := instance.LogFileOwner(entry.Name())
+		if !ok {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue // Deleted in the meantime
+		}
+		path := filepath.Join(logsDir, entry.Name())
+		owned, exists := files[owner]
+		if !exists {
+			owned = &gcLogFiles{}
+			files[owner] = owned
+		}
+		owned.paths = append(owned.paths, path)
+		size, _ := instance.DirSize(path)
+		owned.size += size
+		if info.ModTime().After(owned.newest) {
+			owned.newest = info.ModTime()
+		}
+	}
+	return files, nil
+}
+
+// recordLogFiles returns the files kept in the log directory for the records (see
+// instance.LogFiles) and their total size.
+func recordLogFiles(logsDir string, records []storage.Instance) ([]string, int64) {
+	var paths []string
+	var size int64
+	for _, record := range records {
+		for _, path := range instance.LogFiles(logsDir, record.ID) {
+			fileSize, _ := instance.DirSize(path)
+			size += fileSize
+			paths = append(paths, path)
+		}
+	}
+	return paths, size
+}
+
+// processesIn returns the PIDs of the processes whose working directory is dir or below it.
+func processesIn(workingDirs map[int]string, dir string) []int {
+	var pids []int
+	for pid, cwd := range workingDirs {
+		if cwd == dir || strings.HasPrefix(cwd, dir+string(filepath.Separator)) {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+// describePIDs lists a few PIDs for a report, e.g. "PID 120, 121 and 3 more".
+func describePIDs(pids []int) string {
+	const shown = 3
+	parts := make([]string, 0, shown)
+	for i, pid := range pids {
+		if i == shown {
+			break
+		}
+		parts = append(parts, strconv.Itoa(pid))
+	}
+	description := "PID " + strings.Join(parts, ", ")
+	if len(pids) > shown {
+		description += fmt.Sprintf(" and %d more", len(pids)-shown)
+	}
+	return description
+}
+
+// workspaceRun returns the latest run in the history that used the workspace at path.
+func workspaceRun(runs []storage.RunRecord, path string) (storage.RunRecord, bool) {
+	for i := len(runs) - 1; i >= 0; i-- {
+		if runs[i].Workspace != "" && filepath.Clean(runs[i].Workspace) == path {
+			return runs[i], true
+		}
+	}
+	return storage.RunRecord{}, false
+}
+
+// describeOrphanedWorkspace tells what is known about a workspace no instance refers to.
+func describeOrphanedWorkspace(run storage.RunRecord, hasRun bool) string {
+	if !hasRun {
+		return "no instance or run refers to it"
+	}
+	return fmt.Sprintf("no instance refers to it; left by run %s (%s)", run.ID, run.Status)
+}
+
+// markWorkspaceGone records in the run history that the workspace at path was deleted.
+func markWorkspaceGone(instanceStore storage.InstanceStore, runs []storage.RunRecord, path string) error {
+	for _, run := range runs {
+		if filepath.Clean(run.Workspace) != path || !run.WorkspaceKept {
+			continue
+		}
+		if _, err := instanceStore.ModifyRun(run.ID, func(stored *storage.RunRecord) { stored.WorkspaceKept = false }); err != nil {
+			return fmt.Errorf("failed to update run '%s': %w", run.ID, err)
+		}
+	}
+	return nil
+}
+
+// removePaths deletes files and directories, ignoring those that are already gone.
+func removePaths(paths []string) error {
+	for _, path := range paths {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// plural picks the singular or plural suffix for n things.
+func plural(n int, singular string, pluralSuffix string) string {
+	if n == 1 {
+		return singular
+	}
+	return pluralSuffix
+}
+
+func init() {
+	rootCmd.AddCommand(gcCmd)
+	gcCmd.Flags().BoolVar(&gcOptions.Apply, "apply", false, "Fix the inconsistencies found instead of only reporting them")
+}
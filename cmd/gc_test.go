@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitserve/internal/logger"
+	"gitserve/internal/storage"
+)
+
+// openTestStore opens an empty JSON store in a temporary directory.
+func openTestStore(t *testing.T) storage.InstanceStore {
+	t.Helper()
+	store, err := storage.Open(storage.Location{Dir: t.TempDir(), Backend: storage.BackendJSON}, logger.NewService(logger.LogLevelError))
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	return store
+}
+
+func TestFindGarbageStaleStatus(t *testing.T) {
+	t.Setenv("HOME", t.TempDir()) // The fixes record events in ~/.gitserve
+	pid, identity, exitedPID := testPIDs(t)
+	now := time.Now().UTC()
+	records := []storage.Instance{
+		{ID: "alive", Status: "running", PID: pid, ProcessStartTime: identity.StartTime, BootID: identity.BootID},
+		{ID: "gone", Status: "running", PID: exitedPID},
+		{ID: "gone-stopping", Status: "stopping", PID: exitedPID},
+		{ID: "reused", Status: "running", PID: pid, ProcessStartTime: identity.StartTime + 1, BootID: identity.BootID},
+		{ID: "reused-paused", Status: "paused", PID: pid, ProcessStartTime: identity.StartTime + 1, BootID: identity.BootID},
+		{ID: "exited", Status: "exited", PID: exitedPID},
+	}
+	want := map[string]string{
+		"gone":          "exited_unexpectedly",
+		"gone-stopping": "stopped",
+		"reused":        "exited_or_not_found",
+		"reused-paused": "exited_or_not_found",
+	}
+
+	store := openTestStore(t)
+	for _, record := range records {
+		if err := store.AddInstance(record); err != nil {
+			t.Fatalf("AddInstance(%s) failed: %v", record.ID, err)
+		}
+	}
+	findings, err := findGarbage(store, t.TempDir(), t.TempDir(), now)
+	if err != nil {
+		t.Fatalf("findGarbage() returned error: %v", err)
+	}
+	found := make(map[string]bool)
+	for _, finding := range findings {
+		if finding.problem != "stale status" {
+			t.Errorf("unexpected finding %s %s: %s", finding.problem, finding.subject, finding.detail)
+			continue
+		}
+		found[finding.subject] = true
+		status, ok := want[finding.subject]
+		if !ok {
+			t.Errorf("%s reported as stale: %s", finding.subject, finding.detail)
+			continue
+		}
+		if finding.action != "mark "+status {
+			t.Errorf("%s: action = %q, want %q", finding.subject, finding.action, "mark "+status)
+		}
+		if err := finding.fix(); err != nil {
+			t.Fatalf("fixing %s failed: %v", finding.subject, err)
+		}
+		inst, _, err := store.GetInstanceByID(finding.subject)
+		if err != nil || inst.Status != status || !inst.StopTime.Equal(now) {
+			t.Errorf("%s after the fix: status %s, stop time %s (%v); want %s at %s", finding.subject, inst.Status, inst.StopTime, err, status, now)
+		}
+	}
+	for id := range want {
+		if !found[id] {
+			t.Errorf("%s not reported as stale", id)
+		}
+	}
+}
+
+func TestFindGarbageOrphanedWorkspaces(t *testing.T) {
+	now := time.Now().UTC()
+	workspacesDir := t.TempDir()
+	workspace := func(name string, age time.Duration) string {
+		path := filepath.Join(workspacesDir, name)
+		if err := os.Mkdir(path, 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	orphaned := workspace("orphaned", time.Hour)
+	young := workspace("young", time.Minute)
+	kept := workspace("kept", time.Hour)
+	crashed := workspace("crashed", time.Hour)
+	recorded := workspace("recorded", time.Hour)
+
+	store := openTestStore(t)
+	if err := store.AddInstance(storage.Instance{ID: "a1", Status: "stopped", Path: recorded}); err != nil {
+		t.Fatal(err)
+	}
+	runs := []storage.RunRecord{
+		// A failed foreground run that kept its workspace for inspection.
+		{ID: "r1", Status: "exited", ExitCode: 1, KeepOnFailure: true, Workspace: kept, WorkspaceKept: true, StartTime: now.Add(-2 * time.Hour)},
+		// A run gitserve was killed in the middle of.
+		{ID: "r2", Status: "exited_or_not_found", Workspace: crashed, WorkspaceKept: true, StartTime: now.Add(-2 * time.Hour)},
+	}
+	for _, run := range runs {
+		if err := store.AddRun(run); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	findings, err := findGarbage(store, workspacesDir, t.TempDir(), now)
+	if err != nil {
+		t.Fatalf("findGarbage() returned error: %v", err)
+	}
+	reported := make(map[string]bool)
+	for _, finding := range findings {
+		if finding.problem == "orphaned workspace" {
+			reported[finding.subject] = true
+		}
+	}
+	for path, want := range map[string]bool{orphaned: true, crashed: true, young: false, kept: false, recorded: false} {
+		if reported[path] != want {
+			t.Errorf("%s reported as orphaned: %v, want %v", filepath.Base(path), reported[path], want)
+		}
+	}
+}
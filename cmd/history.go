@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"fmt"
+	"gitserve/internal/storage"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var historyOptions struct {
+	Ref      string
+	Statuses []string
+	Limit    int
+}
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Show past and current runs, foreground runs included",
+	Long: `Lists the runs gitserve recorded, oldest first: the ref and commit that was checked out, the
+command, how the run ended (status and exit code), how long it took and whether its workspace
+is still there. Unlike 'list', it includes foreground runs and runs that were removed or
+pruned long ago.
+
+Use 'gitserve rerun ID' to run one of them again.
+
+Examples:
+  gitserve history                          # The last 20 runs
+  gitserve history --ref main -n 0          # Every run of main
+  gitserve history --status failed,killed   # Runs that went wrong`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		instanceStore, err := openInstanceStore()
+		if err != nil {
+			return err
+		}
+		runs, err := instanceStore.FindRuns(storage.RunFilter{Ref: historyOptions.Ref, Statuses: historyOptions.Statuses})
+		if err != nil {
+			return fmt.Errorf("failed to retrieve the run history: %w", err)
+		}
+		if len(runs) == 0 {
+			fmt.Println("No runs recorded.")
+			return nil
+		}
+		if historyOptions.Limit > 0 && len(runs) > historyOptions.Limit {
+			runs = runs[len(runs)-historyOptions.Limit:]
+		}
+
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.StripEscape)
+		fmt.Fprintln(writer, colorBold+"ID\tNAME\tREF\tSHA\tCOMMAND\tSTATUS\tEXIT\tDURATION\tWORKSPACE\tSTARTED"+colorReset)
+		for _, run := range runs {
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				run.ID,
+				formatRunName(run),
+				run.Ref,
+				shortSHA(run.SHA),
+				formatRunCommand(run),
+				runStatusColor(run)+run.Status+colorReset,
+				formatRunExit(run),
+				run.Duration().Round(time.Second),
+				formatWorkspaceKept(run),
+				run.StartTime.Local().Format("01-02 15:04:05"))
+		}
+		return writer.Flush()
+	},
+}
+
+// formatRunName shows the name of a run's instance; runs recorded before instances had names
+// have none.
+func formatRunName(run storage.RunRecord) string {
+	if run.Name == "" {
+		return "-"
+	}
+	return run.Name
+}
+
+// shortSHA abbreviates a commit hash for display.
+func shortSHA(sha string) string {
+	if sha == "" {
+		return "-"
+	}
+	if len(sha) > 12 {
+		return sha[:12]
+	}
+	return sha
+}
+
+// formatRunCommand shows what a run ran, shortened to fit a table column.
+func formatRunCommand(run storage.RunRecord) string {
+	command := run.Command
+	switch {
+	case command == "" && run.NamedCommand != "":
+		command = "(" + run.NamedCommand + ")"
+	case command == "":
+		command = "(processes)"
+	}
+	command = strings.Join(strings.Fields(command), " ")
+	if len(command) > 40 {
+		command = command[:37] + "..."
+	}
+	return command
+}
+
+// formatRunExit shows how a finished run's command exited: its exit code or signal.
+func formatRunExit(run storage.RunRecord) string {
+	switch {
+	case run.EndTime.IsZero():
+		return "-"
+	case run.ExitSignal != "":
+		return run.ExitSignal
+	case run.Error != "" && run.ExitCode == 0:
+		return "-"
+	}
+	return fmt.Sprintf("%d", run.ExitCode)
+}
+
+// formatWorkspaceKept tells whether a run's workspace is still there.
+func formatWorkspaceKept(run storage.RunRecord) string {
+	if run.WorkspaceKept {
+		return "kept"
+	}
+	return "removed"
+}
+
+// runStatusColor picks the color the status of a run is shown in; failures stand out in red.
+func runStatusColor(run storage.RunRecord) string {
+	switch run.Status {
+	case "running", "starting", "setup", "idle":
+		return colorGreen
+	case "exited":
+		if run.ExitCode != 0 || run.Error != "" {
+			return colorRed
+		}
+		return colorGray
+	case "stopped", "removed":
+		return colorGray
+	case "paused", "stopping", "restarting", "degraded":
+		return colorYellow
+	}
+	return colorRed
+}
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+	historyCmd.Flags().StringVar(&historyOptions.Ref, "ref", "", "Only show runs of this ref (branch, tag, short commit or pr-<number>)")
+	historyCmd.Flags().StringSliceVar(&historyOptions.Statuses, "status", nil, "Only show runs with one of these statuses (e.g. failed,killed)")
+	historyCmd.Flags().IntVarP(&historyOptions.Limit, "limit", "n", 20, "Show only the most recent runs; 0 shows all")
+}
@@ -1,13 +1,15 @@
 package cmd
 
 import (
-	"errors"
 	"fmt"
+	"gitserve/internal/instance"
+	"gitserve/internal/models"
 	"gitserve/internal/storage"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
-	"syscall"
 	"text/tabwriter"
 	"time"
 
@@ -25,104 +27,109 @@ const (
 	colorBold   = "\033[1m"
 )
 
-const pruneAge = 1 * time.Minute // Instances stopped longer than this will be pruned by list
+var listOptions struct {
+	Sort       string // start, mem, cpu or disk
+	Selector   string
+	ShowLabels bool
+}
 
 var listCmd = &cobra.Command{
 	Use:   "list",
-	Short: "List instances, update status, and prune old stopped instances",
-	Long:  `Displays gitserve instances, updates status based on PID liveness, and prunes instances stopped for more than ` + pruneAge.String() + ` along with their workspaces.`,
+	Short: "List instances and their status",
+	Long: `Displays gitserve instances with their status, checked against PID liveness. Stopped instances
+are listed until they are removed, by 'gitserve remove' or 'gitserve prune'. list never changes
+the store: an instance whose process is gone without its exit being recorded is shown as such,
+and 'gitserve gc --apply' records it.
+
+CPU and MEM are summed over each running instance's whole process tree; DISK is the size of its
+workspace, re-measured at most every few minutes. The last row shows the totals.
+
+With -l only the instances whose labels match the selector are listed, e.g. 'gitserve list -l
+team=web,ref!=main'. Besides the labels given with 'gitserve run --label', every instance has
+the labels project, ref, ref-type (branch, tag, commit or pr) and, if it runs a named command,
+command.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		homeDir, err := os.UserHomeDir()
+		instanceStore, err := openInstanceStore()
 		if err != nil {
-			return fmt.Errorf("failed to get home directory: %w", err)
+			return err
 		}
-		storeDataPath := filepath.Join(homeDir, ".gitserve", "store")
 
-		instanceStore, err := storage.NewJSONInstanceStore(storeDataPath)
+		selector, err := models.ParseSelector(listOptions.Selector)
 		if err != nil {
-			return fmt.Errorf("failed to initialize instance store: %w", err)
+			return err
 		}
-
-		instances, err := instanceStore.GetAllInstances()
+		// Processes carry the labels of their instance, so they are selected along with it.
+		instances, err := instanceStore.FindInstances(storage.InstanceFilter{Selector: selector})
 		if err != nil {
 			return fmt.Errorf("failed to retrieve instances: %w", err)
 		}
 
-		var instancesToDisplay []storage.Instance
+		switch listOptions.Sort {
+		case "start", "mem", "cpu", "disk":
+		default:
+			return fmt.Errorf("invalid --sort value '%s' (expected start, mem, cpu or disk)", listOptions.Sort)
+		}
+
+		var groups [][]storage.Instance // Each instance followed by its processes, if any
 		processedTime := time.Now().UTC()
 
+		// Records with a process of their own are probed first, so the status of
+		// multi-process instances can be derived from their processes afterwards.
+		processesByParent := make(map[string][]storage.Instance)
+		var topLevel []storage.Instance
+		gone := 0
 		for _, inst := range instances {
 			currentInst := inst
-			needsStoreUpdate := false
-			originalStatus := currentInst.Status
-
-			if (strings.ToLower(currentInst.Status) == "running" || strings.ToLower(currentInst.Status) == "stopping") && currentInst.PID > 0 {
-				process, _ := os.FindProcess(currentInst.PID) // Error can be ignored here, Signal will fail if PID is bad.
-				if err := process.Signal(syscall.Signal(0)); err != nil {
-					if errors.Is(err, os.ErrProcessDone) || strings.Contains(strings.ToLower(err.Error()), "no such process") {
-						if strings.ToLower(originalStatus) == "running" {
-							currentInst.Status = "exited_unexpectedly"
-						} else { // Was "stopping"
-							currentInst.Status = "stopped"
-						}
-						currentInst.StopTime = processedTime
-						needsStoreUpdate = true
-						cmd.Printf("(Auto-updated ID %s: status '%s' -> '%s', PID %d not found)\n", currentInst.ID, originalStatus, currentInst.Status, currentInst.PID)
-					}
+			if len(currentInst.Processes) == 0 {
+				currentInst = probeInstance(currentInst, processedTime)
+				if currentInst.Status != inst.Status {
+					gone++
 				}
 			}
-
-			// Pruning logic
-			isTerminalStatus := false
-			switch strings.ToLower(currentInst.Status) {
-			case "stopped", "exited_unexpectedly", "failed", "exited_or_not_found", "error_pid_zero":
-				isTerminalStatus = true
+			if currentInst.Parent != "" {
+				processesByParent[currentInst.Parent] = append(processesByParent[currentInst.Parent], currentInst)
+				continue
 			}
+			topLevel = append(topLevel, currentInst)
+		}
 
-			if isTerminalStatus {
-				if currentInst.StopTime.IsZero() { // If StopTime wasn't set (e.g. old record or manual edit)
-					currentInst.StopTime = processedTime // Set it now
-					needsStoreUpdate = true
-				}
-				if time.Since(currentInst.StopTime.In(time.UTC)) > pruneAge {
-					cmd.Printf("(Pruning old instance ID %s: status '%s', stopped at %s)...\n", currentInst.ID, currentInst.Status, currentInst.StopTime.Local().Format(time.RFC3339))
-					if errDel := instanceStore.DeleteInstance(currentInst.ID); errDel != nil {
-						cmd.PrintErrf("  Error deleting instance %s from store: %v\n", currentInst.ID, errDel)
-					} else {
-						cmd.Printf("  Instance %s removed from store.\n", currentInst.ID)
-					}
-					if currentInst.Path != "" {
-						if errRm := os.RemoveAll(currentInst.Path); errRm != nil {
-							cmd.PrintErrf("  Error cleaning up workspace '%s': %v\n", currentInst.Path, errRm)
-						} else {
-							cmd.Printf("  Workspace '%s' cleaned up.\n", currentInst.Path)
-						}
+		for _, inst := range topLevel {
+			currentInst := inst
+			processes := processesByParent[currentInst.ID]
+			if len(currentInst.Processes) > 0 && len(processes) > 0 {
+				if status := aggregateStatus(processes); status != currentInst.Status {
+					currentInst.Status = status
+					if isLiveStatus(status) || status == "degraded" {
+						currentInst.StopTime = time.Time{}
+					} else if currentInst.StopTime.IsZero() {
+						currentInst.StopTime = processedTime
 					}
-					needsStoreUpdate = false // Already deleted, no further update needed for this one.
-					continue                 // Skip adding to display list
-				}
-			}
-
-			if needsStoreUpdate {
-				if updateErr := instanceStore.UpdateInstance(currentInst.ID, currentInst); updateErr != nil {
-					cmd.PrintErrf("Error updating store for instance %s: %v\n", currentInst.ID, updateErr)
-					// if update fails, add original inst to display
-					instancesToDisplay = append(instancesToDisplay, inst)
-					continue
 				}
 			}
-			instancesToDisplay = append(instancesToDisplay, currentInst)
+			groups = append(groups, append([]storage.Instance{currentInst}, orderProcesses(currentInst, processes)...))
 		}
 
-		if len(instancesToDisplay) == 0 {
-			fmt.Println("No active or recently stopped instances found.")
+		if len(groups) == 0 {
+			fmt.Println("No instances found.")
 			return nil
 		}
 
+		usage := measureListUsage(cmd, groups)
+		sortGroups(groups, usage, listOptions.Sort)
+		var instancesToDisplay []storage.Instance
+		for _, group := range groups {
+			instancesToDisplay = append(instancesToDisplay, group...)
+		}
+
 		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.StripEscape) // Pad 2, strip escape for color calcs
-		fmt.Fprintln(writer, colorBold+"ID\tNAME\tPID\tPORT\tSTATUS\tPATH\tSTART TIME\tSTOP TIME"+colorReset)
-		fmt.Fprintln(writer, colorBold+"--\t----\t---\t----\t------\t----\t----------\t---------"+colorReset)
+		header, underline := "ID\tNAME\tPID\tPORT\tSTATUS\tCPU\tMEM\tDISK\tPATH\tSTART TIME\tSTOP TIME", "--\t----\t---\t----\t------\t---\t---\t----\t----\t----------\t---------"
+		if listOptions.ShowLabels {
+			header, underline = header+"\tLABELS", underline+"\t------"
+		}
+		fmt.Fprintln(writer, colorBold+header+colorReset)
+		fmt.Fprintln(writer, colorBold+underline+colorReset)
 
+		var total recordUsage
 		for _, instToDisplay := range instancesToDisplay {
 			startTimeFormatted := "N/A"
 			if !instToDisplay.StartTime.IsZero() {
@@ -133,20 +140,7 @@ var listCmd = &cobra.Command{
 				stopTimeFormatted = instToDisplay.StopTime.Local().Format("01-02 15:04:05")
 			}
 
-			statusColor := colorReset
-			switch strings.ToLower(instToDisplay.Status) {
-			case "running":
-				statusColor = colorGreen
-			case "stopping":
-				statusColor = colorYellow
-			case "stopped", "exited_or_not_found":
-				statusColor = colorGray
-			case "failed", "error_pid_zero", "exited_unexpectedly":
-				statusColor = colorRed
-			default:
-				statusColor = colorCyan
-			}
-			coloredStatus := statusColor + instToDisplay.Status + colorReset
+			coloredStatus := statusColor(instToDisplay) + formatStatus(instToDisplay) + colorReset
 
 			displayPath := instToDisplay.Path
 			maxPathLen := 35
@@ -154,23 +148,297 @@ var listCmd = &cobra.Command{
 				displayPath = "..." + displayPath[len(displayPath)-maxPathLen+3:]
 			}
 
-			fmt.Fprintf(writer, "%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\n",
-				instToDisplay.ID,
-				instToDisplay.Name,
-				instToDisplay.PID,
-				instToDisplay.Port,
+			displayID, displayName := instToDisplay.ID, instToDisplay.Name
+			if instToDisplay.Parent != "" {
+				// Sub-row under its instance
+				displayID, displayName, displayPath = "  └ "+instToDisplay.Process, instToDisplay.Process, ""
+			}
+
+			recUsage := usage[instToDisplay.ID]
+			if instToDisplay.Parent == "" {
+				total.add(recUsage)
+			}
+
+			labelsColumn := ""
+			if listOptions.ShowLabels && instToDisplay.Parent == "" { // Processes have the labels of their instance
+				labelsColumn = "\t" + formatLabels(instToDisplay.Labels)
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s%s\n",
+				displayID,
+				displayName,
+				formatPID(instToDisplay),
+				formatPort(instToDisplay),
 				coloredStatus,
+				recUsage.formatCPU(),
+				recUsage.formatMem(),
+				recUsage.formatDisk(),
 				displayPath,
 				startTimeFormatted,
 				stopTimeFormatted,
+				labelsColumn,
 			)
 		}
+		fmt.Fprintf(writer, "%sTOTAL\t\t\t\t\t%s\t%s\t%s\t\t\t%s\n",
+			colorBold, total.formatCPU(), total.formatMem(), total.formatDisk(), colorReset)
 		writer.Flush()
 
+		if gone > 0 {
+			fmt.Printf("\n%s%d %s no longer running, but not recorded as stopped; 'gitserve gc --apply' records %s.%s\n",
+				colorYellow, gone, plural(gone, "process is", "processes are"), plural(gone, "it", "them"), colorReset)
+		}
+
+		for _, instToDisplay := range instancesToDisplay {
+			if instToDisplay.Status != "crash_loop" {
+				continue
+			}
+			fmt.Printf("\n%sInstance %s is in a crash loop after %d restarts. Last log lines:%s\n",
+				colorRed, instToDisplay.ID, instToDisplay.Restarts, colorReset)
+			for _, line := range instToDisplay.CrashLog {
+				fmt.Printf("  %s%s%s\n", colorGray, line, colorReset)
+			}
+		}
+
 		return nil
 	},
 }
 
+// probeInstance checks whether the process of a running, stopping or paused record still
+// exists. If it is gone or its PID was reused, it returns the record with the status gc would
+// record for it; the store is left alone.
+func probeInstance(inst storage.Instance, processedTime time.Time) storage.Instance {
+	// Paused (SIGSTOP'ed) processes still exist and answer signal 0, so they are probed like running ones.
+	probeStatus := strings.ToLower(inst.Status)
+	if (probeStatus != "running" && probeStatus != "stopping" && probeStatus != "paused") || inst.PID <= 0 {
+		return inst
+	}
+	state := probeProcess(inst)
+	if state == processAlive {
+		return inst
+	}
+
+	probed := inst
+	probed.Status = endedStatus(inst, state)
+	probed.PausedTime = time.Time{}
+	probed.StopTime = processedTime
+	return probed
+}
+
+// orderProcesses returns the process records of a multi-process instance in the order of
+// its Processes list.
+func orderProcesses(parent storage.Instance, processes []storage.Instance) []storage.Instance {
+	ordered := make([]storage.Instance, 0, len(processes))
+	for _, name := range parent.Processes {
+		for _, process := range processes {
+			if process.Process == name {
+				ordered = append(ordered, process)
+			}
+		}
+	}
+	return ordered
+}
+
+// statusColor picks the color a status is rendered with.
+func statusColor(inst storage.Instance) string {
+	switch strings.ToLower(inst.Status) {
+	case "running":
+		return colorGreen
+	case "stopping", "killed", "restarting", "degraded":
+		return colorYellow
+	case "paused":
+		return colorCyan
+	case "stopped", "exited_or_not_found":
+		return colorGray
+	case "exited":
+		if inst.ExitCode != 0 {
+			return colorRed
+		}
+		return colorGray
+	case "failed", "error_pid_zero", "exited_unexpectedly", "crash_loop":
+		return colorRed
+	default:
+		return colorCyan
+	}
+}
+
+// formatPID renders the PID column; multi-process instances show their processes' PIDs in sub-rows.
+func formatPID(inst storage.Instance) string {
+	if len(inst.Processes) > 0 {
+		return "-"
+	}
+	return strconv.Itoa(inst.PID)
+}
+
+// formatPort renders the PORT column.
+func formatPort(inst storage.Instance) string {
+	if len(inst.Processes) > 0 && inst.Port == 0 {
+		return "-"
+	}
+	return strconv.Itoa(inst.Port)
+}
+
+// formatStatus renders the status together with the exit details recorded by the
+// supervisor shim, e.g. "exited(1)" or "killed(SIGKILL)", or the resource limit the process
+// ran into instead, e.g. "killed: RLIMIT_AS".
+// Instances that were restarted by their supervisor get the restart count appended.
+func formatStatus(inst storage.Instance) string {
+	status := inst.Status
+	switch strings.ToLower(inst.Status) {
+	case "exited":
+		status = fmt.Sprintf("%s(%d)", inst.Status, inst.ExitCode)
+	case "killed", "stopped":
+		if inst.ExitSignal != "" {
+			status = fmt.Sprintf("%s(%s)", inst.Status, inst.ExitSignal)
+		}
+	}
+	if inst.LimitViolation != "" {
+		switch strings.ToLower(inst.Status) {
+		case "exited", "killed", "crash_loop":
+			status = fmt.Sprintf("%s: %s", inst.Status, inst.LimitViolation)
+		}
+	}
+	if inst.Restarts > 0 {
+		status = fmt.Sprintf("%s [%d restarts]", status, inst.Restarts)
+	}
+	return status
+}
+
+// listSampleInterval is how long list watches the CPU time of running instances.
+const listSampleInterval = 250 * time.Millisecond
+
+// recordUsage is what list shows in the CPU, MEM and DISK columns of a record.
+type recordUsage struct {
+	live    bool // CPU and memory were measured
+	cpu     float64
+	rss     uint64
+	hasDisk bool
+	disk    int64
+}
+
+func (u *recordUsage) add(other recordUsage) {
+	u.live = u.live || other.live
+	u.cpu += other.cpu
+	u.rss += other.rss
+	u.hasDisk = u.hasDisk || other.hasDisk
+	u.disk += other.disk
+}
+
+func (u recordUsage) formatCPU() string {
+	if !u.live {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", u.cpu)
+}
+
+func (u recordUsage) formatMem() string {
+	if !u.live {
+		return "-"
+	}
+	return formatBytes(u.rss)
+}
+
+func (u recordUsage) formatDisk() string {
+	if !u.hasDisk {
+		return "-"
+	}
+	return formatBytes(uint64(u.disk))
+}
+
+// measureListUsage measures the CPU and memory used by the process trees of live records and
+// the disk used by each instance's workspace, by record ID. A multi-process instance gets the
+// sum of its processes. Workspace sizes are cached in ~/.gitserve/cache.
+func measureListUsage(cmd *cobra.Command, groups [][]storage.Instance) map[string]recordUsage {
+	var pids []int
+	for _, group := range groups {
+		for _, inst := range group {
+			if len(inst.Processes) == 0 && inst.PID > 0 && isLiveStatus(inst.Status) {
+				pids = append(pids, inst.PID)
+			}
+		}
+	}
+	var trees map[int]instance.Usage
+	if len(pids) > 0 {
+		trees = instance.MeasureUsage(pids, listSampleInterval)
+	}
+
+	var diskCache *instance.DiskUsageCache
+	if cacheDir, err := gitserveSubDir("cache"); err == nil {
+		diskCache = instance.LoadDiskUsageCache(filepath.Join(cacheDir, "disk_usage.json"))
+	}
+
+	usage := make(map[string]recordUsage)
+	for _, group := range groups {
+		parent := group[0]
+		var groupUsage recordUsage
+		for _, inst := range group {
+			if len(inst.Processes) > 0 || !isLiveStatus(inst.Status) {
+				continue
+			}
+			if tree, ok := trees[inst.PID]; ok {
+				recUsage := recordUsage{live: true, cpu: tree.CPUPercent, rss: tree.RSS}
+				usage[inst.ID] = recUsage
+				groupUsage.add(recUsage)
+			}
+		}
+		if diskCache != nil && parent.Path != "" {
+			if size, err := diskCache.Size(parent.Path); err == nil {
+				groupUsage.hasDisk = true
+				groupUsage.disk = size
+			}
+		}
+		usage[parent.ID] = groupUsage
+	}
+	if diskCache != nil {
+		if err := diskCache.Save(); err != nil {
+			cmd.PrintErrf("Warning: failed to save disk usage cache: %v\n", err)
+		}
+	}
+	return usage
+}
+
+// sortGroups orders the instances (each with its processes) by start time, or by their memory,
+// CPU or disk usage, largest first.
+func sortGroups(groups [][]storage.Instance, usage map[string]recordUsage, by string) {
+	sort.SliceStable(groups, func(i, j int) bool {
+		a, b := usage[groups[i][0].ID], usage[groups[j][0].ID]
+		switch by {
+		case "mem":
+			if a.rss != b.rss {
+				return a.rss > b.rss
+			}
+		case "cpu":
+			if a.cpu != b.cpu {
+				return a.cpu > b.cpu
+			}
+		case "disk":
+			if a.disk != b.disk {
+				return a.disk > b.disk
+			}
+		}
+		return groups[i][0].StartTime.Before(groups[j][0].StartTime)
+	})
+}
+
+// formatBytes renders a size with a binary unit, e.g. "512K" or "1.5G".
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	value, suffixes := float64(n)/unit, "KMGTP"
+	i := 0
+	for value >= unit && i < len(suffixes)-1 {
+		value /= unit
+		i++
+	}
+	if value >= 100 {
+		return fmt.Sprintf("%.0f%c", value, suffixes[i])
+	}
+	return fmt.Sprintf("%.1f%c", value, suffixes[i])
+}
+
 func init() {
 	rootCmd.AddCommand(listCmd)
+	listCmd.Flags().StringVar(&listOptions.Sort, "sort", "start", "Order instances by start time, or by usage: start, mem, cpu or disk")
+	addSelectorFlag(listCmd, &listOptions.Selector, "Only list the instances whose labels match this selector (e.g. team=web,ref!=main)")
+	listCmd.Flags().BoolVar(&listOptions.ShowLabels, "show-labels", false, "Show the labels of each instance")
 }
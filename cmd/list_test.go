@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"gitserve/internal/instance"
+	"gitserve/internal/storage"
+)
+
+// testPIDs returns the PID and identity of the test process, which is alive, and the PID of
+// a process that has exited.
+func testPIDs(t *testing.T) (int, instance.ProcessIdentity, int) {
+	t.Helper()
+	identity, err := instance.IdentifyProcess(os.Getpid())
+	if err != nil {
+		t.Skipf("can't identify processes here: %v", err)
+	}
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatalf("failed to run true: %v", err)
+	}
+	return os.Getpid(), identity, exited.Process.Pid
+}
+
+func TestProbeInstance(t *testing.T) {
+	pid, identity, exitedPID := testPIDs(t)
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	ours := storage.Instance{PID: pid, ProcessStartTime: identity.StartTime, BootID: identity.BootID}
+	reused := storage.Instance{PID: pid, ProcessStartTime: identity.StartTime + 1, BootID: identity.BootID}
+	gone := storage.Instance{PID: exitedPID}
+
+	tests := []struct {
+		name       string
+		inst       storage.Instance
+		status     string
+		wantStatus string // Empty if the record is returned unchanged
+	}{
+		{name: "running and alive", inst: ours, status: "running"},
+		{name: "paused and alive", inst: ours, status: "paused"},
+		{name: "running and gone", inst: gone, status: "running", wantStatus: "exited_unexpectedly"},
+		{name: "paused and gone", inst: gone, status: "paused", wantStatus: "exited_unexpectedly"},
+		{name: "stopping and gone", inst: gone, status: "stopping", wantStatus: "stopped"},
+		{name: "running with a reused PID", inst: reused, status: "running", wantStatus: "exited_or_not_found"},
+		{name: "stopping with a reused PID", inst: reused, status: "stopping", wantStatus: "exited_or_not_found"},
+		{name: "not live", inst: gone, status: "exited"},
+		{name: "no PID yet", inst: storage.Instance{}, status: "running"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inst := tt.inst
+			inst.Status = tt.status
+			inst.PausedTime = now.Add(-time.Hour)
+			got := probeInstance(inst, now)
+			if tt.wantStatus == "" {
+				if got.Status != inst.Status || !got.StopTime.IsZero() {
+					t.Errorf("probeInstance() = %s (stopped %s), want the record unchanged", got.Status, got.StopTime)
+				}
+				return
+			}
+			if got.Status != tt.wantStatus {
+				t.Errorf("probeInstance() status = %s, want %s", got.Status, tt.wantStatus)
+			}
+			if !got.StopTime.Equal(now) || !got.PausedTime.IsZero() {
+				t.Errorf("probeInstance() stop time = %s, paused time = %s; want %s and none", got.StopTime, got.PausedTime, now)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"fmt"
+	"gitserve/internal/instance"
+	"gitserve/internal/storage"
+	"gitserve/internal/termui"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// logsPollInterval is how often --follow checks the log files for new output.
+const logsPollInterval = 250 * time.Millisecond
+
+var logsOptions struct {
+	Follow   bool
+	Lines    int
+	Stream   string
+	Selector string
+}
+
+// logSource is one log file shown by the logs command.
+type logSource struct {
+	path   string
+	label  string // The process (or instance) the log belongs to, if several are shown
+	prefix string // Shown before every line: the label, padded to the longest one
+	stderr bool
+	offset int64
+}
+
+var logsCmd = &cobra.Command{
+	Use:   "logs (INSTANCE[/PROCESS] | -l SELECTOR)",
+	Short: "Show the logs of a detached instance",
+	Long: `Prints the last lines of a detached instance's stdout and stderr logs. With --follow,
+new output is printed as it is written until you press Ctrl+C.
+
+For a multi-process instance the logs of all processes are shown, each line prefixed with the
+process name; use INSTANCE/PROCESS for the logs of just one of them. With -l, the logs of every
+instance whose labels match the selector are shown, each line prefixed with the instance name.`,
+	Args: instanceArgs(&logsOptions.Selector, 1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		switch logsOptions.Stream {
+		case "stdout", "stderr", "both":
+		default:
+			return fmt.Errorf("invalid --stream value '%s' (expected stdout, stderr or both)", logsOptions.Stream)
+		}
+
+		instanceStore, err := openInstanceStore()
+		if err != nil {
+			return err
+		}
+		var instances []storage.Instance
+		if logsOptions.Selector != "" {
+			if instances, err = selectInstances(instanceStore, logsOptions.Selector); err != nil {
+				return err
+			}
+			if len(instances) == 0 {
+				fmt.Printf("No instances match '%s'.\n", logsOptions.Selector)
+				return nil
+			}
+		} else {
+			storedInst, err := findInstance(instanceStore, args[0])
+			if err != nil {
+				return err
+			}
+			instances = []storage.Instance{storedInst}
+		}
+
+		var sources []*logSource
+		for _, inst := range instances {
+			instanceSources, err := instanceLogSources(instanceStore, inst, len(instances) > 1)
+			if err != nil {
+				return err
+			}
+			sources = append(sources, instanceSources...)
+		}
+		if len(sources) == 0 {
+			if len(instances) == 1 {
+				return fmt.Errorf("instance '%s' has no logs (only detached instances write logs)", instances[0].ID)
+			}
+			return fmt.Errorf("none of the %d instances has logs (only detached instances write logs)", len(instances))
+		}
+		setLogPrefixes(sources)
+
+		for _, source := range sources {
+			lines, err := instance.TailFile(source.path, logsOptions.Lines)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", source.path, err)
+			}
+			printLogLines(source, lines)
+			if info, err := os.Stat(source.path); err == nil {
+				source.offset = info.Size()
+			}
+		}
+
+		if !logsOptions.Follow {
+			return nil
+		}
+		for {
+			time.Sleep(logsPollInterval)
+			for _, source := range sources {
+				lines, offset, err := instance.ReadLinesFrom(source.path, source.offset)
+				if err != nil {
+					return fmt.Errorf("failed to read %s: %w", source.path, err)
+				}
+				source.offset = offset
+				printLogLines(source, lines)
+			}
+		}
+	},
+}
+
+// printLogLines prints lines of a log source with its prefix; stderr goes to stderr.
+func printLogLines(source *logSource, lines []string) {
+	out := os.Stdout
+	if source.stderr {
+		out = os.Stderr
+	}
+	for _, line := range lines {
+		fmt.Fprintf(out, "%s%s\n", source.prefix, line)
+	}
+}
+
+// instanceLogSources returns the logs of an instance: its own or, for a multi-process instance,
+// those of its processes and the log its hooks write to. Logs are labeled with the process
+// name, or with the record's name if byName is set because several instances are shown.
+func instanceLogSources(instanceStore storage.InstanceStore, inst storage.Instance, byName bool) ([]*logSource, error) {
+	records := []storage.Instance{inst}
+	if len(inst.Processes) > 0 {
+		var err error
+		if records, err = processRecords(instanceStore, inst); err != nil {
+			return nil, err
+		}
+	}
+
+	var sources []*logSource
+	for _, record := range records {
+		label := ""
+		if byName {
+			label = record.Name
+		} else if record.Process != "" && len(records) > 1 {
+			label = record.Process
+		}
+		if logsOptions.Stream != "stderr" && record.LogPath != "" {
+			sources = append(sources, &logSource{path: record.LogPath, label: label})
+		}
+		if logsOptions.Stream != "stdout" && record.ErrLogPath != "" {
+			sources = append(sources, &logSource{path: record.ErrLogPath, label: label, stderr: true})
+		}
+	}
+	// Hooks of a multi-process instance write to a log of the instance itself.
+	if len(inst.Processes) > 0 && logsOptions.Stream != "stderr" && inst.LogPath != "" {
+		if _, err := os.Stat(inst.LogPath); err == nil {
+			label := ""
+			if byName {
+				label = inst.Name
+			}
+			sources = append(sources, &logSource{path: inst.LogPath, label: label})
+		}
+	}
+	return sources, nil
+}
+
+// setLogPrefixes sets the prefix of every source to its label, padded to the longest label.
+// Sources get no prefix if none of them is labeled.
+func setLogPrefixes(sources []*logSource) {
+	width := 0
+	for _, source := range sources {
+		width = max(width, len(source.label))
+	}
+	if width == 0 {
+		return
+	}
+	for _, source := range sources {
+		source.prefix = fmt.Sprintf("%s%-*s |%s ", termui.ColorCyan, width, source.label, termui.ColorReset)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(logsCmd)
+	logsCmd.Flags().BoolVarP(&logsOptions.Follow, "follow", "f", false, "Keep printing new output as it is written")
+	logsCmd.Flags().IntVarP(&logsOptions.Lines, "lines", "n", 50, "Number of trailing lines to show from each log")
+	logsCmd.Flags().StringVar(&logsOptions.Stream, "stream", "both", "Which logs to show: stdout, stderr or both")
+	addSelectorFlag(logsCmd, &logsOptions.Selector, "Show the logs of the instances whose labels match this selector instead (e.g. team=web,ref!=main)")
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"fmt"
+	"gitserve/internal/config"
+	"gitserve/internal/instance"
+	"gitserve/internal/journal"
+	"gitserve/internal/logger"
+	"gitserve/internal/storage"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+)
+
+// gitserveHomeDir returns the directory gitserve keeps its state in (~/.gitserve).
+func gitserveHomeDir() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return filepath.Join(homeDir, ".gitserve"), nil
+}
+
+// gitserveSubDir returns a directory below ~/.gitserve, e.g. "workspaces" or "logs".
+func gitserveSubDir(name string) (string, error) {
+	baseDir, err := gitserveHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(baseDir, name), nil
+}
+
+// storeLocation returns where the instance store is kept: under ~/.gitserve/store, with the
+// backend chosen in ~/.gitserve/config.yaml.
+func storeLocation() (storage.Location, error) {
+	storeDataPath, err := gitserveSubDir("store")
+	if err != nil {
+		return storage.Location{}, err
+	}
+	userConfig, err := loadUserConfig()
+	if err != nil {
+		return storage.Location{}, err
+	}
+	return storage.Location{Dir: storeDataPath, Backend: userConfig.Store.Backend}, nil
+}
+
+// loadUserConfig reads the user config, ~/.gitserve/config.yaml.
+func loadUserConfig() (*config.UserConfig, error) {
+	userConfigPath, err := gitserveSubDir(config.UserConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	return config.LoadUserConfig(userConfigPath)
+}
+
+// openInstanceStore opens the instance store under ~/.gitserve/store.
+func openInstanceStore() (storage.InstanceStore, error) {
+	location, err := storeLocation()
+	if err != nil {
+		return nil, err
+	}
+	instanceStore, err := storage.Open(location, logger.NewService(logger.LogLevelInfo))
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize instance store: %w", err)
+	}
+	return instanceStore, nil
+}
+
+// newInstanceService creates an instance service that writes logs to ~/.gitserve/logs and
+// lets supervisors record state in the instance store, which instanceStore is opened on.
+func newInstanceService(instanceStore storage.InstanceStore) (instance.Service, error) {
+	logsDir, err := gitserveSubDir("logs")
+	if err != nil {
+		return nil, err
+	}
+	location, err := storeLocation()
+	if err != nil {
+		return nil, err
+	}
+	return instance.NewService(logsDir, location, instanceStore), nil
+}
+
+var (
+	eventJournalOnce    sync.Once
+	eventJournalService journal.Service
+)
+
+// eventJournal returns the event journal in ~/.gitserve/store, which records events as the
+// user running this gitserve command.
+func eventJournal() journal.Service {
+	eventJournalOnce.Do(func() {
+		log := logger.NewService(logger.LogLevelInfo)
+		storeDir, err := gitserveSubDir("store")
+		if err != nil {
+			log.Warning("Not recording events: %v", err)
+		}
+		eventJournalService = journal.NewService(storeDir, eventActor(), log)
+	})
+	return eventJournalService
+}
+
+// eventActor describes who is running this gitserve command, e.g. "alice (gitserve stop-all)".
+func eventActor() string {
+	name := os.Getenv("USER")
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+	command := rootCmd.Name()
+	if found, _, err := rootCmd.Find(os.Args[1:]); err == nil {
+		command = found.CommandPath()
+	}
+	return fmt.Sprintf("%s (%s)", name, command)
+}
@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"gitserve/internal/instance"
+	"gitserve/internal/models"
+	"gitserve/internal/storage"
+	"gitserve/internal/termui"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var pauseCmd = &cobra.Command{
+	Use:   "pause INSTANCE[/PROCESS]",
+	Short: "Pause a running instance (SIGSTOP) to free up its CPU",
+	Long: `Freezes every process of a running instance with SIGSTOP. The instance keeps its
+memory, ports and workspace, so it can be continued instantly with 'gitserve resume'.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setInstancePaused(args[0], true)
+	},
+}
+
+// setInstancePaused sends SIGSTOP (pause) or SIGCONT (resume) to the instance's process tree
+// and records the new status.
+func setInstancePaused(instanceID string, pause bool) error {
+	instanceStore, err := openInstanceStore()
+	if err != nil {
+		return err
+	}
+
+	storedInst, err := findInstance(instanceStore, instanceID)
+	if err != nil {
+		return err
+	}
+	instanceID = storedInst.ID
+
+	fromStatus, toStatus, sig := "running", "paused", syscall.SIGSTOP
+	if !pause {
+		fromStatus, toStatus, sig = "paused", "running", syscall.SIGCONT
+	}
+
+	if len(storedInst.Processes) > 0 {
+		return setGroupPaused(instanceStore, storedInst, fromStatus, pause)
+	}
+	if storedInst.Status != fromStatus {
+		return fmt.Errorf("instance '%s' is not %s (current status: %s)", instanceID, fromStatus, storedInst.Status)
+	}
+	if storedInst.PID == 0 {
+		return fmt.Errorf("instance '%s' has PID 0 recorded", instanceID)
+	}
+	storedInst, same, err := verifyProcess(instanceStore, storedInst)
+	if err != nil {
+		return err
+	}
+	if !same {
+		return fmt.Errorf("PID %d of instance '%s' now belongs to another process; status updated to 'exited_or_not_found'", storedInst.PID, instanceID)
+	}
+
+	eventJournal().Record(instanceID, models.EventSignalSent, map[string]string{
+		"pgid":   strconv.Itoa(storedInst.PID),
+		"signal": instance.SignalName(sig),
+	})
+	if err := instance.SignalProcessTree(storedInst.PID, sig); err != nil {
+		if errors.Is(err, syscall.ESRCH) {
+			_, _, updateErr := modifyIfUnchanged(instanceStore, storedInst, func(stored *storage.Instance) {
+				stored.Status = "exited_or_not_found"
+				stored.StopTime = time.Now().UTC()
+				stored.PausedTime = time.Time{}
+			})
+			if updateErr != nil {
+				return fmt.Errorf("process group %d not found, and failed to update instance status: %w", storedInst.PID, updateErr)
+			}
+			return fmt.Errorf("process group %d of instance '%s' not found; status updated to 'exited_or_not_found'", storedInst.PID, instanceID)
+		}
+		return fmt.Errorf("failed to send %s to process group %d: %w", instance.SignalName(sig), storedInst.PID, err)
+	}
+
+	// A stop (or an exit) recorded in the meantime wins over the pause.
+	current, applied, err := modifyIfUnchanged(instanceStore, storedInst, func(stored *storage.Instance) {
+		stored.Status = toStatus
+		stored.PausedTime = time.Time{}
+		if pause {
+			stored.PausedTime = time.Now().UTC()
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("sent %s, but failed to update instance status to '%s': %w", instance.SignalName(sig), toStatus, err)
+	}
+	if !applied {
+		return fmt.Errorf("sent %s, but instance '%s' changed meanwhile (now %s); status not updated",
+			instance.SignalName(sig), instanceID, current.Status)
+	}
+
+	fmt.Printf("%sSent %s to instance '%s%s%s%s' (PGID: %d). Status: %s.%s\n",
+		termui.ColorGreen, instance.SignalName(sig), termui.ColorBold, instanceID, termui.ColorReset, termui.ColorGreen,
+		storedInst.PID, toStatus, termui.ColorReset)
+	if storedInst.Parent != "" {
+		if _, err := refreshGroupStatus(instanceStore, storedInst.Parent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setGroupPaused pauses or resumes every process of a multi-process instance that is in
+// fromStatus and updates the instance's status.
+func setGroupPaused(instanceStore storage.InstanceStore, parent storage.Instance, fromStatus string, pause bool) error {
+	processes, err := processRecords(instanceStore, parent)
+	if err != nil {
+		return err
+	}
+	var failures []string
+	changed := 0
+	for _, process := range processes {
+		if process.Status != fromStatus {
+			continue
+		}
+		changed++
+		if err := setInstancePaused(process.ID, pause); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if changed == 0 {
+		return fmt.Errorf("instance '%s' has no %s processes (current status: %s)", parent.ID, fromStatus, parent.Status)
+	}
+
+	if _, err := refreshGroupStatus(instanceStore, parent.ID); err != nil {
+		return err
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("failed for %d of %d process(es): %s", len(failures), changed, strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(pauseCmd)
+}
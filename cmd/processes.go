@@ -0,0 +1,263 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"gitserve/internal/instance"
+	"gitserve/internal/models"
+	"gitserve/internal/storage"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// processRecords returns the process records of a multi-process instance, in the order the
+// processes were started. Records that have gone missing are skipped.
+func processRecords(instanceStore storage.InstanceStore, parent storage.Instance) ([]storage.Instance, error) {
+	records, err := instanceStore.FindInstances(storage.InstanceFilter{Parent: parent.ID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve the processes of instance '%s': %w", parent.ID, err)
+	}
+	return orderProcesses(parent, records), nil
+}
+
+// findInstance returns the instance ref refers to: its ID, a prefix of its ID no other
+// instance shares or its name, optionally followed by /<process> for a single process.
+func findInstance(instanceStore storage.InstanceStore, ref string) (storage.Instance, error) {
+	inst, found, err := storage.ResolveInstance(instanceStore, ref)
+	if err != nil {
+		return inst, err
+	}
+	if !found {
+		return inst, fmt.Errorf("no instance found with ID or name '%s'", ref)
+	}
+	return inst, nil
+}
+
+// isLiveStatus reports whether a process with this status still has (or is about to have) a
+// running process behind it.
+func isLiveStatus(status string) bool {
+	switch status {
+	case "starting", "running", "stopping", "restarting", "paused":
+		return true
+	}
+	return false
+}
+
+// processState is what became of the process recorded for an instance.
+type processState int
+
+const (
+	processAlive  processState = iota // Still there, running or paused
+	processGone                       // It exited
+	processReused                     // Its PID belongs to another process now, or the system rebooted
+)
+
+// probeProcess checks whether the process recorded for inst (with a PID) is still there.
+func probeProcess(inst storage.Instance) processState {
+	if !instance.IsSameProcess(inst.PID, processIdentity(inst)) {
+		return processReused
+	}
+	err := syscall.Kill(inst.PID, 0)
+	if err == nil || errors.Is(err, syscall.EPERM) {
+		return processAlive
+	}
+	return processGone
+}
+
+// isProcessAlive reports whether the process recorded for inst still exists, running or paused.
+func isProcessAlive(inst storage.Instance) bool {
+	return inst.PID > 0 && probeProcess(inst) == processAlive
+}
+
+// endedStatus returns the status to record for a live instance whose process is no longer
+// there: 'exited_or_not_found' if its PID was reused, as verifyProcess records, and otherwise
+// 'stopped' if it was being stopped and 'exited_unexpectedly' if not.
+func endedStatus(inst storage.Instance, state processState) string {
+	switch {
+	case state == processReused:
+		return "exited_or_not_found"
+	case inst.Status == "stopping":
+		return "stopped"
+	default:
+		return "exited_unexpectedly"
+	}
+}
+
+// isShimAlive reports whether the supervisor shim recorded for inst is still running.
+func isShimAlive(inst storage.Instance) bool {
+	if inst.ShimPID <= 0 || !instance.IsSameProcess(inst.ShimPID, shimIdentity(inst)) {
+		return false
+	}
+	err := syscall.Kill(inst.ShimPID, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// processIdentity returns the recorded identity of an instance's process (its PID).
+func processIdentity(inst storage.Instance) instance.ProcessIdentity {
+	return instance.ProcessIdentity{StartTime: inst.ProcessStartTime, BootID: inst.BootID}
+}
+
+// shimIdentity returns the recorded identity of an instance's supervisor shim (its ShimPID).
+func shimIdentity(inst storage.Instance) instance.ProcessIdentity {
+	return instance.ProcessIdentity{StartTime: inst.ShimStartTime, BootID: inst.BootID}
+}
+
+// verifyProcess checks that the PID recorded for inst still belongs to the instance before it is
+// probed or signaled. If the PID was reused by another process (or the system rebooted), the
+// record is marked 'exited_or_not_found' and saved, and false is returned with the updated record.
+func verifyProcess(instanceStore storage.InstanceStore, inst storage.Instance) (storage.Instance, bool, error) {
+	if inst.PID <= 0 || instance.IsSameProcess(inst.PID, processIdentity(inst)) {
+		return inst, true, nil
+	}
+	current, applied, err := modifyIfUnchanged(instanceStore, inst, func(stored *storage.Instance) {
+		stored.Status = "exited_or_not_found"
+		stored.StopTime = time.Now().UTC()
+		stored.PausedTime = time.Time{}
+	})
+	if err != nil {
+		return inst, false, fmt.Errorf("PID %d of instance '%s' now belongs to another process, and failed to update instance status: %w", inst.PID, inst.ID, err)
+	}
+	inst = current
+	if !applied {
+		return inst, false, nil // Someone else recorded what became of it
+	}
+	eventJournal().Record(inst.ID, models.EventExited, map[string]string{
+		"pid":    strconv.Itoa(inst.PID),
+		"status": inst.Status,
+		"reason": "PID belongs to another process",
+	})
+	return inst, false, nil
+}
+
+// modifyIfUnchanged applies modify to the stored record of inst under the store lock, unless
+// its status or PID changed since inst was read, by the supervisor shim or another gitserve
+// command. It returns the stored record and whether modify was applied.
+func modifyIfUnchanged(instanceStore storage.InstanceStore, inst storage.Instance, modify func(stored *storage.Instance)) (storage.Instance, bool, error) {
+	current := inst
+	applied := false
+	found, err := instanceStore.ModifyInstance(inst.ID, func(stored *storage.Instance) {
+		if stored.Status == inst.Status && stored.PID == inst.PID {
+			modify(stored)
+			applied = true
+		}
+		current = *stored
+	})
+	if err != nil {
+		return inst, false, err
+	}
+	if !found {
+		return inst, false, fmt.Errorf("instance '%s' no longer exists", inst.ID)
+	}
+	return current, applied, nil
+}
+
+// aggregateStatus derives the status of a multi-process instance from its processes: their
+// common status if they agree, 'degraded' if only some are still alive, and 'stopped' otherwise.
+func aggregateStatus(processes []storage.Instance) string {
+	if len(processes) == 0 {
+		return "stopped"
+	}
+	status := processes[0].Status
+	live := 0
+	for _, process := range processes {
+		if process.Status != status {
+			status = ""
+		}
+		if isLiveStatus(process.Status) {
+			live++
+		}
+	}
+	switch {
+	case status != "":
+		return status
+	case live > 0:
+		return "degraded"
+	default:
+		return "stopped"
+	}
+}
+
+// refreshGroupStatus recomputes the status of a multi-process instance from its process
+// records and saves it if it changed. It returns the updated parent record.
+func refreshGroupStatus(instanceStore storage.InstanceStore, parentID string) (storage.Instance, error) {
+	var parent storage.Instance
+	// In one transaction, so no process changes status between reading it and saving the
+	// instance status derived from it.
+	err := instanceStore.Transaction(func(tx storage.InstanceStore) error {
+		var found bool
+		var err error
+		parent, found, err = tx.GetInstanceByID(parentID)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve instance '%s': %w", parentID, err)
+		}
+		if !found {
+			return fmt.Errorf("no instance found with ID '%s'", parentID)
+		}
+		processes, err := processRecords(tx, parent)
+		if err != nil {
+			return err
+		}
+
+		status := aggregateStatus(processes)
+		if status == parent.Status {
+			return nil
+		}
+		parent.Status = status
+		if isLiveStatus(status) || status == "degraded" {
+			parent.StopTime = time.Time{}
+		} else if parent.StopTime.IsZero() {
+			parent.StopTime = time.Now().UTC()
+		}
+		if err := tx.UpdateInstance(parent.ID, parent); err != nil {
+			return fmt.Errorf("failed to update status of instance '%s': %w", parent.ID, err)
+		}
+		return nil
+	})
+	return parent, err
+}
+
+// stopGroup stops every running process of a multi-process instance concurrently and updates
+// the instance's status. It returns the new status of the instance.
+func stopGroup(instanceStore storage.InstanceStore, parent storage.Instance, timeout time.Duration, force bool) (string, error) {
+	processes, err := processRecords(instanceStore, parent)
+	if err != nil {
+		return parent.Status, err
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var failures []string
+	stopping := 0
+	for _, process := range processes {
+		if !isStoppableStatus(process.Status) || process.PID == 0 {
+			continue
+		}
+		stopping++
+		wg.Add(1)
+		go func(process storage.Instance) {
+			defer wg.Done()
+			fmt.Printf("  Stopping process '%s' (PGID: %d, %s)...\n", process.Process, process.PID, describeStopMethod(process))
+			finalStatus, err := stopStoredInstance(instanceStore, process, timeout, force)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", process.Process, err))
+				return
+			}
+			fmt.Printf("  Process '%s' %s.\n", process.Process, finalStatus)
+		}(process)
+	}
+	wg.Wait()
+
+	updated, refreshErr := refreshGroupStatus(instanceStore, parent.ID)
+	if len(failures) > 0 {
+		return updated.Status, fmt.Errorf("failed to stop %d of %d process(es): %s", len(failures), stopping, strings.Join(failures, "; "))
+	}
+	if stopping == 0 {
+		return updated.Status, fmt.Errorf("instance '%s' has no running processes (current status: %s)", parent.ID, updated.Status)
+	}
+	return updated.Status, refreshErr
+}
@@ -0,0 +1,322 @@
+package cmd
+
+import (
+	"fmt"
+	"gitserve/internal/config"
+	"gitserve/internal/instance"
+	"gitserve/internal/logger"
+	"gitserve/internal/models"
+	"gitserve/internal/storage"
+	"gitserve/internal/termui"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var pruneOptions struct {
+	DryRun     bool
+	MaxAge     map[string]string
+	KeepLast   int
+	KeepFailed time.Duration
+}
+
+// lastPruneFile is the file in the store directory whose modification time records when
+// gitserve last pruned on its own (prune.auto).
+const lastPruneFile = "gitserve_last_prune"
+
+// pruneCandidate is a stopped instance the prune policy removes.
+type pruneCandidate struct {
+	inst      storage.Instance
+	processes []storage.Instance
+	stopped   time.Time
+	keepFor   time.Duration // How long the policy keeps an instance like this one
+}
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove stopped instances with their workspaces and logs, by the prune policy",
+	Long: `Removes instances that stopped longer ago than the prune policy allows, along with their
+workspaces and logs. Their runs stay in 'gitserve history'.
+
+The policy comes from prune in ~/.gitserve/config.yaml; the flags override it for one prune:
+
+  prune:
+    max_age:           # how long instances are kept after they stopped, by status
+      default: 24h
+      stopped: 2h
+    keep_last: 3       # always keep the 3 most recently stopped instances of each ref
+    keep_failed: 168h  # keep failed instances at least this long (default 72h)
+    auto: true         # prune whenever gitserve runs something...
+    interval: 1h       # ...but at most this often
+
+Failed instances are those that failed to start, crashed, crash looped or exited with a
+non-zero code. Without auto, nothing is pruned unless you run 'gitserve prune', e.g. from cron.
+
+Examples:
+  gitserve prune --dry-run                       # Show what the policy would remove
+  gitserve prune --max-age default=1h,failed=24h
+  gitserve prune --keep-last 1`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		policy, err := prunePolicy(cmd)
+		if err != nil {
+			return err
+		}
+		instanceStore, err := openInstanceStore()
+		if err != nil {
+			return err
+		}
+		logsDir, err := gitserveSubDir("logs")
+		if err != nil {
+			return err
+		}
+		records, err := instanceStore.GetAllInstances()
+		if err != nil {
+			return fmt.Errorf("failed to retrieve instances: %w", err)
+		}
+		candidates := selectPrunable(records, policy, time.Now().UTC())
+		if len(candidates) == 0 {
+			fmt.Println("Nothing to prune.")
+			return nil
+		}
+
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "ID\tREF\tSTATUS\tSTOPPED\tKEPT FOR\tRECLAIM")
+		var total int64
+		for _, candidate := range candidates {
+			size := pruneReclaim(candidate, logsDir)
+			total += size
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				candidate.inst.ID,
+				candidate.inst.Ref,
+				formatStatus(candidate.inst),
+				candidate.stopped.Local().Format("01-02 15:04:05"),
+				candidate.keepFor,
+				formatBytes(uint64(size)))
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		if pruneOptions.DryRun {
+			fmt.Printf("\nWould prune %d instance(s), reclaiming %s%s%s. Run without --dry-run to prune them.\n",
+				len(candidates), termui.ColorBold, formatBytes(uint64(total)), termui.ColorReset)
+			return nil
+		}
+
+		fmt.Println()
+		failed := 0
+		for _, candidate := range candidates {
+			if err := pruneInstance(instanceStore, candidate, logsDir); err != nil {
+				cmd.PrintErrf("%sFailed to prune instance '%s': %v%s\n", termui.ColorRed, candidate.inst.ID, err, termui.ColorReset)
+				failed++
+			}
+		}
+		fmt.Printf("%sPruned %d instance(s), reclaimed %s%s%s%s.%s\n",
+			termui.ColorGreen, len(candidates)-failed,
+			termui.ColorBold, formatBytes(uint64(total)), termui.ColorReset, termui.ColorGreen, termui.ColorReset)
+		if failed > 0 {
+			return fmt.Errorf("failed to prune %d of %d instance(s)", failed, len(candidates))
+		}
+		return nil
+	},
+}
+
+// prunePolicy returns the prune policy from the user config, with the flags given on the
+// command line applied on top.
+func prunePolicy(cmd *cobra.Command) (models.PrunePolicy, error) {
+	userConfig, err := loadUserConfig()
+	if err != nil {
+		return models.PrunePolicy{}, err
+	}
+	pruneConfig := userConfig.Prune
+	if cmd.Flags().Changed("max-age") {
+		maxAge := make(map[string]time.Duration, len(pruneConfig.MaxAge)+len(pruneOptions.MaxAge))
+		for status, age := range pruneConfig.MaxAge {
+			maxAge[status] = age
+		}
+		for status, value := range pruneOptions.MaxAge {
+			age, err := time.ParseDuration(value)
+			if err != nil {
+				return models.PrunePolicy{}, fmt.Errorf("invalid --max-age for %s: %w", status, err)
+			}
+			maxAge[status] = age
+		}
+		pruneConfig.MaxAge = maxAge
+	}
+	if cmd.Flags().Changed("keep-last") {
+		pruneConfig.KeepLast = pruneOptions.KeepLast
+	}
+	if cmd.Flags().Changed("keep-failed") {
+		pruneConfig.KeepFailed = pruneOptions.KeepFailed
+	}
+	if err := pruneConfig.Validate(); err != nil {
+		return models.PrunePolicy{}, err
+	}
+	return pruneConfig.ToPolicy(), nil
+}
+
+// selectPrunable returns the stopped instances, each with its processes, that policy removes
+// at now, the longest stopped first.
+func selectPrunable(records []storage.Instance, policy models.PrunePolicy, now time.Time) []pruneCandidate {
+	processesByParent := make(map[string][]storage.Instance)
+	byRef := make(map[string][]pruneCandidate)
+	for _, inst := range records {
+		if inst.Parent != "" {
+			processesByParent[inst.Parent] = append(processesByParent[inst.Parent], inst)
+			continue
+		}
+		if !models.IsTerminalStatus(inst.Status) {
+			continue
+		}
+		stopped := inst.StopTime
+		if stopped.IsZero() { // Recorded by an older gitserve
+			stopped = inst.StartTime
+		}
+		key := inst.Project + "\x00" + inst.Ref
+		byRef[key] = append(byRef[key], pruneCandidate{
+			inst:    inst,
+			stopped: stopped,
+			keepFor: policy.KeepFor(inst.Status, inst.ExitCode),
+		})
+	}
+
+	var candidates []pruneCandidate
+	for _, stoppedOfRef := range byRef {
+		sort.Slice(stoppedOfRef, func(i, j int) bool { return stoppedOfRef[i].stopped.After(stoppedOfRef[j].stopped) })
+		for i, candidate := range stoppedOfRef {
+			if i < policy.KeepLast || now.Sub(candidate.stopped) < candidate.keepFor {
+				continue
+			}
+			candidate.processes = processesByParent[candidate.inst.ID]
+			candidates = append(candidates, candidate)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].stopped.Before(candidates[j].stopped) })
+	return candidates
+}
+
+// pruneReclaim returns the disk space pruning an instance frees: its workspace and logs.
+func pruneReclaim(candidate pruneCandidate, logsDir string) int64 {
+	var size int64
+	if candidate.inst.Path != "" {
+		size, _ = instance.DirSize(candidate.inst.Path)
+	}
+	_, logSize := recordLogFiles(logsDir, append([]storage.Instance{candidate.inst}, candidate.processes...))
+	return size + logSize
+}
+
+// pruneInstance removes a stopped instance's store records and then deletes its workspace and
+// logs. The records are read again under the store lock first: if the instance was restarted or
+// stopped again since it was selected, nothing is touched. Files that can't be deleted once the
+// records are gone are left to gc, which finds them orphaned.
+func pruneInstance(instanceStore storage.InstanceStore, candidate pruneCandidate, logsDir string) error {
+	inst := candidate.inst
+	group := append([]storage.Instance{inst}, candidate.processes...)
+	err := instanceStore.Transaction(func(tx storage.InstanceStore) error {
+		for _, record := range group {
+			stored, found, err := tx.GetInstanceByID(record.ID)
+			if err != nil {
+				return fmt.Errorf("failed to read '%s' from store: %w", record.ID, err)
+			}
+			if !found {
+				return fmt.Errorf("'%s' no longer exists", record.ID)
+			}
+			if !models.IsTerminalStatus(stored.Status) || !stored.StopTime.Equal(record.StopTime) {
+				return fmt.Errorf("'%s' changed since it was selected (now %s); not pruning it", record.ID, stored.Status)
+			}
+		}
+		for _, record := range group {
+			if err := tx.DeleteInstance(record.ID); err != nil {
+				return fmt.Errorf("failed to delete '%s' from store: %w", record.ID, err)
+			}
+		}
+		_, err := tx.ModifyRun(inst.ID, func(run *storage.RunRecord) { run.WorkspaceKept = false })
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	eventJournal().Record(inst.ID, models.EventPruned, map[string]string{
+		"status":    inst.Status,
+		"stopped":   candidate.stopped.Format(time.RFC3339),
+		"kept_for":  candidate.keepFor.String(),
+		"workspace": inst.Path,
+	})
+
+	if inst.Path != "" {
+		if err := os.RemoveAll(inst.Path); err != nil {
+			return fmt.Errorf("failed to clean up workspace '%s': %w", inst.Path, err)
+		}
+	}
+	logPaths, _ := recordLogFiles(logsDir, group)
+	if err := removePaths(logPaths); err != nil {
+		return fmt.Errorf("failed to delete logs: %w", err)
+	}
+	return nil
+}
+
+// autoPrune prunes by the configured policy if prune.auto is set and gitserve last pruned on
+// its own more than prune.interval ago. Problems are only logged: they must not keep
+// anything from running.
+func autoPrune(log logger.Service) {
+	userConfig, err := loadUserConfig()
+	if err != nil || !userConfig.Prune.Auto {
+		return
+	}
+	if err := userConfig.Prune.Validate(); err != nil {
+		log.Warning("Not pruning automatically: %v", err)
+		return
+	}
+	storeDir, err := gitserveSubDir("store")
+	if err != nil {
+		return
+	}
+	marker := filepath.Join(storeDir, lastPruneFile)
+	if info, err := os.Stat(marker); err == nil && time.Since(info.ModTime()) < userConfig.Prune.AutoInterval() {
+		return
+	}
+	// Claimed before pruning, so concurrent gitserve invocations don't all prune.
+	if err := os.WriteFile(marker, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0600); err != nil {
+		log.Warning("Not pruning automatically: %v", err)
+		return
+	}
+
+	instanceStore, err := openInstanceStore()
+	if err != nil {
+		log.Warning("Not pruning automatically: %v", err)
+		return
+	}
+	logsDir, err := gitserveSubDir("logs")
+	if err != nil {
+		return
+	}
+	records, err := instanceStore.GetAllInstances()
+	if err != nil {
+		log.Warning("Not pruning automatically: failed to retrieve instances: %v", err)
+		return
+	}
+	pruned := 0
+	for _, candidate := range selectPrunable(records, userConfig.Prune.ToPolicy(), time.Now().UTC()) {
+		if err := pruneInstance(instanceStore, candidate, logsDir); err != nil {
+			log.Warning("Failed to prune instance %s: %v", candidate.inst.ID, err)
+			continue
+		}
+		pruned++
+	}
+	if pruned > 0 {
+		log.Info("Pruned %d stopped instance(s) (prune.auto in ~/.gitserve/%s).", pruned, config.UserConfigFile)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(pruneCmd)
+	pruneCmd.Flags().BoolVar(&pruneOptions.DryRun, "dry-run", false, "Only show what would be pruned")
+	pruneCmd.Flags().StringToStringVar(&pruneOptions.MaxAge, "max-age", nil, "How long instances are kept after they stopped, by status (e.g. default=24h,stopped=1h)")
+	pruneCmd.Flags().IntVar(&pruneOptions.KeepLast, "keep-last", 0, "Always keep this many of the most recently stopped instances of each ref")
+	pruneCmd.Flags().DurationVar(&pruneOptions.KeepFailed, "keep-failed", 0, "Keep failed instances at least this long")
+}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"gitserve/internal/models"
+	"gitserve/internal/storage"
+)
+
+func TestSelectPrunable(t *testing.T) {
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+	stopped := func(id string, ref string, status string, stoppedAgo time.Duration) storage.Instance {
+		return storage.Instance{ID: id, Project: "app", Ref: ref, Status: status, StartTime: ago(stoppedAgo + time.Hour), StopTime: ago(stoppedAgo)}
+	}
+	policy := models.PrunePolicy{
+		MaxAge:     map[string]time.Duration{models.DefaultMaxAgeKey: 24 * time.Hour, "stopped": 2 * time.Hour},
+		KeepFailed: 72 * time.Hour,
+	}
+
+	records := []storage.Instance{
+		stopped("old-stopped", "main", "stopped", 3*time.Hour),
+		stopped("new-stopped", "main", "stopped", time.Hour),
+		stopped("old-killed", "dev", "killed", 30*time.Hour),
+		stopped("young-killed", "dev", "killed", 10*time.Hour),
+		stopped("failed-recently", "dev", "exited", 48*time.Hour), // Non-zero exit code set below
+		stopped("failed-long-ago", "dev", "failed", 100*time.Hour),
+		{ID: "running", Project: "app", Ref: "main", Status: "running", StartTime: ago(500 * time.Hour)},
+		// Recorded by an older gitserve, without a stop time: its start time counts.
+		{ID: "no-stop-time", Project: "app", Ref: "old", Status: "stopped", StartTime: ago(5 * time.Hour)},
+		// A multi-process instance is pruned with its processes.
+		{ID: "group", Project: "app", Ref: "multi", Status: "stopped", StopTime: ago(4 * time.Hour), Processes: []string{"web"}},
+		{ID: "group/web", Project: "app", Ref: "multi", Status: "stopped", StopTime: ago(4 * time.Hour), Parent: "group", Process: "web"},
+	}
+	records[4].ExitCode = 1
+
+	tests := []struct {
+		name     string
+		keepLast int
+		want     []string
+	}{
+		{
+			name: "by age",
+			want: []string{"failed-long-ago", "old-killed", "no-stop-time", "group", "old-stopped"},
+		},
+		{
+			name:     "keeping the last two of each ref",
+			keepLast: 2,
+			want:     []string{"failed-long-ago"}, // The two newest of each ref are kept whatever their age
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := policy
+			p.KeepLast = tt.keepLast
+			candidates := selectPrunable(records, p, now)
+			var got []string
+			for _, candidate := range candidates {
+				got = append(got, candidate.inst.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selectPrunable() = %v, want %v", got, tt.want)
+			}
+			for _, candidate := range candidates {
+				if candidate.inst.ID == "group" && (len(candidate.processes) != 1 || candidate.processes[0].ID != "group/web") {
+					t.Errorf("group candidate has processes %v, want [group/web]", candidate.processes)
+				}
+			}
+		})
+	}
+}
+
+func TestPruneInstanceRechecksRecord(t *testing.T) {
+	t.Setenv("HOME", t.TempDir()) // Pruning records an event in ~/.gitserve
+	stopped := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		change     func(stored *storage.Instance) // What happened after prune selected the instance
+		wantPruned bool
+	}{
+		{name: "unchanged", wantPruned: true},
+		{name: "restarted", change: func(stored *storage.Instance) { stored.Status = "running" }},
+		{name: "restarted and stopped again", change: func(stored *storage.Instance) { stored.StopTime = stopped.Add(time.Hour) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workspace := t.TempDir()
+			inst := storage.Instance{ID: "a1", Status: "stopped", Path: workspace, StopTime: stopped}
+			store := openTestStore(t)
+			if err := store.AddInstance(inst); err != nil {
+				t.Fatal(err)
+			}
+			if tt.change != nil {
+				if _, err := store.ModifyInstance(inst.ID, tt.change); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := pruneInstance(store, pruneCandidate{inst: inst, stopped: stopped}, t.TempDir())
+			_, found, _ := store.GetInstanceByID(inst.ID)
+			_, statErr := os.Stat(workspace)
+			if tt.wantPruned {
+				if err != nil || found || !os.IsNotExist(statErr) {
+					t.Errorf("pruneInstance() = %v; record kept: %v, workspace: %v; want both gone", err, found, statErr)
+				}
+				return
+			}
+			if err == nil || !found || statErr != nil {
+				t.Errorf("pruneInstance() = %v; record kept: %v, workspace: %v; want an error and both kept", err, found, statErr)
+			}
+		})
+	}
+}
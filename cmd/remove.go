@@ -0,0 +1,216 @@
+package cmd
+
+import (
+	"fmt"
+	"gitserve/internal/instance"
+	"gitserve/internal/models"
+	"gitserve/internal/storage"
+	"gitserve/internal/termui"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var removeOptions struct {
+	KeepWorkspace bool
+	KeepLogs      bool
+	Timeout       time.Duration
+	Selector      string
+}
+
+var removeCmd = &cobra.Command{
+	Use:   "remove (INSTANCE [INSTANCE...] | -l SELECTOR)",
+	Short: "Stop and remove gitserve instances, cleaning up their workspace and logs",
+	Long: `Removes one or more gitserve instances. A running instance is stopped first
+(using its configured stop signal or command, escalating to SIGKILL after --timeout) and gitserve waits for it to exit.
+Afterwards its workspace and log files are deleted, its port is released and the
+instance record is removed from the store.
+
+Examples:
+  gitserve remove 3f2c9a1e                     # Stop and remove one instance, by ID prefix
+  gitserve remove main-brave-otter id2 id3     # Remove several instances
+  gitserve remove id1 --keep-logs              # Remove but keep the log files around
+  gitserve remove -l ref-type=pr               # Remove every instance of a pull request`,
+	Args: instanceArgs(&removeOptions.Selector, 0),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		instanceStore, err := openInstanceStore()
+		if err != nil {
+			return err
+		}
+
+		if removeOptions.Selector != "" {
+			cmd.SilenceUsage = true
+			selected, err := selectInstances(instanceStore, removeOptions.Selector)
+			if err != nil {
+				return err
+			}
+			if len(selected) == 0 {
+				fmt.Printf("No instances match '%s'.\n", removeOptions.Selector)
+				return nil
+			}
+			for _, inst := range selected {
+				args = append(args, inst.ID)
+			}
+		}
+
+		var failedIDs []string
+		for _, instanceID := range args {
+			if err := removeInstance(instanceStore, instanceID); err != nil {
+				cmd.PrintErrf("%sFailed to remove instance '%s': %v%s\n", termui.ColorRed, instanceID, err, termui.ColorReset)
+				failedIDs = append(failedIDs, instanceID)
+				continue
+			}
+			fmt.Printf("%sInstance '%s%s%s%s' removed.%s\n",
+				termui.ColorGreen, termui.ColorBold, instanceID, termui.ColorReset, termui.ColorGreen, termui.ColorReset)
+		}
+
+		if len(failedIDs) > 0 {
+			return fmt.Errorf("failed to remove %d of %d instance(s): %s", len(failedIDs), len(args), strings.Join(failedIDs, ", "))
+		}
+		return nil
+	},
+}
+
+// removeInstance stops the instance if it is still alive and then deletes its
+// workspace, logs and store record according to removeOptions.
+func removeInstance(instanceStore storage.InstanceStore, instanceID string) error {
+	storedInst, err := findInstance(instanceStore, instanceID)
+	if err != nil {
+		return err
+	}
+	instanceID = storedInst.ID
+	if storedInst.Parent != "" {
+		return fmt.Errorf("'%s' is a process of instance '%s'; stop it, or remove the whole instance", instanceID, storedInst.Parent)
+	}
+
+	// A multi-process instance owns a record (and logs) per process.
+	processes, err := processRecords(instanceStore, storedInst)
+	if err != nil {
+		return err
+	}
+	records := append(processes, storedInst) // The processes first, then the instance itself
+	running := false
+	for _, record := range records {
+		running = running || isStoppableStatus(record.Status)
+	}
+	if running {
+		if err := runInstanceHooks(storedInst, models.HookPreStop, ""); err != nil {
+			return fmt.Errorf("not removing: %w", err)
+		}
+	}
+	for _, record := range records {
+		if err := stopForRemoval(instanceStore, record); err != nil {
+			return err
+		}
+	}
+	if running {
+		// The workspace is still there; it is deleted below.
+		if err := runInstanceHooks(storedInst, models.HookPostStop, "removed"); err != nil {
+			return err
+		}
+	}
+
+	if !removeOptions.KeepWorkspace && storedInst.Path != "" {
+		if err := os.RemoveAll(storedInst.Path); err != nil {
+			return fmt.Errorf("failed to clean up workspace '%s': %w", storedInst.Path, err)
+		}
+		fmt.Printf("  Workspace '%s' cleaned up.\n", storedInst.Path)
+	}
+
+	if !removeOptions.KeepLogs {
+		// Besides the logs: the supervisor log, the attach socket and the sandbox directory.
+		logsDir, err := gitserveSubDir("logs")
+		if err != nil {
+			return err
+		}
+		logPaths, _ := recordLogFiles(logsDir, records)
+		for _, path := range logPaths {
+			if err := os.RemoveAll(path); err != nil {
+				return fmt.Errorf("failed to delete '%s': %w", path, err)
+			}
+		}
+		fmt.Printf("  Logs deleted.\n")
+	}
+
+	// The store records are the only reservation we hold on ports,
+	// so dropping them below is what releases them.
+	for _, record := range records {
+		if record.Port > 0 && (record.Parent != "" || len(processes) == 0) {
+			fmt.Printf("  Port %d released.\n", record.Port)
+		}
+	}
+
+	// The instance and its processes go together.
+	err = instanceStore.Transaction(func(tx storage.InstanceStore) error {
+		for _, process := range processes {
+			if err := tx.DeleteInstance(process.ID); err != nil {
+				return fmt.Errorf("failed to delete process '%s' from store: %w", process.Process, err)
+			}
+		}
+		if err := tx.DeleteInstance(instanceID); err != nil {
+			return fmt.Errorf("failed to delete instance from store: %w", err)
+		}
+		// The run of an instance that never got a terminal status (e.g. an idle one) ends here.
+		_, err := tx.ModifyRun(instanceID, func(run *storage.RunRecord) {
+			if !models.IsTerminalStatus(run.Status) {
+				run.Status = "removed"
+				run.EndTime = time.Now().UTC()
+			}
+			if !removeOptions.KeepWorkspace && storedInst.Path != "" {
+				run.WorkspaceKept = false
+			}
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	details := map[string]string{"status": storedInst.Status}
+	if !removeOptions.KeepWorkspace {
+		details["workspace"] = storedInst.Path
+	}
+	eventJournal().Record(instanceID, models.EventRemoved, details)
+	return nil
+}
+
+// stopForRemoval stops the process group of an instance or process record if it is still alive.
+// The record is marked 'stopping' first, so its supervisor shim doesn't restart the process.
+func stopForRemoval(instanceStore storage.InstanceStore, record storage.Instance) error {
+	if record.PID <= 0 || !instance.IsSameProcess(record.PID, processIdentity(record)) || !instance.IsProcessGroupAlive(record.PID) {
+		return nil // Nothing of ours left to stop; the record is deleted anyway
+	}
+	fmt.Printf("Stopping '%s' (PGID: %d, %s)...\n", record.ID, record.PID, describeStopMethod(record))
+	opts, err := stopOptionsFor(record, removeOptions.Timeout, false)
+	if err != nil {
+		return err
+	}
+	_, err = instanceStore.ModifyInstance(record.ID, func(stored *storage.Instance) {
+		stored.Status = "stopping"
+		stored.PausedTime = time.Time{}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update status of '%s' to 'stopping': %w", record.ID, err)
+	}
+	eventJournal().Record(record.ID, models.EventSignalSent, stopDetails(record, opts))
+	result, err := instance.StopProcessGroup(record.PID, opts)
+	recordEscalation(record, opts, result)
+	if err != nil {
+		return fmt.Errorf("failed to stop process group %d: %w", record.PID, err)
+	}
+	if result.Killed {
+		fmt.Printf("  %sProcess group did not exit within %s and was killed.%s\n", termui.ColorYellow, removeOptions.Timeout, termui.ColorReset)
+	} else {
+		fmt.Printf("  Process group exited.\n")
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(removeCmd)
+	removeCmd.Flags().BoolVar(&removeOptions.KeepWorkspace, "keep-workspace", false, "Do not delete the instance's workspace directory")
+	removeCmd.Flags().BoolVar(&removeOptions.KeepLogs, "keep-logs", false, "Do not delete the instance's log files")
+	addSelectorFlag(removeCmd, &removeOptions.Selector, selectorFlagUsage)
+	removeCmd.Flags().DurationVarP(&removeOptions.Timeout, "timeout", "t", defaultStopTimeout, "Time to wait for a graceful shutdown before sending SIGKILL")
+}
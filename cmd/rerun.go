@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"fmt"
+	"gitserve/internal/logger"
+	"gitserve/internal/models"
+	"gitserve/internal/storage"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var rerunOptions struct {
+	SameSHA bool
+}
+
+var rerunCmd = &cobra.Command{
+	Use:   "rerun HISTORY_ID|NAME",
+	Short: "Run a recorded run again, with the same run definition",
+	Long: `Replays a run from 'gitserve history': the same source, command, named command, port,
+detached or foreground mode, TTY and sandbox settings. The run gets a new instance and
+workspace of its own. The run is picked by its ID in the history, a prefix of that ID no other
+run shares, or the name its instance had.
+
+By default the ref is checked out at its current tip, picking up commits made since. With
+--same-sha the exact commit the original run had checked out is used instead, e.g. to tell
+whether a failure comes from the code or from the environment.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		historyID := args[0]
+
+		instanceStore, err := openInstanceStore()
+		if err != nil {
+			return err
+		}
+		run, found, err := storage.ResolveRun(instanceStore, historyID)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("no run found with ID or name '%s' (see 'gitserve history')", historyID)
+		}
+		historyID = run.ID
+
+		source := run.Source
+		if rerunOptions.SameSHA {
+			if run.SHA == "" {
+				return fmt.Errorf("run '%s' has no commit recorded; rerun it without --same-sha", historyID)
+			}
+			if source.Type == models.PRSource {
+				return fmt.Errorf("--same-sha is not supported for pull request runs: the commit is only in the pull request's branch")
+			}
+			source = models.GitSource{
+				Type:       models.CommitSource,
+				RepoPath:   run.Source.RepoPath,
+				CommitHash: run.SHA,
+				RemoteName: run.Source.RemoteName,
+			}
+		}
+
+		request := &models.RunRequest{
+			Source:        source,
+			Detached:      run.Detached,
+			Command:       run.Command,
+			NamedCommand:  run.NamedCommand,
+			Port:          run.RequestedPort,
+			TTY:           run.TTY,
+			Sandbox:       run.Sandbox,
+			KeepOnFailure: run.KeepOnFailure,
+			GracePeriod:   run.GracePeriod,
+			RerunOf:       run.ID,
+			Labels:        userLabels(run.Labels),
+		}
+		fmt.Printf("Running '%s' again (%s)...\n", historyID, describeRerunSource(source))
+		return executeRun(logger.NewService(logger.LogLevelInfo), request, rerunConfigDir(source))
+	},
+}
+
+// userLabels returns the labels that were given with --label; gitserve adds the others again.
+func userLabels(labels map[string]string) map[string]string {
+	given := make(map[string]string, len(labels))
+	for key, value := range labels {
+		if !models.IsReservedLabel(key) {
+			given[key] = value
+		}
+	}
+	return given
+}
+
+// describeRerunSource tells what a rerun checks out.
+func describeRerunSource(source models.GitSource) string {
+	switch source.Type {
+	case models.CommitSource:
+		return "commit " + shortSHA(source.CommitHash)
+	case models.PRSource:
+		return fmt.Sprintf("pull request #%d at its current head", source.PRNumber)
+	}
+	return fmt.Sprintf("%s %s at its current tip", strings.ToLower(source.Type.String()), source.RefName)
+}
+
+// rerunConfigDir returns where the project config of a rerun is read from: the repository it
+// was run from if that is a local directory, like for 'gitserve run' inside it, and the
+// current directory otherwise.
+func rerunConfigDir(source models.GitSource) string {
+	if info, err := os.Stat(source.RepoPath); err == nil && info.IsDir() {
+		return source.RepoPath
+	}
+	return "."
+}
+
+func init() {
+	rootCmd.AddCommand(rerunCmd)
+	rerunCmd.Flags().BoolVar(&rerunOptions.SameSHA, "same-sha", false, "Check out the exact commit of the original run instead of the ref's current tip")
+}
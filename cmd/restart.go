@@ -0,0 +1,255 @@
+package cmd
+
+import (
+	"fmt"
+	"gitserve/internal/instance"
+	"gitserve/internal/models"
+	"gitserve/internal/storage"
+	"gitserve/internal/termui"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// shimExitTimeout is how long restart waits for the old supervisor to record the exit
+// before starting a new one, so the two don't race on the instance record.
+const shimExitTimeout = 5 * time.Second
+
+var restartOptions struct {
+	Timeout  time.Duration
+	Selector string
+}
+
+var restartCmd = &cobra.Command{
+	Use:   "restart (INSTANCE[/PROCESS] | -l SELECTOR)",
+	Short: "Restart a detached instance, or one process of a multi-process instance",
+	Long: `Stops a detached instance (if it is still running) the same way 'gitserve stop' does and
+starts its command again in the same workspace, with the same environment and port.
+For a multi-process instance every process is restarted; use INSTANCE/PROCESS to restart
+just one of them. With -l, every instance whose labels match the selector is restarted.`,
+	Args: instanceArgs(&restartOptions.Selector, 1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		instanceStore, err := openInstanceStore()
+		if err != nil {
+			return err
+		}
+		instanceService, err := newInstanceService(instanceStore)
+		if err != nil {
+			return err
+		}
+		if restartOptions.Selector == "" {
+			return restartInstance(cmd, instanceStore, instanceService, args[0])
+		}
+
+		selected, err := selectInstances(instanceStore, restartOptions.Selector)
+		if err != nil {
+			return err
+		}
+		if len(selected) == 0 {
+			fmt.Printf("No instances match '%s'.\n", restartOptions.Selector)
+			return nil
+		}
+		var failedIDs []string
+		for _, inst := range selected {
+			if err := restartInstance(cmd, instanceStore, instanceService, inst.ID); err != nil {
+				cmd.PrintErrf("%s%v%s\n", termui.ColorRed, err, termui.ColorReset)
+				failedIDs = append(failedIDs, inst.ID)
+			}
+		}
+		if len(failedIDs) > 0 {
+			return fmt.Errorf("failed to restart %d of %d instance(s): %s", len(failedIDs), len(selected), strings.Join(failedIDs, ", "))
+		}
+		return nil
+	},
+}
+
+// restartInstance stops the instance (or process) instanceID refers to, if it is running,
+// and starts it again.
+func restartInstance(cmd *cobra.Command, instanceStore storage.InstanceStore, instanceService instance.Service, instanceID string) error {
+	storedInst, err := findInstance(instanceStore, instanceID)
+	if err != nil {
+		return err
+	}
+	instanceID = storedInst.ID
+
+	targets := []storage.Instance{storedInst}
+	parentID := storedInst.Parent
+	if len(storedInst.Processes) > 0 {
+		if targets, err = processRecords(instanceStore, storedInst); err != nil {
+			return err
+		}
+		parentID = storedInst.ID
+	}
+
+	// A whole instance is stopped between its pre_stop and post_stop hooks before anything
+	// is started again; its processes are stopped together.
+	if !storedInst.Hooks.IsZero() && anyStoppable(targets) {
+		fmt.Printf("Stopping '%s' (%s)...\n", storedInst.ID, describeStopMethod(storedInst))
+		finalStatus, err := stopWithHooks(instanceStore, storedInst, restartOptions.Timeout, false)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("  Status: %s.\n", finalStatus)
+	}
+
+	var failures []string
+	for _, target := range targets {
+		if err := restartStoredInstance(instanceStore, instanceService, target.ID); err != nil {
+			cmd.PrintErrf("%sFailed to restart '%s': %v%s\n", termui.ColorRed, target.ID, err, termui.ColorReset)
+			failures = append(failures, target.ID)
+			continue
+		}
+		fmt.Printf("%s'%s%s%s%s' restarted.%s\n", termui.ColorGreen, termui.ColorBold, target.ID, termui.ColorReset, termui.ColorGreen, termui.ColorReset)
+	}
+
+	if parentID != "" {
+		if _, err := refreshGroupStatus(instanceStore, parentID); err != nil {
+			return err
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("failed to restart %d of %d: %s", len(failures), len(targets), strings.Join(failures, ", "))
+	}
+	if !storedInst.Hooks.IsZero() {
+		if err := runPostStartHooks(instanceStore, storedInst.ID); err != nil {
+			return err
+		}
+	}
+	eventJournal().Record(storedInst.ID, models.EventReady, nil)
+	return nil
+}
+
+// anyStoppable reports whether any of the records is in a state stop acts on.
+func anyStoppable(records []storage.Instance) bool {
+	for _, record := range records {
+		if isStoppableStatus(record.Status) && record.PID != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// runPostStartHooks runs the post_start hooks of an instance that was started again. If one
+// fails (with on_failure: fail), the instance is stopped again.
+func runPostStartHooks(instanceStore storage.InstanceStore, instanceID string) error {
+	inst, found, err := instanceStore.GetInstanceByID(instanceID)
+	if err != nil || !found {
+		return fmt.Errorf("failed to re-read record of '%s': %v", instanceID, err)
+	}
+	hookErr := runInstanceHooks(inst, models.HookPostStart, "")
+	if hookErr == nil {
+		return nil
+	}
+	stop := stopStoredInstance
+	if len(inst.Processes) > 0 {
+		stop = stopGroup
+	}
+	if _, err := stop(instanceStore, inst, restartOptions.Timeout, false); err != nil {
+		return fmt.Errorf("%w (and failed to stop the instance again: %v)", hookErr, err)
+	}
+	return fmt.Errorf("%w; the instance was stopped again", hookErr)
+}
+
+// restartStoredInstance stops a detached instance or process if it is running and starts its
+// recorded command again under a new supervisor.
+func restartStoredInstance(instanceStore storage.InstanceStore, instanceService instance.Service, instanceID string) error {
+	record, found, err := instanceStore.GetInstanceByID(instanceID)
+	if err != nil || !found {
+		return fmt.Errorf("failed to read record of '%s': %v", instanceID, err)
+	}
+	if record.Command == "" {
+		return fmt.Errorf("no command recorded for '%s' (started by an older gitserve or kept after a shell); start it again with 'gitserve run'", record.ID)
+	}
+	if info, err := os.Stat(record.Path); err != nil || !info.IsDir() {
+		return fmt.Errorf("workspace '%s' no longer exists", record.Path)
+	}
+
+	if isStoppableStatus(record.Status) && record.PID > 0 {
+		fmt.Printf("Stopping '%s' (PGID: %d, %s)...\n", record.ID, record.PID, describeStopMethod(record))
+		finalStatus, err := stopStoredInstance(instanceStore, record, restartOptions.Timeout, false)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("  Status: %s.\n", finalStatus)
+	}
+	// A reused ShimPID belongs to someone else; there is no supervisor of ours to wait for.
+	if record.ShimPID > 0 && instance.IsSameProcess(record.ShimPID, shimIdentity(record)) &&
+		!instance.WaitForProcessExit(record.ShimPID, shimExitTimeout) {
+		// A supervisor sleeping out a restart backoff only notices the stop when it wakes up.
+		// Its process group is gone at this point, so it has nothing left to record.
+		if record.PID > 0 && instance.IsSameProcess(record.PID, processIdentity(record)) && instance.IsProcessGroupAlive(record.PID) {
+			return fmt.Errorf("previous supervisor (PID %d) did not exit within %s", record.ShimPID, shimExitTimeout)
+		}
+		eventJournal().Record(record.ID, models.EventSignalSent, map[string]string{
+			"pid":    strconv.Itoa(record.ShimPID),
+			"signal": "SIGTERM",
+			"reason": "supervisor did not exit",
+		})
+		_ = syscall.Kill(record.ShimPID, syscall.SIGTERM)
+		if !instance.WaitForProcessExit(record.ShimPID, shimExitTimeout) {
+			return fmt.Errorf("previous supervisor (PID %d) did not exit within %s", record.ShimPID, shimExitTimeout)
+		}
+	}
+
+	// Another restart may have got here first; it has recorded a new PID (or none yet).
+	var current storage.Instance
+	conflict := false
+	found, err = instanceStore.ModifyInstance(record.ID, func(stored *storage.Instance) {
+		if stored.PID != record.PID {
+			conflict = true
+			current = *stored
+			return
+		}
+		stored.Status = "starting"
+		stored.PID = 0
+		stored.ShimPID = 0
+		stored.ProcessStartTime = 0
+		stored.ShimStartTime = 0
+		stored.BootID = ""
+		stored.ExitCode = 0
+		stored.ExitSignal = ""
+		stored.StartTime = time.Now().UTC()
+		stored.StopTime = time.Time{}
+		stored.PausedTime = time.Time{}
+		stored.Restarts = 0
+		stored.LastRestartTime = time.Time{}
+		stored.CrashLog = nil
+		stored.LimitViolation = ""
+		current = *stored
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update instance status to 'starting': %w", err)
+	}
+	if !found {
+		return fmt.Errorf("instance '%s' no longer exists", record.ID)
+	}
+	if conflict {
+		return fmt.Errorf("'%s' was started again by someone else meanwhile (status: %s)", record.ID, current.Status)
+	}
+
+	// The record holds the whole run definition; the supervisor fills in the rest.
+	model := current
+	if err := instanceService.StartDetachedProcess(&model); err != nil {
+		_, _, updateErr := modifyIfUnchanged(instanceStore, current, func(stored *storage.Instance) {
+			stored.Status = "failed"
+			stored.StopTime = time.Now().UTC()
+		})
+		if updateErr != nil {
+			return fmt.Errorf("%w (and failed to mark it as failed: %v)", err, updateErr)
+		}
+		return err
+	}
+	fmt.Printf("  Started again (PID: %d).\n", model.PID)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(restartCmd)
+	restartCmd.Flags().DurationVarP(&restartOptions.Timeout, "timeout", "t", defaultStopTimeout, "Time to wait for a graceful shutdown before sending SIGKILL")
+	addSelectorFlag(restartCmd, &restartOptions.Selector, selectorFlagUsage)
+}
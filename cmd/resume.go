@@ -0,0 +1,19 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var resumeCmd = &cobra.Command{
+	Use:   "resume INSTANCE[/PROCESS]",
+	Short: "Resume a paused instance (SIGCONT)",
+	Long:  `Continues every process of an instance previously paused with 'gitserve pause'.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setInstancePaused(args[0], false)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(resumeCmd)
+}
@@ -3,6 +3,8 @@
 package cmd
 
 import (
+	"errors"
+	"gitserve/internal/instance"
 	"os"
 
 	"github.com/spf13/cobra"
@@ -20,7 +22,11 @@ run commands against specific Git branches in isolated environments.
 How?
 It clones the desired branch, runs setup commands (like dependency installs),
 and executes your primary command (like starting a dev server).
-It can manage these processes running in the background.`,
+It can manage these processes running in the background.
+
+Commands that take an instance accept its ID, any prefix of its ID that no other
+instance shares, or its name (e.g. main-brave-otter, or the one given with
+'gitserve run --instance-name').`,
 	// Uncomment SilenceUsage if you don't want Cobra to print usage info on error.
 	// The error itself will still be printed.
 	// SilenceUsage: true,
@@ -34,6 +40,11 @@ func Execute() {
 	// Execute the root command. Cobra handles parsing args and running subcommands.
 	if err := rootCmd.Execute(); err != nil {
 		// Cobra usually prints the error, so we just exit with a non-zero status.
+		// If a command we ran failed, exit with its exit code so gitserve works in scripts and hooks.
+		var exitErr *instance.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.ExitCode())
+		}
 		os.Exit(1)
 	}
 }
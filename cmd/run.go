@@ -1,32 +1,48 @@
 package cmd
 
 import (
+	"bufio"
 	"fmt"
+	"gitserve/internal/config"
 	"gitserve/internal/git"
 	"gitserve/internal/instance"
+	"gitserve/internal/journal"
 	"gitserve/internal/logger"
 	"gitserve/internal/models"
 	"gitserve/internal/runner"
 	"gitserve/internal/sourceresolver"
 	"gitserve/internal/storage"
+	"gitserve/internal/termui"
 	"gitserve/internal/validation"
 	"gitserve/internal/workspace"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 )
 
 var runOptions struct {
-	PortNumber   int
-	IsDetached   bool
-	CommandToRun string
-	PRLink       string
-	BranchName   string
-	CommitHash   string
-	TagName      string
-	NamedCommand string
-	RemoteName   string
+	PortNumber    int
+	IsDetached    bool
+	CommandToRun  string
+	PRLink        string
+	BranchName    string
+	CommitHash    string
+	TagName       string
+	NamedCommand  string
+	RemoteName    string
+	KeepOnFailure bool
+	GracePeriod   time.Duration
+	Interactive   bool
+	TTY           bool
+	AfterShell    string
+	Sandbox       bool
+	SandboxNet    string
+	InstanceName  string
+	Labels        map[string]string
 }
 
 var runCmd = &cobra.Command{
@@ -46,8 +62,12 @@ Examples:
   gitserve run --commit abc123def            # Run from commit
   gitserve run --tag v1.0.0               # Run from tag
   gitserve run --port 3000 develop         # Run on port 3000 from develop branch
+  gitserve run -i feature/xyz              # Open a shell in the workspace first
+  gitserve run -d main --label team=web    # Label the instance, for 'gitserve list -l team=web'
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		// Arguments are parsed at this point; don't bury runtime errors under the usage text.
+		cmd.SilenceUsage = true
 		log := logger.NewService(logger.LogLevelInfo)
 
 		cliOpts := sourceresolver.CLIOptions{
@@ -59,6 +79,12 @@ Examples:
 			RemoteName: runOptions.RemoteName,
 		}
 
+		switch runOptions.AfterShell {
+		case "ask", models.AfterShellRun, models.AfterShellKeep, models.AfterShellRemove:
+		default:
+			return fmt.Errorf("invalid --after-shell value '%s' (expected ask, run, keep or remove)", runOptions.AfterShell)
+		}
+
 		resolverService := sourceresolver.NewService(log)
 		gitSource, err := resolverService.Resolve(cliOpts)
 		if err != nil {
@@ -67,72 +93,143 @@ Examples:
 		}
 
 		request := &models.RunRequest{
-			Source:   gitSource,
-			Detached: runOptions.IsDetached,
-			Command:  runOptions.CommandToRun,
+			Source:        gitSource,
+			Detached:      runOptions.IsDetached,
+			Command:       runOptions.CommandToRun,
+			NamedCommand:  runOptions.NamedCommand,
+			Port:          runOptions.PortNumber,
+			TTY:           runOptions.TTY,
+			Sandbox:       models.SandboxOptions{Enabled: runOptions.Sandbox, Network: runOptions.SandboxNet},
+			KeepOnFailure: runOptions.KeepOnFailure,
+			GracePeriod:   runOptions.GracePeriod,
+			Interactive:   runOptions.Interactive,
+			AfterShell:    afterShellChoice(runOptions.AfterShell),
+			InstanceName:  runOptions.InstanceName,
+			Labels:        runOptions.Labels,
 		}
+		return executeRun(log, request, ".")
+	},
+}
 
-		validationService := validation.NewService()
-		gitService := git.NewService(log)
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			return fmt.Errorf("failed to get home directory: %w", err)
-		}
-		workspacesDir := filepath.Join(homeDir, ".gitserve", "workspaces")
-		workspaceService := workspace.NewService(workspacesDir)
-		instanceService := instance.NewService()
-		storeDataPath := filepath.Join(homeDir, ".gitserve", "store")
-		instanceStore, err := storage.NewJSONInstanceStore(storeDataPath)
-		if err != nil {
-			return fmt.Errorf("failed to initialize instance store: %w", err)
-		}
-		runnerService := runner.NewService(
-			validationService,
-			gitService,
-			workspaceService,
-			instanceService,
-			instanceStore,
-			log,
-		)
-
-		finalInstanceModel, err := runnerService.Run(request)
-		if err != nil {
-			instanceIDForError := "unknown"
-			branchNameForError := "unknown"
-			statusForError := "unknown"
-
-			if finalInstanceModel != nil {
-				instanceIDForError = finalInstanceModel.ID
-				branchNameForError = finalInstanceModel.BranchName
-				statusForError = finalInstanceModel.Status
-			} else {
-				switch gitSource.Type {
-				case models.BranchSource, models.TagSource:
-					branchNameForError = gitSource.RefName
-				case models.CommitSource:
-					branchNameForError = gitSource.CommitHash
-				case models.PRSource:
-					branchNameForError = fmt.Sprintf("pr-%d", gitSource.PRNumber)
-				}
+// executeRun runs request with the project config found in configDir and reports how it went.
+func executeRun(log logger.Service, request *models.RunRequest, configDir string) error {
+	gitSource := request.Source
+	configService, err := config.NewService(configDir)
+	if err != nil {
+		log.Error("Failed to load config: %v", err)
+		return err
+	}
+
+	// Opportunistic pruning (prune.auto), before the run takes up disk space of its own.
+	autoPrune(log)
+
+	validationService := validation.NewService()
+	gitService := git.NewService(log)
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return fmt.Errorf("failed to get home directory: %w", err)
+	}
+	workspacesDir := filepath.Join(homeDir, ".gitserve", "workspaces")
+	workspaceService := workspace.NewService(workspacesDir)
+	logsDir := filepath.Join(homeDir, ".gitserve", "logs")
+	location, err := storeLocation()
+	if err != nil {
+		return err
+	}
+	instanceStore, err := storage.Open(location, log)
+	if err != nil {
+		return fmt.Errorf("failed to initialize instance store: %w", err)
+	}
+	instanceService := instance.NewService(logsDir, location, instanceStore)
+	runnerService := runner.NewService(
+		configService,
+		validationService,
+		gitService,
+		workspaceService,
+		instanceService,
+		instanceStore,
+		journal.NewService(location.Dir, eventActor(), log),
+		log,
+	)
+
+	finalInstanceModel, err := runnerService.Run(request)
+	if err != nil {
+		instanceIDForError := "unknown"
+		branchNameForError := "unknown"
+		statusForError := "unknown"
+
+		if finalInstanceModel != nil {
+			instanceIDForError = finalInstanceModel.ID
+			branchNameForError = finalInstanceModel.Ref
+			statusForError = finalInstanceModel.Status
+		} else {
+			switch gitSource.Type {
+			case models.BranchSource, models.TagSource:
+				branchNameForError = gitSource.RefName
+			case models.CommitSource:
+				branchNameForError = gitSource.CommitHash
+			case models.PRSource:
+				branchNameForError = fmt.Sprintf("pr-%d", gitSource.PRNumber)
 			}
+		}
 
-			log.Error("Run failed for instance %s (Source Ref: %s, Status: %s): %v",
-				instanceIDForError, branchNameForError, statusForError, err)
-			return err
+		log.Error("Run failed for instance %s (Source Ref: %s, Status: %s): %v",
+			instanceIDForError, branchNameForError, statusForError, err)
+		return err
+	}
+
+	switch {
+	case finalInstanceModel.Status == "idle":
+		log.Info("Workspace %s kept as instance %s (ID %s).", finalInstanceModel.Path, finalInstanceModel.Name, finalInstanceModel.ID)
+		log.Info("Use 'gitserve shell %s' to go back and 'gitserve remove %s' when done.",
+			finalInstanceModel.Name, finalInstanceModel.Name)
+	case finalInstanceModel.Status == "removed":
+		log.Info("Workspace %s cleaned up.", finalInstanceModel.Path)
+	case request.Detached:
+		log.Info("Instance %s (ID %s, Ref: %s, PID: %d) is running detached and saved.",
+			finalInstanceModel.Name, finalInstanceModel.ID, finalInstanceModel.Ref, finalInstanceModel.PID)
+		log.Info("Workspace: %s. Use 'gitserve list' and 'gitserve logs %s'.",
+			finalInstanceModel.Path, finalInstanceModel.Name)
+		if request.TTY {
+			log.Info("Use 'gitserve attach %s' to connect to its terminal (detach with %s).",
+				finalInstanceModel.Name, instance.DefaultDetachKeys)
 		}
+	default:
+		log.Info("Foreground process for instance %s (Ref: %s) completed with status: %s.",
+			finalInstanceModel.ID, finalInstanceModel.Ref, finalInstanceModel.Status)
+		log.Info("Workspace %s cleaned up.", finalInstanceModel.Path)
+	}
+	return nil
+}
 
-		if request.Detached {
-			log.Info("Instance %s (Ref: %s, PID: %d) is running detached and saved.",
-				finalInstanceModel.ID, finalInstanceModel.BranchName, finalInstanceModel.ProcessID)
-			log.Info("Workspace: %s. Use 'gitserve list' and 'gitserve logs %s'.",
-				finalInstanceModel.Path, finalInstanceModel.ID)
-		} else {
-			log.Info("Foreground process for instance %s (Ref: %s) completed with status: %s.",
-				finalInstanceModel.ID, finalInstanceModel.BranchName, finalInstanceModel.Status)
-			log.Info("Workspace %s cleaned up.", finalInstanceModel.Path)
+// afterShellChoice returns the AfterShell callback for an interactive run. With "ask" the user
+// is prompted when stdin is a terminal; otherwise the workspace is removed.
+func afterShellChoice(choice string) func() string {
+	if choice != "ask" {
+		return func() string { return choice }
+	}
+	return func() string {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return models.AfterShellRemove
 		}
-		return nil
-	},
+		reader := bufio.NewReader(os.Stdin)
+		for {
+			fmt.Printf("%sShell exited.%s [r]un the command, [k]eep the workspace, or [d]iscard it? [r/k/D] ", termui.ColorBold, termui.ColorReset)
+			answer, err := reader.ReadString('\n')
+			if err != nil {
+				fmt.Println()
+				return models.AfterShellRemove
+			}
+			switch strings.ToLower(strings.TrimSpace(answer)) {
+			case "r", "run":
+				return models.AfterShellRun
+			case "k", "keep":
+				return models.AfterShellKeep
+			case "", "d", "discard":
+				return models.AfterShellRemove
+			}
+		}
+	}
 }
 
 func init() {
@@ -147,4 +244,13 @@ func init() {
 	runCmd.Flags().StringVarP(&runOptions.TagName, "tag", "t", "", "Tag name")
 	runCmd.Flags().StringVarP(&runOptions.NamedCommand, "name", "n", "", "Named command")
 	runCmd.Flags().StringVarP(&runOptions.RemoteName, "remote", "R", "", "Remote name")
+	runCmd.Flags().BoolVar(&runOptions.KeepOnFailure, "keep-on-failure", false, "Keep the workspace if a foreground command fails")
+	runCmd.Flags().BoolVar(&runOptions.TTY, "tty", false, "Run a detached command under a terminal that 'gitserve attach' can connect to")
+	runCmd.Flags().BoolVar(&runOptions.Sandbox, "sandbox", false, "Run pre_command and the command in a sandbox: private /tmp, read-only home outside the workspace, no network")
+	runCmd.Flags().StringVar(&runOptions.SandboxNet, "sandbox-network", "", "Network of a sandboxed run: loopback (default, the port is forwarded in) or host")
+	runCmd.Flags().BoolVarP(&runOptions.Interactive, "interactive", "i", false, "Open a shell in the workspace after pre_command, before running the command")
+	runCmd.Flags().StringVar(&runOptions.AfterShell, "after-shell", "ask", "What to do when the interactive shell exits: ask, run, keep or remove")
+	runCmd.Flags().StringVar(&runOptions.InstanceName, "instance-name", "", "Name of the instance, used instead of its ID in other commands (default: generated, e.g. main-brave-otter)")
+	runCmd.Flags().StringToStringVar(&runOptions.Labels, "label", nil, "Label the instance with key=value, to select it with -l in other commands (repeatable)")
+	runCmd.Flags().DurationVar(&runOptions.GracePeriod, "grace-period", 10*time.Second, "Time to wait after forwarding Ctrl+C before force killing a foreground command")
 }
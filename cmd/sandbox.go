@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"gitserve/internal/instance"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// sandboxCmd runs inside the namespaces of a sandboxed instance (run --sandbox). It is not meant
+// to be run by hand: it sets up the mounts and network described by its instance.SandboxSpec
+// argument and then runs the instance's command.
+var sandboxCmd = &cobra.Command{
+	Use:    instance.SandboxCommandName + " SPEC",
+	Short:  "Internal: run a command inside an instance sandbox",
+	Hidden: true,
+	Args:   cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		spec, err := instance.ReadSandboxSpec(args[0])
+		if err != nil {
+			return err
+		}
+		os.Exit(instance.RunSandbox(spec))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(sandboxCmd)
+}
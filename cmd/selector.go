@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"fmt"
+	"gitserve/internal/models"
+	"gitserve/internal/storage"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// selectorFlagUsage describes -l/--selector, the same for every command that has it.
+const selectorFlagUsage = "Act on the instances whose labels match this selector instead of the given ones (e.g. team=web,ref!=main)"
+
+// addSelectorFlag adds -l/--selector to a command that acts on instances.
+func addSelectorFlag(cmd *cobra.Command, target *string, usage string) {
+	cmd.Flags().StringVarP(target, "selector", "l", "", usage)
+}
+
+// instanceArgs accepts between one and maxArgs INSTANCE arguments (any number if maxArgs is
+// 0), or none when the instances are selected with -l.
+func instanceArgs(selector *string, maxArgs int) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if *selector != "" {
+			if len(args) > 0 {
+				return fmt.Errorf("give either INSTANCE arguments or -l/--selector, not both")
+			}
+			return nil
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("requires an INSTANCE argument or -l/--selector")
+		}
+		if maxArgs > 0 && len(args) > maxArgs {
+			return fmt.Errorf("accepts at most %d INSTANCE argument(s), received %d", maxArgs, len(args))
+		}
+		return nil
+	}
+}
+
+// selectInstances returns the instances, not their processes, whose labels match the selector
+// expression, the oldest first.
+func selectInstances(instanceStore storage.InstanceStore, expression string) ([]storage.Instance, error) {
+	selector, err := models.ParseSelector(expression)
+	if err != nil {
+		return nil, err
+	}
+	instances, err := instanceStore.FindInstances(storage.InstanceFilter{TopLevel: true, Selector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve instances: %w", err)
+	}
+	sort.SliceStable(instances, func(i, j int) bool { return instances[i].StartTime.Before(instances[j].StartTime) })
+	return instances, nil
+}
+
+// formatLabels returns the labels of an instance as "key=value" pairs sorted by key.
+func formatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + labels[key]
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"fmt"
+	"gitserve/internal/instance"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var shellCmd = &cobra.Command{
+	Use:   "shell INSTANCE",
+	Short: "Open an interactive shell in an instance's workspace",
+	Long: `Opens your $SHELL in the workspace of an existing instance, with the instance's
+environment variables and port. The prompt is prefixed with the instance's ref so it is
+clear which checkout you are in. Exit the shell to return; the instance is left as it is.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		instanceID := args[0]
+
+		instanceStore, err := openInstanceStore()
+		if err != nil {
+			return err
+		}
+		storedInst, err := findInstance(instanceStore, instanceID)
+		if err != nil {
+			return err
+		}
+		instanceID = storedInst.ID
+		if info, err := os.Stat(storedInst.Path); err != nil || !info.IsDir() {
+			return fmt.Errorf("workspace '%s' of instance '%s' no longer exists", storedInst.Path, instanceID)
+		}
+
+		ref := storedInst.Env[instance.EnvRef]
+		if ref == "" {
+			ref = storedInst.Name
+		}
+		return instance.RunShell(instance.ShellOptions{Dir: storedInst.Path, Env: storedInst.Env, Ref: ref})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(shellCmd)
+}
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"gitserve/internal/instance"
+	"gitserve/internal/logger"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// shimCmd is the supervisor process spawned for every detached instance. It is not meant to be
+// run by hand: it reads an instance.ShimSpec from stdin, starts the instance's command, reports
+// the PID back on stdout and then records the command's exit in the store.
+var shimCmd = &cobra.Command{
+	Use:    instance.ShimCommandName,
+	Short:  "Internal: supervise a detached instance",
+	Hidden: true,
+	Args:   cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Everything the shim logs ends up in <id>.shim.log (its stderr).
+		log := logger.NewService(logger.LogLevelInfo)
+		log.SetOutput(os.Stderr)
+
+		spec, err := instance.ReadShimSpec(os.Stdin)
+		if err != nil {
+			return err
+		}
+		os.Exit(instance.RunShim(spec, os.Stdout, log))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(shimCmd)
+}
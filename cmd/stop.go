@@ -1,15 +1,15 @@
 package cmd
 
 import (
-	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
-	// "gitserve/internal/instance" // Not strictly needed if we signal directly
+	"gitserve/internal/instance"
+	"gitserve/internal/logger"
+	"gitserve/internal/models"
 	"gitserve/internal/storage"
-	"os"
-	"path/filepath"
-	"syscall"
 
 	"github.com/spf13/cobra"
 )
@@ -24,114 +24,308 @@ const (
 	colorBoldStop   = "\033[1m"
 )
 
+// defaultStopTimeout is how long stop, stop-all and remove wait for a graceful shutdown.
+const defaultStopTimeout = 10 * time.Second
+
+var stopOptions struct {
+	Force    bool
+	Timeout  time.Duration
+	Selector string
+}
+
 var stopCmd = &cobra.Command{
-	Use:   "stop [INSTANCE_ID]",
+	Use:   "stop (INSTANCE[/PROCESS] | -l SELECTOR)",
 	Short: "Stop a running gitserve instance",
-	Long:  `Stops a specific gitserve instance by its ID. The instance must be in a 'running' state.`,
-	Args:  cobra.ExactArgs(1), // Requires exactly one argument: the instance ID
-	RunE: func(cmd *cobra.Command, args []string) error {
-		instanceID := args[0]
+	Long: `Stops a specific gitserve instance by its ID. The instance must be in a 'running' state.
+
+The instance's process group is asked to shut down using the configured stop_command
+or stop_signal (SIGTERM by default). gitserve waits up to --timeout for the group to exit
+and then escalates to SIGKILL. The final status is written before the command returns.
 
-		homeDir, err := os.UserHomeDir()
+For a multi-process instance all of its processes are stopped; use INSTANCE/PROCESS to stop
+just one of them. With -l, every running instance whose labels match the selector is stopped,
+e.g. 'gitserve stop -l team=web,ref!=main'.`,
+	Args: instanceArgs(&stopOptions.Selector, 1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		instanceStore, err := openInstanceStore()
 		if err != nil {
-			return fmt.Errorf("failed to get home directory: %w", err)
+			return err
+		}
+		if stopOptions.Selector == "" {
+			return stopInstance(cmd, instanceStore, args[0])
 		}
-		storeDataPath := filepath.Join(homeDir, ".gitserve", "store")
 
-		instanceStore, err := storage.NewJSONInstanceStore(storeDataPath)
+		cmd.SilenceUsage = true
+		selected, err := selectInstances(instanceStore, stopOptions.Selector)
 		if err != nil {
-			return fmt.Errorf("failed to initialize instance store: %w", err)
+			return err
+		}
+		var failedIDs []string
+		matched := 0
+		for _, inst := range selected {
+			if !isStoppableStatus(inst.Status) && inst.Status != "degraded" {
+				continue
+			}
+			matched++
+			if err := stopInstance(cmd, instanceStore, inst.ID); err != nil {
+				cmd.PrintErrf("%s%v%s\n", colorRedStop, err, colorResetStop)
+				failedIDs = append(failedIDs, inst.ID)
+			}
 		}
+		if matched == 0 {
+			fmt.Printf("No running instances match '%s'.\n", stopOptions.Selector)
+			return nil
+		}
+		if len(failedIDs) > 0 {
+			return fmt.Errorf("failed to stop %d of %d instance(s): %s", len(failedIDs), matched, strings.Join(failedIDs, ", "))
+		}
+		return nil
+	},
+}
 
-		storedInst, found, err := instanceStore.GetInstanceByID(instanceID)
+// stopInstance stops the instance (or process) instanceID refers to and waits for it to exit.
+func stopInstance(cmd *cobra.Command, instanceStore storage.InstanceStore, instanceID string) error {
+	storedInst, err := findInstance(instanceStore, instanceID)
+	if err != nil {
+		return err
+	}
+	instanceID = storedInst.ID
+
+	if len(storedInst.Processes) > 0 {
+		fmt.Printf("Attempting to stop the %d processes of instance '%s%s%s'...\n",
+			len(storedInst.Processes), colorBoldStop, storedInst.ID, colorResetStop)
+		finalStatus, err := stopWithHooks(instanceStore, storedInst, stopOptions.Timeout, stopOptions.Force)
 		if err != nil {
-			return fmt.Errorf("failed to retrieve instance '%s%s%s': %w", colorBoldStop, instanceID, colorResetStop, err)
-		}
-		if !found {
-			return fmt.Errorf("no instance found with ID '%s%s%s'", colorBoldStop, instanceID, colorResetStop)
+			return fmt.Errorf("failed to stop instance '%s%s%s': %w", colorBoldStop, instanceID, colorResetStop, err)
 		}
+		fmt.Printf("%sInstance '%s%s%s' status updated to '%s%s%s'.%s\n",
+			colorGreenStop, colorBoldStop, instanceID, colorResetStop, colorGrayStop, finalStatus, colorResetStop, colorResetStop)
+		return nil
+	}
 
-		if storedInst.Status != "running" {
-			return fmt.Errorf("instance '%s%s%s' is not in a '%srunning%s' state (current status: %s%s%s). Cannot stop.",
-				colorBoldStop, instanceID, colorResetStop,
-				colorGreenStop, colorResetStop,
-				colorYellowStop, storedInst.Status, colorResetStop)
+	// 'stopping' is accepted so an interrupted stop can be retried, 'restarting' so a
+	// supervisor backing off between restarts can be told to give up. Paused instances
+	// are continued as part of the stop.
+	if !isStoppableStatus(storedInst.Status) {
+		return fmt.Errorf("instance '%s%s%s' is not in a '%srunning%s' state (current status: %s%s%s). Cannot stop.",
+			colorBoldStop, instanceID, colorResetStop,
+			colorGreenStop, colorResetStop,
+			colorYellowStop, storedInst.Status, colorResetStop)
+	}
+
+	if storedInst.PID == 0 {
+		current, applied, updateErr := modifyIfUnchanged(instanceStore, storedInst, func(stored *storage.Instance) {
+			stored.Status = "error_pid_zero"
+			stored.StopTime = time.Now().UTC()
+		})
+		if updateErr != nil {
+			cmd.PrintErrf("%sAdditionally, failed to update instance status to '%serror_pid_zero%s': %v%s\n", colorRedStop, colorRedStop, colorResetStop, updateErr, colorResetStop)
+		} else if !applied {
+			return fmt.Errorf("instance '%s%s%s' changed while stopping it (now %s%s%s); try again",
+				colorBoldStop, instanceID, colorResetStop, colorYellowStop, current.Status, colorResetStop)
 		}
+		return fmt.Errorf("instance '%s%s%s' has PID 0 recorded, cannot stop. Status updated to '%serror_pid_zero%s'.",
+			colorBoldStop, instanceID, colorResetStop, colorRedStop, colorResetStop)
+	}
 
-		if storedInst.PID == 0 {
-			// originalStatus := storedInst.Status // Unused in this block
-			storedInst.Status = "error_pid_zero"
-			storedInst.StopTime = time.Now().UTC()
-			if updateErr := instanceStore.UpdateInstance(instanceID, storedInst); updateErr != nil {
-				cmd.PrintErrf("%sAdditionally, failed to update instance status to '%serror_pid_zero%s': %v%s\n", colorRedStop, colorRedStop, colorResetStop, updateErr, colorResetStop)
-			}
-			return fmt.Errorf("instance '%s%s%s' has PID 0 recorded, cannot stop. Status updated to '%serror_pid_zero%s'.",
-				colorBoldStop, instanceID, colorResetStop, colorRedStop, colorResetStop)
+	fmt.Printf("Attempting to stop instance '%s%s%s' (PGID: %s%d%s, %s)...\n",
+		colorBoldStop, storedInst.ID, colorResetStop, colorBoldStop, storedInst.PID, colorResetStop, describeStopMethod(storedInst))
+
+	finalStatus, err := stopWithHooks(instanceStore, storedInst, stopOptions.Timeout, stopOptions.Force)
+	if err != nil {
+		return fmt.Errorf("failed to stop instance '%s%s%s': %w", colorBoldStop, instanceID, colorResetStop, err)
+	}
+
+	statusColor := colorGrayStop
+	if finalStatus == "killed" {
+		statusColor = colorYellowStop
+	}
+	fmt.Printf("%sInstance '%s%s%s' status updated to '%s%s%s'.%s\n",
+		colorGreenStop, colorBoldStop, instanceID, colorResetStop, statusColor, finalStatus, colorResetStop, colorResetStop)
+	if storedInst.Parent != "" {
+		if _, err := refreshGroupStatus(instanceStore, storedInst.Parent); err != nil {
+			cmd.PrintErrf("%sWarning: %v%s\n", colorYellowStop, err, colorResetStop)
 		}
+	}
+	return nil
+}
 
-		fmt.Printf("Attempting to stop instance '%s%s%s' (PGID to be used: %s%d%s)...\n",
-			colorBoldStop, storedInst.ID, colorResetStop, colorBoldStop, storedInst.PID, colorResetStop)
-
-		// We don't need to os.FindProcess anymore if we are killing by PGID directly using syscall.Kill
-		// proc, err := os.FindProcess(storedInst.PID)
-		// if err != nil {
-		// 	// Error finding process (e.g., os.ErrProcessDone if already exited)
-		// 	fmt.Printf("Failed to find process with PID %d for instance '%s': %v. It might have already exited.\n", storedInst.PID, instanceID, err)
-		// 	// Update status in store
-		// 	originalStatus := storedInst.Status
-		// 	storedInst.Status = "exited_or_not_found" // A more descriptive status
-		// 	if updateErr := instanceStore.UpdateInstance(instanceID, storedInst); updateErr != nil {
-		// 		return fmt.Errorf("instance process not found, and failed to update instance status from '%s' to '%s': %w", originalStatus, storedInst.Status, updateErr)
-		// 	}
-		// 	fmt.Printf("Instance '%s' status updated to '%s'.\n", instanceID, storedInst.Status)
-		// 	return nil // Considered handled, process is not running.
-		// }
-
-		// Send a SIGTERM signal (graceful shutdown) to the entire process group
-		// Note the negative PID to target the process group.
-		if err := syscall.Kill(-storedInst.PID, syscall.SIGTERM); err != nil {
-			// If signaling fails, check if it's because the process group doesn't exist (already stopped/gone)
-			if errors.Is(err, syscall.ESRCH) { // ESRCH: No such process
-				fmt.Printf("%sProcess group with PGID %s%d%s for instance '%s%s%s' not found. It might have already exited.%s\n",
-					colorGrayStop, colorBoldStop, storedInst.PID, colorResetStop, colorBoldStop, instanceID, colorResetStop, colorResetStop)
-				originalStatus := storedInst.Status
-				storedInst.Status = "exited_or_not_found"
-				storedInst.StopTime = time.Now().UTC()
-				if updateErr := instanceStore.UpdateInstance(instanceID, storedInst); updateErr != nil {
-					return fmt.Errorf("process group not found, and failed to update instance status from '%s' to '%s%s%s': %w",
-						originalStatus, colorGrayStop, storedInst.Status, colorResetStop, updateErr)
-				}
-				fmt.Printf("%sInstance '%s%s%s' status updated to '%s%s%s'.%s\n",
-					colorGreenStop, colorBoldStop, instanceID, colorResetStop, colorGrayStop, storedInst.Status, colorResetStop, colorResetStop)
-				return nil // Considered handled.
-			}
-			// Other errors (e.g., permission issues)
-			return fmt.Errorf("failed to send SIGTERM to process group PGID %s%d%s for instance '%s%s%s': %w. Current status remains '%s%s%s'.",
-				colorBoldStop, storedInst.PID, colorResetStop, colorBoldStop, instanceID, colorResetStop, err, colorYellowStop, storedInst.Status, colorResetStop)
+// isStoppableStatus reports whether stop/stop-all should act on an instance with this status.
+func isStoppableStatus(status string) bool {
+	switch status {
+	case "running", "stopping", "restarting", "paused":
+		return true
+	}
+	return false
+}
+
+// stopOptionsFor builds the StopOptions for a stored instance from its recorded stop settings.
+func stopOptionsFor(inst storage.Instance, timeout time.Duration, force bool) (instance.StopOptions, error) {
+	sig, err := instance.ParseSignal(inst.StopSignal)
+	if err != nil {
+		return instance.StopOptions{}, fmt.Errorf("invalid stop signal recorded for instance: %w", err)
+	}
+	return instance.StopOptions{
+		Signal:  sig,
+		Command: inst.StopCommand,
+		Dir:     inst.Path,
+		Env:     inst.Env,
+		Timeout: timeout,
+		Force:   force,
+		CommandFailed: func(err error) {
+			eventJournal().Record(inst.ID, models.EventSignalSent, map[string]string{
+				"pgid":   strconv.Itoa(inst.PID),
+				"signal": instance.SignalName(sig),
+				"reason": err.Error(),
+			})
+		},
+	}, nil
+}
+
+// describeStopMethod returns a short human readable description of how an instance will be stopped.
+func describeStopMethod(inst storage.Instance) string {
+	if inst.StopCommand != "" {
+		return fmt.Sprintf("stop command: %s", inst.StopCommand)
+	}
+	sig, err := instance.ParseSignal(inst.StopSignal)
+	if err != nil {
+		return "signal: " + inst.StopSignal
+	}
+	return "signal: " + instance.SignalName(sig)
+}
+
+// stopStoredInstance marks the instance as stopping, stops its process group, waits for it to
+// exit and synchronously writes the final status to the store. It returns the final status.
+func stopStoredInstance(instanceStore storage.InstanceStore, inst storage.Instance, timeout time.Duration, force bool) (string, error) {
+	opts, err := stopOptionsFor(inst, timeout, force)
+	if err != nil {
+		return inst.Status, err
+	}
+	inst, same, err := verifyProcess(instanceStore, inst)
+	if err != nil || !same {
+		return inst.Status, err
+	}
+
+	// Only the status changes: the supervisor shim records exits in the same record.
+	previousStatus := inst.Status
+	alreadyEnded := false
+	found, err := instanceStore.ModifyInstance(inst.ID, func(stored *storage.Instance) {
+		if models.IsTerminalStatus(stored.Status) {
+			alreadyEnded = true
+			inst = *stored
+			return
 		}
+		stored.Status = "stopping"
+		stored.PausedTime = time.Time{}
+	})
+	if err != nil {
+		return inst.Status, fmt.Errorf("failed to update instance status to 'stopping': %w", err)
+	}
+	if !found {
+		return inst.Status, fmt.Errorf("instance '%s' no longer exists", inst.ID)
+	}
+	if alreadyEnded {
+		return inst.Status, nil
+	}
+	inst.Status = "stopping"
+	inst.PausedTime = time.Time{}
 
-		fmt.Printf("%sSent SIGTERM to process group of instance '%s%s%s' (PGID: %s%d%s).%s\n",
-			colorGreenStop, colorBoldStop, storedInst.ID, colorResetStop, colorBoldStop, storedInst.PID, colorResetStop, colorResetStop)
+	eventJournal().Record(inst.ID, models.EventSignalSent, stopDetails(inst, opts))
+	result, stopErr := instance.StopProcessGroup(inst.PID, opts)
+	recordEscalation(inst, opts, result)
+	if stopErr != nil {
+		// The group may still be alive; leave it in 'stopping' so a retry is possible.
+		return inst.Status, stopErr
+	}
 
-		// Update the status in the store
-		originalStatus := storedInst.Status
-		storedInst.Status = "stopping"
-		storedInst.StopTime = time.Now().UTC()
-		if err := instanceStore.UpdateInstance(instanceID, storedInst); err != nil {
-			return fmt.Errorf("signal sent, but failed to update instance status from '%s' to '%s%s%s': %w",
-				originalStatus, colorYellowStop, storedInst.Status, colorResetStop, err)
+	var stoppedStatus string
+	switch {
+	case result.AlreadyExited && previousStatus == "restarting":
+		stoppedStatus = "stopped" // Caught between restarts; the supervisor sees this and gives up
+	case result.AlreadyExited:
+		stoppedStatus = "exited_or_not_found"
+	case result.Killed:
+		stoppedStatus = "killed"
+	default:
+		stoppedStatus = "stopped"
+	}
+	// If the shim has recorded the exit by now (with its exit code and signal), its status
+	// stands; otherwise the record is still 'stopping' and gets the status derived here.
+	finalStatus := stoppedStatus
+	_, err = instanceStore.ModifyInstance(inst.ID, func(stored *storage.Instance) {
+		if stored.Status != "stopping" {
+			finalStatus = stored.Status
+			return
 		}
+		stored.Status = stoppedStatus
+		stored.StopTime = time.Now().UTC()
+	})
+	if err != nil {
+		return stoppedStatus, fmt.Errorf("process stopped, but failed to update instance status to '%s': %w", stoppedStatus, err)
+	}
+	return finalStatus, nil
+}
 
-		fmt.Printf("%sInstance '%s%s%s' status updated to '%s%s%s'. The process is now attempting to shut down gracefully.%s\n",
-			colorGreenStop, colorBoldStop, instanceID, colorResetStop, colorYellowStop, storedInst.Status, colorResetStop, colorResetStop)
-		fmt.Println("Use 'gitserve list' to check its final status after a short while.")
+// stopDetails describes how an instance is being stopped, for the journal: with its stop
+// command or stop signal, or with SIGKILL right away when forced.
+func stopDetails(inst storage.Instance, opts instance.StopOptions) map[string]string {
+	details := map[string]string{"pgid": strconv.Itoa(inst.PID)}
+	switch {
+	case opts.Force:
+		details["signal"] = "SIGKILL"
+	case opts.Command != "":
+		details["command"] = opts.Command
+	default:
+		details["signal"] = instance.SignalName(opts.Signal)
+	}
+	return details
+}
+
+// recordEscalation journals the SIGKILL a stop had to send after the graceful stop timed out.
+func recordEscalation(inst storage.Instance, opts instance.StopOptions, result instance.StopResult) {
+	if result.Killed && !opts.Force {
+		eventJournal().Record(inst.ID, models.EventSignalSent, map[string]string{
+			"pgid":   strconv.Itoa(inst.PID),
+			"signal": "SIGKILL",
+			"reason": fmt.Sprintf("still running after %s", opts.Timeout),
+		})
+	}
+}
+
+// runInstanceHooks runs the hooks of a phase recorded for an instance. status is the status
+// the instance ended with, for post_stop hooks.
+func runInstanceHooks(inst storage.Instance, phase string, status string) error {
+	if inst.Hooks.IsZero() {
 		return nil
-	},
+	}
+	target := instance.HookTarget{Dir: inst.Path, Env: inst.Env, LogPath: inst.LogPath, PID: inst.PID, Status: status}
+	return instance.RunHooks(phase, inst.Hooks.For(phase), target, logger.NewService(logger.LogLevelInfo))
+}
+
+// stopWithHooks stops an instance, or every process of a multi-process instance, between its
+// pre_stop and post_stop hooks. A failing pre_stop hook (with on_failure: fail) keeps the
+// instance running. It returns the final status.
+func stopWithHooks(instanceStore storage.InstanceStore, inst storage.Instance, timeout time.Duration, force bool) (string, error) {
+	if err := runInstanceHooks(inst, models.HookPreStop, ""); err != nil {
+		return inst.Status, fmt.Errorf("not stopping: %w", err)
+	}
+	stop := stopStoredInstance
+	if len(inst.Processes) > 0 {
+		stop = stopGroup
+	}
+	finalStatus, err := stop(instanceStore, inst, timeout, force)
+	if err != nil {
+		return finalStatus, err
+	}
+	if err := runInstanceHooks(inst, models.HookPostStop, finalStatus); err != nil {
+		return finalStatus, fmt.Errorf("instance %s, but %w", finalStatus, err)
+	}
+	return finalStatus, nil
 }
 
 func init() {
 	rootCmd.AddCommand(stopCmd)
-	// Potential future flags:
-	// stopCmd.Flags().BoolP("force", "f", false, "Force stop the instance (SIGKILL)")
-	// stopCmd.Flags().DurationP("timeout", "t", 0, "Timeout to wait for graceful shutdown before force stopping")
+	stopCmd.Flags().BoolVarP(&stopOptions.Force, "force", "f", false, "Force stop the instance (SIGKILL) without a graceful shutdown")
+	stopCmd.Flags().DurationVarP(&stopOptions.Timeout, "timeout", "t", defaultStopTimeout, "Time to wait for graceful shutdown before sending SIGKILL")
+	addSelectorFlag(stopCmd, &stopOptions.Selector, selectorFlagUsage)
 }
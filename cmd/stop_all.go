@@ -1,14 +1,11 @@
 package cmd
 
 import (
-	"errors"
 	"fmt"
+	"gitserve/internal/models"
 	"gitserve/internal/storage"
-	"os"
-	"path/filepath"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -27,25 +24,32 @@ const (
 
 var (
 	stopAllProjectName string
+	stopAllOptions     struct {
+		Force    bool
+		Timeout  time.Duration
+		Selector string
+	}
 )
 
 var stopAllCmd = &cobra.Command{
 	Use:   "stop-all",
-	Short: "Stop all running gitserve instances, optionally filtered by project name",
-	Long:  `Stops all gitserve instances that are currently in a 'running' state. Can be filtered by project name.`,
+	Short: "Stop all running gitserve instances, optionally filtered by project or labels",
+	Long: `Stops all gitserve instances that are currently in a 'running' state. Can be filtered by project
+(the name of the repository the instance was run from) and by labels with -l.
+Instances are stopped concurrently, each with its configured stop_command or stop_signal,
+escalating to SIGKILL after --timeout. Final statuses are written before the command returns.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		homeDir, err := os.UserHomeDir()
+		instanceStore, err := openInstanceStore()
 		if err != nil {
-			return fmt.Errorf("failed to get home directory: %w", err)
+			return err
 		}
-		storeDataPath := filepath.Join(homeDir, ".gitserve", "store")
 
-		instanceStore, err := storage.NewJSONInstanceStore(storeDataPath)
+		selector, err := models.ParseSelector(stopAllOptions.Selector)
 		if err != nil {
-			return fmt.Errorf("failed to initialize instance store: %w", err)
+			return err
 		}
-
-		instances, err := instanceStore.GetAllInstances()
+		// Processes are stopped together with their instance.
+		instances, err := instanceStore.FindInstances(storage.InstanceFilter{TopLevel: true, Project: stopAllProjectName, Selector: selector})
 		if err != nil {
 			return fmt.Errorf("failed to retrieve instances: %w", err)
 		}
@@ -62,12 +66,7 @@ var stopAllCmd = &cobra.Command{
 
 		fmt.Printf("Attempting to stop instances (%sfilter%s: '%s%s%s')...\n",
 			colorCyanStopAll, colorResetStopAll,
-			colorBoldStopAll, func() string {
-				if stopAllProjectName == "" {
-					return "none"
-				}
-				return stopAllProjectName
-			}(), colorResetStopAll)
+			colorBoldStopAll, describeStopAllFilter(selector), colorResetStopAll)
 
 		// Quick fix for counters: Use a channel to collect results.
 		type result struct {
@@ -85,19 +84,41 @@ var stopAllCmd = &cobra.Command{
 
 		for _, inst := range instances {
 			instanceCopy := inst // Work with a copy for the goroutine
-			if stopAllProjectName != "" {
-				if instanceCopy.Path == "" {
-					resultsChan <- result{id: instanceCopy.ID, name: instanceCopy.Name, isSkipped: true, skippedReason: "missing path for project filtering"}
+
+			if len(instanceCopy.Processes) > 0 {
+				processes, err := processRecords(instanceStore, instanceCopy)
+				if err != nil {
+					resultsChan <- result{id: instanceCopy.ID, name: instanceCopy.Name, success: false, finalStatus: instanceCopy.Status, errorMsg: err.Error()}
 					continue
 				}
-				instanceProjectName := filepath.Base(instanceCopy.Path)
-				if !strings.EqualFold(instanceProjectName, stopAllProjectName) {
-					resultsChan <- result{id: instanceCopy.ID, name: instanceCopy.Name, isSkipped: true, skippedReason: "project name mismatch"}
+				running := 0
+				for _, process := range processes {
+					if isStoppableStatus(process.Status) && process.Status != "stopping" && process.PID != 0 {
+						running++
+					}
+				}
+				if running == 0 {
+					resultsChan <- result{id: instanceCopy.ID, name: instanceCopy.Name, isSkipped: true, skippedReason: "no running processes"}
 					continue
 				}
+
+				activeAttempts++
+				wg.Add(1)
+				go func(parent storage.Instance) {
+					defer wg.Done()
+					cmd.Printf("  Stopping instance %s%s%s (%s) - %d running process(es)...\n",
+						colorBoldStopAll, parent.ID, colorResetStopAll, parent.Name, running)
+					finalStatus, stopErr := stopWithHooks(instanceStore, parent, stopAllOptions.Timeout, stopAllOptions.Force)
+					if stopErr != nil {
+						resultsChan <- result{id: parent.ID, name: parent.Name, success: false, finalStatus: finalStatus, errorMsg: stopErr.Error()}
+						return
+					}
+					resultsChan <- result{id: parent.ID, name: parent.Name, success: true, finalStatus: finalStatus}
+				}(instanceCopy)
+				continue
 			}
 
-			if instanceCopy.Status != "running" {
+			if !isStoppableStatus(instanceCopy.Status) || instanceCopy.Status == "stopping" {
 				resultsChan <- result{id: instanceCopy.ID, name: instanceCopy.Name, isSkipped: true, skippedReason: fmt.Sprintf("status is '%s%s%s', not '%srunning%s'", colorYellowStopAll, instanceCopy.Status, colorResetStopAll, colorGreenStopAll, colorResetStopAll)}
 				continue
 			}
@@ -111,36 +132,15 @@ var stopAllCmd = &cobra.Command{
 			wg.Add(1)
 			go func(instanceToStop storage.Instance) {
 				defer wg.Done()
-				cmd.Printf("  Stopping instance %s%s%s (%s) - PGID: %s%d%s...\n",
-					colorBoldStopAll, instanceToStop.ID, colorResetStopAll, instanceToStop.Name, colorBoldStopAll, instanceToStop.PID, colorResetStopAll)
-
-				finalStatus := instanceToStop.Status
-				currentTime := time.Now().UTC()
-				signalErr := syscall.Kill(-instanceToStop.PID, syscall.SIGTERM)
-
-				if signalErr != nil {
-					if errors.Is(signalErr, syscall.ESRCH) {
-						cmd.Printf("    %sProcess group for %s%s%s (PGID: %s%d%s) not found. Already exited.%s\n",
-							colorGrayStopAll, colorBoldStopAll, instanceToStop.ID, colorResetStopAll, colorBoldStopAll, instanceToStop.PID, colorResetStopAll, colorResetStopAll)
-						finalStatus = "exited_or_not_found"
-						instanceToStop.StopTime = currentTime
-					} else {
-						resultsChan <- result{id: instanceToStop.ID, name: instanceToStop.Name, success: false, errorMsg: fmt.Sprintf("failed to send SIGTERM to PGID %d: %v", instanceToStop.PID, signalErr)}
-						return
-					}
-				} else {
-					cmd.Printf("    %sSent SIGTERM to PGID %s%d%s for %s%s%s.%s\n",
-						colorGreenStopAll, colorBoldStopAll, instanceToStop.PID, colorResetStopAll, colorBoldStopAll, instanceToStop.ID, colorResetStopAll, colorResetStopAll)
-					finalStatus = "stopping"
-					instanceToStop.StopTime = currentTime
-				}
+				cmd.Printf("  Stopping instance %s%s%s (%s) - PGID: %s%d%s, %s...\n",
+					colorBoldStopAll, instanceToStop.ID, colorResetStopAll, instanceToStop.Name, colorBoldStopAll, instanceToStop.PID, colorResetStopAll, describeStopMethod(instanceToStop))
 
-				instanceToStop.Status = finalStatus
-				if updateErr := instanceStore.UpdateInstance(instanceToStop.ID, instanceToStop); updateErr != nil {
-					resultsChan <- result{id: instanceToStop.ID, name: instanceToStop.Name, success: false, finalStatus: finalStatus, errorMsg: fmt.Sprintf("failed to update store to '%s': %v", finalStatus, updateErr)}
-				} else {
-					resultsChan <- result{id: instanceToStop.ID, name: instanceToStop.Name, success: true, finalStatus: finalStatus}
+				finalStatus, stopErr := stopWithHooks(instanceStore, instanceToStop, stopAllOptions.Timeout, stopAllOptions.Force)
+				if stopErr != nil {
+					resultsChan <- result{id: instanceToStop.ID, name: instanceToStop.Name, success: false, finalStatus: finalStatus, errorMsg: stopErr.Error()}
+					return
 				}
+				resultsChan <- result{id: instanceToStop.ID, name: instanceToStop.Name, success: true, finalStatus: finalStatus}
 			}(instanceCopy)
 		}
 
@@ -153,13 +153,13 @@ var stopAllCmd = &cobra.Command{
 				cmd.Printf("  %sSkipped %s%s%s (%s): %s%s\n", colorGrayStopAll, colorBoldStopAll, res.id, colorResetStopAll, res.name, res.skippedReason, colorResetStopAll)
 				skippedCount++
 			} else if res.success {
-				color := colorGreenStopAll
-				if res.finalStatus == "stopping" {
+				color := colorGrayStopAll
+				if res.finalStatus == "killed" {
 					color = colorYellowStopAll
 				}
 				cmd.Printf("  %sInstance %s%s%s (%s) processed. Final status: %s%s%s%s\n",
 					colorGreenStopAll, colorBoldStopAll, res.id, colorResetStopAll, res.name, color, res.finalStatus, colorResetStopAll, colorResetStopAll)
-				if res.finalStatus == "stopping" || res.finalStatus == "exited_or_not_found" {
+				if res.finalStatus == "stopped" || res.finalStatus == "killed" || res.finalStatus == "exited_or_not_found" {
 					stoppedCount++
 				}
 			} else {
@@ -170,16 +170,34 @@ var stopAllCmd = &cobra.Command{
 		}
 
 		fmt.Printf("\n%s--- Stop All Summary ---%s\n", colorBoldStopAll, colorResetStopAll)
-		fmt.Printf("  %sSuccessfully signaled/processed: %s%d%s%s\n", colorGreenStopAll, colorBoldStopAll, stoppedCount, colorResetStopAll, colorResetStopAll)
+		fmt.Printf("  %sSuccessfully stopped/processed: %s%d%s%s\n", colorGreenStopAll, colorBoldStopAll, stoppedCount, colorResetStopAll, colorResetStopAll)
 		fmt.Printf("  %sFailed to stop/update:         %s%d%s%s\n", colorRedStopAll, colorBoldStopAll, failedToStopCount, colorResetStopAll, colorResetStopAll)
 		fmt.Printf("  %sSkipped:                       %s%d%s%s\n", colorGrayStopAll, colorBoldStopAll, skippedCount, colorResetStopAll, colorResetStopAll)
-		fmt.Println("Use 'gitserve list' to verify final statuses and for pruning.")
+		fmt.Println("Use 'gitserve list' to view final statuses and for pruning.")
 
 		return nil
 	},
 }
 
+// describeStopAllFilter tells which instances stop-all acts on, for its progress output.
+func describeStopAllFilter(selector models.Selector) string {
+	var terms []string
+	if stopAllProjectName != "" {
+		terms = append(terms, "project "+stopAllProjectName)
+	}
+	if len(selector) > 0 {
+		terms = append(terms, "labels "+selector.String())
+	}
+	if len(terms) == 0 {
+		return "none"
+	}
+	return strings.Join(terms, ", ")
+}
+
 func init() {
 	rootCmd.AddCommand(stopAllCmd)
-	stopAllCmd.Flags().StringVarP(&stopAllProjectName, "project", "p", "", "Filter instances by project name (derived from the repository directory name)")
+	stopAllCmd.Flags().StringVarP(&stopAllProjectName, "project", "p", "", "Filter instances by project (the name of the repository they were run from)")
+	addSelectorFlag(stopAllCmd, &stopAllOptions.Selector, "Only stop the instances whose labels match this selector (e.g. team=web,ref!=main)")
+	stopAllCmd.Flags().BoolVarP(&stopAllOptions.Force, "force", "f", false, "Force stop instances (SIGKILL) without a graceful shutdown")
+	stopAllCmd.Flags().DurationVarP(&stopAllOptions.Timeout, "timeout", "t", defaultStopTimeout, "Time to wait for graceful shutdown before sending SIGKILL")
 }
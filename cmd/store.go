@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"gitserve/internal/config"
+	"gitserve/internal/logger"
+	"gitserve/internal/storage"
+	"gitserve/internal/termui"
+
+	"github.com/spf13/cobra"
+)
+
+var storeMigrateOptions struct {
+	To      string
+	Replace bool
+}
+
+var storeCmd = &cobra.Command{
+	Use:   "store",
+	Short: "Manage the store gitserve keeps instance state in",
+}
+
+var storeMigrateCmd = &cobra.Command{
+	Use:   "migrate --to json|sqlite",
+	Short: "Copy all instances to another store backend and switch to it",
+	Long: `Copies every instance and the run history from the current store backend to the one given
+with --to, and then sets store.backend in ~/.gitserve/config.yaml so gitserve uses it from now on.
+
+The sqlite backend keeps instances in an SQLite database with indexed lookups, which stays
+fast as the number of instances grows; the json backend (the default) rewrites one JSON file
+on every change. The old store is left in place.
+
+Running instances have to be stopped first: their supervisors keep writing to the store they
+were started with.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		to := storeMigrateOptions.To
+		if to != storage.BackendJSON && to != storage.BackendSQLite {
+			return fmt.Errorf("invalid --to value '%s' (expected %s or %s)", to, storage.BackendJSON, storage.BackendSQLite)
+		}
+
+		location, err := storeLocation()
+		if err != nil {
+			return err
+		}
+		from := location.Backend
+		if from == "" {
+			from = storage.BackendJSON
+		}
+		if from == to {
+			return fmt.Errorf("the store already uses the %s backend", to)
+		}
+
+		log := logger.NewService(logger.LogLevelInfo)
+		source, err := storage.Open(location, log)
+		if err != nil {
+			return fmt.Errorf("failed to open the %s store: %w", from, err)
+		}
+		target, err := storage.Open(storage.Location{Dir: location.Dir, Backend: to}, log)
+		if err != nil {
+			return fmt.Errorf("failed to open the %s store: %w", to, err)
+		}
+
+		// Both stores stay locked while copying, so nothing is written to the old one after it
+		// was read, and the new one is filled completely or not at all.
+		copied := 0
+		err = source.Transaction(func(src storage.InstanceStore) error {
+			instances, err := src.GetAllInstances()
+			if err != nil {
+				return fmt.Errorf("failed to retrieve instances: %w", err)
+			}
+			var live []string
+			for _, inst := range instances {
+				if inst.Parent == "" && isLiveStatus(inst.Status) {
+					live = append(live, inst.ID)
+				}
+			}
+			if len(live) > 0 {
+				return fmt.Errorf("%d instance(s) still running (%s); stop them first, e.g. with 'gitserve stop-all'",
+					len(live), strings.Join(live, ", "))
+			}
+
+			return target.Transaction(func(dst storage.InstanceStore) error {
+				existing, err := dst.GetAllInstances()
+				if err != nil {
+					return fmt.Errorf("failed to retrieve instances from the %s store: %w", to, err)
+				}
+				if len(existing) > 0 && !storeMigrateOptions.Replace {
+					return fmt.Errorf("the %s store already holds %d instance(s); use --replace to overwrite them", to, len(existing))
+				}
+				for _, inst := range existing {
+					if err := dst.DeleteInstance(inst.ID); err != nil {
+						return err
+					}
+				}
+				for _, inst := range instances {
+					if err := dst.AddInstance(inst); err != nil {
+						return fmt.Errorf("failed to copy instance '%s': %w", inst.ID, err)
+					}
+				}
+				// The run history has no deletion; with --replace, runs already in the target store
+				// are overwritten with the copied ones.
+				runs, err := src.FindRuns(storage.RunFilter{})
+				if err != nil {
+					return fmt.Errorf("failed to retrieve the run history: %w", err)
+				}
+				for _, run := range runs {
+					replaced, err := dst.ModifyRun(run.ID, func(existing *storage.RunRecord) { *existing = run })
+					if err == nil && !replaced {
+						err = dst.AddRun(run)
+					}
+					if err != nil {
+						return fmt.Errorf("failed to copy run '%s': %w", run.ID, err)
+					}
+				}
+				copied = len(instances)
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		userConfigPath, err := gitserveSubDir(config.UserConfigFile)
+		if err != nil {
+			return err
+		}
+		if err := config.SetStoreBackend(userConfigPath, to); err != nil {
+			return fmt.Errorf("copied %d instance(s), but failed to switch to the %s store: %w", copied, to, err)
+		}
+		fmt.Printf("%sCopied %s%d%s%s instance record(s) from the %s store to the %s store.%s\n",
+			termui.ColorGreen, termui.ColorBold, copied, termui.ColorReset, termui.ColorGreen, from, to, termui.ColorReset)
+		fmt.Printf("gitserve now uses the %s store (store.backend in %s).\n", to, userConfigPath)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(storeCmd)
+	storeCmd.AddCommand(storeMigrateCmd)
+	storeMigrateCmd.Flags().StringVar(&storeMigrateOptions.To, "to", "", "Backend to move the instances to: json or sqlite")
+	storeMigrateCmd.Flags().BoolVar(&storeMigrateOptions.Replace, "replace", false, "Overwrite instances already in the target store")
+	_ = storeMigrateCmd.MarkFlagRequired("to")
+}
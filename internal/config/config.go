@@ -0,0 +1,457 @@
+package config
+
+import (
+	"fmt"
+	"gitserve/internal/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config mirrors the project configuration file (.gitserve.yaml / .gitserve.json).
+// JSON is a subset of YAML, so both formats are decoded by the same parser.
+type Config struct {
+	// PreCommand runs before EACH main command (npm ci, bundle install, ...).
+	PreCommand CommandList `yaml:"pre_command"`
+
+	// DefaultRunCommand is used when neither -c nor --name is given.
+	DefaultRunCommand string `yaml:"default_run_command"`
+
+	// Processes turns the default command into a multi-process instance (web, worker, ...).
+	// It replaces default_run_command; a Procfile in the repository is used when neither is set.
+	Processes ProcessList `yaml:"processes"`
+
+	// DefaultPort is the port gitserve tries first.
+	DefaultPort int `yaml:"default_port"`
+
+	// PreferredPortsList is tried in order when DefaultPort is taken.
+	PreferredPortsList []int `yaml:"preferred_ports_list"`
+
+	// BranchPortMapping maps branches to the port they should try first.
+	BranchPortMapping map[string]int `yaml:"branch_port_mapping"`
+
+	// StopSignal and StopCommand control how instances of the default run command are stopped.
+	StopSignal  string `yaml:"stop_signal"`
+	StopCommand string `yaml:"stop_command"`
+
+	// Restart is the restart policy for detached instances of the default run command.
+	Restart RestartConfig `yaml:"restart"`
+
+	// Limits are the resource limits for instances of the default run command.
+	Limits LimitsConfig `yaml:"limits"`
+
+	// Hooks run at the phases of an instance's lifetime.
+	Hooks HooksConfig `yaml:"hooks"`
+
+	// NamedCommands are the saved "recipes" selectable with --name.
+	NamedCommands map[string]NamedCommand `yaml:"named_commands"`
+
+	// GlobalEnvVars are applied to ALL commands gitserve runs.
+	GlobalEnvVars map[string]string `yaml:"global_env_vars"`
+}
+
+// NamedCommand is a saved command definition selectable with `gitserve run --name <name>`.
+type NamedCommand struct {
+	Description string            `yaml:"description"`
+	RunCommand  string            `yaml:"run_command"`
+	Processes   ProcessList       `yaml:"processes"` // Instead of run_command, for multi-process instances
+	PreCommand  CommandList       `yaml:"pre_command"`
+	DefaultPort int               `yaml:"default_port"`
+	EnvVars     map[string]string `yaml:"env_vars"`
+
+	// StopSignal is sent to the process group on stop instead of SIGTERM (e.g. SIGINT).
+	StopSignal string `yaml:"stop_signal"`
+	// StopCommand is run in the workspace to stop the instance instead of signaling it (e.g. npm run stop).
+	StopCommand string `yaml:"stop_command"`
+
+	// Restart is the restart policy applied by the supervisor of a detached instance.
+	Restart RestartConfig `yaml:"restart"`
+
+	// Limits replace the top-level limits for this command.
+	Limits LimitsConfig `yaml:"limits"`
+
+	// Hooks replace the top-level hooks of the phases they are set for.
+	Hooks HooksConfig `yaml:"hooks"`
+}
+
+// RestartConfig is either just a policy (`restart: on-failure`) or a mapping:
+//
+//	restart:
+//	  policy: on-failure      # no | on-failure | always
+//	  max_retries: 5          # restarts allowed within crash_loop_window
+//	  backoff: 1s             # initial delay, doubled on each consecutive restart
+//	  max_backoff: 30s
+//	  crash_loop_window: 1m
+type RestartConfig struct {
+	Policy          string        `yaml:"policy"`
+	MaxRetries      int           `yaml:"max_retries"`
+	Backoff         time.Duration `yaml:"backoff"`
+	MaxBackoff      time.Duration `yaml:"max_backoff"`
+	CrashLoopWindow time.Duration `yaml:"crash_loop_window"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler to accept the short scalar form.
+func (r *RestartConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&r.Policy)
+	}
+	type plain RestartConfig // avoid recursing into this method
+	return node.Decode((*plain)(r))
+}
+
+// IsSet reports whether any restart setting was configured.
+func (r RestartConfig) IsSet() bool {
+	return r != RestartConfig{}
+}
+
+// Validate checks the policy name.
+func (r RestartConfig) Validate() error {
+	switch r.Policy {
+	case "", models.RestartNo, models.RestartOnFailure, models.RestartAlways:
+		return nil
+	default:
+		return fmt.Errorf("invalid restart policy '%s' (expected %s, %s or %s)",
+			r.Policy, models.RestartNo, models.RestartOnFailure, models.RestartAlways)
+	}
+}
+
+// ToPolicy converts the configuration into the policy handed to the supervisor, with defaults applied.
+func (r RestartConfig) ToPolicy() models.RestartPolicy {
+	return models.RestartPolicy{
+		Policy:          r.Policy,
+		MaxRetries:      r.MaxRetries,
+		Backoff:         r.Backoff,
+		MaxBackoff:      r.MaxBackoff,
+		CrashLoopWindow: r.CrashLoopWindow,
+	}.WithDefaults()
+}
+
+// LimitsConfig are the resource limits of an instance's process:
+//
+//	limits:
+//	  memory: 2G           # address space (RLIMIT_AS); K, M, G and T suffixes are powers of 1024
+//	  cpu_time: 10m        # CPU time (RLIMIT_CPU)
+//	  open_files: 1024     # RLIMIT_NOFILE
+//	  max_processes: 512   # RLIMIT_NPROC, counted across all processes of the user
+//	  nice: 10
+//	  ionice: idle         # idle, best-effort[:0-7] or realtime[:0-7]
+type LimitsConfig struct {
+	Memory       string        `yaml:"memory"`
+	CPUTime      time.Duration `yaml:"cpu_time"`
+	OpenFiles    uint64        `yaml:"open_files"`
+	MaxProcesses uint64        `yaml:"max_processes"`
+	Nice         int           `yaml:"nice"`
+	IONice       string        `yaml:"ionice"`
+}
+
+// IsSet reports whether any limit was configured.
+func (l LimitsConfig) IsSet() bool {
+	return l != LimitsConfig{}
+}
+
+// ToLimits validates the configuration and converts it into the limits applied to the process.
+func (l LimitsConfig) ToLimits() (models.ResourceLimits, error) {
+	limits := models.ResourceLimits{
+		CPUTime:      l.CPUTime,
+		OpenFiles:    l.OpenFiles,
+		MaxProcesses: l.MaxProcesses,
+		Nice:         l.Nice,
+	}
+	if l.Memory != "" {
+		size, err := parseByteSize(l.Memory)
+		if err != nil {
+			return models.ResourceLimits{}, fmt.Errorf("invalid memory limit: %w", err)
+		}
+		limits.AddressSpace = size
+	}
+	if l.CPUTime < 0 {
+		return models.ResourceLimits{}, fmt.Errorf("invalid cpu_time limit '%s'", l.CPUTime)
+	}
+	if l.Nice < -20 || l.Nice > 19 {
+		return models.ResourceLimits{}, fmt.Errorf("invalid nice level %d (expected -20 to 19)", l.Nice)
+	}
+	if l.IONice != "" {
+		class, level, hasLevel := strings.Cut(l.IONice, ":")
+		switch class {
+		case models.IOClassIdle:
+			if hasLevel {
+				return models.ResourceLimits{}, fmt.Errorf("invalid ionice '%s' (the idle class has no level)", l.IONice)
+			}
+		case models.IOClassBestEffort, models.IOClassRealtime:
+			limits.IOLevel = 4 // The kernel's default level
+			if hasLevel {
+				n, err := strconv.Atoi(level)
+				if err != nil || n < 0 || n > 7 {
+					return models.ResourceLimits{}, fmt.Errorf("invalid ionice level '%s' (expected 0 to 7)", level)
+				}
+				limits.IOLevel = n
+			}
+		default:
+			return models.ResourceLimits{}, fmt.Errorf("invalid ionice class '%s' (expected %s, %s or %s)",
+				class, models.IOClassIdle, models.IOClassBestEffort, models.IOClassRealtime)
+		}
+		limits.IOClass = class
+	}
+	return limits, nil
+}
+
+// parseByteSize parses sizes like "512M", "2G" or "1048576" (bytes).
+func parseByteSize(value string) (uint64, error) {
+	units := map[string]uint64{"": 1, "B": 1, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+	upper := strings.ToUpper(strings.TrimSpace(value))
+	upper = strings.TrimSuffix(upper, "IB") // 2GiB
+	upper = strings.TrimSuffix(upper, "B")  // 2GB, still powers of 1024
+	i := strings.IndexFunc(upper, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		i = len(upper)
+	}
+	multiplier, ok := units[upper[i:]]
+	n, err := strconv.ParseUint(upper[:i], 10, 64)
+	if !ok || err != nil || n == 0 {
+		return 0, fmt.Errorf("'%s' is not a size like 512M or 2G", value)
+	}
+	return n * multiplier, nil
+}
+
+// defaultHookTimeout bounds a hook that doesn't set a timeout.
+const defaultHookTimeout = time.Minute
+
+// HooksConfig are the lifecycle hooks, by phase:
+//
+//	hooks:
+//	  post_checkout: ./scripts/seed-db.sh     # just the command
+//	  post_start:
+//	    - name: register
+//	      command: curl -fsS -X POST localhost:9000/routes -d "$GITSERVE_INSTANCE_ID=$PORT"
+//	      timeout: 10s                        # 1m by default
+//	      on_failure: warn                    # fail or warn
+//	  pre_stop: [./scripts/dump-state.sh]
+//
+// A failing hook fails the run by default; pre_stop and post_stop hooks only warn, so a broken
+// hook can't keep an instance from being stopped.
+type HooksConfig struct {
+	PreClone     HookList `yaml:"pre_clone"`
+	PostCheckout HookList `yaml:"post_checkout"`
+	PostStart    HookList `yaml:"post_start"`
+	PreStop      HookList `yaml:"pre_stop"`
+	PostStop     HookList `yaml:"post_stop"`
+}
+
+// Merge returns h with the phases that are not set taken from base.
+func (h HooksConfig) Merge(base HooksConfig) HooksConfig {
+	pick := func(list, fallback HookList) HookList {
+		if len(list) > 0 {
+			return list
+		}
+		return fallback
+	}
+	return HooksConfig{
+		PreClone:     pick(h.PreClone, base.PreClone),
+		PostCheckout: pick(h.PostCheckout, base.PostCheckout),
+		PostStart:    pick(h.PostStart, base.PostStart),
+		PreStop:      pick(h.PreStop, base.PreStop),
+		PostStop:     pick(h.PostStop, base.PostStop),
+	}
+}
+
+// ToHooks validates the configuration and fills in the defaults.
+func (h HooksConfig) ToHooks() (models.Hooks, error) {
+	var hooks models.Hooks
+	phases := []struct {
+		name     string
+		list     HookList
+		resolved *[]models.Hook
+	}{
+		{models.HookPreClone, h.PreClone, &hooks.PreClone},
+		{models.HookPostCheckout, h.PostCheckout, &hooks.PostCheckout},
+		{models.HookPostStart, h.PostStart, &hooks.PostStart},
+		{models.HookPreStop, h.PreStop, &hooks.PreStop},
+		{models.HookPostStop, h.PostStop, &hooks.PostStop},
+	}
+	for _, phase := range phases {
+		for i, hook := range phase.list {
+			resolved, err := hook.toHook(phase.name, i, len(phase.list))
+			if err != nil {
+				return models.Hooks{}, fmt.Errorf("%s hook %d: %w", phase.name, i+1, err)
+			}
+			*phase.resolved = append(*phase.resolved, resolved)
+		}
+	}
+	return hooks, nil
+}
+
+// HookConfig is one hook command.
+type HookConfig struct {
+	Name      string        `yaml:"name"` // Defaults to the phase, numbered if it has several hooks
+	Command   string        `yaml:"command"`
+	Timeout   time.Duration `yaml:"timeout"`
+	OnFailure string        `yaml:"on_failure"`
+}
+
+// toHook validates the i-th of count hooks of a phase and fills in its defaults.
+func (h HookConfig) toHook(phase string, i, count int) (models.Hook, error) {
+	hook := models.Hook{Name: h.Name, Command: h.Command, Timeout: h.Timeout, OnFailure: h.OnFailure}
+	if hook.Command == "" {
+		return hook, fmt.Errorf("no command")
+	}
+	if hook.Name == "" {
+		hook.Name = phase
+		if count > 1 {
+			hook.Name = fmt.Sprintf("%s-%d", phase, i+1)
+		}
+	}
+	if hook.Timeout < 0 {
+		return hook, fmt.Errorf("invalid timeout '%s'", hook.Timeout)
+	}
+	if hook.Timeout == 0 {
+		hook.Timeout = defaultHookTimeout
+	}
+	switch hook.OnFailure {
+	case models.HookFail, models.HookWarn:
+	case "":
+		hook.OnFailure = models.HookFail
+		if phase == models.HookPreStop || phase == models.HookPostStop {
+			hook.OnFailure = models.HookWarn
+		}
+	default:
+		return hook, fmt.Errorf("invalid on_failure '%s' (expected %s or %s)", hook.OnFailure, models.HookFail, models.HookWarn)
+	}
+	return hook, nil
+}
+
+// HookList accepts a single command, or a list of commands and hook mappings.
+type HookList []HookConfig
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (l *HookList) UnmarshalYAML(node *yaml.Node) error {
+	items := []*yaml.Node{node}
+	switch node.Kind {
+	case yaml.ScalarNode:
+	case yaml.SequenceNode:
+		items = node.Content
+	default:
+		return fmt.Errorf("line %d: expected a command or a list of hooks", node.Line)
+	}
+	list := make(HookList, 0, len(items))
+	for _, item := range items {
+		var hook HookConfig
+		switch item.Kind {
+		case yaml.ScalarNode:
+			if err := item.Decode(&hook.Command); err != nil {
+				return err
+			}
+		case yaml.MappingNode:
+			if err := item.Decode(&hook); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("line %d: expected a command or a hook mapping", item.Line)
+		}
+		list = append(list, hook)
+	}
+	*l = list
+	return nil
+}
+
+// CommandList accepts either a single command string or a list of commands.
+type CommandList []string
+
+// UnmarshalYAML implements yaml.Unmarshaler so `pre_command: npm ci` and
+// `pre_command: [npm ci, npm run build]` are both accepted.
+func (c *CommandList) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		var single string
+		if err := node.Decode(&single); err != nil {
+			return err
+		}
+		if single != "" {
+			*c = CommandList{single}
+		}
+		return nil
+	case yaml.SequenceNode:
+		var list []string
+		if err := node.Decode(&list); err != nil {
+			return err
+		}
+		*c = list
+		return nil
+	default:
+		return fmt.Errorf("line %d: expected a command or a list of commands", node.Line)
+	}
+}
+
+// ProcessConfig is one process of a multi-process instance.
+type ProcessConfig struct {
+	Name    string            `yaml:"-"`
+	Command string            `yaml:"command"`
+	Port    int               `yaml:"port"` // Defaults to the instance port + 100 * position
+	EnvVars map[string]string `yaml:"env_vars"`
+}
+
+// ProcessList is the `processes:` mapping. It is kept in file order, which decides the ports
+// processes get. Each entry is either just the command or a mapping:
+//
+//	processes:
+//	  web: npm run dev
+//	  worker:
+//	    command: npm run worker
+//	    port: 9000
+//	    env_vars:
+//	      QUEUE: default
+type ProcessList []ProcessConfig
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (p *ProcessList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: processes must be a mapping of process name to command", node.Line)
+	}
+	list := make(ProcessList, 0, len(node.Content)/2)
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, valueNode := node.Content[i], node.Content[i+1]
+		var process ProcessConfig
+		switch valueNode.Kind {
+		case yaml.ScalarNode:
+			if err := valueNode.Decode(&process.Command); err != nil {
+				return err
+			}
+		case yaml.MappingNode:
+			if err := valueNode.Decode(&process); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("line %d: expected a command or a mapping for process '%s'", valueNode.Line, keyNode.Value)
+		}
+		process.Name = keyNode.Value
+		if err := ValidateProcessName(process.Name); err != nil {
+			return fmt.Errorf("line %d: %w", keyNode.Line, err)
+		}
+		if process.Command == "" {
+			return fmt.Errorf("line %d: process '%s' has no command", valueNode.Line, process.Name)
+		}
+		if seen[process.Name] {
+			return fmt.Errorf("line %d: process '%s' is defined twice", keyNode.Line, process.Name)
+		}
+		seen[process.Name] = true
+		list = append(list, process)
+	}
+	*p = list
+	return nil
+}
+
+// ValidateProcessName checks that a process name can be used in instance IDs (<id>/<process>)
+// and log file names.
+func ValidateProcessName(name string) error {
+	if name == "" {
+		return fmt.Errorf("process name must not be empty")
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return fmt.Errorf("invalid process name '%s' (use letters, digits, '-' and '_')", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package config
+
+import "gitserve/internal/models"
+
+// ResolvedCommand is the effective command definition for a single run, after
+// merging the selected named command (if any) with the top-level defaults.
+type ResolvedCommand struct {
+	Name        string // Named command this was resolved from, empty for the default command
+	RunCommand  string
+	Processes   []ProcessDefinition // Set instead of RunCommand for multi-process instances
+	PreCommand  []string            // Run in the workspace after cloning, before the command (or shell)
+	StopSignal  string
+	StopCommand string
+	Restart     models.RestartPolicy
+	Limits      models.ResourceLimits
+	Hooks       models.Hooks
+	DefaultPort int               // Command-specific default_port, falling back to the top-level one
+	Env         map[string]string // global_env_vars overlaid with the named command's env_vars
+}
+
+// ProcessDefinition is one process of a multi-process instance, from `processes:` or a Procfile.
+type ProcessDefinition struct {
+	Name    string
+	Command string
+	Port    int               // Explicit port, 0 to derive it from the instance port
+	Env     map[string]string // Process-specific variables on top of the instance's
+}
+
+// Service defines the interface for reading the project configuration
+type Service interface {
+	// Get returns the loaded configuration. It is never nil; a missing file yields an empty Config.
+	Get() *Config
+
+	// Path returns the path of the loaded configuration file, or "" if none was found.
+	Path() string
+
+	// ResolveCommand returns the effective command definition for the named command,
+	// or for the default run command if name is empty.
+	ResolveCommand(name string) (*ResolvedCommand, error)
+
+	// ProcfileProcesses returns the processes defined in a Procfile in dir, or nil if there is none.
+	ProcfileProcesses(dir string) ([]ProcessDefinition, error)
+
+	// PortForRef returns the port configured for a ref via branch_port_mapping, or 0.
+	PortForRef(ref string) int
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// procfileName is the Procfile looked up in the workspace when no command is configured.
+const procfileName = "Procfile"
+
+// parseProcfile reads a Procfile (`name: command` per line, # comments) from dir.
+// It returns nil without an error if there is no Procfile.
+func parseProcfile(dir string) ([]ProcessDefinition, error) {
+	path := filepath.Join(dir, procfileName)
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var processes []ProcessDefinition
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, command, ok := strings.Cut(line, ":")
+		name, command = strings.TrimSpace(name), strings.TrimSpace(command)
+		if !ok || command == "" {
+			return nil, fmt.Errorf("%s:%d: expected 'name: command'", path, lineNumber)
+		}
+		if err := ValidateProcessName(name); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%s:%d: process '%s' is defined twice", path, lineNumber, name)
+		}
+		seen[name] = true
+		processes = append(processes, ProcessDefinition{Name: name, Command: command})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return processes, nil
+}
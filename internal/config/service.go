@@ -0,0 +1,181 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configFileNames are looked up in order in the project directory; the first match wins.
+var configFileNames = []string{".gitserve.yaml", ".gitserve.yml", "gitserve.yaml", ".gitserve.json"}
+
+// ServiceImpl implements the Config service interface
+type ServiceImpl struct {
+	config *Config
+	path   string
+}
+
+// NewService loads the configuration file from projectDir.
+// A missing configuration file is not an error; an unreadable or invalid one is.
+func NewService(projectDir string) (Service, error) {
+	s := &ServiceImpl{config: &Config{}}
+
+	for _, name := range configFileNames {
+		candidate := filepath.Join(projectDir, name)
+		data, err := os.ReadFile(candidate)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read config file %s: %w", candidate, err)
+		}
+		if err := yaml.Unmarshal(data, s.config); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", candidate, err)
+		}
+		s.path = candidate
+		break
+	}
+
+	return s, nil
+}
+
+// Get returns the loaded configuration
+func (s *ServiceImpl) Get() *Config {
+	return s.config
+}
+
+// Path returns the path of the loaded configuration file
+func (s *ServiceImpl) Path() string {
+	return s.path
+}
+
+// ResolveCommand returns the effective command definition for a named command or the default command
+func (s *ServiceImpl) ResolveCommand(name string) (*ResolvedCommand, error) {
+	if name == "" {
+		if err := s.config.Restart.Validate(); err != nil {
+			return nil, err
+		}
+		if s.config.DefaultRunCommand != "" && len(s.config.Processes) > 0 {
+			return nil, fmt.Errorf("set either default_run_command or processes in %s, not both", s.path)
+		}
+		limits, err := s.config.Limits.ToLimits()
+		if err != nil {
+			return nil, err
+		}
+		hooks, err := s.config.Hooks.ToHooks()
+		if err != nil {
+			return nil, err
+		}
+		return &ResolvedCommand{
+			RunCommand:  s.config.DefaultRunCommand,
+			Processes:   toProcessDefinitions(s.config.Processes),
+			PreCommand:  s.config.PreCommand,
+			StopSignal:  s.config.StopSignal,
+			StopCommand: s.config.StopCommand,
+			Restart:     s.config.Restart.ToPolicy(),
+			Limits:      limits,
+			Hooks:       hooks,
+			DefaultPort: s.config.DefaultPort,
+			Env:         mergeEnv(s.config.GlobalEnvVars, nil),
+		}, nil
+	}
+
+	named, ok := s.config.NamedCommands[name]
+	if !ok {
+		if s.path == "" {
+			return nil, fmt.Errorf("named command '%s' requested but no config file was found", name)
+		}
+		return nil, fmt.Errorf("named command '%s' is not defined in %s", name, s.path)
+	}
+
+	if named.RunCommand != "" && len(named.Processes) > 0 {
+		return nil, fmt.Errorf("named command '%s': set either run_command or processes, not both", name)
+	}
+	resolved := &ResolvedCommand{
+		Name:        name,
+		RunCommand:  named.RunCommand,
+		Processes:   toProcessDefinitions(named.Processes),
+		StopSignal:  named.StopSignal,
+		StopCommand: named.StopCommand,
+	}
+	// A named command's pre_command replaces the top-level one rather than adding to it.
+	resolved.PreCommand = named.PreCommand
+	if len(resolved.PreCommand) == 0 {
+		resolved.PreCommand = s.config.PreCommand
+	}
+	// Fall back to the top-level stop settings when the named command doesn't override them.
+	if resolved.StopSignal == "" && resolved.StopCommand == "" {
+		resolved.StopSignal = s.config.StopSignal
+		resolved.StopCommand = s.config.StopCommand
+	}
+
+	restart := named.Restart
+	if !restart.IsSet() {
+		restart = s.config.Restart
+	}
+	if err := restart.Validate(); err != nil {
+		return nil, fmt.Errorf("named command '%s': %w", name, err)
+	}
+	resolved.Restart = restart.ToPolicy()
+
+	limits := named.Limits
+	if !limits.IsSet() {
+		limits = s.config.Limits
+	}
+	resolvedLimits, err := limits.ToLimits()
+	if err != nil {
+		return nil, fmt.Errorf("named command '%s': %w", name, err)
+	}
+	resolved.Limits = resolvedLimits
+
+	resolvedHooks, err := named.Hooks.Merge(s.config.Hooks).ToHooks()
+	if err != nil {
+		return nil, fmt.Errorf("named command '%s': %w", name, err)
+	}
+	resolved.Hooks = resolvedHooks
+
+	resolved.DefaultPort = named.DefaultPort
+	if resolved.DefaultPort == 0 {
+		resolved.DefaultPort = s.config.DefaultPort
+	}
+	resolved.Env = mergeEnv(s.config.GlobalEnvVars, named.EnvVars)
+	return resolved, nil
+}
+
+// ProcfileProcesses returns the processes of the Procfile in dir
+func (s *ServiceImpl) ProcfileProcesses(dir string) ([]ProcessDefinition, error) {
+	return parseProcfile(dir)
+}
+
+// PortForRef returns the port mapped to ref in branch_port_mapping
+func (s *ServiceImpl) PortForRef(ref string) int {
+	return s.config.BranchPortMapping[ref]
+}
+
+// mergeEnv returns a new map with the entries of base overridden by overrides.
+func mergeEnv(base, overrides map[string]string) map[string]string {
+	merged := make(map[string]string, len(base)+len(overrides))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		merged[k] = v
+	}
+	return merged
+}
+
+// toProcessDefinitions converts the `processes:` config entries into process definitions.
+func toProcessDefinitions(list ProcessList) []ProcessDefinition {
+	var processes []ProcessDefinition
+	for _, process := range list {
+		processes = append(processes, ProcessDefinition{
+			Name:    process.Name,
+			Command: process.Command,
+			Port:    process.Port,
+			Env:     mergeEnv(process.EnvVars, nil),
+		})
+	}
+	return processes
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"gitserve/internal/models"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// UserConfigFile is the name of the user configuration file in ~/.gitserve. It holds the
+// settings shared by all projects, unlike the project configuration file.
+const UserConfigFile = "config.yaml"
+
+// UserConfig mirrors the user configuration file (~/.gitserve/config.yaml).
+type UserConfig struct {
+	// Store selects where instance state is kept.
+	Store StoreConfig `yaml:"store"`
+
+	// Prune controls which stopped instances 'gitserve prune' removes, and whether gitserve
+	// prunes on its own.
+	Prune PruneConfig `yaml:"prune"`
+}
+
+// StoreConfig selects the backend of the instance store.
+type StoreConfig struct {
+	Backend string `yaml:"backend"` // json (the default) or sqlite
+}
+
+// PruneConfig controls pruning of stopped instances:
+//
+//	prune:
+//	  max_age:           # how long instances are kept after they stopped, by status
+//	    default: 24h
+//	    stopped: 2h
+//	  keep_last: 3       # always keep the 3 most recently stopped instances of each ref
+//	  keep_failed: 168h  # keep failed instances at least this long
+//	  auto: true         # prune whenever gitserve runs something...
+//	  interval: 1h       # ...but at most this often
+type PruneConfig struct {
+	MaxAge     map[string]time.Duration `yaml:"max_age"`
+	KeepLast   int                      `yaml:"keep_last"`
+	KeepFailed time.Duration            `yaml:"keep_failed"`
+	Auto       bool                     `yaml:"auto"`
+	Interval   time.Duration            `yaml:"interval"`
+}
+
+// DefaultPruneInterval is how often automatic pruning runs if prune.interval isn't set.
+const DefaultPruneInterval = time.Hour
+
+// Validate checks the statuses and durations.
+func (p PruneConfig) Validate() error {
+	for status, age := range p.MaxAge {
+		if status != models.DefaultMaxAgeKey && (!models.IsTerminalStatus(status) || status == "removed") {
+			return fmt.Errorf("invalid prune.max_age status '%s' (expected %s or the status of a stopped instance, e.g. stopped, exited or failed)", status, models.DefaultMaxAgeKey)
+		}
+		if age < 0 {
+			return fmt.Errorf("invalid prune.max_age of %s: %s is negative", status, age)
+		}
+	}
+	if p.KeepLast < 0 || p.KeepFailed < 0 || p.Interval < 0 {
+		return fmt.Errorf("prune.keep_last, prune.keep_failed and prune.interval must not be negative")
+	}
+	return nil
+}
+
+// ToPolicy converts the configuration into a prune policy, with defaults applied.
+func (p PruneConfig) ToPolicy() models.PrunePolicy {
+	return models.PrunePolicy{
+		MaxAge:     p.MaxAge,
+		KeepLast:   p.KeepLast,
+		KeepFailed: p.KeepFailed,
+	}.WithDefaults()
+}
+
+// AutoInterval returns how often automatic pruning runs.
+func (p PruneConfig) AutoInterval() time.Duration {
+	if p.Interval == 0 {
+		return DefaultPruneInterval
+	}
+	return p.Interval
+}
+
+// LoadUserConfig reads the user configuration file at path.
+// A missing file is not an error and yields an empty UserConfig.
+func LoadUserConfig(path string) (*UserConfig, error) {
+	userConfig := &UserConfig{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return userConfig, nil
+		}
+		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+	if err := yaml.Unmarshal(data, userConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return userConfig, nil
+}
+
+// SetStoreBackend sets store.backend in the user configuration file at path, creating the
+// file if needed. The rest of the file, comments included, is kept as it is.
+func SetStoreBackend(path string, backend string) error {
+	var doc yaml.Node
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	if doc.Kind == 0 { // Empty file
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("config file %s is not a mapping", path)
+	}
+	store := mappingValue(root, "store", yaml.MappingNode)
+	if store.Kind == yaml.ScalarNode && store.Tag == "!!null" { // "store:" without a value
+		*store = yaml.Node{Kind: yaml.MappingNode}
+	}
+	if store.Kind != yaml.MappingNode {
+		return fmt.Errorf("store in config file %s is not a mapping", path)
+	}
+	mappingValue(store, "backend", yaml.ScalarNode).SetString(backend)
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return fmt.Errorf("failed to encode config file %s: %w", path, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	return os.WriteFile(path, out.Bytes(), 0600)
+}
+
+// mappingValue returns the value of key in a YAML mapping node, adding an empty node of the
+// given kind if the key is missing.
+func mappingValue(mapping *yaml.Node, key string, kind yaml.Kind) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	value := &yaml.Node{Kind: kind}
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, value)
+	return value
+}
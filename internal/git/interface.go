@@ -12,4 +12,7 @@ type Service interface {
 
 	// PrepareRepo clones a repository and checks out the specified source (branch, commit, tag, or PR)
 	PrepareRepo(workspacePath string, source models.GitSource) error
+
+	// HeadCommit returns the full hash of the commit checked out in the repository
+	HeadCommit(repoDirectory string) (string, error)
 }
@@ -72,3 +72,12 @@ func (s *ServiceImpl) Checkout(repoDirectory string, refName string) error {
 	s.log.Info("Successfully checked out %s in %s", refName, repoDirectory)
 	return nil
 }
+
+// HeadCommit returns the full hash of the commit checked out in the repository
+func (s *ServiceImpl) HeadCommit(repoDirectory string) (string, error) {
+	output, err := s.runGitCommand(repoDirectory, "rev-parse", "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve HEAD in '%s': %w", repoDirectory, err)
+	}
+	return strings.TrimSpace(output), nil
+}
@@ -0,0 +1,341 @@
+package instance
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gitserve/internal/logger"
+
+	"github.com/creack/pty"
+	"golang.org/x/term"
+)
+
+// DefaultDetachKeys is the key sequence that detaches `gitserve attach` from an instance.
+const DefaultDetachKeys = "ctrl-p,ctrl-q"
+
+// Frames sent from an attached client to the supervisor. Each frame is a type byte, a
+// big-endian uint16 payload length and the payload. The supervisor sends raw terminal output.
+const (
+	attachFrameInput  byte = 0 // Payload is keyboard input for the PTY
+	attachFrameResize byte = 1 // Payload is rows and columns as two big-endian uint16s
+)
+
+const (
+	// attachReplayBytes of recent output are replayed to a client when it attaches.
+	attachReplayBytes = 16 * 1024
+	// attachWriteTimeout bounds how long a stuck client can hold up the instance's output.
+	attachWriteTimeout = 2 * time.Second
+	// ptyDrainTimeout is how long the supervisor keeps reading the PTY after the main process
+	// exits, in case background children still hold it open.
+	ptyDrainTimeout = time.Second
+)
+
+// defaultPTYSize is used until a client attaches and reports its terminal size.
+var defaultPTYSize = pty.Winsize{Rows: 24, Cols: 80}
+
+// attachHub is the supervisor's end of `gitserve attach`. It listens on a Unix socket, relays
+// input and resizes from the attached client to the current PTY and mirrors the PTY output
+// to the client. A new client replaces the previous one.
+type attachHub struct {
+	socketPath string
+	listener   net.Listener
+	log        logger.Service
+
+	mutex  sync.Mutex
+	client net.Conn
+	ptmx   *os.File
+	size   pty.Winsize
+	recent []byte // The last attachReplayBytes of output
+}
+
+// newAttachHub creates the attach socket and starts accepting clients.
+func newAttachHub(socketPath string, log logger.Service) (*attachHub, error) {
+	_ = os.Remove(socketPath) // Left behind by a supervisor that died
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on attach socket %s: %w", socketPath, err)
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict attach socket %s: %w", socketPath, err)
+	}
+	h := &attachHub{socketPath: socketPath, listener: listener, log: log, size: defaultPTYSize}
+	go h.acceptLoop()
+	return h, nil
+}
+
+func (h *attachHub) acceptLoop() {
+	for {
+		conn, err := h.listener.Accept()
+		if err != nil {
+			return // Listener closed
+		}
+		h.mutex.Lock()
+		if h.client != nil {
+			h.client.Close()
+		}
+		h.client = conn
+		// Replay under the lock, so no live output can overtake it.
+		conn.SetWriteDeadline(time.Now().Add(attachWriteTimeout))
+		if _, err := conn.Write(h.recent); err != nil {
+			conn.Close()
+			h.client = nil
+			h.mutex.Unlock()
+			continue
+		}
+		h.mutex.Unlock()
+		h.log.Info("Attach client connected")
+		go h.readClient(conn)
+	}
+}
+
+// readClient relays frames from a client until it disconnects.
+func (h *attachHub) readClient(conn net.Conn) {
+	defer func() {
+		h.mutex.Lock()
+		if h.client == conn {
+			h.client = nil
+		}
+		h.mutex.Unlock()
+		conn.Close()
+		h.log.Info("Attach client disconnected")
+	}()
+
+	header := make([]byte, 3)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint16(header[1:]))
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return
+		}
+
+		h.mutex.Lock()
+		switch header[0] {
+		case attachFrameInput:
+			if h.ptmx != nil {
+				_, _ = h.ptmx.Write(payload)
+			}
+		case attachFrameResize:
+			if len(payload) == 4 {
+				h.size = pty.Winsize{Rows: binary.BigEndian.Uint16(payload), Cols: binary.BigEndian.Uint16(payload[2:])}
+				if h.ptmx != nil {
+					_ = pty.Setsize(h.ptmx, &h.size)
+				}
+			}
+		}
+		h.mutex.Unlock()
+	}
+}
+
+// setPTY switches input and resizes to a new PTY (nil while no process is running) and
+// returns the size it should have.
+func (h *attachHub) setPTY(ptmx *os.File) pty.Winsize {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.ptmx = ptmx
+	return h.size
+}
+
+// Write records PTY output for replay and mirrors it to the attached client. It never fails,
+// so the log file written alongside it is not affected by a misbehaving client.
+func (h *attachHub) Write(p []byte) (int, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.recent = append(h.recent, p...)
+	if excess := len(h.recent) - attachReplayBytes; excess > 0 {
+		h.recent = append(h.recent[:0], h.recent[excess:]...)
+	}
+	h.sendLocked(p)
+	return len(p), nil
+}
+
+// Notice shows a gitserve message to the attached client only.
+func (h *attachHub) Notice(format string, args ...interface{}) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.sendLocked([]byte("\r\n[gitserve] " + fmt.Sprintf(format, args...) + "\r\n"))
+}
+
+func (h *attachHub) sendLocked(p []byte) {
+	if h.client == nil {
+		return
+	}
+	h.client.SetWriteDeadline(time.Now().Add(attachWriteTimeout))
+	if _, err := h.client.Write(p); err != nil {
+		h.client.Close()
+		h.client = nil
+	}
+}
+
+// Close stops accepting clients, disconnects the current one and removes the socket.
+func (h *attachHub) Close() {
+	h.listener.Close()
+	h.mutex.Lock()
+	if h.client != nil {
+		h.client.Close()
+		h.client = nil
+	}
+	h.mutex.Unlock()
+	_ = os.Remove(h.socketPath)
+}
+
+// ParseDetachKeys parses a comma separated key sequence such as "ctrl-p,ctrl-q" into the
+// bytes a terminal sends for it. Items are either ctrl-<key> or a single character.
+func ParseDetachKeys(spec string) ([]byte, error) {
+	var keys []byte
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		switch {
+		case len(item) == 1:
+			keys = append(keys, item[0])
+		case strings.HasPrefix(strings.ToLower(item), "ctrl-") && len(item) == 6:
+			c := item[5]
+			if c >= 'A' && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			if !(c >= 'a' && c <= 'z') && !strings.ContainsRune("@[\\]^_", rune(c)) {
+				return nil, fmt.Errorf("unsupported key '%s' in detach keys", item)
+			}
+			keys = append(keys, c&0x1f)
+		default:
+			return nil, fmt.Errorf("invalid key '%s' in detach keys (expected e.g. ctrl-p or a single character)", item)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("detach keys must not be empty")
+	}
+	return keys, nil
+}
+
+// AttachOptions describes a `gitserve attach` session.
+type AttachOptions struct {
+	SocketPath string
+	DetachKeys []byte
+}
+
+// Attach connects the terminal to an instance's PTY through its supervisor until the user
+// types the detach keys or the instance's supervisor goes away. It reports whether the user
+// detached (as opposed to the instance ending the session).
+func Attach(opts AttachOptions) (bool, error) {
+	conn, err := net.Dial("unix", opts.SocketPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to the instance's supervisor: %w", err)
+	}
+	defer conn.Close()
+
+	var writeMutex sync.Mutex
+	send := func(frameType byte, payload []byte) error {
+		frame := make([]byte, 3, 3+len(payload))
+		frame[0] = frameType
+		binary.BigEndian.PutUint16(frame[1:], uint16(len(payload)))
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		_, err := conn.Write(append(frame, payload...))
+		return err
+	}
+
+	stdinFd := int(os.Stdin.Fd())
+	if term.IsTerminal(stdinFd) {
+		oldState, err := term.MakeRaw(stdinFd)
+		if err != nil {
+			return false, fmt.Errorf("failed to put the terminal into raw mode: %w", err)
+		}
+		defer term.Restore(stdinFd, oldState)
+	}
+
+	sendSize := func() {
+		cols, rows, err := term.GetSize(int(os.Stdout.Fd()))
+		if err != nil {
+			return
+		}
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint16(payload, uint16(rows))
+		binary.BigEndian.PutUint16(payload[2:], uint16(cols))
+		_ = send(attachFrameResize, payload)
+	}
+	sendSize()
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+	go func() {
+		for range winch {
+			sendSize()
+		}
+	}()
+
+	closed := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(os.Stdout, conn)
+		close(closed)
+	}()
+
+	detached := make(chan struct{})
+	go func() {
+		matcher := detachMatcher{keys: opts.DetachKeys}
+		buf := make([]byte, 1024)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				input, detach := matcher.feed(buf[:n])
+				if len(input) > 0 && send(attachFrameInput, input) != nil {
+					return
+				}
+				if detach {
+					close(detached)
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-detached:
+		return true, nil
+	case <-closed:
+		return false, nil
+	}
+}
+
+// detachMatcher filters the detach key sequence out of the input stream. Bytes that might be
+// the start of the sequence are held back until it is clear whether they are.
+type detachMatcher struct {
+	keys    []byte
+	matched int
+}
+
+// feed returns the input to forward and whether the full detach sequence was typed.
+func (m *detachMatcher) feed(in []byte) ([]byte, bool) {
+	var out []byte
+	for _, b := range in {
+		if b == m.keys[m.matched] {
+			m.matched++
+			if m.matched == len(m.keys) {
+				return out, true
+			}
+			continue
+		}
+		// Not the sequence after all: release what was held back.
+		out = append(out, m.keys[:m.matched]...)
+		m.matched = 0
+		if b == m.keys[0] {
+			m.matched = 1
+			continue
+		}
+		out = append(out, b)
+	}
+	return out, false
+}
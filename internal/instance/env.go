@@ -0,0 +1,39 @@
+package instance
+
+import (
+	"os"
+	"sort"
+)
+
+// Environment variables gitserve sets for every process it starts.
+const (
+	EnvInstanceID = "GITSERVE_INSTANCE_ID"
+	EnvRef        = "GITSERVE_REF"
+	EnvWorkspace  = "GITSERVE_WORKSPACE"
+	EnvPort       = "PORT"
+	EnvProcess    = "GITSERVE_PROCESS" // Only set for the processes of a multi-process instance
+)
+
+// Environment variables hooks get on top of the instance's.
+const (
+	EnvHook     = "GITSERVE_HOOK"      // Phase, e.g. post_start
+	EnvHookName = "GITSERVE_HOOK_NAME" // Name of the hook
+	EnvPID      = "GITSERVE_PID"       // Process group of the instance, once it has started
+	EnvStatus   = "GITSERVE_STATUS"    // post_stop only: status the instance ended with
+	EnvLogPath  = "GITSERVE_LOG"       // Log the instance (and the hook) writes to, if any
+)
+
+// BuildEnv returns the current process environment with the instance's variables applied on
+// top, in the KEY=VALUE form expected by exec.Cmd.Env.
+func BuildEnv(instanceEnv map[string]string) []string {
+	env := os.Environ()
+	keys := make([]string, 0, len(instanceEnv))
+	for k := range instanceEnv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) // Deterministic order, which makes the env easy to diff when debugging
+	for _, k := range keys {
+		env = append(env, k+"="+instanceEnv[k])
+	}
+	return env
+}
@@ -0,0 +1,76 @@
+package instance
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+
+	"gitserve/internal/models"
+)
+
+// Executor builds the commands an instance's processes run as. The plain executor runs them
+// directly; the sandbox executor runs them inside Linux namespaces. Either way the command is
+// started, limited, waited for and stopped by the same code.
+type Executor interface {
+	// Command returns an unstarted command running argv in dir with env. Its SysProcAttr is
+	// never nil, so callers can add Setpgid or Setsid to it.
+	Command(dir string, env []string, argv ...string) (*exec.Cmd, error)
+
+	// Started is called right after the command has started. The returned func releases what
+	// was set up for the running command and must be called once it has exited.
+	Started(cmd *exec.Cmd) (release func(), err error)
+}
+
+// NewExecutor returns the executor for an instance's processes. port is the instance port,
+// forwarded into a sandbox that has no network of its own; runtimeDir is a directory gitserve
+// owns, where the sandbox keeps the socket the port is forwarded through.
+func NewExecutor(sandbox models.SandboxOptions, runtimeDir string, port int) Executor {
+	if !sandbox.Enabled {
+		return plainExecutor{}
+	}
+	return &sandboxExecutor{options: sandbox, runtimeDir: runtimeDir, port: port}
+}
+
+// plainExecutor runs commands as ordinary child processes.
+type plainExecutor struct{}
+
+func (plainExecutor) Command(dir string, env []string, argv ...string) (*exec.Cmd, error) {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	return cmd, nil
+}
+
+func (plainExecutor) Started(cmd *exec.Cmd) (func(), error) {
+	return func() {}, nil
+}
+
+// finishStart completes starting a command built by executor: it applies limits and lets the
+// executor set up what the command needs. A command that can't be set up is killed rather than
+// left running without its limits or sandbox.
+func finishStart(executor Executor, cmd *exec.Cmd, limits models.ResourceLimits) (func(), error) {
+	if !limits.IsZero() {
+		if err := ApplyLimits(cmd.Process.Pid, limits); err != nil {
+			killStarted(cmd)
+			return nil, err
+		}
+	}
+	release, err := executor.Started(cmd)
+	if err != nil {
+		killStarted(cmd)
+		return nil, fmt.Errorf("failed to set up process: %w", err)
+	}
+	return release, nil
+}
+
+// killStarted kills a command that was started but can't be allowed to run, together with its
+// process group if it leads one, and reaps it.
+func killStarted(cmd *exec.Cmd) {
+	if cmd.SysProcAttr.Setpgid || cmd.SysProcAttr.Setsid {
+		_ = SignalProcessGroup(cmd.Process.Pid, syscall.SIGKILL)
+	} else {
+		_ = cmd.Process.Kill()
+	}
+	_ = cmd.Wait()
+}
@@ -0,0 +1,112 @@
+package instance
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"gitserve/internal/models"
+)
+
+// defaultGracePeriod is used when no grace period is configured for a foreground run.
+const defaultGracePeriod = 10 * time.Second
+
+// ExitError reports that an instance's process did not exit successfully.
+// Code is the exit code gitserve should exit with itself; for a process killed by a
+// signal it follows the shell convention of 128+signal.
+type ExitError struct {
+	Code   int
+	Signal string // Name of the terminating signal, if any
+	Limit  string // Resource limit the process ran into, e.g. "RLIMIT_CPU", if known
+}
+
+func (e *ExitError) Error() string {
+	message := fmt.Sprintf("process exited with code %d", e.Code)
+	if e.Signal != "" {
+		message = fmt.Sprintf("process was killed by %s", e.Signal)
+	}
+	if e.Limit != "" {
+		message += fmt.Sprintf(" (%s exceeded)", e.Limit)
+	}
+	return message
+}
+
+// ExitCode returns the exit code to propagate.
+func (e *ExitError) ExitCode() int {
+	return e.Code
+}
+
+// runForeground starts cmd (built by executor and set up with its own process group), applies
+// limits to it and waits for it. started, if not nil, is called with the process group once the
+// command is running; it must not block.
+// SIGINT/SIGTERM/SIGHUP received by gitserve are forwarded to the child's process group; if the
+// group has not exited after gracePeriod, or a second SIGINT arrives, it is killed with SIGKILL.
+// It returns the child's exit code (128+signal if it was killed) and the signal name.
+func runForeground(executor Executor, cmd *exec.Cmd, gracePeriod time.Duration, limits models.ResourceLimits, started func(pgid int)) (int, string, error) {
+	if gracePeriod <= 0 {
+		gracePeriod = defaultGracePeriod
+	}
+
+	// Subscribe before starting so no signal slips through in between.
+	signals := make(chan os.Signal, 4)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		return 0, "", fmt.Errorf("failed to start process: %w", err)
+	}
+	pgid := cmd.Process.Pid
+	release, err := finishStart(executor, cmd, limits)
+	if err != nil {
+		return 0, "", err
+	}
+	defer release()
+	if started != nil {
+		started(pgid)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		_ = cmd.Wait() // The exit details are read from cmd.ProcessState below
+		close(done)
+	}()
+
+	var graceTimer <-chan time.Time
+	forwarded := false
+	for waiting := true; waiting; {
+		select {
+		case <-done:
+			waiting = false
+		case sig := <-signals:
+			if !forwarded {
+				forwarded = true
+				fmt.Fprintf(os.Stderr, "\nForwarding %s to process group %d, waiting up to %s for it to exit (press Ctrl+C again to force kill)...\n",
+					SignalName(sig.(syscall.Signal)), pgid, gracePeriod)
+				_ = SignalProcessGroup(pgid, sig.(syscall.Signal))
+				graceTimer = time.After(gracePeriod)
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "Force killing process group %d...\n", pgid)
+			_ = SignalProcessGroup(pgid, syscall.SIGKILL)
+		case <-graceTimer:
+			fmt.Fprintf(os.Stderr, "Process group %d did not exit within %s, killing it...\n", pgid, gracePeriod)
+			_ = SignalProcessGroup(pgid, syscall.SIGKILL)
+			graceTimer = nil
+		}
+	}
+
+	// The main process is gone; don't leave its background children running in a
+	// workspace that is about to be cleaned up.
+	if IsProcessGroupAlive(pgid) {
+		_, _ = StopProcessGroup(pgid, StopOptions{Timeout: gracePeriod})
+	}
+
+	exitCode, exitSignal := exitDetails(cmd)
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		exitCode = 128 + int(status.Signal())
+	}
+	return exitCode, exitSignal, nil
+}
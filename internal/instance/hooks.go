@@ -0,0 +1,159 @@
+package instance
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"gitserve/internal/logger"
+	"gitserve/internal/models"
+)
+
+// hookKillGrace is how long a hook that ran out of time gets between SIGTERM and SIGKILL.
+const hookKillGrace = 5 * time.Second
+
+// hookOutputDelay is how long a finished hook's output is still read, in case it left
+// something running in the background that holds on to it.
+const hookOutputDelay = time.Second
+
+// HookTarget describes the instance hooks run for.
+type HookTarget struct {
+	Dir     string            // Working directory, the workspace
+	Env     map[string]string // Instance environment; the hook variables are added on top
+	LogPath string            // Instance log the output is appended to; "" prints it to stdout
+	PID     int               // Process group of the instance, 0 before it has started
+	Status  string            // Status the instance ended with, for post_stop hooks
+}
+
+// RunHooks runs the hooks of a phase one after the other, on the host (outside any sandbox).
+// Their output goes to the instance log, each line prefixed with [hook:<name>]. A hook that
+// fails or runs out of time is reported as a warning when its on_failure is warn; otherwise
+// RunHooks returns its error without running the rest.
+func RunHooks(phase string, hooks []models.Hook, target HookTarget, log logger.Service) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+	out := io.Writer(os.Stdout)
+	if target.LogPath != "" {
+		if err := os.MkdirAll(filepath.Dir(target.LogPath), 0750); err != nil {
+			return fmt.Errorf("failed to create log directory for %s hooks: %w", phase, err)
+		}
+		logFile, err := os.OpenFile(target.LogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return fmt.Errorf("failed to open log %s for %s hooks: %w", target.LogPath, phase, err)
+		}
+		defer logFile.Close()
+		out = logFile
+	}
+
+	for _, hook := range hooks {
+		log.Info("Running %s hook '%s'...", phase, hook.Name)
+		err := runHook(phase, hook, target, out)
+		if err == nil {
+			continue
+		}
+		if hook.OnFailure == models.HookWarn {
+			log.Warning("%s hook '%s' %v; continuing (on_failure: warn)", phase, hook.Name, err)
+			continue
+		}
+		if target.LogPath != "" {
+			return fmt.Errorf("%s hook '%s' %w (output in %s)", phase, hook.Name, err, target.LogPath)
+		}
+		return fmt.Errorf("%s hook '%s' %w", phase, hook.Name, err)
+	}
+	return nil
+}
+
+// runHook runs a single hook in its own process group, killing the group if the hook runs
+// past its timeout.
+func runHook(phase string, hook models.Hook, target HookTarget, out io.Writer) error {
+	env := make(map[string]string, len(target.Env)+5)
+	for k, v := range target.Env {
+		env[k] = v
+	}
+	env[EnvHook] = phase
+	env[EnvHookName] = hook.Name
+	if target.PID > 0 {
+		env[EnvPID] = strconv.Itoa(target.PID)
+	}
+	if target.Status != "" {
+		env[EnvStatus] = target.Status
+	}
+	if target.LogPath != "" {
+		env[EnvLogPath] = target.LogPath
+	}
+
+	output := &prefixWriter{out: out, prefix: []byte(fmt.Sprintf("[hook:%s] ", hook.Name))}
+	cmd := exec.Command("sh", "-c", hook.Command)
+	cmd.Dir = target.Dir
+	cmd.Env = BuildEnv(env)
+	cmd.Stdout = output // The same writer for both, so lines are never interleaved mid-way
+	cmd.Stderr = output
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.WaitDelay = hookOutputDelay
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start: %w", err)
+	}
+	defer output.Flush()
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("failed: %w", err)
+		}
+		return nil
+	case <-time.After(hook.Timeout):
+		_, _ = StopProcessGroup(cmd.Process.Pid, StopOptions{Timeout: hookKillGrace})
+		<-done
+		return fmt.Errorf("timed out after %s", hook.Timeout)
+	}
+}
+
+// prefixWriter writes every line it is given to out with prefix in front of it. An incomplete
+// last line is held back until it is completed or Flush is called.
+type prefixWriter struct {
+	out     io.Writer
+	prefix  []byte
+	pending []byte
+	mutex   sync.Mutex
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.pending = append(w.pending, p...)
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		if err := w.writeLine(w.pending[:i+1]); err != nil {
+			return len(p), err
+		}
+		w.pending = w.pending[i+1:]
+	}
+}
+
+// Flush writes out an incomplete last line.
+func (w *prefixWriter) Flush() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if len(w.pending) > 0 {
+		_ = w.writeLine(append(w.pending, '\n'))
+		w.pending = nil
+	}
+}
+
+func (w *prefixWriter) writeLine(line []byte) error {
+	_, err := w.out.Write(append(append([]byte{}, w.prefix...), line...))
+	return err
+}
@@ -0,0 +1,61 @@
+package instance
+
+import (
+	"os"
+	"strings"
+)
+
+// bootIDPath holds a random ID the kernel generates on every boot.
+const bootIDPath = "/proc/sys/kernel/random/boot_id"
+
+// ProcessIdentity tells a process apart from a later one that was given the same PID: after a
+// reboot, or once PIDs wrap around, a stored PID may belong to something unrelated.
+type ProcessIdentity struct {
+	StartTime uint64 // Start time from /proc/<pid>/stat, in clock ticks since boot
+	BootID    string // Boot the start time is relative to
+}
+
+// IsZero reports whether no identity was recorded, e.g. by an older gitserve.
+func (id ProcessIdentity) IsZero() bool {
+	return id.StartTime == 0
+}
+
+// IdentifyProcess returns the identity of the running process pid.
+func IdentifyProcess(pid int) (ProcessIdentity, error) {
+	stat, err := readProcStat(pid)
+	if err != nil {
+		return ProcessIdentity{}, err
+	}
+	return ProcessIdentity{StartTime: stat.StartTime, BootID: currentBootID()}, nil
+}
+
+// currentBootID returns the ID of the running boot, or "" if the kernel doesn't expose one.
+func currentBootID() string {
+	data, err := os.ReadFile(bootIDPath)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// IsSameProcess reports whether pid may still be the process identified by want. It is false
+// when the system has rebooted since or pid now belongs to a process that started at another
+// time. A PID that no longer exists counts as the same process, so callers still see it exit;
+// for a process group leader that has exited this is also right, as the kernel doesn't hand
+// out a PID that is still in use as a process group ID. Without a recorded identity there is
+// nothing to check against.
+func IsSameProcess(pid int, want ProcessIdentity) bool {
+	if want.IsZero() {
+		return true
+	}
+	if want.BootID != "" {
+		if boot := currentBootID(); boot != "" && boot != want.BootID {
+			return false
+		}
+	}
+	stat, err := readProcStat(pid)
+	if err != nil {
+		return true
+	}
+	return stat.StartTime == want.StartTime
+}
@@ -7,21 +7,30 @@ import (
 
 // Service defines the interface for instance operations
 type Service interface {
-	// Create creates a new instance
-	Create(workspace *workspace.Workspace, branchName string, command string) (*models.Instance, error)
+	// Create creates a new instance for ref, without recording it in the store
+	Create(workspace *workspace.Workspace, ref string, command string) (*models.Instance, error)
 
-	// RunProcess runs the process and blocks until it completes (for non-detached mode)
-	RunProcess(instance *models.Instance) error
+	// RunProcess runs the process and blocks until it completes (for non-detached mode).
+	// started, if not nil, is called with the process group once the command has started.
+	RunProcess(instance *models.Instance, started func(pgid int)) error
 
-	// StartDetachedProcess starts the process in background (for detached mode)
+	// RunPreCommands runs the pre_command steps in the instance's workspace (blocking)
+	RunPreCommands(instance *models.Instance, commands []string) error
+
+	// StartDetachedProcess starts the process in background (for detached mode) under a
+	// supervisor shim. The instance must already be recorded in the store.
 	StartDetachedProcess(instance *models.Instance) error
 
+	// LogPath returns the stdout log a detached instance writes to. Hooks of detached
+	// instances write to it as well, also before the process has started.
+	LogPath(instanceID string) string
+
 	// StopProcess stops the process for an instance
 	StopProcess(instance *models.Instance) error
 
-	// List returns all instances
+	// List returns all instances in the store
 	List() ([]*models.Instance, error)
 
-	// Get returns an instance by ID
+	// Get returns an instance from the store by ID
 	Get(id string) (*models.Instance, error)
 }
@@ -0,0 +1,128 @@
+package instance
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"gitserve/internal/models"
+
+	"golang.org/x/sys/unix"
+)
+
+// cpuKillMargin is how much CPU time a process gets after SIGXCPU (at the soft RLIMIT_CPU)
+// before the kernel kills it at the hard limit.
+const cpuKillMargin = 5 * time.Second
+
+// ioprio_set(2) constants, which x/sys/unix doesn't define.
+const (
+	ioprioWhoProcessGroup = 2
+	ioprioClassShift      = 13
+)
+
+var ioprioClasses = map[string]int{
+	models.IOClassRealtime:   1,
+	models.IOClassBestEffort: 2,
+	models.IOClassIdle:       3,
+}
+
+// rlimitSetting is one rlimit to set; a zero soft limit means it is not configured.
+type rlimitSetting struct {
+	name       string
+	resource   int
+	soft, hard uint64
+}
+
+// ApplyLimits sets the resource limits on a freshly started process, which leads its own
+// process group. Rlimits are inherited by whatever the process starts afterwards; niceness
+// and I/O priority are set for the whole process group.
+func ApplyLimits(pid int, limits models.ResourceLimits) error {
+	rlimits := []rlimitSetting{
+		{"RLIMIT_AS", unix.RLIMIT_AS, limits.AddressSpace, limits.AddressSpace},
+		{"RLIMIT_NOFILE", unix.RLIMIT_NOFILE, limits.OpenFiles, limits.OpenFiles},
+		{"RLIMIT_NPROC", unix.RLIMIT_NPROC, limits.MaxProcesses, limits.MaxProcesses},
+	}
+	if limits.CPUTime > 0 {
+		seconds := uint64((limits.CPUTime + time.Second - 1) / time.Second)
+		rlimits = append(rlimits, rlimitSetting{"RLIMIT_CPU", unix.RLIMIT_CPU, seconds, seconds + uint64(cpuKillMargin/time.Second)})
+	}
+	for _, rlimit := range rlimits {
+		if rlimit.soft == 0 {
+			continue
+		}
+		if err := unix.Prlimit(pid, rlimit.resource, &unix.Rlimit{Cur: rlimit.soft, Max: rlimit.hard}, nil); err != nil {
+			return fmt.Errorf("failed to set %s to %d: %w", rlimit.name, rlimit.soft, err)
+		}
+	}
+
+	if limits.Nice != 0 {
+		if err := unix.Setpriority(unix.PRIO_PGRP, pid, limits.Nice); err != nil {
+			return fmt.Errorf("failed to set nice level %d: %w", limits.Nice, err)
+		}
+	}
+	if limits.IOClass != "" {
+		class, ok := ioprioClasses[limits.IOClass]
+		if !ok {
+			return fmt.Errorf("unknown ionice class '%s'", limits.IOClass)
+		}
+		prio := class<<ioprioClassShift | limits.IOLevel
+		if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcessGroup, uintptr(pid), uintptr(prio)); errno != 0 {
+			return fmt.Errorf("failed to set ionice class %s: %w", limits.IOClass, errno)
+		}
+	}
+	return nil
+}
+
+// limitMessages are log messages that give away a failed allocation, file open or fork,
+// by the limit that most likely caused them.
+var limitMessages = []struct {
+	limit    string
+	messages []string
+}{
+	{"RLIMIT_AS", []string{"cannot allocate memory", "out of memory", "bad_alloc", "memoryerror", "failed to reserve", "mmap failed"}},
+	{"RLIMIT_NOFILE", []string{"too many open files"}},
+	{"RLIMIT_NPROC", []string{"cannot fork", "can't fork", "fork: retry", "fork: resource temporarily unavailable", "failed to create new os thread"}},
+}
+
+// LimitViolation names the limit (e.g. "RLIMIT_AS") a process most likely ran into, or returns
+// "" if there is no sign of one. CPU time is recognized by the signals the kernel sends; the
+// other limits make system calls fail, which only shows in the process's output, so logTail
+// (the last lines it wrote) is searched for the usual error messages. Only limits that are set
+// are considered, and only for processes that did not exit cleanly.
+func LimitViolation(limits models.ResourceLimits, state *os.ProcessState, logTail []string) string {
+	if state == nil || limits.IsZero() || state.Success() {
+		return ""
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() && limits.CPUTime > 0 {
+		switch status.Signal() {
+		case syscall.SIGXCPU:
+			return "RLIMIT_CPU"
+		case syscall.SIGKILL:
+			if state.UserTime()+state.SystemTime() >= limits.CPUTime {
+				return "RLIMIT_CPU"
+			}
+		}
+	}
+
+	set := map[string]bool{
+		"RLIMIT_AS":     limits.AddressSpace > 0,
+		"RLIMIT_NOFILE": limits.OpenFiles > 0,
+		"RLIMIT_NPROC":  limits.MaxProcesses > 0,
+	}
+	for i := len(logTail) - 1; i >= 0; i-- { // The most recent message is the most telling
+		line := strings.ToLower(logTail[i])
+		for _, candidate := range limitMessages {
+			if !set[candidate.limit] {
+				continue
+			}
+			for _, message := range candidate.messages {
+				if strings.Contains(line, message) {
+					return candidate.limit
+				}
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,90 @@
+package instance
+
+import (
+	"io"
+	"os"
+	"strings"
+)
+
+// tailReadSize bounds how much of a log file TailFile reads from the end.
+const tailReadSize = 64 * 1024
+
+// TailFile returns up to n trailing lines of the file at path.
+// A missing file yields no lines and no error.
+func TailFile(path string, n int) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := info.Size() - tailReadSize
+	if offset < 0 {
+		offset = 0
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if offset > 0 && len(lines) > 0 {
+		lines = lines[1:] // The first line is most likely cut in half
+	}
+	if len(lines) == 1 && lines[0] == "" {
+		return nil, nil
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
+
+// ReadLinesFrom returns the complete lines written to the file at path after offset, and the
+// offset to continue from. A trailing partial line is left for the next call. If the file
+// shrank (it was truncated or replaced), reading starts over from the beginning.
+// A missing file yields no lines and the same offset.
+func ReadLinesFrom(path string, offset int64) ([]string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, offset, nil
+		}
+		return nil, offset, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, offset, err
+	}
+	if info.Size() < offset {
+		offset = 0
+	}
+	if info.Size() == offset {
+		return nil, offset, nil
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, offset, err
+	}
+
+	end := strings.LastIndexByte(string(data), '\n')
+	if end < 0 {
+		return nil, offset, nil
+	}
+	return strings.Split(string(data[:end]), "\n"), offset + int64(end) + 1, nil
+}
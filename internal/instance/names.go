@@ -0,0 +1,49 @@
+package instance
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+	"strings"
+)
+
+// nameAdjectives and nameAnimals make up generated instance names, e.g. "main-brave-otter".
+var (
+	nameAdjectives = []string{
+		"amber", "bold", "brave", "bright", "calm", "clever", "cosmic", "crisp", "curious", "daring",
+		"eager", "fancy", "fast", "fierce", "gentle", "glad", "golden", "happy", "humble", "jolly",
+		"keen", "kind", "lively", "lucky", "merry", "mighty", "misty", "noble", "patient", "plucky",
+		"proud", "quick", "quiet", "rapid", "shiny", "silent", "sleepy", "snowy", "steady", "sunny",
+		"swift", "tidy", "vivid", "warm", "wild", "wise", "witty", "zesty",
+	}
+	nameAnimals = []string{
+		"badger", "beaver", "bison", "cobra", "crane", "dingo", "dolphin", "eagle", "falcon", "ferret",
+		"finch", "fox", "gecko", "heron", "hippo", "ibis", "jackal", "koala", "lemur", "lion",
+		"llama", "lynx", "marmot", "moose", "newt", "ocelot", "orca", "otter", "owl", "panda",
+		"parrot", "pelican", "puffin", "quokka", "rabbit", "raven", "seal", "shrew", "sloth", "stork",
+		"tapir", "tiger", "toucan", "walrus", "weasel", "whale", "wombat", "yak",
+	}
+)
+
+// nameUnsafe matches what a ref may contain that doesn't belong in an instance name, such as
+// the slashes of "feature/login".
+var nameUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// GenerateName returns a readable name for an instance of ref, e.g. "main-brave-otter", that
+// taken reports as free.
+func GenerateName(ref string, taken func(name string) bool) string {
+	prefix := strings.Trim(nameUnsafe.ReplaceAllString(ref, "-"), "-.")
+	if prefix == "" {
+		prefix = "instance"
+	}
+	for attempt := 0; ; attempt++ {
+		name := fmt.Sprintf("%s-%s-%s", prefix,
+			nameAdjectives[rand.IntN(len(nameAdjectives))], nameAnimals[rand.IntN(len(nameAnimals))])
+		if attempt >= 100 { // Most combinations for this ref are in use
+			name = fmt.Sprintf("%s-%d", name, attempt)
+		}
+		if !taken(name) {
+			return name
+		}
+	}
+}
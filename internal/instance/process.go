@@ -0,0 +1,212 @@
+package instance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// pollInterval is how often we re-check a process group while waiting for it to exit.
+const pollInterval = 100 * time.Millisecond
+
+// killWaitTimeout is how long we wait for a process group to disappear after SIGKILL.
+const killWaitTimeout = 5 * time.Second
+
+// IsProcessGroupAlive reports whether any process in the group led by pgid still exists.
+func IsProcessGroupAlive(pgid int) bool {
+	if pgid <= 0 {
+		return false
+	}
+	err := syscall.Kill(-pgid, syscall.Signal(0))
+	// EPERM means the group exists but belongs to someone else; treat it as alive.
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// SignalProcessGroup sends sig to every process in the group led by pgid.
+func SignalProcessGroup(pgid int, sig syscall.Signal) error {
+	if pgid <= 0 {
+		return fmt.Errorf("invalid process group id %d", pgid)
+	}
+	return syscall.Kill(-pgid, sig)
+}
+
+// WaitForProcessGroupExit polls until the process group is gone or the timeout elapses.
+// It returns true if the group exited within the timeout.
+func WaitForProcessGroupExit(pgid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if !IsProcessGroupAlive(pgid) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// WaitForProcessExit polls until the process pid no longer exists or timeout expires.
+// It reports whether the process exited.
+func WaitForProcessExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// StopOptions controls how StopProcessGroup shuts a process group down.
+type StopOptions struct {
+	Signal  syscall.Signal    // Signal for the graceful phase; SIGTERM if zero
+	Command string            // Optional stop command run (via sh -c) instead of sending Signal
+	Dir     string            // Working directory for Command
+	Env     map[string]string // Instance environment for Command, on top of gitserve's own
+	Timeout time.Duration     // Grace period before escalating to SIGKILL
+	Force   bool              // Skip the graceful phase and send SIGKILL right away
+
+	// CommandFailed, if set, is called with the reason when Command fails, before Signal is
+	// sent instead.
+	CommandFailed func(err error)
+}
+
+// StopResult describes how a process group ended up being stopped.
+type StopResult struct {
+	AlreadyExited bool // The group was gone before we signaled it
+	Killed        bool // SIGKILL had to be used
+}
+
+// StopProcessGroup stops the process group led by pgid and waits for it to exit.
+// The graceful phase either runs opts.Command or sends opts.Signal; if the group is
+// still alive after opts.Timeout it is sent SIGKILL.
+func StopProcessGroup(pgid int, opts StopOptions) (StopResult, error) {
+	if !IsProcessGroupAlive(pgid) {
+		return StopResult{AlreadyExited: true}, nil
+	}
+
+	if !opts.Force {
+		deadline := time.Now().Add(opts.Timeout)
+		if err := gracefulStop(pgid, opts); err != nil {
+			return StopResult{}, err
+		}
+		if WaitForProcessGroupExit(pgid, time.Until(deadline)) {
+			return StopResult{}, nil
+		}
+	}
+
+	if err := SignalProcessTree(pgid, syscall.SIGKILL); err != nil {
+		if errors.Is(err, syscall.ESRCH) {
+			return StopResult{}, nil
+		}
+		return StopResult{}, fmt.Errorf("failed to send SIGKILL to process group %d: %w", pgid, err)
+	}
+	if !WaitForProcessGroupExit(pgid, killWaitTimeout) {
+		return StopResult{Killed: true}, fmt.Errorf("process group %d is still alive after SIGKILL", pgid)
+	}
+	return StopResult{Killed: true}, nil
+}
+
+// gracefulStop runs the configured stop command, falling back to the stop signal
+// if there is no command or the command fails.
+func gracefulStop(pgid int, opts StopOptions) error {
+	// A paused instance can't react to a stop command or a catchable signal until it is continued.
+	_ = SignalProcessTree(pgid, syscall.SIGCONT)
+
+	sig := opts.Signal
+	if sig == 0 {
+		sig = syscall.SIGTERM
+	}
+	if opts.Command != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+		defer cancel()
+		stopCmd := exec.CommandContext(ctx, "sh", "-c", opts.Command)
+		stopCmd.Dir = opts.Dir
+		stopCmd.Env = BuildEnv(opts.Env)
+		stopCmd.Stdout = os.Stdout
+		stopCmd.Stderr = os.Stderr
+		err := stopCmd.Run()
+		if err == nil {
+			return nil
+		}
+		// The stop command failed; say so and fall through to signal the group directly.
+		err = fmt.Errorf("stop command '%s' failed: %w", opts.Command, err)
+		fmt.Fprintf(os.Stderr, "Warning: %v; sending %s to process group %d instead\n", err, SignalName(sig), pgid)
+		if opts.CommandFailed != nil {
+			opts.CommandFailed(err)
+		}
+	}
+
+	if err := SignalProcessGroup(pgid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return fmt.Errorf("failed to send %s to process group %d: %w", SignalName(sig), pgid, err)
+	}
+	return nil
+}
+
+// ParseSignal converts a signal name ("SIGINT", "INT", "int") or number ("2") into a syscall.Signal.
+// An empty name yields SIGTERM.
+func ParseSignal(name string) (syscall.Signal, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if name == "" {
+		return syscall.SIGTERM, nil
+	}
+	if num, err := strconv.Atoi(name); err == nil {
+		if num <= 0 || num > 64 {
+			return 0, fmt.Errorf("invalid signal number %d", num)
+		}
+		return syscall.Signal(num), nil
+	}
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := signalsByName[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal '%s'", name)
+	}
+	return sig, nil
+}
+
+// SignalName returns the conventional name of sig (e.g. "SIGTERM").
+func SignalName(sig syscall.Signal) string {
+	for name, s := range signalsByName {
+		if s == sig {
+			return name
+		}
+	}
+	return fmt.Sprintf("signal %d", int(sig))
+}
+
+// signalsByName maps the conventional signal names to their values.
+var signalsByName = map[string]syscall.Signal{
+	"SIGHUP":   syscall.SIGHUP,
+	"SIGINT":   syscall.SIGINT,
+	"SIGQUIT":  syscall.SIGQUIT,
+	"SIGILL":   syscall.SIGILL,
+	"SIGTRAP":  syscall.SIGTRAP,
+	"SIGABRT":  syscall.SIGABRT,
+	"SIGBUS":   syscall.SIGBUS,
+	"SIGFPE":   syscall.SIGFPE,
+	"SIGKILL":  syscall.SIGKILL,
+	"SIGUSR1":  syscall.SIGUSR1,
+	"SIGSEGV":  syscall.SIGSEGV,
+	"SIGUSR2":  syscall.SIGUSR2,
+	"SIGPIPE":  syscall.SIGPIPE,
+	"SIGALRM":  syscall.SIGALRM,
+	"SIGTERM":  syscall.SIGTERM,
+	"SIGCHLD":  syscall.SIGCHLD,
+	"SIGCONT":  syscall.SIGCONT,
+	"SIGSTOP":  syscall.SIGSTOP,
+	"SIGTSTP":  syscall.SIGTSTP,
+	"SIGXCPU":  syscall.SIGXCPU,
+	"SIGXFSZ":  syscall.SIGXFSZ,
+	"SIGWINCH": syscall.SIGWINCH,
+}
@@ -0,0 +1,124 @@
+package instance
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    syscall.Signal
+		wantErr bool
+	}{
+		{"", syscall.SIGTERM, false},
+		{"  ", syscall.SIGTERM, false},
+		{"SIGINT", syscall.SIGINT, false},
+		{"INT", syscall.SIGINT, false},
+		{"int", syscall.SIGINT, false},
+		{" sigquit ", syscall.SIGQUIT, false},
+		{"KILL", syscall.SIGKILL, false},
+		{"2", syscall.SIGINT, false},
+		{"15", syscall.SIGTERM, false},
+		{"64", syscall.Signal(64), false},
+		{"0", 0, true},
+		{"-1", 0, true},
+		{"65", 0, true},
+		{"SIGNOPE", 0, true},
+		{"SIG", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSignal(tt.name)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseSignal(%q) = %v, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSignal(%q) returned error: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseSignal(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSignalName(t *testing.T) {
+	tests := []struct {
+		sig  syscall.Signal
+		want string
+	}{
+		{syscall.SIGTERM, "SIGTERM"},
+		{syscall.SIGKILL, "SIGKILL"},
+		{syscall.Signal(40), "signal 40"},
+	}
+	for _, tt := range tests {
+		if got := SignalName(tt.sig); got != tt.want {
+			t.Errorf("SignalName(%d) = %q, want %q", int(tt.sig), got, tt.want)
+		}
+		if sig, err := ParseSignal(SignalName(tt.sig)); err == nil && sig != tt.sig {
+			t.Errorf("ParseSignal(SignalName(%d)) = %v", int(tt.sig), sig)
+		}
+	}
+}
+
+func TestStopProcessGroupStopCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string // %d is replaced by the PID of the group leader
+		dir     string
+		wantErr string // Empty if the stop command should succeed
+	}{
+		{name: "command stops the group", command: "kill %d"},
+		{name: "command fails", command: "exit 3", wantErr: "exit status 3"},
+		{name: "command can't start", command: "true", dir: filepath.Join(t.TempDir(), "missing"), wantErr: "no such file or directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sleep := exec.Command("sleep", "30")
+			sleep.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+			if err := sleep.Start(); err != nil {
+				t.Fatal(err)
+			}
+			pgid := sleep.Process.Pid
+			go sleep.Wait() // Reap it, so the group goes away once it exits
+			t.Cleanup(func() { _ = syscall.Kill(-pgid, syscall.SIGKILL) })
+
+			command := tt.command
+			if strings.Contains(command, "%d") {
+				command = fmt.Sprintf(command, pgid)
+			}
+			var commandErr error
+			opts := StopOptions{
+				Command:       command,
+				Dir:           tt.dir,
+				Timeout:       5 * time.Second,
+				CommandFailed: func(err error) { commandErr = err },
+			}
+			result, err := StopProcessGroup(pgid, opts)
+			if err != nil {
+				t.Fatalf("StopProcessGroup() returned error: %v", err)
+			}
+			if result.Killed {
+				t.Error("StopProcessGroup() had to send SIGKILL, want the group stopped gracefully")
+			}
+			if tt.wantErr == "" {
+				if commandErr != nil {
+					t.Errorf("stop command reported failed: %v", commandErr)
+				}
+				return
+			}
+			// The stop signal was sent instead, after reporting why.
+			if commandErr == nil || !strings.Contains(commandErr.Error(), tt.wantErr) {
+				t.Errorf("stop command failure = %v, want one containing %q", commandErr, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package instance
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// procStat holds the fields of /proc/<pid>/stat gitserve cares about.
+type procStat struct {
+	PID      int
+	PPID     int
+	PGID     int
+	CPUTicks uint64 // utime + stime, in clock ticks
+	RSSPages uint64 // Resident set size, in pages
+	// Time the process started, in clock ticks since boot. Together with the PID it tells
+	// processes apart, as a PID is only reused after the process holding it is gone.
+	StartTime uint64
+}
+
+// readProcStat parses /proc/<pid>/stat. The command name is wrapped in parentheses and may
+// itself contain spaces or parentheses, so fields are counted from the last ')'.
+func readProcStat(pid int) (procStat, error) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return procStat{}, err
+	}
+	content := string(data)
+	end := strings.LastIndexByte(content, ')')
+	if end < 0 {
+		return procStat{}, os.ErrInvalid
+	}
+	// After the command name: state ppid pgrp session tty_nr tpgid flags minflt cminflt majflt
+	// cmajflt utime stime cutime cstime priority nice num_threads itrealvalue starttime vsize rss ...
+	fields := strings.Fields(content[end+1:])
+	if len(fields) < 22 {
+		return procStat{}, os.ErrInvalid
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return procStat{}, err
+	}
+	pgid, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return procStat{}, err
+	}
+	stat := procStat{PID: pid, PPID: ppid, PGID: pgid}
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	stat.CPUTicks = utime + stime
+	stat.StartTime, _ = strconv.ParseUint(fields[19], 10, 64)
+	stat.RSSPages, _ = strconv.ParseUint(fields[21], 10, 64)
+	return stat, nil
+}
+
+// listProcesses returns the stat of every process visible in /proc.
+func listProcesses() ([]procStat, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]procStat, 0, len(entries))
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := readProcStat(pid)
+		if err != nil {
+			continue // The process exited while we were looking
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+// ProcessWorkingDirs returns the working directory of every process whose /proc entry can be
+// read, by PID. Processes of other users are usually left out.
+func ProcessWorkingDirs() map[int]string {
+	dirs := make(map[int]string)
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return dirs
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if dir, err := os.Readlink(filepath.Join("/proc", entry.Name(), "cwd")); err == nil {
+			dirs[pid] = dir
+		}
+	}
+	return dirs
+}
+
+// ProcessTree returns rootPID followed by all of its descendants, plus any other members of
+// the process group led by rootPID. On systems without /proc it returns just rootPID.
+func ProcessTree(rootPID int) []int {
+	stats, err := listProcesses()
+	if err != nil {
+		return []int{rootPID}
+	}
+	return processTree(stats, rootPID)
+}
+
+// processTree is ProcessTree on an already taken list of processes.
+func processTree(stats []procStat, rootPID int) []int {
+	children := make(map[int][]int)
+	for _, stat := range stats {
+		children[stat.PPID] = append(children[stat.PPID], stat.PID)
+	}
+
+	seen := map[int]bool{rootPID: true}
+	tree := []int{rootPID}
+	for i := 0; i < len(tree); i++ {
+		for _, child := range children[tree[i]] {
+			if !seen[child] {
+				seen[child] = true
+				tree = append(tree, child)
+			}
+		}
+	}
+	// Group members whose parent already exited were re-parented away from the tree.
+	for _, stat := range stats {
+		if stat.PGID == rootPID && !seen[stat.PID] {
+			seen[stat.PID] = true
+			tree = append(tree, stat.PID)
+		}
+	}
+	return tree
+}
+
+// SignalProcessTree sends sig to the process group led by pgid and to every descendant that
+// has moved into a process group of its own (e.g. tools that call setsid/setpgid).
+func SignalProcessTree(pgid int, sig syscall.Signal) error {
+	if err := SignalProcessGroup(pgid, sig); err != nil {
+		return err
+	}
+	for _, pid := range ProcessTree(pgid) {
+		if stat, err := readProcStat(pid); err == nil && stat.PGID != pgid {
+			_ = syscall.Kill(pid, sig) // Best effort; it may have exited in the meantime
+		}
+	}
+	return nil
+}
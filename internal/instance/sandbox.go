@@ -0,0 +1,349 @@
+package instance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"gitserve/internal/models"
+
+	"golang.org/x/sys/unix"
+)
+
+// SandboxCommandName is the hidden CLI subcommand that sets up a sandbox and runs a command in it.
+const SandboxCommandName = "__sandbox"
+
+// sandboxSetupExitCode is what the sandbox exits with when it could not be set up, so the
+// failure isn't mistaken for the command's own (like container runtimes do).
+const sandboxSetupExitCode = 125
+
+// forwardDialTimeout bounds how long a forwarded connection waits for the sandbox's socket.
+const forwardDialTimeout = 5 * time.Second
+
+// SandboxSpec tells `gitserve __sandbox` what to set up. It runs as root of a new user
+// namespace, with a mount and possibly a network namespace of its own.
+type SandboxSpec struct {
+	Dir        string   `json:"dir"`                  // Workspace; stays writable
+	Home       string   `json:"home,omitempty"`       // Made read-only, except for Dir and RuntimeDir
+	RuntimeDir string   `json:"runtimeDir,omitempty"` // Writable; holds the port forwarding socket
+	Network    string   `json:"network"`
+	Port       int      `json:"port,omitempty"` // Forwarded in from the host when Network is loopback
+	UID        int      `json:"uid"`            // Identity the command runs as, as seen from the host
+	GID        int      `json:"gid"`
+	Argv       []string `json:"argv"`
+}
+
+// forwardSocketPath is the Unix socket connections to the instance port are forwarded through.
+// Path based sockets work across network namespaces.
+func forwardSocketPath(runtimeDir string) string {
+	return filepath.Join(runtimeDir, "port.sock")
+}
+
+// sandboxExecutor runs commands through `gitserve __sandbox` in new user and mount namespaces,
+// plus a network namespace unless the host network was asked for.
+type sandboxExecutor struct {
+	options    models.SandboxOptions
+	runtimeDir string
+	port       int
+}
+
+func (e *sandboxExecutor) forwardsPort() bool {
+	return e.options.Network != models.SandboxNetworkHost && e.port > 0 && e.runtimeDir != ""
+}
+
+func (e *sandboxExecutor) Command(dir string, env []string, argv ...string) (*exec.Cmd, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate gitserve executable for the sandbox: %w", err)
+	}
+	home, _ := os.UserHomeDir() // Without a home directory there is nothing to protect
+	spec := SandboxSpec{
+		Dir:     dir,
+		Home:    home,
+		Network: e.options.Network,
+		UID:     os.Getuid(),
+		GID:     os.Getgid(),
+		Argv:    argv,
+	}
+	if spec.Network == "" {
+		spec.Network = models.SandboxNetworkLoopback
+	}
+	if e.forwardsPort() {
+		if err := os.MkdirAll(e.runtimeDir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create sandbox directory %s: %w", e.runtimeDir, err)
+		}
+		_ = os.Remove(forwardSocketPath(e.runtimeDir)) // Left over from an earlier run
+		spec.RuntimeDir = e.runtimeDir
+		spec.Port = e.port
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode sandbox spec: %w", err)
+	}
+
+	cloneFlags := uintptr(syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS)
+	if spec.Network != models.SandboxNetworkHost {
+		cloneFlags |= syscall.CLONE_NEWNET
+	}
+	cmd := exec.Command(executable, SandboxCommandName, string(data))
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: cloneFlags,
+		// Root inside the namespace, so the sandbox can set up its mounts; the command itself
+		// runs as our own user again.
+		UidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: spec.UID, Size: 1}},
+		GidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: spec.GID, Size: 1}},
+		GidMappingsEnableSetgroups: false,
+	}
+	return cmd, nil
+}
+
+// Started forwards the instance port on the host's loopback interface into the sandbox.
+func (e *sandboxExecutor) Started(cmd *exec.Cmd) (func(), error) {
+	if !e.forwardsPort() {
+		return func() {}, nil
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(e.port)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to forward port %d into the sandbox: %w", e.port, err)
+	}
+	socketPath := forwardSocketPath(e.runtimeDir)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return // Listener closed
+			}
+			go func() {
+				upstream, err := dialWithRetry("unix", socketPath, forwardDialTimeout)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				relay(conn, upstream)
+			}()
+		}
+	}()
+	return func() {
+		listener.Close()
+		_ = os.RemoveAll(e.runtimeDir)
+	}, nil
+}
+
+// dialWithRetry dials address until it succeeds or timeout elapses; the sandbox may not have
+// created its socket yet when the first connection comes in.
+func dialWithRetry(network, address string, timeout time.Duration) (net.Conn, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.Dial(network, address)
+		if err == nil || time.Now().After(deadline) {
+			return conn, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// relay copies data both ways between two connections until either side is done.
+func relay(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	copyHalf := func(dst, src net.Conn) {
+		_, _ = io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// ReadSandboxSpec decodes the spec `gitserve __sandbox` is started with.
+func ReadSandboxSpec(data string) (SandboxSpec, error) {
+	var spec SandboxSpec
+	if err := json.Unmarshal([]byte(data), &spec); err != nil {
+		return SandboxSpec{}, fmt.Errorf("failed to decode sandbox spec: %w", err)
+	}
+	if spec.Dir == "" || len(spec.Argv) == 0 {
+		return SandboxSpec{}, errors.New("sandbox spec is missing the directory or command")
+	}
+	return spec, nil
+}
+
+// RunSandbox is the body of `gitserve __sandbox`. It sets up the sandbox's mounts and network,
+// runs the command as the original user in a nested user namespace (which can't undo the
+// mounts) and exits the way the command did. It returns the exit code to exit with.
+func RunSandbox(spec SandboxSpec) int {
+	if err := setupSandboxMounts(spec); err != nil {
+		fmt.Fprintf(os.Stderr, "gitserve sandbox: %v\n", err)
+		return sandboxSetupExitCode
+	}
+	if spec.Network != models.SandboxNetworkHost {
+		if err := bringUpLoopback(); err != nil {
+			fmt.Fprintf(os.Stderr, "gitserve sandbox: %v\n", err)
+			return sandboxSetupExitCode
+		}
+	}
+	if spec.RuntimeDir != "" && spec.Port > 0 {
+		listener, err := net.Listen("unix", forwardSocketPath(spec.RuntimeDir))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gitserve sandbox: failed to listen for port forwarding: %v\n", err)
+			return sandboxSetupExitCode
+		}
+		defer listener.Close()
+		go forwardToPort(listener, spec.Port)
+	}
+
+	// The signals sent to the process group reach the command as well; the sandbox only has
+	// to outlive it. A SIGTERM sent to the sandbox alone is passed on.
+	signals := make(chan os.Signal, 4)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+
+	cmd := exec.Command(spec.Argv[0], spec.Argv[1:]...)
+	cmd.Dir = spec.Dir // Looked up again, so it resolves to the sandbox's mounts
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:                 syscall.CLONE_NEWUSER,
+		UidMappings:                []syscall.SysProcIDMap{{ContainerID: spec.UID, HostID: 0, Size: 1}},
+		GidMappings:                []syscall.SysProcIDMap{{ContainerID: spec.GID, HostID: 0, Size: 1}},
+		GidMappingsEnableSetgroups: false,
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "gitserve sandbox: failed to start %s: %v\n", spec.Argv[0], err)
+		return sandboxSetupExitCode
+	}
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGTERM {
+				_ = cmd.Process.Signal(sig)
+			}
+		}
+	}()
+	_ = cmd.Wait()
+
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		// Die the same way, so whoever waits for the sandbox sees the signal.
+		signal.Reset(status.Signal())
+		_ = syscall.Kill(os.Getpid(), status.Signal())
+		return 128 + int(status.Signal())
+	}
+	return cmd.ProcessState.ExitCode()
+}
+
+// setupSandboxMounts gives the sandbox a private /tmp and a read-only home directory, in which
+// only the workspace and the runtime directory stay writable.
+func setupSandboxMounts(spec SandboxSpec) error {
+	// Nothing we mount may propagate back to the host.
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+
+	// The home directory and workspace may live below /tmp, so hold on to them before a fresh
+	// /tmp hides them, and mount them back afterwards.
+	var writable []string
+	for _, dir := range []string{spec.Dir, spec.RuntimeDir} {
+		if dir != "" {
+			writable = append(writable, dir)
+		}
+	}
+	protectHome := spec.Home != "" && spec.Home != "/"
+	held := writable
+	if protectHome {
+		held = append([]string{spec.Home}, writable...)
+	}
+	fds := make(map[string]int, len(held))
+	for _, dir := range held {
+		fd, err := unix.Open(dir, unix.O_PATH|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", dir, err)
+		}
+		defer unix.Close(fd)
+		fds[dir] = fd
+	}
+
+	if err := unix.Mount("tmpfs", "/tmp", "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("failed to mount a private /tmp: %w", err)
+	}
+	for _, dir := range held {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to recreate %s: %w", dir, err)
+		}
+		source := fmt.Sprintf("/proc/self/fd/%d", fds[dir])
+		if err := unix.Mount(source, dir, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to mount %s: %w", dir, err)
+		}
+	}
+
+	if protectHome {
+		// A remount has to keep the flags the mount was locked with when the namespace was created.
+		var stat unix.Statfs_t
+		if err := unix.Statfs(spec.Home, &stat); err != nil {
+			return fmt.Errorf("failed to inspect %s: %w", spec.Home, err)
+		}
+		locked := uintptr(stat.Flags) & (unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC | unix.MS_NOATIME | unix.MS_NODIRATIME | unix.MS_RELATIME)
+		if err := unix.Mount("", spec.Home, "", unix.MS_REMOUNT|unix.MS_BIND|unix.MS_RDONLY|locked, ""); err != nil {
+			return fmt.Errorf("failed to make %s read-only: %w", spec.Home, err)
+		}
+	}
+
+	// Our working directory still points at the directory from before the mounts.
+	if err := os.Chdir(spec.Dir); err != nil {
+		return fmt.Errorf("failed to enter %s: %w", spec.Dir, err)
+	}
+	return nil
+}
+
+// bringUpLoopback enables the loopback interface of a new network namespace, which starts out down.
+func bringUpLoopback() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to configure loopback interface: %w", err)
+	}
+	defer unix.Close(fd)
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return fmt.Errorf("failed to configure loopback interface: %w", err)
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("failed to read loopback interface flags: %w", err)
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	if err := unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("failed to bring up loopback interface: %w", err)
+	}
+	return nil
+}
+
+// forwardToPort relays connections arriving on the forwarding socket to the instance port on
+// the sandbox's loopback interface.
+func forwardToPort(listener net.Listener, port int) {
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go func() {
+			upstream, err := net.Dial("tcp", address)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			relay(conn, upstream)
+		}()
+	}
+}
@@ -1,14 +1,17 @@
 package instance
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"sync"
+	"strings"
 	"syscall"
 
 	"gitserve/internal/models"
+	"gitserve/internal/storage"
 	"gitserve/internal/workspace"
 
 	"github.com/google/uuid"
@@ -16,253 +19,304 @@ import (
 
 // ServiceImpl implements the Instance service interface
 type ServiceImpl struct {
-	instances      map[string]*models.Instance
-	workspacePaths map[string]string // Map workspace IDs to workspace paths
-	mutex          sync.RWMutex
+	logDir        string                // Directory detached process logs are written to
+	storeLocation storage.Location      // Where store is kept, handed to supervisor shims
+	store         storage.InstanceStore // Where instances are recorded
 }
 
-// NewService creates a new Instance service
-func NewService() Service {
+// NewService creates a new Instance service.
+// Logs of detached processes are written to logDir, outside of the workspace,
+// so they can outlive it. store is the instance store List and Get read from, and
+// storeLocation where it is kept, so supervisor shims can record process state in it.
+func NewService(logDir string, storeLocation storage.Location, store storage.InstanceStore) Service {
 	return &ServiceImpl{
-		instances:      make(map[string]*models.Instance),
-		workspacePaths: make(map[string]string),
+		logDir:        logDir,
+		storeLocation: storeLocation,
+		store:         store,
 	}
 }
 
-// Create creates a new instance
-func (s *ServiceImpl) Create(workspace *workspace.Workspace, branchName string, command string) (*models.Instance, error) {
-	id := uuid.New().String()
-
-	instance := &models.Instance{
-		ID:          id,
-		BranchName:  branchName,
-		WorkspaceID: workspace.ID,
-		Path:        workspace.Path,
-		Status:      "created",
-		Command:     command,
-	}
-
-	s.mutex.Lock()
-	s.instances[id] = instance
-	s.workspacePaths[workspace.ID] = workspace.Path // Store the workspace path
-	s.mutex.Unlock()
-
-	return instance, nil
+// Create creates a new instance for the ref checked out in workspace. It is not recorded in
+// the store until the caller adds it.
+func (s *ServiceImpl) Create(workspace *workspace.Workspace, ref string, command string) (*models.Instance, error) {
+	return &models.Instance{
+		ID:      uuid.New().String(),
+		Name:    ref,
+		Ref:     ref,
+		Path:    workspace.Path,
+		Status:  "created",
+		Command: command,
+	}, nil
 }
 
-// RunProcess runs the process for an instance - blocks until the process completes
-func (s *ServiceImpl) RunProcess(instance *models.Instance) error {
-	s.mutex.Lock()
-	// Find instance to ensure it exists
-	storedInstance, exists := s.instances[instance.ID]
-	if !exists {
-		s.mutex.Unlock()
-		return fmt.Errorf("instance %s not found", instance.ID)
+// RunProcess runs the process for an instance - blocks until the process completes.
+// started, if not nil, is called with the process group once the command has started; it
+// must not block. A non-zero exit is reported as an *ExitError carrying the exit code to
+// propagate.
+func (s *ServiceImpl) RunProcess(instance *models.Instance, started func(pgid int)) error {
+	if instance.Path == "" {
+		return fmt.Errorf("workspace path for instance %s not set", instance.ID)
 	}
 
-	// Get the workspace path
-	workspacePath, exists := s.workspacePaths[storedInstance.WorkspaceID]
-	if !exists {
-		s.mutex.Unlock()
-		return fmt.Errorf("workspace path for instance %s not found", instance.ID)
+	// Create cmd in the workspace, sandboxed if requested
+	executor := NewExecutor(instance.Sandbox, s.sandboxDir(instance.ID), instance.Port)
+	cmd, err := executor.Command(instance.Path, BuildEnv(instance.Env), "sh", "-c", instance.Command)
+	if err != nil {
+		return err
 	}
-	s.mutex.Unlock()
-
-	// Create cmd
-	parts := []string{"sh", "-c", storedInstance.Command}
-	cmd := exec.Command(parts[0], parts[1:]...)
-
-	// Set current directory to workspace path
-	cmd.Dir = workspacePath
 
 	// Configure stdout/stderr
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	// Update status
-	s.mutex.Lock()
-	storedInstance.Status = "running"
-	s.mutex.Unlock()
+	// Own process group, so signals can be forwarded to the whole tree
+	cmd.SysProcAttr.Setpgid = true
+
+	instance.Status = "running"
 
-	// Run the command (this blocks until it completes)
-	err := cmd.Run()
+	// Run the command (this blocks until it completes), forwarding Ctrl+C and friends
+	exitCode, exitSignal, err := runForeground(executor, cmd, instance.GracePeriod, instance.Limits, started)
 
-	// Update status when done
-	s.mutex.Lock()
-	storedInstance.Status = "stopped"
-	s.mutex.Unlock()
+	instance.Status = "stopped"
 
-	// If it's an exit error, that's expected (non-zero exit code)
-	if exitErr, ok := err.(*exec.ExitError); ok {
-		return fmt.Errorf("process exited with code %d", exitErr.ExitCode())
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 || exitSignal != "" {
+		// Foreground output goes to the terminal, so only CPU time violations can be told apart.
+		return &ExitError{Code: exitCode, Signal: exitSignal, Limit: LimitViolation(instance.Limits, cmd.ProcessState, nil)}
 	}
+	return nil
+}
 
-	return err
+// RunPreCommands runs the pre_command steps for an instance in its workspace, one after the
+// other, with the instance environment and output on the terminal. It stops at the first
+// failing command. They run in the instance's sandbox, if it has one, without the port forwarded.
+func (s *ServiceImpl) RunPreCommands(instance *models.Instance, commands []string) error {
+	executor := NewExecutor(instance.Sandbox, "", 0)
+	for _, command := range commands {
+		cmd, err := executor.Command(instance.Path, BuildEnv(instance.Env), "sh", "-c", command)
+		if err != nil {
+			return fmt.Errorf("pre_command '%s': %w", command, err)
+		}
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.SysProcAttr.Setpgid = true
+
+		exitCode, exitSignal, err := runForeground(executor, cmd, instance.GracePeriod, models.ResourceLimits{}, nil)
+		if err != nil {
+			return fmt.Errorf("pre_command '%s': %w", command, err)
+		}
+		if exitCode != 0 || exitSignal != "" {
+			return fmt.Errorf("pre_command '%s' failed: %w", command, &ExitError{Code: exitCode, Signal: exitSignal})
+		}
+	}
+	return nil
 }
 
-// StartDetachedProcess starts the process in the background for an instance
+// StartDetachedProcess starts the process in the background for an instance.
+// The process is owned by a supervisor shim (`gitserve __shim`) that outlives this CLI
+// invocation, waits on the child and records its exit in the store. The instance must
+// already exist in the store, because the shim writes the PID and status to it.
 func (s *ServiceImpl) StartDetachedProcess(instance *models.Instance) error {
-	s.mutex.Lock()
-	// defer s.mutex.Unlock() // Deferring unlock until after goroutine is spawned if PID is updated within lock
-
-	// Find instance to ensure it exists and get its path
-	storedInstance, exists := s.instances[instance.ID]
-	if !exists {
-		s.mutex.Unlock()
-		return fmt.Errorf("instance %s not found", instance.ID)
-	}
-
-	// The instance.Path should be populated correctly from Create() method
-	workspacePath := storedInstance.Path
-	if workspacePath == "" {
-		// Fallback or error if path somehow not set, though it should be by Create.
-		// For now, let's try to get it from s.workspacePaths as a safeguard, though less direct.
-		// This part of the logic might be redundant if instance.Path is reliably set.
-		var wpExists bool
-		workspacePath, wpExists = s.workspacePaths[storedInstance.WorkspaceID]
-		if !wpExists {
-			s.mutex.Unlock()
-			return fmt.Errorf("workspace path for instance %s (ID: %s) not found and not set in instance model", storedInstance.BranchName, instance.ID)
-		}
+	if instance.Path == "" {
+		return fmt.Errorf("workspace path for instance %s (ref %s) not set", instance.ID, instance.Ref)
+	}
+
+	// Ensure log directory exists
+	if err := os.MkdirAll(s.logDir, 0750); err != nil {
+		return fmt.Errorf("failed to create log directory %s: %w", s.logDir, err)
+	}
+
+	spec := ShimSpec{
+		InstanceID:    instance.ID,
+		Store:         s.storeLocation,
+		Dir:           instance.Path,
+		Command:       instance.Command,
+		Env:           instance.Env,
+		StdoutLogPath: s.LogPath(instance.ID),
+		StderrLogPath: filepath.Join(s.logDir, fmt.Sprintf("%s.err.log", LogFileBase(instance.ID))),
+		Restart:       instance.Restart,
+		Limits:        instance.Limits,
+		Sandbox:       instance.Sandbox,
+		Port:          instance.Port,
+	}
+	if instance.Sandbox.Enabled {
+		spec.SandboxDir = s.sandboxDir(instance.ID)
+	}
+	if instance.TTY {
+		spec.TTY = true
+		spec.AttachSocket = filepath.Join(s.logDir, fmt.Sprintf("%s.sock", LogFileBase(instance.ID)))
+	}
+
+	pid, err := s.spawnShim(spec)
+	if err != nil {
+		return err
 	}
-	s.mutex.Unlock() // Unlock before os.Create and cmd.Start to avoid holding lock too long
 
-	// Create cmd
-	parts := []string{"sh", "-c", storedInstance.Command}
-	cmd := exec.Command(parts[0], parts[1:]...)
+	instance.PID = pid
+	instance.Status = "running"
+	instance.LogPath = spec.StdoutLogPath
+	instance.ErrLogPath = spec.StderrLogPath
+	return nil
+}
 
-	// Set current directory to workspace path
-	cmd.Dir = workspacePath
+// LogPath returns the stdout log of a detached instance
+func (s *ServiceImpl) LogPath(instanceID string) string {
+	return filepath.Join(s.logDir, fmt.Sprintf("%s.out.log", LogFileBase(instanceID)))
+}
+
+// sandboxDir is the runtime directory of an instance's sandbox, next to its logs.
+func (s *ServiceImpl) sandboxDir(instanceID string) string {
+	return filepath.Join(s.logDir, fmt.Sprintf("%s.sandbox", LogFileBase(instanceID)))
+}
 
-	// Set PGID to enable killing the entire process group
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+// LogFileBase turns an instance ID into a file name; process IDs (<id>/<process>) contain a slash.
+func LogFileBase(instanceID string) string {
+	return strings.ReplaceAll(instanceID, "/", ".")
+}
 
-	// Ensure log directory exists (optional, if logs are in a subfolder of workspacePath)
-	// For now, logs directly in workspacePath
+// logFileSuffixes are the files kept per instance in the log directory, after LogFileBase.
+var logFileSuffixes = []string{".out.log", ".err.log", ".shim.log", ".sock", ".sandbox"}
+
+// LogFiles returns the files of an instance in the log directory logDir that exist: its
+// stdout and stderr logs, the supervisor log, the attach socket and the sandbox directory.
+func LogFiles(logDir string, instanceID string) []string {
+	var paths []string
+	for _, suffix := range logFileSuffixes {
+		path := filepath.Join(logDir, LogFileBase(instanceID)+suffix)
+		if _, err := os.Lstat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
 
-	// Configure stdout/stderr to be redirected to files within the workspace
-	stdoutLogPath := filepath.Join(workspacePath, fmt.Sprintf("%s.out.log", instance.ID))
-	stderrLogPath := filepath.Join(workspacePath, fmt.Sprintf("%s.err.log", instance.ID))
+// LogFileOwner returns the LogFileBase of the instance a file in the log directory belongs
+// to, or false if gitserve doesn't name its files like that.
+func LogFileOwner(name string) (string, bool) {
+	for _, suffix := range logFileSuffixes {
+		if base, found := strings.CutSuffix(name, suffix); found && base != "" {
+			return base, true
+		}
+	}
+	return "", false
+}
 
-	stdoutFile, err := os.Create(stdoutLogPath)
+// spawnShim starts the supervisor shim in its own session, hands it the spec on stdin and
+// waits for its handshake. It returns the PID of the instance's process.
+func (s *ServiceImpl) spawnShim(spec ShimSpec) (int, error) {
+	executable, err := os.Executable()
 	if err != nil {
-		return fmt.Errorf("failed to create stdout log file %s: %w", stdoutLogPath, err)
+		return 0, fmt.Errorf("failed to locate gitserve executable for the supervisor: %w", err)
 	}
 
-	stderrFile, err := os.Create(stderrLogPath)
+	specReader, specWriter, err := os.Pipe()
 	if err != nil {
-		stdoutFile.Close()
-		return fmt.Errorf("failed to create stderr log file %s: %w", stderrLogPath, err)
-	}
-
-	cmd.Stdout = stdoutFile
-	cmd.Stderr = stderrFile
-
-	// Start the process
-	if err := cmd.Start(); err != nil {
-		stdoutFile.Close()
-		stderrFile.Close()
-		return fmt.Errorf("failed to start process: %w", err)
-	}
-
-	// Update instance with process ID and status
-	// This needs to be done carefully with the lock
-	s.mutex.Lock()
-	// Re-fetch storedInstance in case of concurrent modifications, though less likely here
-	// if si, ok := s.instances[instance.ID]; ok {
-	// 	si.ProcessID = cmd.Process.Pid
-	// 	si.Status = "running"
-	// }
-	// Directly update the instance passed in, which is a pointer.
-	// Also update the one in the map.
-	storedInstance.ProcessID = cmd.Process.Pid
-	storedInstance.Status = "running"
-	// Update the original instance object that was passed in as well, if it's different
-	// from storedInstance (which it is, instance vs storedInstance)
-	// The caller (cmd/run.go) has 'instanceModel', which is 'instance' here.
-	// So we update 'instance' (which is 'instanceModel' in cmd/run.go)
-	instance.ProcessID = cmd.Process.Pid
-	instance.Status = "running"
-	s.mutex.Unlock()
-
-	// Start a goroutine to wait for the process to complete
-	// This is needed to avoid zombie processes
-	go func() {
-		processErr := cmd.Wait() // Capture error from Wait
-
-		// Close log files
-		stdoutFile.Close()
-		stderrFile.Close()
-
-		// Update status
-		s.mutex.Lock()
-		defer s.mutex.Unlock()
-
-		if si, exists := s.instances[instance.ID]; exists {
-			if processErr != nil {
-				si.Status = "failed" // Or "exited_with_error"
-			} else {
-				si.Status = "stopped"
-			}
-			// Also update the original instance object if necessary, though its lifecycle might be over
-			instance.Status = si.Status // Reflect final status
-		}
-	}()
+		return 0, fmt.Errorf("failed to create supervisor spec pipe: %w", err)
+	}
+	handshakeReader, handshakeWriter, err := os.Pipe()
+	if err != nil {
+		specReader.Close()
+		specWriter.Close()
+		return 0, fmt.Errorf("failed to create supervisor handshake pipe: %w", err)
+	}
+	defer handshakeReader.Close()
 
-	return nil
-}
+	shimLogPath := filepath.Join(s.logDir, fmt.Sprintf("%s.shim.log", LogFileBase(spec.InstanceID)))
+	shimLog, err := os.OpenFile(shimLogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		specReader.Close()
+		specWriter.Close()
+		handshakeWriter.Close()
+		return 0, fmt.Errorf("failed to create supervisor log file %s: %w", shimLogPath, err)
+	}
+	defer shimLog.Close()
+
+	cmd := exec.Command(executable, ShimCommandName)
+	cmd.Stdin = specReader
+	cmd.Stdout = handshakeWriter
+	cmd.Stderr = shimLog
+	// New session: the shim must survive this CLI exiting and the terminal closing.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	startErr := cmd.Start()
+	// The child holds its own copies of these ends now.
+	specReader.Close()
+	handshakeWriter.Close()
+	if startErr != nil {
+		specWriter.Close()
+		return 0, fmt.Errorf("failed to start supervisor process: %w", startErr)
+	}
 
-// StopProcess stops the process for an instance
-func (s *ServiceImpl) StopProcess(instance *models.Instance) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	encodeErr := json.NewEncoder(specWriter).Encode(spec)
+	specWriter.Close()
+	if encodeErr != nil {
+		return 0, fmt.Errorf("failed to send spec to supervisor process: %w", encodeErr)
+	}
 
-	storedInstance, exists := s.instances[instance.ID]
-	if !exists {
-		return fmt.Errorf("instance %s not found", instance.ID)
+	line, readErr := bufio.NewReader(handshakeReader).ReadBytes('\n')
+	// The shim keeps running on its own; we never wait for it.
+	cmd.Process.Release()
+	if readErr != nil && len(line) == 0 {
+		return 0, fmt.Errorf("supervisor exited without reporting a PID (see %s): %w", shimLogPath, readErr)
 	}
 
-	if storedInstance.Status != "running" {
-		return fmt.Errorf("instance %s is not running", instance.ID)
+	var handshake shimHandshake
+	if err := json.Unmarshal(line, &handshake); err != nil {
+		return 0, fmt.Errorf("invalid handshake from supervisor process: %w", err)
+	}
+	if handshake.Error != "" {
+		return 0, fmt.Errorf("supervisor failed to start process: %s", handshake.Error)
 	}
+	return handshake.PID, nil
+}
 
-	proc, err := os.FindProcess(storedInstance.ProcessID)
+// StopProcess asks the process group of a running instance to terminate and marks it as
+// stopping in the store; its supervisor records the exit.
+func (s *ServiceImpl) StopProcess(instance *models.Instance) error {
+	stored, err := s.Get(instance.ID)
 	if err != nil {
-		return fmt.Errorf("failed to find process: %w", err)
+		return err
+	}
+	if stored.Status != "running" {
+		return fmt.Errorf("instance %s is not running", instance.ID)
+	}
+	if !IsSameProcess(stored.PID, ProcessIdentity{StartTime: stored.ProcessStartTime, BootID: stored.BootID}) {
+		return fmt.Errorf("instance %s is not running (PID %d belongs to another process)", instance.ID, stored.PID)
 	}
 
-	// Send a SIGTERM signal
-	if err := proc.Signal(syscall.SIGTERM); err != nil {
+	if _, err := s.store.ModifyInstance(stored.ID, func(inst *storage.Instance) { inst.Status = "stopping" }); err != nil {
+		return fmt.Errorf("failed to mark instance %s as stopping: %w", instance.ID, err)
+	}
+	if err := SignalProcessGroup(stored.PID, syscall.SIGTERM); err != nil {
 		return fmt.Errorf("failed to stop process: %w", err)
 	}
-
-	storedInstance.Status = "stopping"
-
+	instance.Status = "stopping"
 	return nil
 }
 
-// List returns all instances
+// List returns all instances in the store
 func (s *ServiceImpl) List() ([]*models.Instance, error) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-
-	instances := make([]*models.Instance, 0, len(s.instances))
-	for _, instance := range s.instances {
-		instances = append(instances, instance)
+	stored, err := s.store.GetAllInstances()
+	if err != nil {
+		return nil, err
+	}
+	instances := make([]*models.Instance, 0, len(stored))
+	for i := range stored {
+		instances = append(instances, &stored[i])
 	}
-
 	return instances, nil
 }
 
-// Get returns an instance by ID
+// Get returns an instance from the store by ID
 func (s *ServiceImpl) Get(id string) (*models.Instance, error) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-
-	instance, exists := s.instances[id]
-	if !exists {
+	instance, found, err := s.store.GetInstanceByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
 		return nil, fmt.Errorf("instance %s not found", id)
 	}
-
-	return instance, nil
+	return &instance, nil
 }
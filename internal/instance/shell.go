@@ -0,0 +1,109 @@
+package instance
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+// EnvShell is set inside interactive shells started by gitserve, so prompts and scripts can tell.
+const EnvShell = "GITSERVE_SHELL"
+
+// envPromptMarker carries the prompt marker into the shell's rc file, which avoids quoting
+// ref names into shell source.
+const envPromptMarker = "GITSERVE_PROMPT_MARKER"
+
+// ShellOptions describes an interactive shell session in a workspace.
+type ShellOptions struct {
+	Dir string            // Workspace to start the shell in
+	Env map[string]string // Instance variables applied on top of the current environment
+	Ref string            // Shown in the prompt marker, e.g. "(gitserve:main)"
+}
+
+// RunShell opens the user's $SHELL (falling back to /bin/sh) in the workspace and blocks until
+// the user leaves it. The prompt is prefixed with a marker showing the ref. The shell shares
+// gitserve's terminal and process group, so gitserve ignores Ctrl+C and friends while it runs.
+// The shell's own exit status is not treated as an error.
+func RunShell(opts ShellOptions) error {
+	shellPath := os.Getenv("SHELL")
+	if shellPath == "" {
+		shellPath = "/bin/sh"
+	}
+
+	rcDir, err := os.MkdirTemp("", "gitserve-shell-")
+	if err != nil {
+		return fmt.Errorf("failed to create shell rc directory: %w", err)
+	}
+	defer os.RemoveAll(rcDir)
+
+	marker := fmt.Sprintf("(gitserve:%s) ", opts.Ref)
+	env := BuildEnv(opts.Env)
+	env = append(env, EnvShell+"=1", envPromptMarker+"="+marker)
+
+	args, extraEnv, err := shellPromptSetup(filepath.Base(shellPath), rcDir, marker)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(shellPath, args...)
+	cmd.Dir = opts.Dir
+	cmd.Env = append(env, extraEnv...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	signals := make(chan os.Signal, 4)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGQUIT)
+	defer signal.Stop(signals)
+	go func() {
+		for range signals {
+			// The shell gets these from the terminal itself.
+		}
+	}()
+
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return nil // Whatever the last command in the shell returned
+		}
+		return fmt.Errorf("failed to start shell %s: %w", shellPath, err)
+	}
+	return nil
+}
+
+// shellPromptSetup returns the arguments and extra environment needed to prefix the prompt of
+// the given shell with the marker. bash and zsh read the user's rc files first and then apply
+// the marker; other shells just get PS1.
+func shellPromptSetup(shellName, rcDir, marker string) ([]string, []string, error) {
+	switch shellName {
+	case "bash":
+		rcFile := filepath.Join(rcDir, "bashrc")
+		rc := `[ -f "$HOME/.bashrc" ] && . "$HOME/.bashrc"
+PS1="${` + envPromptMarker + `}${PS1}"
+`
+		if err := os.WriteFile(rcFile, []byte(rc), 0600); err != nil {
+			return nil, nil, fmt.Errorf("failed to write shell rc file: %w", err)
+		}
+		return []string{"--rcfile", rcFile, "-i"}, nil, nil
+	case "zsh":
+		// zsh reads .zshenv and .zshrc from ZDOTDIR; ours source the user's and then set the prompt.
+		files := map[string]string{
+			".zshenv": `[ -f "${GITSERVE_ORIG_ZDOTDIR:-$HOME}/.zshenv" ] && . "${GITSERVE_ORIG_ZDOTDIR:-$HOME}/.zshenv"
+`,
+			".zshrc": `ZDOTDIR="${GITSERVE_ORIG_ZDOTDIR:-$HOME}"
+[ -f "$ZDOTDIR/.zshrc" ] && . "$ZDOTDIR/.zshrc"
+PROMPT="${` + envPromptMarker + `}${PROMPT}"
+`,
+		}
+		for name, rc := range files {
+			if err := os.WriteFile(filepath.Join(rcDir, name), []byte(rc), 0600); err != nil {
+				return nil, nil, fmt.Errorf("failed to write shell rc file: %w", err)
+			}
+		}
+		return []string{"-i"}, []string{"GITSERVE_ORIG_ZDOTDIR=" + os.Getenv("ZDOTDIR"), "ZDOTDIR=" + rcDir}, nil
+	default:
+		return []string{"-i"}, []string{"PS1=" + marker + "$ "}, nil
+	}
+}
@@ -0,0 +1,426 @@
+package instance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+
+	"gitserve/internal/journal"
+	"gitserve/internal/logger"
+	"gitserve/internal/models"
+	"gitserve/internal/storage"
+
+	"github.com/creack/pty"
+)
+
+// ShimCommandName is the hidden CLI subcommand that runs the supervisor shim.
+const ShimCommandName = "__shim"
+
+// ShimSpec describes the process a supervisor shim should start and look after.
+// It is handed to the shim as JSON on its stdin.
+type ShimSpec struct {
+	InstanceID    string            `json:"instanceId"`
+	Store         storage.Location  `json:"store"`
+	Dir           string            `json:"dir"`
+	Command       string            `json:"command"`
+	Env           map[string]string `json:"env,omitempty"`
+	StdoutLogPath string            `json:"stdoutLogPath"`
+	StderrLogPath string            `json:"stderrLogPath"`
+
+	// TTY runs the command under a PTY owned by the shim; its output goes to the stdout log
+	// and to clients attached through AttachSocket.
+	TTY          bool   `json:"tty,omitempty"`
+	AttachSocket string `json:"attachSocket,omitempty"`
+
+	Restart models.RestartPolicy  `json:"restart"`
+	Limits  models.ResourceLimits `json:"limits,omitempty"`
+
+	// Sandbox runs the command inside namespaces; SandboxDir is the sandbox's runtime directory.
+	Sandbox    models.SandboxOptions `json:"sandbox,omitempty"`
+	SandboxDir string                `json:"sandboxDir,omitempty"`
+	Port       int                   `json:"port,omitempty"` // Forwarded into a sandbox without network
+}
+
+// shimHandshake is the single JSON line a shim writes back to the process that spawned it,
+// once the child has been started (or failed to start).
+type shimHandshake struct {
+	PID   int    `json:"pid,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// ReadShimSpec decodes a ShimSpec from r.
+func ReadShimSpec(r io.Reader) (ShimSpec, error) {
+	var spec ShimSpec
+	if err := json.NewDecoder(r).Decode(&spec); err != nil {
+		return ShimSpec{}, fmt.Errorf("failed to decode shim spec: %w", err)
+	}
+	if spec.InstanceID == "" || spec.Store.Dir == "" || spec.Command == "" {
+		return ShimSpec{}, errors.New("shim spec is missing the instance ID, store directory or command")
+	}
+	if spec.TTY && spec.AttachSocket == "" {
+		return ShimSpec{}, errors.New("shim spec requests a TTY but has no attach socket")
+	}
+	return spec, nil
+}
+
+// crashLogLines is how many trailing log lines are saved when an instance enters crash_loop.
+const crashLogLines = 20
+
+// RunShim is the body of the supervisor process. It starts the instance's command in its own
+// process group, reports the PID through handshake (which it closes afterwards), waits for the
+// child to exit and records the exit code, signal, stop time and final status in the store.
+// If the spec carries a restart policy, the child is restarted with exponential backoff until
+// it exceeds the allowed restarts within the crash-loop window and is marked crash_loop.
+// It returns the exit code the shim process itself should exit with.
+func RunShim(spec ShimSpec, handshake io.WriteCloser, log logger.Service) int {
+	policy := spec.Restart.WithDefaults()
+	var recentRestarts []time.Time // Restarts within the crash-loop window
+	events := journal.NewService(spec.Store.Dir, "supervisor", log)
+
+	var hub *attachHub
+	if spec.TTY {
+		var err error
+		if hub, err = newAttachHub(spec.AttachSocket, log); err != nil {
+			log.Error("Instance %s: %v", spec.InstanceID, err)
+			writeHandshake(handshake, shimHandshake{Error: err.Error()}, log)
+			recordShimResult(spec, log, func(inst *storage.Instance) {
+				inst.Status = "failed"
+				inst.StopTime = time.Now().UTC()
+			})
+			events.Record(spec.InstanceID, models.EventExited, map[string]string{"status": "failed", "error": err.Error()})
+			return 1
+		}
+		defer hub.Close()
+	}
+
+	shimIdentity, _ := IdentifyProcess(os.Getpid())
+	// markRunning records the freshly started child in the instance record.
+	markRunning := func(inst *storage.Instance, pid int) {
+		identity, err := IdentifyProcess(pid)
+		if err != nil {
+			log.Warning("Instance %s: failed to read start time of PID %d: %v", spec.InstanceID, pid, err)
+		}
+		inst.PID = pid
+		inst.ShimPID = os.Getpid()
+		inst.ProcessStartTime = identity.StartTime
+		inst.ShimStartTime = shimIdentity.StartTime
+		inst.BootID = identity.BootID
+		inst.Status = "running"
+		inst.LogPath = spec.StdoutLogPath
+		inst.ErrLogPath = spec.StderrLogPath
+		inst.AttachSocket = spec.AttachSocket
+		inst.LimitViolation = ""
+	}
+
+	for attempt := 0; ; attempt++ {
+		var child *shimChild
+		var err error
+		if attempt == 0 {
+			child, err = startShimChild(spec, hub)
+		} else {
+			// Someone may have stopped or removed the instance while we were backing off. The
+			// child is started under the store lock, so a stop either finds it running or keeps
+			// it from being started at all.
+			restarting := false
+			recordShimResult(spec, log, func(inst *storage.Instance) {
+				if inst.Status != "restarting" {
+					return
+				}
+				restarting = true
+				if child, err = startShimChild(spec, hub); err == nil {
+					markRunning(inst, child.cmd.Process.Pid)
+				}
+			})
+			if !restarting {
+				log.Info("Instance %s: no longer restarting, supervisor exiting", spec.InstanceID)
+				return 0
+			}
+		}
+		if err != nil {
+			log.Error("Instance %s: %v", spec.InstanceID, err)
+			if attempt == 0 {
+				writeHandshake(handshake, shimHandshake{Error: err.Error()}, log)
+			}
+			recordShimResult(spec, log, func(inst *storage.Instance) {
+				inst.Status = "failed"
+				inst.StopTime = time.Now().UTC()
+			})
+			events.Record(spec.InstanceID, models.EventExited, map[string]string{"status": "failed", "error": err.Error()})
+			return 1
+		}
+
+		pid := child.cmd.Process.Pid
+		if attempt == 0 {
+			recordShimResult(spec, log, func(inst *storage.Instance) {
+				markRunning(inst, pid)
+				inst.StartTime = time.Now().UTC()
+			})
+		}
+		// Recorded before the handshake, so it precedes whatever the spawning command records next.
+		events.Record(spec.InstanceID, models.EventStarted, map[string]string{"pid": strconv.Itoa(pid), "attempt": strconv.Itoa(attempt + 1)})
+		if attempt == 0 {
+			writeHandshake(handshake, shimHandshake{PID: pid}, log)
+		}
+		log.Info("Instance %s: started PID %d (attempt %d)", spec.InstanceID, pid, attempt+1)
+
+		child.wait()
+		exitCode, exitSignal := exitDetails(child.cmd)
+		log.Info("Instance %s: PID %d finished (exit code %d, signal %q)", spec.InstanceID, pid, exitCode, exitSignal)
+		violation := limitViolation(spec, child.cmd.ProcessState, log)
+		if violation != "" {
+			log.Warning("Instance %s: PID %d most likely exceeded %s", spec.InstanceID, pid, violation)
+		}
+
+		now := time.Now()
+		cutoff := now.Add(-policy.CrashLoopWindow)
+		for len(recentRestarts) > 0 && recentRestarts[0].Before(cutoff) {
+			recentRestarts = recentRestarts[1:]
+		}
+
+		var delay time.Duration
+		restart := false
+		status := ""
+		found := recordShimResult(spec, log, func(inst *storage.Instance) {
+			defer func() { status = inst.Status }()
+			inst.LimitViolation = violation
+			// A stop (or remove) in progress always wins over the restart policy.
+			stopping := inst.Status == "stopping" || inst.Status == "stopped"
+			if stopping || !policy.ShouldRestart(exitCode, exitSignal) {
+				applyExit(inst, exitCode, exitSignal)
+				return
+			}
+			if len(recentRestarts) >= policy.MaxRetries {
+				applyExit(inst, exitCode, exitSignal)
+				inst.Status = "crash_loop"
+				inst.CrashLog = crashLogTail(spec, log)
+				log.Warning("Instance %s: %d restarts within %s, giving up (crash_loop)", spec.InstanceID, len(recentRestarts), policy.CrashLoopWindow)
+				return
+			}
+			restart = true
+			delay = policy.BackoffFor(len(recentRestarts))
+			inst.Status = "restarting"
+			inst.ExitCode = exitCode
+			inst.ExitSignal = exitSignal
+			inst.Restarts++
+			inst.LastRestartTime = now.UTC()
+		})
+		exited := map[string]string{"pid": strconv.Itoa(pid)}
+		if status != "" {
+			exited["status"] = status
+		}
+		if exitSignal != "" {
+			exited["signal"] = exitSignal
+		} else {
+			exited["exit_code"] = strconv.Itoa(exitCode)
+		}
+		if violation != "" {
+			exited["limit"] = violation
+		}
+		if restart {
+			exited["restart_in"] = delay.String()
+		}
+		events.Record(spec.InstanceID, models.EventExited, exited)
+		if !found || !restart {
+			return 0
+		}
+
+		if hub != nil {
+			hub.Notice("process exited, restarting in %s", delay)
+		}
+		recentRestarts = append(recentRestarts, now)
+		log.Info("Instance %s: restarting in %s (policy %s, restart %d/%d in window)",
+			spec.InstanceID, delay, policy.Policy, len(recentRestarts), policy.MaxRetries)
+		time.Sleep(delay)
+	}
+}
+
+// crashLogTail collects the last log lines of an instance, preferring stderr.
+func crashLogTail(spec ShimSpec, log logger.Service) []string {
+	for _, path := range []string{spec.StderrLogPath, spec.StdoutLogPath} {
+		lines, err := TailFile(path, crashLogLines)
+		if err != nil {
+			log.Warning("Instance %s: failed to read %s: %v", spec.InstanceID, path, err)
+			continue
+		}
+		if len(lines) > 0 {
+			return lines
+		}
+	}
+	return nil
+}
+
+// limitViolation works out which resource limit, if any, the finished child ran into, from
+// its exit status and the end of its logs.
+func limitViolation(spec ShimSpec, state *os.ProcessState, log logger.Service) string {
+	if spec.Limits.IsZero() || state == nil || state.Success() {
+		return ""
+	}
+	var tail []string
+	for _, path := range []string{spec.StdoutLogPath, spec.StderrLogPath} {
+		lines, err := TailFile(path, crashLogLines)
+		if err != nil {
+			log.Warning("Instance %s: failed to read %s: %v", spec.InstanceID, path, err)
+			continue
+		}
+		tail = append(tail, lines...)
+	}
+	return LimitViolation(spec.Limits, state, tail)
+}
+
+// shimChild is a started instance command together with what has to be cleaned up after it.
+type shimChild struct {
+	cmd      *exec.Cmd
+	logFiles []*os.File
+	ptmx     *os.File      // PTY master, for TTY instances
+	hub      *attachHub    // Attach hub the PTY is connected to, for TTY instances
+	copied   chan struct{} // Closed once the PTY output has been drained
+	release  func()        // Releases what the executor set up for the command
+}
+
+// startShimChild opens the log files and starts the instance command in its own process group,
+// or, for TTY instances, in its own session on a new PTY connected to hub. Sandboxed commands
+// are started inside their sandbox.
+func startShimChild(spec ShimSpec, hub *attachHub) (*shimChild, error) {
+	stdoutFile, err := os.OpenFile(spec.StdoutLogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdout log file %s: %w", spec.StdoutLogPath, err)
+	}
+	stderrFile, err := os.OpenFile(spec.StderrLogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		stdoutFile.Close()
+		return nil, fmt.Errorf("failed to create stderr log file %s: %w", spec.StderrLogPath, err)
+	}
+	child := &shimChild{logFiles: []*os.File{stdoutFile, stderrFile}, hub: hub}
+
+	executor := NewExecutor(spec.Sandbox, spec.SandboxDir, spec.Port)
+	cmd, err := executor.Command(spec.Dir, BuildEnv(spec.Env), "sh", "-c", spec.Command)
+	if err != nil {
+		closeAll(child.logFiles)
+		return nil, err
+	}
+	child.cmd = cmd
+
+	if hub != nil {
+		// A session of its own (and so a process group of its own) with the PTY as its
+		// controlling terminal. stdout and stderr are merged in the stdout log.
+		size := hub.setPTY(nil)
+		ptmx, err := pty.StartWithSize(cmd, &size)
+		if err != nil {
+			closeAll(child.logFiles)
+			return nil, fmt.Errorf("failed to start process on a PTY: %w", err)
+		}
+		if child.release, err = finishStart(executor, cmd, spec.Limits); err != nil {
+			ptmx.Close()
+			closeAll(child.logFiles)
+			return nil, err
+		}
+		child.ptmx = ptmx
+		child.copied = make(chan struct{})
+		hub.setPTY(ptmx)
+		go func() {
+			_, _ = io.Copy(io.MultiWriter(stdoutFile, hub), ptmx)
+			close(child.copied)
+		}()
+		return child, nil
+	}
+
+	cmd.Stdout = stdoutFile
+	cmd.Stderr = stderrFile
+	// Own process group, so stop can signal the whole tree without hitting the shim.
+	cmd.SysProcAttr.Setpgid = true
+
+	if err := cmd.Start(); err != nil {
+		closeAll(child.logFiles)
+		return nil, fmt.Errorf("failed to start process: %w", err)
+	}
+	if child.release, err = finishStart(executor, cmd, spec.Limits); err != nil {
+		closeAll(child.logFiles)
+		return nil, err
+	}
+	return child, nil
+}
+
+// wait waits for the command to exit, drains its PTY if it has one and closes its log files.
+func (c *shimChild) wait() {
+	_ = c.cmd.Wait() // The exit details are read from cmd.ProcessState
+	c.release()
+	if c.ptmx != nil {
+		select {
+		case <-c.copied:
+		case <-time.After(ptyDrainTimeout): // Background children still hold the PTY open
+		}
+		c.hub.setPTY(nil)
+		c.ptmx.Close()
+		<-c.copied
+	}
+	closeAll(c.logFiles)
+}
+
+// exitDetails extracts the exit code and terminating signal name from a finished command.
+func exitDetails(cmd *exec.Cmd) (int, string) {
+	if cmd.ProcessState == nil {
+		return -1, ""
+	}
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return -1, SignalName(status.Signal())
+	}
+	return cmd.ProcessState.ExitCode(), ""
+}
+
+// applyExit sets the terminal status and exit details on a stored instance.
+// An instance that was being stopped on purpose ends up 'stopped' rather than 'exited', unless
+// the stop had to escalate to SIGKILL.
+func applyExit(inst *storage.Instance, exitCode int, exitSignal string) {
+	inst.ExitCode = exitCode
+	inst.ExitSignal = exitSignal
+	inst.StopTime = time.Now().UTC()
+	switch {
+	case (inst.Status == "stopping" || inst.Status == "stopped") && exitSignal != "SIGKILL":
+		inst.Status = "stopped"
+	case exitSignal != "":
+		inst.Status = "killed"
+	default:
+		inst.Status = "exited"
+	}
+}
+
+// recordShimResult applies update to the shim's instance record in the store, under the
+// store lock so changes other gitserve commands make at the same time are not lost. It returns
+// false if the record no longer exists.
+func recordShimResult(spec ShimSpec, log logger.Service, update func(inst *storage.Instance)) bool {
+	instanceStore, err := storage.Open(spec.Store, log)
+	if err != nil {
+		log.Error("Instance %s: failed to open instance store: %v", spec.InstanceID, err)
+		return false
+	}
+	found, err := instanceStore.ModifyInstance(spec.InstanceID, update)
+	if err != nil {
+		log.Error("Instance %s: failed to update store: %v", spec.InstanceID, err)
+		return false
+	}
+	if !found {
+		log.Warning("Instance %s: record not found in store (removed?), not recording state", spec.InstanceID)
+	}
+	return found
+}
+
+// writeHandshake sends the handshake line and closes the channel; the spawning process is
+// only waiting for this single line.
+func writeHandshake(handshake io.WriteCloser, msg shimHandshake, log logger.Service) {
+	if err := json.NewEncoder(handshake).Encode(msg); err != nil {
+		log.Warning("Failed to write shim handshake: %v", err)
+	}
+	handshake.Close()
+}
+
+func closeAll(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
@@ -0,0 +1,78 @@
+package instance
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitserve/internal/logger"
+	"gitserve/internal/models"
+	"gitserve/internal/storage"
+)
+
+// nopCloser stands in for the handshake pipe.
+type nopCloser struct{}
+
+func (nopCloser) Write(p []byte) (int, error) { return len(p), nil }
+func (nopCloser) Close() error                { return nil }
+
+func TestRunShimStoppedDuringBackoff(t *testing.T) {
+	dir := t.TempDir()
+	spec := ShimSpec{
+		InstanceID:    "a1",
+		Store:         storage.Location{Dir: dir, Backend: storage.BackendJSON},
+		Dir:           dir,
+		Command:       "exit 1",
+		StdoutLogPath: filepath.Join(dir, "stdout.log"),
+		StderrLogPath: filepath.Join(dir, "stderr.log"),
+		Restart:       models.RestartPolicy{Policy: models.RestartAlways, Backoff: 500 * time.Millisecond},
+	}
+	log := logger.NewService(logger.LogLevelError)
+	store, err := storage.Open(spec.Store, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddInstance(storage.Instance{ID: "a1", Status: "starting"}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan int)
+	go func() { done <- RunShim(spec, nopCloser{}, log) }()
+
+	// Stop the instance while the supervisor backs off after the first exit.
+	var firstPID int
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		inst, _, err := store.GetInstanceByID("a1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inst.Status == "restarting" {
+			firstPID = inst.PID
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("instance never restarting, status %s", inst.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := store.ModifyInstance("a1", func(inst *storage.Instance) { inst.Status = "stopping" }); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case code := <-done:
+		if code != 0 {
+			t.Errorf("RunShim() = %d, want 0", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor still running after the stop")
+	}
+	inst, _, err := store.GetInstanceByID("a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.Status != "stopping" || inst.PID != firstPID {
+		t.Errorf("record is %s with PID %d, want it left stopping with PID %d", inst.Status, inst.PID, firstPID)
+	}
+}
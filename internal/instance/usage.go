@@ -0,0 +1,157 @@
+package instance
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// clockTicksPerSecond is USER_HZ, the unit of the CPU times in /proc/<pid>/stat. It is 100 on
+// every Linux architecture gitserve runs on.
+const clockTicksPerSecond = 100
+
+// Usage is the resource usage of an instance's process tree.
+type Usage struct {
+	RSS        uint64  // Sum of the resident set sizes, in bytes (shared pages are counted per process)
+	CPUPercent float64 // CPU used over the sampling interval; 100 is one full core
+	Processes  int
+}
+
+// MeasureUsage samples the process trees led by rootPIDs twice, interval apart, and returns
+// their usage by root PID. Processes that are gone are left out of the result.
+func MeasureUsage(rootPIDs []int, interval time.Duration) map[int]Usage {
+	before, err := listProcesses()
+	if err != nil {
+		return nil
+	}
+	trees := make(map[int][]int, len(rootPIDs))
+	for _, root := range rootPIDs {
+		trees[root] = processTree(before, root)
+	}
+	ticksBefore := make(map[int]uint64, len(before))
+	for _, stat := range before {
+		ticksBefore[stat.PID] = stat.CPUTicks
+	}
+
+	time.Sleep(interval)
+
+	pageSize := uint64(os.Getpagesize())
+	usage := make(map[int]Usage, len(rootPIDs))
+	for root, tree := range trees {
+		var total Usage
+		var ticks uint64
+		for _, pid := range tree {
+			stat, err := readProcStat(pid)
+			if err != nil {
+				continue // Exited in the meantime
+			}
+			total.Processes++
+			total.RSS += stat.RSSPages * pageSize
+			if previous, ok := ticksBefore[pid]; ok && stat.CPUTicks >= previous {
+				ticks += stat.CPUTicks - previous
+			}
+		}
+		if total.Processes == 0 {
+			continue
+		}
+		total.CPUPercent = float64(ticks) / clockTicksPerSecond / interval.Seconds() * 100
+		usage[root] = total
+	}
+	return usage
+}
+
+// diskUsageTTL is how long a measured workspace size is reused before it is measured again.
+const diskUsageTTL = 5 * time.Minute
+
+// diskUsageEntry is a cached workspace size.
+type diskUsageEntry struct {
+	Bytes      int64     `json:"bytes"`
+	MeasuredAt time.Time `json:"measuredAt"`
+}
+
+// DiskUsageCache remembers workspace sizes in a JSON file, so listing instances doesn't walk
+// every workspace (node_modules and all) each time.
+type DiskUsageCache struct {
+	path    string
+	entries map[string]diskUsageEntry
+	dirty   bool
+}
+
+// LoadDiskUsageCache reads the cache kept at path. A missing or unreadable cache starts empty.
+func LoadDiskUsageCache(path string) *DiskUsageCache {
+	cache := &DiskUsageCache{path: path, entries: make(map[string]diskUsageEntry)}
+	if data, err := os.ReadFile(path); err == nil {
+		if json.Unmarshal(data, &cache.entries) != nil {
+			cache.entries = make(map[string]diskUsageEntry)
+		}
+	}
+	return cache
+}
+
+// Size returns the disk usage of dir in bytes, measuring it if the cached value is missing
+// or older than diskUsageTTL.
+func (c *DiskUsageCache) Size(dir string) (int64, error) {
+	if entry, ok := c.entries[dir]; ok && time.Since(entry.MeasuredAt) < diskUsageTTL {
+		return entry.Bytes, nil
+	}
+	size, err := DirSize(dir)
+	if err != nil {
+		return 0, err
+	}
+	c.entries[dir] = diskUsageEntry{Bytes: size, MeasuredAt: time.Now().UTC()}
+	c.dirty = true
+	return size, nil
+}
+
+// Save writes the cache back if anything was measured, dropping entries of directories that
+// no longer exist.
+func (c *DiskUsageCache) Save() error {
+	if !c.dirty {
+		return nil
+	}
+	for dir := range c.entries {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			delete(c.entries, dir)
+		}
+	}
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0750); err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, data, 0600)
+}
+
+// DirSize returns the disk space used by the files below dir, like du. Files that vanish while
+// walking are skipped; hard links are counted once per link.
+func DirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) || os.IsPermission(err) {
+				return nil
+			}
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		size += diskBlocks(info)
+		return nil
+	})
+	return size, err
+}
+
+// diskBlocks returns the space a file takes up on disk, falling back to its size.
+func diskBlocks(info fs.FileInfo) int64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Blocks * 512 // st_blocks is always in 512-byte units
+	}
+	return info.Size()
+}
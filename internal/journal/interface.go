@@ -0,0 +1,37 @@
+package journal
+
+import (
+	"gitserve/internal/models"
+	"strings"
+	"time"
+)
+
+// Service defines the interface for the event journal, the append-only record of every state
+// transition of every instance.
+type Service interface {
+	// Record appends an event of the given type (one of the models.Event* values) for an
+	// instance. Failures are logged, not returned: an unwritable journal must never keep
+	// gitserve from managing an instance.
+	Record(instanceID string, eventType string, details map[string]string)
+
+	// Query returns the recorded events that match filter, oldest first.
+	Query(filter Filter) ([]models.Event, error)
+
+	// Follow calls fn for every recorded event that matches filter, oldest first, and then for
+	// every matching event recorded later on. It only returns if reading the journal fails.
+	Follow(filter Filter, fn func(event models.Event)) error
+}
+
+// Filter selects journal events. Zero fields match everything.
+type Filter struct {
+	InstanceID string    // The instance and its processes
+	Since      time.Time // Events recorded at or after this time
+}
+
+// Matches reports whether event is selected by the filter.
+func (f Filter) Matches(event models.Event) bool {
+	if f.InstanceID != "" && event.InstanceID != f.InstanceID && !strings.HasPrefix(event.InstanceID, f.InstanceID+"/") {
+		return false
+	}
+	return f.Since.IsZero() || !event.Time.Before(f.Since)
+}
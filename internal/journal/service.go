@@ -0,0 +1,150 @@
+package journal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gitserve/internal/logger"
+	"gitserve/internal/models"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// JournalFile is the name of the event journal in the store directory. It holds one JSON
+// encoded models.Event per line.
+const JournalFile = "gitserve_events.jsonl"
+
+// followPollInterval is how often Follow checks the journal for new events.
+const followPollInterval = 250 * time.Millisecond
+
+// ServiceImpl implements the journal Service interface
+type ServiceImpl struct {
+	path  string // Journal file; empty if no journal could be located
+	actor string // Recorded as the actor of every event
+	log   logger.Service
+}
+
+// NewService creates a journal service that records events in the journal in storeDir, as
+// actor. An empty storeDir disables recording.
+func NewService(storeDir string, actor string, log logger.Service) Service {
+	path := ""
+	if storeDir != "" {
+		path = filepath.Join(storeDir, JournalFile)
+	}
+	return &ServiceImpl{path: path, actor: actor, log: log}
+}
+
+// Record appends an event to the journal. Each event is a single write to a file opened with
+// O_APPEND, under an exclusive flock(2), so events of concurrent gitserve processes never
+// interleave.
+func (s *ServiceImpl) Record(instanceID string, eventType string, details map[string]string) {
+	if s.path == "" {
+		return
+	}
+	event := models.Event{
+		Time:       time.Now().UTC(),
+		InstanceID: instanceID,
+		Type:       eventType,
+		Actor:      s.actor,
+		Details:    details,
+	}
+	if err := s.append(event); err != nil {
+		s.log.Warning("Failed to record %s event of instance %s: %v", eventType, instanceID, err)
+	}
+}
+
+func (s *ServiceImpl) append(event models.Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+	line = append(line, '\n')
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0750); err != nil {
+		return fmt.Errorf("failed to create journal directory: %w", err)
+	}
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open journal %s: %w", s.path, err)
+	}
+	defer f.Close()
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock journal %s: %w", s.path, err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	if _, err := f.Write(line); err != nil {
+		return fmt.Errorf("failed to write journal %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// Query returns the matching events in the journal, oldest first.
+func (s *ServiceImpl) Query(filter Filter) ([]models.Event, error) {
+	events, _, err := s.readFrom(0, filter)
+	return events, err
+}
+
+// Follow polls the journal for events past the ones already handed to fn.
+func (s *ServiceImpl) Follow(filter Filter, fn func(event models.Event)) error {
+	var offset int64
+	for {
+		events, next, err := s.readFrom(offset, filter)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			fn(event)
+		}
+		offset = next
+		time.Sleep(followPollInterval)
+	}
+}
+
+// readFrom returns the matching events of the complete lines in the journal after offset, and
+// the offset to continue from. A line still being written is left for the next call. A missing
+// journal holds no events.
+func (s *ServiceImpl) readFrom(offset int64, filter Filter) ([]models.Event, int64, error) {
+	if s.path == "" {
+		return nil, offset, fmt.Errorf("no event journal available")
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, offset, nil
+		}
+		return nil, offset, fmt.Errorf("failed to open journal %s: %w", s.path, err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, fmt.Errorf("failed to read journal %s: %w", s.path, err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, offset, fmt.Errorf("failed to read journal %s: %w", s.path, err)
+	}
+	end := bytes.LastIndexByte(data, '\n') + 1
+	var events []models.Event
+	for _, line := range bytes.Split(data[:end], []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var event models.Event
+		if err := json.Unmarshal(line, &event); err != nil {
+			s.log.Warning("Skipping unreadable journal entry: %v", err)
+			continue
+		}
+		if filter.Matches(event) {
+			events = append(events, event)
+		}
+	}
+	return events, offset + int64(end), nil
+}
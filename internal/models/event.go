@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// Event is one state transition of an instance, as recorded in the event journal.
+type Event struct {
+	Time       time.Time         `json:"time"`
+	InstanceID string            `json:"instanceId"` // "<instance ID>/<process>" for processes
+	Type       string            `json:"type"`       // One of the Event* values
+	Actor      string            `json:"actor"`      // Who caused it, e.g. "alice (gitserve stop)" or "supervisor"
+	Details    map[string]string `json:"details,omitempty"`
+}
+
+// Types of journal events.
+const (
+	EventCreated       = "created"        // The instance and its workspace were created
+	EventCloned        = "cloned"         // The source was checked out into the workspace
+	EventSetupStarted  = "setup_started"  // post_checkout hooks and pre_command steps are running
+	EventSetupFinished = "setup_finished" // Setup is done, successfully or not (details: result)
+	EventStarted       = "started"        // The command was started (details: pid)
+	EventReady         = "ready"          // The command is up and its post_start hooks passed
+	EventSignalSent    = "signal_sent"    // A signal or stop command was sent (details: signal or command)
+	EventExited        = "exited"         // The command ended (details: status, exit code or signal)
+	EventPruned        = "pruned"         // The finished instance was pruned along with its workspace
+	EventRemoved       = "removed"        // The instance was removed, or its workspace cleaned up
+)
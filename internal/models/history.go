@@ -0,0 +1,46 @@
+package models
+
+import "time"
+
+// RunRecord is one run in the run history: what was run, from which commit, and how it ended.
+// Every run is recorded, also foreground runs, which never get an instance record. A run has
+// the ID of the instance it created; while that instance is in the store, the run follows its
+// status.
+type RunRecord struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name,omitempty"` // Name of the instance, see Instance.Name
+	Source  GitSource `json:"source"`
+	Project string    `json:"project,omitempty"`
+	Ref     string    `json:"ref"`
+	SHA     string    `json:"sha,omitempty"` // Commit that was checked out
+
+	// The run definition, as far as it doesn't come from the config: Command is the command
+	// that was run (empty for multi-process runs, whose processes come from the config).
+	NamedCommand  string            `json:"namedCommand,omitempty"`
+	Command       string            `json:"command,omitempty"`
+	RequestedPort int               `json:"requestedPort,omitempty"`
+	Detached      bool              `json:"detached,omitempty"`
+	TTY           bool              `json:"tty,omitempty"`
+	Sandbox       SandboxOptions    `json:"sandbox,omitzero"`
+	GracePeriod   time.Duration     `json:"gracePeriod,omitempty"`
+	KeepOnFailure bool              `json:"keepOnFailure,omitempty"`
+	RerunOf       string            `json:"rerunOf,omitempty"` // The run this one replayed, if any
+	Labels        map[string]string `json:"labels,omitempty"`
+
+	Status        string    `json:"status"`
+	StartTime     time.Time `json:"startTime"`
+	EndTime       time.Time `json:"endTime,omitempty"` // Zero while the run is going on
+	ExitCode      int       `json:"exitCode,omitempty"`
+	ExitSignal    string    `json:"exitSignal,omitempty"`
+	Error         string    `json:"error,omitempty"` // Why the run failed before its command ended
+	Workspace     string    `json:"workspace"`
+	WorkspaceKept bool      `json:"workspaceKept,omitempty"` // The workspace is still there
+}
+
+// Duration returns how long the run took, or has been going on for.
+func (r RunRecord) Duration() time.Duration {
+	if r.EndTime.IsZero() {
+		return time.Since(r.StartTime)
+	}
+	return r.EndTime.Sub(r.StartTime)
+}
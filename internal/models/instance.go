@@ -0,0 +1,93 @@
+package models
+
+import "time"
+
+// Instance is a gitserve instance as recorded in the instance store. Besides its state it
+// holds the complete run definition, so the instance can be restarted, inspected or run
+// again from the store alone, by any gitserve process.
+type Instance struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"` // Unique name like "main-brave-otter", "<instance name>/<process>" for processes
+	PID        int       `json:"pid"`
+	Port       int       `json:"port"` // Port assigned to the instance, 0 if none
+	Path       string    `json:"path"` // Workspace the source is checked out in
+	Status     string    `json:"status"`
+	StartTime  time.Time `json:"startTime"`
+	StopTime   time.Time `json:"stopTime,omitempty"`   // Time the instance was stopped or entered a terminal state
+	PausedTime time.Time `json:"pausedTime,omitempty"` // Time the instance was paused, zero unless status is 'paused'
+	LogPath    string    `json:"logPath"`
+	ErrLogPath string    `json:"errLogPath,omitempty"`
+
+	// What was run: the source as resolved from the command line, the ref it is named after
+	// (branch, tag, short commit hash or pr-<number>), the named command from the config, if
+	// any, and the port asked for with -p.
+	Source        GitSource `json:"source,omitzero"`
+	Project       string    `json:"project,omitempty"` // Name of the repository, see GitSource.ProjectName
+	Ref           string    `json:"ref,omitempty"`
+	NamedCommand  string    `json:"namedCommand,omitempty"`
+	RequestedPort int       `json:"requestedPort,omitempty"`
+	Detached      bool      `json:"detached,omitempty"`
+	// Labels given with --label, and those gitserve adds (see LabelProject and the others).
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Command the instance runs (via sh -c) and whether it runs under a PTY.
+	Command string `json:"command,omitempty"`
+	TTY     bool   `json:"tty,omitempty"`
+
+	// Multi-process instances have a parent record listing its Processes and one record per
+	// process with the ID "<parent ID>/<process>", which points back through Parent.
+	Processes []string `json:"processes,omitempty"`
+	Parent    string   `json:"parent,omitempty"`
+	Process   string   `json:"process,omitempty"`
+
+	// Environment the instance was started with (on top of gitserve's own environment),
+	// including PORT when a port was assigned.
+	Env map[string]string `json:"env,omitempty"`
+
+	// Set by the supervisor shim that owns the process.
+	ShimPID    int    `json:"shimPid,omitempty"`
+	ExitCode   int    `json:"exitCode,omitempty"`
+	ExitSignal string `json:"exitSignal,omitempty"` // e.g. "SIGKILL" if the process was killed by a signal
+	// Start times of PID and ShimPID (clock ticks since boot) and the boot they belong to, so a
+	// PID that was reused by an unrelated process is never probed or signaled as ours.
+	ProcessStartTime uint64 `json:"processStartTime,omitempty"`
+	ShimStartTime    uint64 `json:"shimStartTime,omitempty"`
+	BootID           string `json:"bootId,omitempty"`
+	// Resource limit the process most likely ran into when it ended, e.g. "RLIMIT_AS".
+	LimitViolation string `json:"limitViolation,omitempty"`
+	// Unix socket `gitserve attach` connects to, for instances started with a TTY.
+	AttachSocket string `json:"attachSocket,omitempty"`
+
+	// Restart policy of a detached instance, and the bookkeeping the supervisor shim keeps.
+	Restart         RestartPolicy `json:"restart,omitzero"`
+	Restarts        int           `json:"restarts,omitempty"`
+	LastRestartTime time.Time     `json:"lastRestartTime,omitempty"`
+	CrashLog        []string      `json:"crashLog,omitempty"` // Last log lines, saved when the instance enters crash_loop
+
+	// Resource limits the process is started with, resolved from the config at start time.
+	Limits ResourceLimits `json:"limits,omitzero"`
+
+	// Namespace sandbox the instance runs in, if any.
+	Sandbox SandboxOptions `json:"sandbox,omitzero"`
+
+	// Lifecycle hooks, resolved from the config at start time. Only set on the record of an
+	// instance, not on those of its processes.
+	Hooks Hooks `json:"hooks,omitzero"`
+
+	// Foreground only: time between forwarding Ctrl+C and force killing.
+	GracePeriod time.Duration `json:"gracePeriod,omitempty"`
+
+	// How the instance should be stopped, resolved from the config at start time.
+	StopSignal  string `json:"stopSignal,omitempty"`
+	StopCommand string `json:"stopCommand,omitempty"`
+}
+
+// IsTerminalStatus reports whether an instance with this status has ended for good: its
+// command is no longer running and nothing will start it again on its own.
+func IsTerminalStatus(status string) bool {
+	switch status {
+	case "stopped", "killed", "exited", "exited_unexpectedly", "failed", "exited_or_not_found", "error_pid_zero", "crash_loop", "removed":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Labels gitserve adds to every instance; they can't be set with --label.
+const (
+	LabelProject = "project"  // Name of the repository, see GitSource.ProjectName
+	LabelRef     = "ref"      // The ref the instance is named after, see Instance.Ref
+	LabelRefType = "ref-type" // branch, tag, commit or pr
+	LabelCommand = "command"  // The named command from the config, only set if one was run
+)
+
+// IsReservedLabel reports whether key is one of the labels gitserve sets itself.
+func IsReservedLabel(key string) bool {
+	switch key {
+	case LabelProject, LabelRef, LabelRefType, LabelCommand:
+		return true
+	}
+	return false
+}
+
+// RefTypeLabel returns the value of the ref-type label for a source type.
+func RefTypeLabel(sourceType GitSourceType) string {
+	switch sourceType {
+	case BranchSource:
+		return "branch"
+	case TagSource:
+		return "tag"
+	case CommitSource:
+		return "commit"
+	case PRSource:
+		return "pr"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	// labelKeyPattern and labelValuePattern are what label keys and values may look like.
+	// Values may contain a slash, so refs like "feature/login" can be label values.
+	labelKeyPattern   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	labelValuePattern = regexp.MustCompile(`^[A-Za-z0-9._/-]*$`)
+)
+
+// ValidateLabel checks that key=value can be used as a label.
+func ValidateLabel(key string, value string) error {
+	if !labelKeyPattern.MatchString(key) {
+		return fmt.Errorf("invalid label key '%s' (use letters, digits, '.', '_' and '-', starting with a letter or digit)", key)
+	}
+	if !labelValuePattern.MatchString(value) {
+		return fmt.Errorf("invalid value '%s' for label '%s' (use letters, digits, '.', '_', '-' and '/')", value, key)
+	}
+	return nil
+}
+
+// Operators of a label requirement.
+const (
+	SelectorEquals    = "="
+	SelectorNotEquals = "!="
+	SelectorExists    = "exists"  // "key": the label is set, to any value
+	SelectorNotExists = "!exists" // "!key": the label isn't set
+)
+
+// LabelRequirement is one comma-separated term of a selector.
+type LabelRequirement struct {
+	Key      string
+	Operator string
+	Value    string // Unused for SelectorExists and SelectorNotExists
+}
+
+// Matches reports whether labels satisfy the requirement. "key!=value" also matches when
+// the label isn't set at all.
+func (r LabelRequirement) Matches(labels map[string]string) bool {
+	value, ok := labels[r.Key]
+	switch r.Operator {
+	case SelectorEquals:
+		return ok && value == r.Value
+	case SelectorNotEquals:
+		return !ok || value != r.Value
+	case SelectorExists:
+		return ok
+	case SelectorNotExists:
+		return !ok
+	}
+	return false
+}
+
+func (r LabelRequirement) String() string {
+	switch r.Operator {
+	case SelectorExists:
+		return r.Key
+	case SelectorNotExists:
+		return "!" + r.Key
+	}
+	return r.Key + r.Operator + r.Value
+}
+
+// Selector selects instances by their labels: all of its requirements must match. The zero
+// Selector matches everything.
+type Selector []LabelRequirement
+
+// ParseSelector parses a selector expression like "team=web,ref!=main": comma-separated
+// requirements of the form key=value (or key==value), key!=value, key (the label is set)
+// and !key (the label isn't set). An empty expression selects everything.
+func ParseSelector(expression string) (Selector, error) {
+	if strings.TrimSpace(expression) == "" {
+		return nil, nil
+	}
+	var selector Selector
+	for _, term := range strings.Split(expression, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			return nil, fmt.Errorf("invalid selector '%s': empty requirement", expression)
+		}
+		var requirement LabelRequirement
+		switch {
+		case strings.Contains(term, "!="):
+			key, value, _ := strings.Cut(term, "!=")
+			requirement = LabelRequirement{Key: strings.TrimSpace(key), Operator: SelectorNotEquals, Value: strings.TrimSpace(value)}
+		case strings.Contains(term, "="):
+			key, value, _ := strings.Cut(term, "=")
+			value = strings.TrimPrefix(value, "=")
+			requirement = LabelRequirement{Key: strings.TrimSpace(key), Operator: SelectorEquals, Value: strings.TrimSpace(value)}
+		case strings.HasPrefix(term, "!"):
+			requirement = LabelRequirement{Key: strings.TrimSpace(term[1:]), Operator: SelectorNotExists}
+		default:
+			requirement = LabelRequirement{Key: term, Operator: SelectorExists}
+		}
+		if err := ValidateLabel(requirement.Key, requirement.Value); err != nil {
+			return nil, fmt.Errorf("invalid selector '%s': %w", expression, err)
+		}
+		selector = append(selector, requirement)
+	}
+	return selector, nil
+}
+
+// Matches reports whether labels satisfy every requirement of the selector.
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, requirement := range s {
+		if !requirement.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Selector) String() string {
+	terms := make([]string, len(s))
+	for i, requirement := range s {
+		terms[i] = requirement.String()
+	}
+	return strings.Join(terms, ",")
+}
@@ -0,0 +1,160 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		want       Selector
+		wantErr    bool
+	}{
+		{name: "empty selects everything", expression: "", want: nil},
+		{name: "blank selects everything", expression: "  ", want: nil},
+		{
+			name:       "equals",
+			expression: "team=web",
+			want:       Selector{{Key: "team", Operator: SelectorEquals, Value: "web"}},
+		},
+		{
+			name:       "double equals",
+			expression: "team==web",
+			want:       Selector{{Key: "team", Operator: SelectorEquals, Value: "web"}},
+		},
+		{
+			name:       "not equals",
+			expression: "ref!=main",
+			want:       Selector{{Key: "ref", Operator: SelectorNotEquals, Value: "main"}},
+		},
+		{
+			name:       "exists and not exists",
+			expression: "team,!command",
+			want: Selector{
+				{Key: "team", Operator: SelectorExists},
+				{Key: "command", Operator: SelectorNotExists},
+			},
+		},
+		{
+			name:       "several requirements with spaces",
+			expression: "team=web, ref!=main ,ref-type=branch",
+			want: Selector{
+				{Key: "team", Operator: SelectorEquals, Value: "web"},
+				{Key: "ref", Operator: SelectorNotEquals, Value: "main"},
+				{Key: "ref-type", Operator: SelectorEquals, Value: "branch"},
+			},
+		},
+		{
+			name:       "value with a slash",
+			expression: "ref=feature/login",
+			want:       Selector{{Key: "ref", Operator: SelectorEquals, Value: "feature/login"}},
+		},
+		{
+			name:       "empty value",
+			expression: "team=",
+			want:       Selector{{Key: "team", Operator: SelectorEquals, Value: ""}},
+		},
+		{name: "trailing comma", expression: "team=web,", wantErr: true},
+		{name: "missing key", expression: "=web", wantErr: true},
+		{name: "missing key after bang", expression: "!", wantErr: true},
+		{name: "invalid key", expression: "te am=web", wantErr: true},
+		{name: "invalid value", expression: "team=we b", wantErr: true},
+		{name: "key starting with a dash", expression: "-team=web", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSelector(tt.expression)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseSelector(%q) = %v, want an error", tt.expression, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseSelector(%q) returned error: %v", tt.expression, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseSelector(%q) = %#v, want %#v", tt.expression, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	labels := map[string]string{"team": "web", "ref": "main", "ref-type": "branch"}
+	tests := []struct {
+		expression string
+		want       bool
+	}{
+		{"", true},
+		{"team=web", true},
+		{"team=api", false},
+		{"team!=api", true},
+		{"team!=web", false},
+		{"owner!=alice", true}, // Also matches without the label
+		{"team", true},
+		{"owner", false},
+		{"!owner", true},
+		{"!team", false},
+		{"team=web,ref!=main", false},
+		{"team=web,ref=main,ref-type=branch", true},
+	}
+	for _, tt := range tests {
+		selector, err := ParseSelector(tt.expression)
+		if err != nil {
+			t.Fatalf("ParseSelector(%q) returned error: %v", tt.expression, err)
+		}
+		if got := selector.Matches(labels); got != tt.want {
+			t.Errorf("%q matches %v = %v, want %v", tt.expression, labels, got, tt.want)
+		}
+	}
+}
+
+func TestSelectorString(t *testing.T) {
+	for _, expression := range []string{"team=web", "ref!=main", "team", "!team", "team=web,ref!=main,!command"} {
+		selector, err := ParseSelector(expression)
+		if err != nil {
+			t.Fatalf("ParseSelector(%q) returned error: %v", expression, err)
+		}
+		if got := selector.String(); got != expression {
+			t.Errorf("ParseSelector(%q).String() = %q", expression, got)
+		}
+	}
+}
+
+func TestValidateLabel(t *testing.T) {
+	tests := []struct {
+		key     string
+		value   string
+		wantErr bool
+	}{
+		{"team", "web", false},
+		{"app.kubernetes_io-name", "v1.2_3", false},
+		{"ref", "feature/login", false},
+		{"team", "", false},
+		{"", "web", true},
+		{"-team", "web", true},
+		{"team/sub", "web", true},
+		{"team", "we b", true},
+		{"team", "web=1", true},
+	}
+	for _, tt := range tests {
+		err := ValidateLabel(tt.key, tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ValidateLabel(%q, %q) = %v, want error: %v", tt.key, tt.value, err, tt.wantErr)
+		}
+	}
+}
+
+func TestIsReservedLabel(t *testing.T) {
+	for _, key := range []string{LabelProject, LabelRef, LabelRefType, LabelCommand} {
+		if !IsReservedLabel(key) {
+			t.Errorf("IsReservedLabel(%q) = false, want true", key)
+		}
+	}
+	if IsReservedLabel("team") {
+		t.Errorf("IsReservedLabel(%q) = true, want false", "team")
+	}
+}
@@ -0,0 +1,55 @@
+package models
+
+import "time"
+
+// DefaultMaxAgeKey is the key of PrunePolicy.MaxAge that applies to statuses without an age
+// of their own.
+const DefaultMaxAgeKey = "default"
+
+// PrunePolicy decides which stopped instances 'gitserve prune' removes.
+type PrunePolicy struct {
+	// How long an instance is kept after it stopped, by terminal status, with
+	// DefaultMaxAgeKey for the other statuses.
+	MaxAge map[string]time.Duration
+	// The most recently stopped KeepLast instances of each ref are kept whatever their age.
+	KeepLast int
+	// Failed instances are kept at least this long, so there is time to look into them.
+	KeepFailed time.Duration
+}
+
+// WithDefaults fills in unset fields with sensible defaults.
+func (p PrunePolicy) WithDefaults() PrunePolicy {
+	maxAge := map[string]time.Duration{DefaultMaxAgeKey: 24 * time.Hour}
+	for status, age := range p.MaxAge {
+		maxAge[status] = age
+	}
+	p.MaxAge = maxAge
+	if p.KeepFailed == 0 {
+		p.KeepFailed = 72 * time.Hour
+	}
+	return p
+}
+
+// KeepFor returns how long an instance that ended with status and exitCode is kept.
+func (p PrunePolicy) KeepFor(status string, exitCode int) time.Duration {
+	age, ok := p.MaxAge[status]
+	if !ok {
+		age = p.MaxAge[DefaultMaxAgeKey]
+	}
+	if IsFailure(status, exitCode) && p.KeepFailed > age {
+		age = p.KeepFailed
+	}
+	return age
+}
+
+// IsFailure reports whether an instance that ended with status and exitCode failed, as
+// opposed to being stopped or finishing successfully.
+func IsFailure(status string, exitCode int) bool {
+	switch status {
+	case "failed", "crash_loop", "exited_unexpectedly", "error_pid_zero":
+		return true
+	case "exited":
+		return exitCode != 0
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrunePolicyKeepFor(t *testing.T) {
+	policy := PrunePolicy{
+		MaxAge: map[string]time.Duration{
+			DefaultMaxAgeKey: 24 * time.Hour,
+			"stopped":        2 * time.Hour,
+			"crash_loop":     200 * time.Hour,
+		},
+		KeepFailed: 72 * time.Hour,
+	}
+	tests := []struct {
+		status   string
+		exitCode int
+		want     time.Duration
+	}{
+		{"stopped", 0, 2 * time.Hour},
+		{"killed", 0, 24 * time.Hour},
+		{"exited", 0, 24 * time.Hour},
+		{"exited", 1, 72 * time.Hour},              // Failed: kept at least KeepFailed
+		{"failed", 0, 72 * time.Hour},              // Failed whatever the exit code
+		{"exited_unexpectedly", 0, 72 * time.Hour}, // Also a failure
+		{"crash_loop", 0, 200 * time.Hour},         // Its own age is longer than KeepFailed
+	}
+	for _, tt := range tests {
+		if got := policy.KeepFor(tt.status, tt.exitCode); got != tt.want {
+			t.Errorf("KeepFor(%q, %d) = %s, want %s", tt.status, tt.exitCode, got, tt.want)
+		}
+	}
+}
+
+func TestPrunePolicyWithDefaults(t *testing.T) {
+	policy := PrunePolicy{MaxAge: map[string]time.Duration{"stopped": time.Hour}}.WithDefaults()
+	if got := policy.MaxAge[DefaultMaxAgeKey]; got != 24*time.Hour {
+		t.Errorf("default max age = %s, want 24h", got)
+	}
+	if got := policy.MaxAge["stopped"]; got != time.Hour {
+		t.Errorf("max age of stopped = %s, want 1h", got)
+	}
+	if policy.KeepFailed != 72*time.Hour {
+		t.Errorf("KeepFailed = %s, want 72h", policy.KeepFailed)
+	}
+
+	custom := PrunePolicy{MaxAge: map[string]time.Duration{DefaultMaxAgeKey: time.Hour}, KeepFailed: time.Minute}.WithDefaults()
+	if custom.MaxAge[DefaultMaxAgeKey] != time.Hour || custom.KeepFailed != time.Minute {
+		t.Errorf("WithDefaults overrode set fields: %+v", custom)
+	}
+}
+
+func TestIsFailure(t *testing.T) {
+	tests := []struct {
+		status   string
+		exitCode int
+		want     bool
+	}{
+		{"exited", 0, false},
+		{"exited", 2, true},
+		{"stopped", 0, false},
+		{"killed", 0, false},
+		{"failed", 0, true},
+		{"crash_loop", 0, true},
+		{"exited_unexpectedly", 0, true},
+		{"error_pid_zero", 0, true},
+		{"exited_or_not_found", 0, false},
+	}
+	for _, tt := range tests {
+		if got := IsFailure(tt.status, tt.exitCode); got != tt.want {
+			t.Errorf("IsFailure(%q, %d) = %v, want %v", tt.status, tt.exitCode, got, tt.want)
+		}
+	}
+}
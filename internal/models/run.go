@@ -1,23 +1,196 @@
 package models
 
+import "time"
+
 // RunRequest represents the parameters for running a Git branch
 type RunRequest struct {
-	Source   GitSource
-	Detached bool
-	Command  string // Command to run
-}
+	Source       GitSource
+	Detached     bool
+	Command      string // Command to run
+	NamedCommand string // Named command from the config file, used when Command is empty
+	Port         int    // Requested port (-p); 0 means use the configured default, if any
+	TTY          bool   // Detached runs only: run under a PTY that `gitserve attach` can connect to
+	Sandbox      SandboxOptions
+
+	// Foreground runs only
+	KeepOnFailure bool          // Keep the workspace if the command fails
+	GracePeriod   time.Duration // Time between forwarding Ctrl+C and force killing
+
+	// Interactive opens a shell in the workspace after pre_command, before the command runs.
+	Interactive bool
+	// AfterShell is called once the interactive shell exits and returns what to do next,
+	// one of the AfterShell* values. A nil func means AfterShellRemove.
+	AfterShell func() string
+
+	// RerunOf is the ID of the run in the history this run replays, if any.
+	RerunOf string
 
-// Instance represents a running instance of a Git branch
-type Instance struct {
-	ID          string
-	BranchName  string
-	WorkspaceID string
-	Path        string // Filesystem path of the cloned repository in the workspace
-	ProcessID   int
-	Port        int
-	Status      string
-	Command     string
+	// InstanceName names the instance (--instance-name); empty to generate a name.
+	InstanceName string
+
+	// Labels to attach to the instance (--label), on top of the ones gitserve adds.
+	Labels map[string]string
 }
 
+// What an interactive run (-i) does once the user leaves the shell.
+const (
+	AfterShellRun    = "run"    // Run the command as requested (foreground or detached)
+	AfterShellKeep   = "keep"   // Keep the workspace as an idle instance, without running anything
+	AfterShellRemove = "remove" // Clean up the workspace
+)
+
 type RunOptions struct {
 }
+
+// Restart policies for detached instances.
+const (
+	RestartNo        = "no"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// RestartPolicy tells the supervisor of a detached instance whether and how to restart it.
+type RestartPolicy struct {
+	Policy          string        `json:"policy,omitempty"`          // no | on-failure | always
+	MaxRetries      int           `json:"maxRetries,omitempty"`      // Restarts allowed within CrashLoopWindow
+	Backoff         time.Duration `json:"backoff,omitempty"`         // Initial delay, doubled on each consecutive restart
+	MaxBackoff      time.Duration `json:"maxBackoff,omitempty"`      // Upper bound for the delay
+	CrashLoopWindow time.Duration `json:"crashLoopWindow,omitempty"` // Window in which restarts count towards MaxRetries
+}
+
+// WithDefaults fills in unset fields with sensible defaults.
+func (p RestartPolicy) WithDefaults() RestartPolicy {
+	if p.Policy == "" {
+		p.Policy = RestartNo
+	}
+	if p.MaxRetries <= 0 {
+		p.MaxRetries = 5
+	}
+	if p.Backoff <= 0 {
+		p.Backoff = time.Second
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = 30 * time.Second
+	}
+	if p.CrashLoopWindow <= 0 {
+		p.CrashLoopWindow = time.Minute
+	}
+	return p
+}
+
+// ShouldRestart reports whether a process that ended with the given exit code/signal
+// should be restarted under this policy.
+func (p RestartPolicy) ShouldRestart(exitCode int, exitSignal string) bool {
+	switch p.Policy {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return exitCode != 0 || exitSignal != ""
+	default:
+		return false
+	}
+}
+
+// BackoffFor returns the delay before the n-th consecutive restart (n starting at 0).
+func (p RestartPolicy) BackoffFor(n int) time.Duration {
+	delay := p.Backoff
+	for i := 0; i < n && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay
+}
+
+// I/O scheduling classes for ResourceLimits.IOClass, as used by ionice(1).
+const (
+	IOClassRealtime   = "realtime"
+	IOClassBestEffort = "best-effort"
+	IOClassIdle       = "idle"
+)
+
+// ResourceLimits are applied to an instance's process when it starts, and are inherited by
+// everything it starts in turn. Zero values leave the corresponding setting untouched.
+type ResourceLimits struct {
+	AddressSpace uint64        `json:"addressSpace,omitempty"` // RLIMIT_AS, in bytes
+	CPUTime      time.Duration `json:"cpuTime,omitempty"`      // RLIMIT_CPU, rounded up to whole seconds
+	OpenFiles    uint64        `json:"openFiles,omitempty"`    // RLIMIT_NOFILE
+	MaxProcesses uint64        `json:"maxProcesses,omitempty"` // RLIMIT_NPROC; counts all processes of the user
+	Nice         int           `json:"nice,omitempty"`         // Niceness of the process group
+	IOClass      string        `json:"ioClass,omitempty"`      // realtime | best-effort | idle
+	IOLevel      int           `json:"ioLevel,omitempty"`      // 0 (highest) to 7, for realtime and best-effort
+}
+
+// IsZero reports whether no limit is set.
+func (l ResourceLimits) IsZero() bool {
+	return l == ResourceLimits{}
+}
+
+// Networks a sandboxed instance can get.
+const (
+	SandboxNetworkLoopback = "loopback" // Only a loopback interface; the instance port is forwarded in
+	SandboxNetworkHost     = "host"     // The host's network
+)
+
+// SandboxOptions describe the namespace sandbox an instance runs in (`gitserve run --sandbox`):
+// a private /tmp, a read-only home directory apart from the workspace and, by default, no
+// network but loopback.
+type SandboxOptions struct {
+	Enabled bool   `json:"enabled,omitempty"`
+	Network string `json:"network,omitempty"` // loopback (the default) or host
+}
+
+// Phases of an instance's lifetime that hooks can run at.
+const (
+	HookPreClone     = "pre_clone"     // Before the source is checked out into the (empty) workspace
+	HookPostCheckout = "post_checkout" // After checkout, before pre_command
+	HookPostStart    = "post_start"    // Once the command has started
+	HookPreStop      = "pre_stop"      // Before gitserve stops the instance
+	HookPostStop     = "post_stop"     // After the instance has stopped
+)
+
+// What a failing hook does.
+const (
+	HookFail = "fail" // Fail the run, stop or remove
+	HookWarn = "warn" // Report the failure and carry on
+)
+
+// Hook is a command run at one phase of an instance's lifetime.
+type Hook struct {
+	Name      string        `json:"name"`
+	Command   string        `json:"command"`
+	Timeout   time.Duration `json:"timeout,omitempty"`
+	OnFailure string        `json:"onFailure,omitempty"` // fail | warn
+}
+
+// Hooks are an instance's lifecycle hooks by phase, each run in order.
+type Hooks struct {
+	PreClone     []Hook `json:"preClone,omitempty"`
+	PostCheckout []Hook `json:"postCheckout,omitempty"`
+	PostStart    []Hook `json:"postStart,omitempty"`
+	PreStop      []Hook `json:"preStop,omitempty"`
+	PostStop     []Hook `json:"postStop,omitempty"`
+}
+
+// For returns the hooks of a phase.
+func (h Hooks) For(phase string) []Hook {
+	switch phase {
+	case HookPreClone:
+		return h.PreClone
+	case HookPostCheckout:
+		return h.PostCheckout
+	case HookPostStart:
+		return h.PostStart
+	case HookPreStop:
+		return h.PreStop
+	case HookPostStop:
+		return h.PostStop
+	}
+	return nil
+}
+
+// IsZero reports whether no hook is set.
+func (h Hooks) IsZero() bool {
+	return len(h.PreClone)+len(h.PostCheckout)+len(h.PostStart)+len(h.PreStop)+len(h.PostStop) == 0
+}
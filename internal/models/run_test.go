@@ -0,0 +1,66 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestartPolicyShouldRestart(t *testing.T) {
+	tests := []struct {
+		policy     string
+		exitCode   int
+		exitSignal string
+		want       bool
+	}{
+		{RestartNo, 1, "", false},
+		{"", 1, "SIGKILL", false}, // No policy means no restarts
+		{RestartOnFailure, 0, "", false},
+		{RestartOnFailure, 1, "", true},
+		{RestartOnFailure, 0, "SIGSEGV", true},
+		{RestartAlways, 0, "", true},
+		{RestartAlways, 2, "", true},
+	}
+	for _, tt := range tests {
+		policy := RestartPolicy{Policy: tt.policy}
+		if got := policy.ShouldRestart(tt.exitCode, tt.exitSignal); got != tt.want {
+			t.Errorf("%q.ShouldRestart(%d, %q) = %v, want %v", tt.policy, tt.exitCode, tt.exitSignal, got, tt.want)
+		}
+	}
+}
+
+func TestRestartPolicyBackoffFor(t *testing.T) {
+	policy := RestartPolicy{Backoff: time.Second, MaxBackoff: 10 * time.Second}
+	tests := []struct {
+		n    int
+		want time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{3, 8 * time.Second},
+		{4, 10 * time.Second}, // Capped at MaxBackoff
+		{100, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := policy.BackoffFor(tt.n); got != tt.want {
+			t.Errorf("BackoffFor(%d) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+
+	capped := RestartPolicy{Backoff: time.Minute, MaxBackoff: 30 * time.Second}
+	if got := capped.BackoffFor(0); got != 30*time.Second {
+		t.Errorf("BackoffFor(0) with an initial delay above the maximum = %s, want 30s", got)
+	}
+}
+
+func TestRestartPolicyWithDefaults(t *testing.T) {
+	got := RestartPolicy{}.WithDefaults()
+	want := RestartPolicy{Policy: RestartNo, MaxRetries: 5, Backoff: time.Second, MaxBackoff: 30 * time.Second, CrashLoopWindow: time.Minute}
+	if got != want {
+		t.Errorf("WithDefaults() = %+v, want %+v", got, want)
+	}
+	set := RestartPolicy{Policy: RestartAlways, MaxRetries: 2, Backoff: 3 * time.Second, MaxBackoff: time.Minute, CrashLoopWindow: time.Hour}
+	if got := set.WithDefaults(); got != set {
+		t.Errorf("WithDefaults() = %+v, want the set fields kept: %+v", got, set)
+	}
+}
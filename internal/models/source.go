@@ -1,5 +1,10 @@
 package models
 
+import (
+	"fmt"
+	"strings"
+)
+
 // GitSourceType defines the type of the Git source.
 // Using iota for enum-like behavior, though direct string constants might also work well.
 type GitSourceType int
@@ -30,6 +35,23 @@ func (gst GitSourceType) String() string {
 	}
 }
 
+// MarshalText stores a source type by name, so stored instances don't depend on the order of
+// the constants above.
+func (gst GitSourceType) MarshalText() ([]byte, error) {
+	return []byte(gst.String()), nil
+}
+
+// UnmarshalText parses a source type stored by MarshalText.
+func (gst *GitSourceType) UnmarshalText(text []byte) error {
+	for _, candidate := range []GitSourceType{UndefinedSource, BranchSource, CommitSource, TagSource, PRSource} {
+		if candidate.String() == string(text) {
+			*gst = candidate
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown git source type '%s'", text)
+}
+
 // PRProviderType identifies the Git hosting provider for a Pull Request.
 type PRProviderType int
 
@@ -59,29 +81,39 @@ func (ppt PRProviderType) String() string {
 // GitSource specifies the details of the Git entity to be checked out.
 // This structure will be populated based on CLI arguments.
 type GitSource struct {
-	Type GitSourceType
+	Type GitSourceType `json:"type"`
 
 	// RepoPath specifies the primary repository URL or local path to clone from.
 	// For PRs, this would be the base repository URL.
-	RepoPath string
+	RepoPath string `json:"repoPath,omitempty"`
 
 	// RefName is the primary reference: branch name, tag name.
 	// For commits, CommitHash is used directly.
 	// For PRs, this might be the target branch of the PR or the head branch name fetched locally.
-	RefName string
+	RefName string `json:"refName,omitempty"`
 
-	CommitHash string // Specific commit SHA to checkout.
-	PRNumber   int    // Pull Request number (e.g., for GitHub).
-	RemoteName string // Optional: name of the remote (e.g., "origin", "upstream"). Defaults to "origin".
+	CommitHash string `json:"commitHash,omitempty"` // Specific commit SHA to checkout.
+	PRNumber   int    `json:"prNumber,omitempty"`   // Pull Request number (e.g., for GitHub).
+	RemoteName string `json:"remoteName,omitempty"` // Optional: name of the remote (e.g., "origin", "upstream"). Defaults to "origin".
 
 	// PRProvider indicates the source control provider for PRSource type.
-	PRProvider PRProviderType
+	PRProvider PRProviderType `json:"prProvider,omitempty"`
 
 	// For PRs, these might be populated after fetching PR details from an API:
-	PRApiUrl      string // Full URL to the PR (e.g. GitHub PR URL provided by user)
-	PRHeadRepoURL string // Clone URL of the repository containing the PR's head branch.
-	PRHeadBranch  string // Name of the head branch in the PR's source repository.
-	PRBaseRepoURL string // Clone URL of the repository the PR targets.
-	PRBaseBranch  string // Name of the base branch in the PR's target repository.
+	PRApiUrl      string `json:"prApiUrl,omitempty"`      // Full URL to the PR (e.g. GitHub PR URL provided by user)
+	PRHeadRepoURL string `json:"prHeadRepoUrl,omitempty"` // Clone URL of the repository containing the PR's head branch.
+	PRHeadBranch  string `json:"prHeadBranch,omitempty"`  // Name of the head branch in the PR's source repository.
+	PRBaseRepoURL string `json:"prBaseRepoUrl,omitempty"` // Clone URL of the repository the PR targets.
+	PRBaseBranch  string `json:"prBaseBranch,omitempty"`  // Name of the base branch in the PR's target repository.
 
 }
+
+// ProjectName returns the name of the repository the source is checked out from: the
+// directory name of a local repository or the last path element of a URL, without ".git".
+func (s GitSource) ProjectName() string {
+	repo := strings.TrimRight(s.RepoPath, "/")
+	if i := strings.LastIndexAny(repo, "/:"); i >= 0 {
+		repo = repo[i+1:]
+	}
+	return strings.TrimSuffix(repo, ".git")
+}
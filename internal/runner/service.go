@@ -1,55 +1,88 @@
 package runner
 
 import (
+	"errors"
 	"fmt"
+	"gitserve/internal/config"
 	// "gitserve/internal/git" // No longer directly using gitService.Clone or gitService.Checkout here
 	"gitserve/internal/git" // Ensuring git.Service is available for PrepareRepo
 	"gitserve/internal/instance"
+	"gitserve/internal/journal"
 	"gitserve/internal/logger" // Import logger
 	"gitserve/internal/models"
 	"gitserve/internal/storage"
 	"gitserve/internal/validation"
 	"gitserve/internal/workspace"
+	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 )
 
+// defaultStopTimeout bounds how long already started processes get to exit when a
+// multi-process instance fails to start.
+const defaultStopTimeout = 10 * time.Second
+
 // ServiceImpl implements the Runner service interface
 type ServiceImpl struct {
+	configService     config.Service
 	validationService validation.Service
 	gitService        git.Service
 	workspaceService  workspace.Service
 	instanceService   instance.Service
 	instanceStore     storage.InstanceStore
+	journal           journal.Service
 	log               logger.Service // Add logger to struct
 }
 
 // NewService creates a new Runner service
 func NewService(
+	configService config.Service,
 	validationService validation.Service,
 	gitService git.Service,
 	workspaceService workspace.Service,
 	instanceService instance.Service,
 	instanceStore storage.InstanceStore,
+	journal journal.Service,
 	log logger.Service, // Add logger to parameters
 ) Service {
 	return &ServiceImpl{
+		configService:     configService,
 		validationService: validationService,
 		gitService:        gitService,
 		workspaceService:  workspaceService,
 		instanceService:   instanceService,
 		instanceStore:     instanceStore,
+		journal:           journal,
 		log:               log, // Initialize logger
 	}
 }
 
-// Run sets up a Git source, executes the command, and manages instance state.
+// Run sets up a Git source, executes the command, and manages instance state. Every run is
+// recorded in the run history, however it ends.
 func (s *ServiceImpl) Run(request *models.RunRequest) (*models.Instance, error) {
+	instanceModel, err := s.run(request)
+	if instanceModel != nil {
+		s.settleRun(instanceModel, err)
+	}
+	return instanceModel, err
+}
+
+func (s *ServiceImpl) run(request *models.RunRequest) (*models.Instance, error) {
 	// Validate the request
 	if err := s.validationService.ValidateRunRequest(request); err != nil {
 		return nil, fmt.Errorf("validation error: %w", err)
 	}
 
+	// Resolve the command definition up front so config mistakes fail before we clone anything
+	resolvedCommand, err := s.configService.ResolveCommand(request.NamedCommand)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve command: %w", err)
+	}
+	if _, err := instance.ParseSignal(resolvedCommand.StopSignal); err != nil {
+		return nil, fmt.Errorf("invalid stop_signal in config: %w", err)
+	}
+
 	// Create a workspace
 	ws, err := s.workspaceService.Create()
 	if err != nil {
@@ -57,29 +90,10 @@ func (s *ServiceImpl) Run(request *models.RunRequest) (*models.Instance, error)
 	}
 	wsPath := s.workspaceService.GetPath(ws)
 
-	// --- Modified Git Setup ---
-	s.log.Info("Preparing repository in workspace: %s", wsPath)
-	if err := s.gitService.PrepareRepo(wsPath, request.Source); err != nil {
-		s.workspaceService.Cleanup(ws)
-		// Error already logged by gitService.PrepareRepo if it uses the logger
-		return nil, fmt.Errorf("failed to prepare repository from source (%s %s): %w",
-			request.Source.Type, request.Source.RefName, err)
-	}
-	s.log.Info("Repository prepared successfully.")
-	// --- End Modified Git Setup ---
-
-	// Determine the command to run (will use config later)
-	command := request.Command
-	if command == "" {
-		command = "npm run dev" // Placeholder
-	}
-
-	// Create an instance model
-	// The BranchName for models.Instance should reflect the primary reference being worked on.
+	// The ref the instance is named after:
 	// For branches and tags, this is request.Source.RefName.
-	// For commits, it could be request.Source.CommitHash (or a shortened version).
-	// For PRs, it could be the local PR branch name (e.g., "pr-123") that git.Service checks out.
-	// For now, let's use a general approach; instance.Service might need adjustment or a clear contract.
+	// For commits, it is the (shortened) commit hash.
+	// For PRs, it is the local PR branch name (e.g., "pr-123") that git.Service checks out.
 	var instanceRefName string
 	switch request.Source.Type {
 	case models.BranchSource, models.TagSource:
@@ -95,49 +109,619 @@ func (s *ServiceImpl) Run(request *models.RunRequest) (*models.Instance, error)
 		instanceRefName = "unknown-ref"
 	}
 
-	instanceModel, err := s.instanceService.Create(ws, instanceRefName, command)
+	// The instance exists before the checkout, so pre_clone hooks get its ID and environment.
+	// Its command is only known once the source (and a possible Procfile) is checked out.
+	instanceModel, err := s.instanceService.Create(ws, instanceRefName, "")
 	if err != nil {
 		s.workspaceService.Cleanup(ws)
 		return nil, fmt.Errorf("failed to create instance model: %w", err)
 	}
+	if instanceModel.Name, err = s.instanceName(request.InstanceName, instanceRefName); err != nil {
+		s.workspaceService.Cleanup(ws)
+		return nil, err
+	}
+	// Record the whole run definition, so the instance can be restarted or run again from
+	// the store alone.
+	instanceModel.Source = recordedSource(request.Source)
+	instanceModel.Project = instanceModel.Source.ProjectName()
+	instanceModel.NamedCommand = request.NamedCommand
+	instanceModel.Labels = instanceLabels(request, instanceModel.Project, instanceRefName)
+	instanceModel.RequestedPort = request.Port
+	instanceModel.Detached = request.Detached
+	instanceModel.GracePeriod = request.GracePeriod
+	instanceModel.Restart = resolvedCommand.Restart
+	instanceModel.Port = s.resolvePort(request, resolvedCommand, instanceRefName)
+	instanceModel.TTY = request.TTY
+	instanceModel.Limits = resolvedCommand.Limits
+	instanceModel.Sandbox = request.Sandbox
+	instanceModel.Hooks = resolvedCommand.Hooks
+	instanceModel.StopSignal = resolvedCommand.StopSignal
+	instanceModel.StopCommand = resolvedCommand.StopCommand
+	instanceModel.Env = resolvedCommand.Env
+	instanceModel.Env[instance.EnvInstanceID] = instanceModel.ID
+	instanceModel.Env[instance.EnvRef] = instanceRefName
+	instanceModel.Env[instance.EnvWorkspace] = instanceModel.Path
+	if instanceModel.Port > 0 {
+		instanceModel.Env[instance.EnvPort] = strconv.Itoa(instanceModel.Port)
+	}
+	s.journal.Record(instanceModel.ID, models.EventCreated, map[string]string{
+		"ref":       instanceRefName,
+		"project":   instanceModel.Project,
+		"workspace": wsPath,
+	})
+	s.recordRun(instanceModel, request)
+
+	// Hooks of detached instances write to the instance log, foreground ones to the terminal.
+	hookTarget := instance.HookTarget{Dir: wsPath, Env: instanceModel.Env}
+	if request.Detached {
+		hookTarget.LogPath = s.instanceService.LogPath(instanceModel.ID)
+	}
+	if err := instance.RunHooks(models.HookPreClone, resolvedCommand.Hooks.PreClone, hookTarget, s.log); err != nil {
+		s.discard(ws, instanceModel.ID, "pre_clone hook failed")
+		return instanceModel, err
+	}
+
+	// --- Modified Git Setup ---
+	s.log.Info("Preparing repository in workspace: %s", wsPath)
+	if err := s.gitService.PrepareRepo(wsPath, request.Source); err != nil {
+		s.discard(ws, instanceModel.ID, "checkout failed")
+		// Error already logged by gitService.PrepareRepo if it uses the logger
+		return instanceModel, fmt.Errorf("failed to prepare repository from source (%s %s): %w",
+			request.Source.Type, request.Source.RefName, err)
+	}
+	s.log.Info("Repository prepared successfully.")
+	sha, err := s.gitService.HeadCommit(wsPath)
+	if err != nil {
+		s.log.Warning("Not recording the commit of this run: %v", err)
+	}
+	s.journal.Record(instanceModel.ID, models.EventCloned, cloneDetails(instanceModel.Source))
+	// --- End Modified Git Setup ---
+
+	// Determine what to run: explicit -c, then the named/default command or processes from
+	// config, then a Procfile in the checked out repository
+	command := request.Command
+	var processes []config.ProcessDefinition
+	if command == "" {
+		command = resolvedCommand.RunCommand
+		processes = resolvedCommand.Processes
+	}
+	if command == "" && len(processes) == 0 {
+		if processes, err = s.configService.ProcfileProcesses(wsPath); err != nil {
+			s.discard(ws, instanceModel.ID, "invalid Procfile")
+			return instanceModel, err
+		}
+		if len(processes) > 0 {
+			s.log.Info("Using the %d process(es) from the Procfile.", len(processes))
+		}
+	}
+	if command == "" && len(processes) == 0 {
+		command = "npm run dev" // Placeholder when nothing is configured
+	}
+	if len(processes) > 0 && !request.Detached {
+		s.discard(ws, instanceModel.ID, "multi-process instances can only run detached")
+		return instanceModel, fmt.Errorf("multi-process instances (%d processes) can only run detached; add -d, or pick one with -c", len(processes))
+	}
+	instanceModel.Command = command
+	s.modifyRun(instanceModel.ID, func(run *models.RunRecord) {
+		run.SHA = sha
+		run.Command = command
+	})
+
+	s.journal.Record(instanceModel.ID, models.EventSetupStarted, map[string]string{"pre_command": strconv.Itoa(len(resolvedCommand.PreCommand))})
+	if err := instance.RunHooks(models.HookPostCheckout, resolvedCommand.Hooks.PostCheckout, hookTarget, s.log); err != nil {
+		s.journal.Record(instanceModel.ID, models.EventSetupFinished, map[string]string{"result": "failed", "error": err.Error()})
+		s.discard(ws, instanceModel.ID, "setup failed")
+		return instanceModel, err
+	}
+
+	if len(resolvedCommand.PreCommand) > 0 {
+		s.log.Info("Running %d pre_command step(s) in %s...", len(resolvedCommand.PreCommand), wsPath)
+		if err := s.instanceService.RunPreCommands(instanceModel, resolvedCommand.PreCommand); err != nil {
+			s.journal.Record(instanceModel.ID, models.EventSetupFinished, map[string]string{"result": "failed", "error": err.Error()})
+			if request.KeepOnFailure {
+				s.log.Warning("Keeping workspace %s for inspection (--keep-on-failure).", wsPath)
+			} else {
+				s.discard(ws, instanceModel.ID, "setup failed")
+			}
+			return instanceModel, err
+		}
+	}
+	s.journal.Record(instanceModel.ID, models.EventSetupFinished, map[string]string{"result": "ok"})
+
+	if request.Interactive {
+		s.log.Info("Opening a shell in %s. Exit the shell to continue.", wsPath)
+		shellErr := instance.RunShell(instance.ShellOptions{Dir: wsPath, Env: instanceModel.Env, Ref: instanceRefName})
+		if shellErr != nil {
+			s.discard(ws, instanceModel.ID, "shell failed")
+			return instanceModel, shellErr
+		}
+
+		next := models.AfterShellRemove
+		if request.AfterShell != nil {
+			next = request.AfterShell()
+		}
+		switch next {
+		case models.AfterShellRun:
+			// Carry on below
+		case models.AfterShellKeep:
+			// Record the workspace so shell, exec and remove can find it again.
+			storageInst := s.newStoreRecord(instanceModel, "idle")
+			if err := s.addRecords(instanceModel, request.InstanceName != "", []storage.Instance{storageInst}); err != nil {
+				return instanceModel, err
+			}
+			instanceModel.Status = "idle"
+			return instanceModel, nil
+		default:
+			if cleanupErr := s.discard(ws, instanceModel.ID, "removed after the shell"); cleanupErr != nil {
+				s.log.Warning("Failed to clean up workspace %s: %v", wsPath, cleanupErr)
+			}
+			instanceModel.Status = "removed"
+			return instanceModel, nil
+		}
+	}
+
+	if len(processes) > 0 {
+		records, err := s.startProcesses(instanceModel, request.InstanceName != "", resolvedCommand, processes)
+		if err != nil {
+			s.discard(ws, instanceModel.ID, "failed to start")
+			return instanceModel, err
+		}
+		if err := instance.RunHooks(models.HookPostStart, resolvedCommand.Hooks.PostStart, hookTarget, s.log); err != nil {
+			s.stopAfterFailedHook(records...)
+			s.discard(ws, instanceModel.ID, "post_start hook failed")
+			return instanceModel, err
+		}
+		s.journal.Record(instanceModel.ID, models.EventReady, nil)
+		return instanceModel, nil
+	}
 
 	// Execute the command based on detached mode (logic remains largely the same)
 	if request.Detached {
 		s.log.Info("Starting process in detached mode for instance %s (Ref: %s)...", instanceModel.ID, instanceRefName)
+		// The record has to exist before the process starts: the supervisor shim fills in the
+		// PID and status, and records the exit later on, possibly before we return.
+		storageInst := s.newStoreRecord(instanceModel, "starting")
+		if err := s.addRecords(instanceModel, request.InstanceName != "", []storage.Instance{storageInst}); err != nil {
+			s.discard(ws, instanceModel.ID, "failed to save instance")
+			return instanceModel, err
+		}
 		if err := s.instanceService.StartDetachedProcess(instanceModel); err != nil {
-			s.workspaceService.Cleanup(ws)
+			s.discard(ws, instanceModel.ID, "failed to start")
+			// The supervisor may have recorded an exit already; that status stands.
+			_, updateErr := s.instanceStore.ModifyInstance(storageInst.ID, func(stored *storage.Instance) {
+				if !models.IsTerminalStatus(stored.Status) {
+					stored.Status = "failed"
+					stored.StopTime = time.Now().UTC()
+				}
+			})
+			if updateErr != nil {
+				s.log.Warning("Failed to mark instance %s as failed in store: %v", storageInst.ID, updateErr)
+			}
 			// s.log.Error already handled by the caller (cmd/run.go) which has access to finalInstanceModel
 			return instanceModel, fmt.Errorf("failed to start detached process: %w", err)
 		}
-		storageInst := storage.Instance{
-			ID:         instanceModel.ID,
-			Name:       fmt.Sprintf("%s-%s", instanceModel.BranchName, instanceModel.ID[:8]), // BranchName is now more generic ref name
-			PID:        instanceModel.ProcessID,
-			Port:       instanceModel.Port,
-			Path:       instanceModel.Path,
-			Status:     instanceModel.Status,
-			StartTime:  time.Now().UTC(),
-			LogPath:    filepath.Join(instanceModel.Path, fmt.Sprintf("%s.out.log", instanceModel.ID)),
-			GitServeID: "",
-		}
-		if err := s.instanceStore.AddInstance(storageInst); err != nil {
-			// s.log.Error might be appropriate here, but caller also handles it.
-			return instanceModel, fmt.Errorf("failed to save instance to store: %w", err)
-		}
 		s.log.Info("Instance %s (PID: %d, Ref: %s) is running in detached mode. Logs: %s",
-			instanceModel.ID, instanceModel.ProcessID, instanceModel.BranchName, storageInst.LogPath)
+			instanceModel.ID, instanceModel.PID, instanceModel.Ref, instanceModel.LogPath)
+		hookTarget.PID = instanceModel.PID
+		if err := instance.RunHooks(models.HookPostStart, resolvedCommand.Hooks.PostStart, hookTarget, s.log); err != nil {
+			storageInst.PID = instanceModel.PID
+			s.stopAfterFailedHook(storageInst)
+			s.discard(ws, instanceModel.ID, "post_start hook failed")
+			return instanceModel, err
+		}
+		s.journal.Record(instanceModel.ID, models.EventReady, map[string]string{"pid": strconv.Itoa(instanceModel.PID)})
 		return instanceModel, nil
 	} else {
 		s.log.Info("Process is running in foreground for instance %s (Ref: %s). Press Ctrl+C to stop.", instanceModel.ID, instanceRefName)
-		runErr := s.instanceService.RunProcess(instanceModel)
+		// post_start hooks run next to the command; a failing one stops it.
+		var postStart chan error
+		started := func(pgid int) {
+			s.journal.Record(instanceModel.ID, models.EventStarted, map[string]string{"pid": strconv.Itoa(pgid)})
+			s.modifyRun(instanceModel.ID, func(run *models.RunRecord) { run.Status = "running" })
+			hookTarget.PID = pgid
+			postStart = make(chan error, 1)
+			go func(target instance.HookTarget) {
+				err := instance.RunHooks(models.HookPostStart, resolvedCommand.Hooks.PostStart, target, s.log)
+				if err != nil {
+					s.log.Error("%v; stopping the command.", err)
+					s.journal.Record(instanceModel.ID, models.EventSignalSent, map[string]string{"signal": "SIGTERM", "reason": "post_start hook failed"})
+					if _, stopErr := instance.StopProcessGroup(pgid, instance.StopOptions{Timeout: defaultStopTimeout}); stopErr != nil {
+						s.log.Warning("Failed to stop process group %d: %v", pgid, stopErr)
+					}
+				} else {
+					s.journal.Record(instanceModel.ID, models.EventReady, map[string]string{"pid": strconv.Itoa(pgid)})
+				}
+				postStart <- err
+			}(hookTarget)
+		}
+		runErr := s.instanceService.RunProcess(instanceModel, started)
+		if postStart != nil {
+			s.finishForegroundRun(instanceModel.ID, runErr)
+			if hookErr := <-postStart; hookErr != nil {
+				runErr = hookErr
+			}
+		}
+		hookTarget.Status = "exited"
 		if runErr != nil {
-			// Replace fmt.Fprintf with s.log.Error (or Warning depending on if runErr is a true error or just non-zero exit)
-			// For now, using Error, assuming runErr implies a problem beyond just non-zero exit.
-			s.log.Error("Foreground process for instance %s (Ref: %s) exited: %v", instanceModel.ID, instanceModel.BranchName, runErr)
+			hookTarget.Status = "failed"
+		}
+		if err := instance.RunHooks(models.HookPostStop, resolvedCommand.Hooks.PostStop, hookTarget, s.log); err != nil && runErr == nil {
+			runErr = err
+		}
+		if runErr != nil {
+			s.log.Error("Foreground process for instance %s (Ref: %s) exited: %v", instanceModel.ID, instanceModel.Ref, runErr)
+			if request.KeepOnFailure {
+				s.log.Warning("Keeping workspace %s for inspection (--keep-on-failure).", wsPath)
+			} else if cleanupErr := s.discard(ws, instanceModel.ID, "foreground run finished"); cleanupErr != nil {
+				s.log.Warning("Failed to clean up workspace %s: %v", wsPath, cleanupErr)
+			}
 			return instanceModel, fmt.Errorf("foreground process error: %w", runErr)
 		}
-		s.log.Info("Foreground process for instance %s (Ref: %s) completed.", instanceModel.ID, instanceModel.BranchName)
-		s.workspaceService.Cleanup(ws)
+		s.log.Info("Foreground process for instance %s (Ref: %s) completed.", instanceModel.ID, instanceModel.Ref)
+		if cleanupErr := s.discard(ws, instanceModel.ID, "foreground run finished"); cleanupErr != nil {
+			s.log.Warning("Failed to clean up workspace %s: %v", wsPath, cleanupErr)
+		}
 		return instanceModel, nil
 	}
 }
+
+// discard cleans up the workspace of an instance that is not kept and records its removal.
+func (s *ServiceImpl) discard(ws *workspace.Workspace, instanceID string, reason string) error {
+	err := s.workspaceService.Cleanup(ws)
+	s.journal.Record(instanceID, models.EventRemoved, map[string]string{"reason": reason})
+	s.modifyRun(instanceID, func(run *models.RunRecord) { run.WorkspaceKept = false })
+	return err
+}
+
+// instanceLabels returns the labels of a new instance: the ones requested with --label and
+// those gitserve adds for its project, ref, ref type and named command.
+func instanceLabels(request *models.RunRequest, project string, refName string) map[string]string {
+	labels := make(map[string]string, len(request.Labels)+4)
+	for key, value := range request.Labels {
+		labels[key] = value
+	}
+	labels[models.LabelProject] = project
+	labels[models.LabelRef] = refName
+	labels[models.LabelRefType] = models.RefTypeLabel(request.Source.Type)
+	if request.NamedCommand != "" {
+		labels[models.LabelCommand] = request.NamedCommand
+	}
+	return labels
+}
+
+// recordRun adds a run to the history for a newly created instance.
+func (s *ServiceImpl) recordRun(instanceModel *models.Instance, request *models.RunRequest) {
+	run := models.RunRecord{
+		ID:            instanceModel.ID,
+		Name:          instanceModel.Name,
+		Source:        instanceModel.Source,
+		Project:       instanceModel.Project,
+		Ref:           instanceModel.Ref,
+		NamedCommand:  request.NamedCommand,
+		Command:       request.Command,
+		RequestedPort: request.Port,
+		Detached:      request.Detached,
+		TTY:           request.TTY,
+		Sandbox:       request.Sandbox,
+		GracePeriod:   request.GracePeriod,
+		KeepOnFailure: request.KeepOnFailure,
+		RerunOf:       request.RerunOf,
+		Labels:        instanceModel.Labels,
+		Status:        "setup",
+		StartTime:     time.Now().UTC(),
+		Workspace:     instanceModel.Path,
+		WorkspaceKept: true,
+	}
+	if err := s.instanceStore.AddRun(run); err != nil {
+		s.log.Warning("Failed to record run %s in the history: %v", run.ID, err)
+	}
+}
+
+// modifyRun updates a run in the history. The history is a record only: failing to update it
+// doesn't fail the run.
+func (s *ServiceImpl) modifyRun(id string, modify func(run *models.RunRecord)) {
+	if _, err := s.instanceStore.ModifyRun(id, modify); err != nil {
+		s.log.Warning("Failed to update run %s in the history: %v", id, err)
+	}
+}
+
+// finishForegroundRun records how a foreground command ended, in the history and the journal.
+func (s *ServiceImpl) finishForegroundRun(instanceID string, runErr error) {
+	status, exitCode, signal := "exited", 0, ""
+	var exitErr *instance.ExitError
+	switch {
+	case errors.As(runErr, &exitErr) && exitErr.Signal != "":
+		status, exitCode, signal = "killed", exitErr.Code, exitErr.Signal
+	case errors.As(runErr, &exitErr):
+		exitCode = exitErr.Code
+	case runErr != nil:
+		status = "failed"
+	}
+	s.modifyRun(instanceID, func(run *models.RunRecord) {
+		run.Status = status
+		run.ExitCode = exitCode
+		run.ExitSignal = signal
+		run.EndTime = time.Now().UTC()
+	})
+
+	details := map[string]string{"status": status}
+	switch {
+	case signal != "":
+		details["signal"] = signal
+	case status == "failed":
+		details["error"] = runErr.Error()
+	default:
+		details["exit_code"] = strconv.Itoa(exitCode)
+	}
+	s.journal.Record(instanceID, models.EventExited, details)
+}
+
+// settleRun records how a run ended, unless that is already known: a run that failed before
+// its command ended is marked failed, and one whose workspace was discarded after the
+// interactive shell as removed. Detached runs that started keep following their instance.
+func (s *ServiceImpl) settleRun(instanceModel *models.Instance, runErr error) {
+	s.modifyRun(instanceModel.ID, func(run *models.RunRecord) {
+		if runErr != nil {
+			run.Error = runErr.Error()
+		}
+		if models.IsTerminalStatus(run.Status) {
+			return
+		}
+		switch {
+		case runErr != nil:
+			run.Status = "failed"
+		case instanceModel.Status == "removed":
+			run.Status = "removed"
+		default:
+			return // Running detached, or kept as an idle instance
+		}
+		run.EndTime = time.Now().UTC()
+	})
+}
+
+// cloneDetails describes what was checked out, for the journal.
+func cloneDetails(source models.GitSource) map[string]string {
+	details := map[string]string{"type": source.Type.String(), "repo": source.RepoPath}
+	switch source.Type {
+	case models.CommitSource:
+		details["commit"] = source.CommitHash
+	case models.PRSource:
+		details["pr"] = strconv.Itoa(source.PRNumber)
+	default:
+		details["ref"] = source.RefName
+	}
+	return details
+}
+
+// stopAfterFailedHook stops the just started processes of an instance whose post_start hook
+// failed. The records are marked 'stopping' first, so their supervisors record them as
+// stopped rather than restarting them.
+func (s *ServiceImpl) stopAfterFailedHook(records ...storage.Instance) {
+	for _, record := range records {
+		_, err := s.instanceStore.ModifyInstance(record.ID, func(stored *storage.Instance) {
+			stored.Status = "stopping"
+		})
+		if err != nil {
+			s.log.Warning("Failed to update process %s in store: %v", record.ID, err)
+		}
+	}
+	for _, record := range records {
+		s.journal.Record(record.ID, models.EventSignalSent, map[string]string{"signal": "SIGTERM", "reason": "post_start hook failed"})
+		if _, err := instance.StopProcessGroup(record.PID, instance.StopOptions{Timeout: defaultStopTimeout}); err != nil {
+			s.log.Warning("Failed to stop process %s: %v", record.ID, err)
+		}
+	}
+}
+
+// startProcesses starts every process of a multi-process instance under its own supervisor.
+// The instance gets a parent record and each process a record with the ID "<id>/<process>",
+// its own logs and a port of its own: the one configured for it, or the instance port plus
+// 100 times its position (the Procfile convention). It returns the records of the processes.
+func (s *ServiceImpl) startProcesses(instanceModel *models.Instance, nameRequested bool, resolvedCommand *config.ResolvedCommand, processes []config.ProcessDefinition) ([]storage.Instance, error) {
+	parent := s.newStoreRecord(instanceModel, "running")
+	parent.Command = ""
+	parent.LogPath = s.instanceService.LogPath(parent.ID) // Where the instance's hooks write to
+	children := make([]*models.Instance, 0, len(processes))
+	records := make([]storage.Instance, 0, len(processes))
+	for i, process := range processes {
+		child := *instanceModel
+		child.ID = instanceModel.ID + "/" + process.Name
+		child.Command = process.Command
+		child.Processes = nil
+		child.Port = process.Port
+		if child.Port == 0 && instanceModel.Port > 0 {
+			child.Port = instanceModel.Port + 100*i
+		}
+		child.Env = make(map[string]string, len(instanceModel.Env)+len(process.Env)+2)
+		for k, v := range instanceModel.Env {
+			child.Env[k] = v
+		}
+		for k, v := range process.Env {
+			child.Env[k] = v
+		}
+		child.Env[instance.EnvProcess] = process.Name
+		delete(child.Env, instance.EnvPort)
+		if child.Port > 0 {
+			child.Env[instance.EnvPort] = strconv.Itoa(child.Port)
+		}
+
+		record := s.newStoreRecord(&child, "starting")
+		record.Name = parent.Name + "/" + process.Name
+		record.Parent = parent.ID
+		record.Process = process.Name
+		record.Hooks = models.Hooks{} // Hooks run once for the whole instance
+		parent.Processes = append(parent.Processes, process.Name)
+		children = append(children, &child)
+		records = append(records, record)
+	}
+
+	// All records go in together, before the first supervisor starts writing to the store.
+	if err := s.addRecords(instanceModel, nameRequested, append([]storage.Instance{parent}, records...)); err != nil {
+		return nil, err
+	}
+
+	for i, child := range children {
+		s.log.Info("Starting process '%s' (port %d): %s", records[i].Process, child.Port, child.Command)
+		if err := s.instanceService.StartDetachedProcess(child); err != nil {
+			s.log.Error("Process '%s' failed to start, stopping the others: %v", records[i].Process, err)
+			for _, started := range children[:i] {
+				if _, stopErr := instance.StopProcessGroup(started.PID, instance.StopOptions{Timeout: defaultStopTimeout}); stopErr != nil {
+					s.log.Warning("Failed to stop process %s: %v", started.ID, stopErr)
+				}
+			}
+			// Settle every record explicitly so nothing is left looking alive; only the status
+			// changes, so the exits the supervisors recorded are kept.
+			now := time.Now().UTC()
+			updateErr := s.instanceStore.Transaction(func(tx storage.InstanceStore) error {
+				for j := range records {
+					_, err := tx.ModifyInstance(records[j].ID, func(stored *storage.Instance) {
+						stored.Status = "failed"
+						if j < i {
+							stored.Status = "stopped"
+							stored.PID = children[j].PID
+						}
+						stored.StopTime = now
+					})
+					if err != nil {
+						return err
+					}
+				}
+				_, err := tx.ModifyInstance(parent.ID, func(stored *storage.Instance) {
+					stored.Status = "failed"
+					stored.StopTime = now
+				})
+				return err
+			})
+			if updateErr != nil {
+				s.log.Warning("Failed to mark instance %s as failed in store: %v", parent.ID, updateErr)
+			}
+			return nil, fmt.Errorf("failed to start process '%s': %w", records[i].Process, err)
+		}
+		s.log.Info("Process '%s' is running (PID: %d). Logs: %s", records[i].Process, child.PID, child.LogPath)
+		records[i].PID = child.PID
+	}
+
+	instanceModel.Processes = parent.Processes
+	instanceModel.Status = "running"
+	return records, nil
+}
+
+// newStoreRecord builds the store record for an instance with the given initial status.
+func (s *ServiceImpl) newStoreRecord(instanceModel *models.Instance, status string) storage.Instance {
+	record := *instanceModel
+	record.Status = status
+	record.StartTime = time.Now().UTC()
+	return record
+}
+
+// recordedSource returns source as it is recorded on an instance: a local repository path
+// relative to the directory gitserve was run in is made absolute, so it still points to the
+// same repository when the instance is run again from somewhere else.
+func recordedSource(source models.GitSource) models.GitSource {
+	if source.RepoPath == "" || filepath.IsAbs(source.RepoPath) {
+		return source
+	}
+	if _, err := os.Stat(source.RepoPath); err != nil {
+		return source // Not a local path
+	}
+	if absPath, err := filepath.Abs(source.RepoPath); err == nil {
+		source.RepoPath = absPath
+	}
+	return source
+}
+
+// instanceName returns the name asked for with --instance-name, or else generates one for the
+// ref, e.g. "main-brave-otter". Names are unique among the instances in the store; addRecords
+// checks again once the instance is saved.
+func (s *ServiceImpl) instanceName(requested string, refName string) (string, error) {
+	taken, err := takenNames(s.instanceStore)
+	if err != nil {
+		return "", err
+	}
+	if requested == "" {
+		return instance.GenerateName(refName, func(name string) bool { return taken[name] }), nil
+	}
+	if taken[requested] {
+		return "", nameTakenError(requested)
+	}
+	return requested, nil
+}
+
+// addRecords adds the records of a new instance to the store together: its own, first, and
+// those of its processes. Its name was picked before the checkout, so it is checked again under
+// the store lock: a generated name another instance took in the meantime is replaced with a
+// new one, while a name asked for with --instance-name fails the run.
+func (s *ServiceImpl) addRecords(instanceModel *models.Instance, nameRequested bool, records []storage.Instance) error {
+	err := s.instanceStore.Transaction(func(tx storage.InstanceStore) error {
+		if !nameRequested {
+			taken, err := takenNames(tx)
+			if err != nil {
+				return err
+			}
+			if taken[records[0].Name] {
+				name := instance.GenerateName(instanceModel.Ref, func(name string) bool { return taken[name] })
+				for i := range records {
+					records[i].Name = name
+					if records[i].Parent != "" {
+						records[i].Name = name + "/" + records[i].Process
+					}
+				}
+				if _, err := tx.ModifyRun(instanceModel.ID, func(run *storage.RunRecord) { run.Name = name }); err != nil {
+					return err
+				}
+			}
+		}
+		for _, record := range records {
+			if err := tx.AddInstance(record); err != nil {
+				if record.Parent != "" {
+					return fmt.Errorf("failed to save process '%s' to store: %w", record.Process, err)
+				}
+				return fmt.Errorf("failed to save instance to store: %w", err)
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, storage.ErrNameTaken) && nameRequested {
+		return nameTakenError(records[0].Name)
+	}
+	if err != nil {
+		return err
+	}
+	instanceModel.Name = records[0].Name
+	return nil
+}
+
+// takenNames returns the names of the instances in the store.
+func takenNames(instanceStore storage.InstanceStore) (map[string]bool, error) {
+	instances, err := instanceStore.FindInstances(storage.InstanceFilter{TopLevel: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve instances: %w", err)
+	}
+	taken := make(map[string]bool, len(instances))
+	for _, inst := range instances {
+		taken[inst.Name] = true
+	}
+	return taken, nil
+}
+
+// nameTakenError tells the user that the name asked for with --instance-name is taken.
+func nameTakenError(name string) error {
+	return fmt.Errorf("an instance named '%s' already exists; pick another --instance-name, or remove it first", name)
+}
+
+// resolvePort picks the port for a run: an explicit -p wins, then the named command's
+// default_port, then branch_port_mapping for the ref, then the top-level default_port.
+func (s *ServiceImpl) resolvePort(request *models.RunRequest, resolvedCommand *config.ResolvedCommand, refName string) int {
+	if request.Port > 0 {
+		return request.Port
+	}
+	if request.NamedCommand != "" {
+		if named, ok := s.configService.Get().NamedCommands[request.NamedCommand]; ok && named.DefaultPort > 0 {
+			return named.DefaultPort
+		}
+	}
+	if port := s.configService.PortForRef(refName); port > 0 {
+		return port
+	}
+	return resolvedCommand.DefaultPort
+}
@@ -0,0 +1,72 @@
+package runner
+
+import (
+	"strings"
+	"testing"
+
+	"gitserve/internal/logger"
+	"gitserve/internal/models"
+	"gitserve/internal/storage"
+)
+
+func TestAddRecordsNameTaken(t *testing.T) {
+	tests := []struct {
+		name          string
+		nameRequested bool
+		processes     []string
+		wantErr       string
+	}{
+		{name: "generated name is replaced"},
+		{name: "generated name is replaced for the processes too", processes: []string{"web", "worker"}},
+		{name: "requested name fails", nameRequested: true, wantErr: "pick another --instance-name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := storage.Open(storage.Location{Dir: t.TempDir(), Backend: storage.BackendJSON}, logger.NewService(logger.LogLevelError))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Another run took the name between picking it and saving the instance.
+			if err := store.AddInstance(storage.Instance{ID: "other", Name: "main-brave-otter"}); err != nil {
+				t.Fatal(err)
+			}
+			s := &ServiceImpl{instanceStore: store}
+			instanceModel := &models.Instance{ID: "new", Name: "main-brave-otter", Ref: "main"}
+			if err := store.AddRun(storage.RunRecord{ID: "new", Name: instanceModel.Name}); err != nil {
+				t.Fatal(err)
+			}
+			records := []storage.Instance{{ID: "new", Name: instanceModel.Name, Processes: tt.processes}}
+			for _, process := range tt.processes {
+				records = append(records, storage.Instance{ID: "new/" + process, Name: instanceModel.Name + "/" + process, Parent: "new", Process: process})
+			}
+
+			err = s.addRecords(instanceModel, tt.nameRequested, records)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("addRecords() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				if _, found, _ := store.GetInstanceByID("new"); found {
+					t.Error("the instance was saved under a taken name")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("addRecords() returned error: %v", err)
+			}
+			if instanceModel.Name == "main-brave-otter" || !strings.HasPrefix(instanceModel.Name, "main-") {
+				t.Fatalf("instance named %q, want a new name for main", instanceModel.Name)
+			}
+			stored, _, _ := store.GetInstanceByID("new")
+			run, _, _ := store.GetRun("new")
+			if stored.Name != instanceModel.Name || run.Name != instanceModel.Name {
+				t.Errorf("stored as %q, run recorded as %q; want %q", stored.Name, run.Name, instanceModel.Name)
+			}
+			for _, process := range tt.processes {
+				stored, _, _ := store.GetInstanceByID("new/" + process)
+				if want := instanceModel.Name + "/" + process; stored.Name != want {
+					t.Errorf("process stored as %q, want %q", stored.Name, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"gitserve/internal/models"
+	"reflect"
+	"slices"
+	"time"
+)
+
+// RunRecord is the record the store keeps per run in the run history; see models.RunRecord.
+type RunRecord = models.RunRecord
+
+// RunFilter selects runs in FindRuns. Zero fields match every run.
+type RunFilter struct {
+	Statuses []string // Any of these statuses
+	Project  string   // Runs of this project
+	Ref      string   // Runs of this ref
+}
+
+// Matches reports whether run is selected by the filter.
+func (f RunFilter) Matches(run RunRecord) bool {
+	if len(f.Statuses) > 0 && !slices.Contains(f.Statuses, run.Status) {
+		return false
+	}
+	if f.Project != "" && run.Project != f.Project {
+		return false
+	}
+	return f.Ref == "" || run.Ref == f.Ref
+}
+
+// followInstance brings a run up to date with the instance it created: the run mirrors the
+// instance's status and, once it has ended, its exit and stop time. Both stores call it
+// whenever they save an instance, so the history stays current whoever changes the instance.
+// It reports whether the run changed.
+func followInstance(run *RunRecord, inst Instance) bool {
+	before := *run
+	run.Status = inst.Status
+	run.ExitCode = inst.ExitCode
+	run.ExitSignal = inst.ExitSignal
+	switch {
+	case !models.IsTerminalStatus(inst.Status):
+		run.EndTime = time.Time{}
+	case !inst.StopTime.IsZero():
+		run.EndTime = inst.StopTime
+	case run.EndTime.IsZero():
+		run.EndTime = time.Now().UTC()
+	}
+	return !reflect.DeepEqual(before, *run)
+}
+
+// sortRuns orders runs oldest first.
+func sortRuns(runs []RunRecord) {
+	slices.SortFunc(runs, func(a, b RunRecord) int {
+		return a.StartTime.Compare(b.StartTime)
+	})
+}
@@ -2,58 +2,141 @@ package storage
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"gitserve/internal/logger"
+	"gitserve/internal/models"
 	"os"
 	"path/filepath"
-	"sync"
-	"time"
+	"reflect"
+	"slices"
+	"syscall"
 )
 
-// Instance represents a running or detached gitserve instance.
-type Instance struct {
-	ID         string    `json:"id"`
-	Name       string    `json:"name"`
-	PID        int       `json:"pid"`
-	Port       int       `json:"port"`
-	Path       string    `json:"path"`
-	Status     string    `json:"status"`
-	StartTime  time.Time `json:"startTime"`
-	StopTime   time.Time `json:"stopTime,omitempty"` // Time the instance was stopped or entered a terminal state
-	LogPath    string    `json:"logPath"`
-	GitServeID string    `json:"gitserveId"`
-}
-
-// InstanceStore defines the interface for managing gitserve instances.
+// Instance is the record the store keeps per instance and per process of a multi-process
+// instance; see models.Instance.
+type Instance = models.Instance
+
+// ErrNameTaken is returned when an instance is added with the name another instance has.
+// Names are unique among instances; processes are named after their instance.
+var ErrNameTaken = errors.New("instance name already taken")
+
+// InstanceStore defines the interface for managing gitserve instances and the run history.
 type InstanceStore interface {
+	// AddInstance adds a new instance. It fails with ErrNameTaken if the instance, not being a
+	// process, has the name of another instance.
 	AddInstance(instance Instance) error
 	GetInstanceByID(id string) (Instance, bool, error)
 	GetAllInstances() ([]Instance, error)
+	// FindInstances returns the stored instances that match filter.
+	FindInstances(filter InstanceFilter) ([]Instance, error)
 	UpdateInstance(id string, updatedInstance Instance) error
+	// ModifyInstance applies modify to a stored instance and saves the result, without any
+	// other process changing the instance in between. It reports false if there is no such
+	// instance.
+	ModifyInstance(id string, modify func(inst *Instance)) (bool, error)
 	DeleteInstance(id string) error
+
+	// AddRun records a run in the run history.
+	AddRun(run RunRecord) error
+	// GetRun returns a run from the run history by its ID.
+	GetRun(id string) (RunRecord, bool, error)
+	// FindRuns returns the runs in the history that match filter, oldest first.
+	FindRuns(filter RunFilter) ([]RunRecord, error)
+	// ModifyRun applies modify to a run in the history and saves the result. It reports false
+	// if there is no such run.
+	ModifyRun(id string, modify func(run *RunRecord)) (bool, error)
+
+	// Transaction calls fn with a view of the store whose changes are saved together once fn
+	// returns nil, and discarded if it returns an error. No other process changes the store
+	// while fn runs. Transactions don't nest: fn runs in the same transaction if tx is used
+	// to start another one.
+	Transaction(fn func(tx InstanceStore) error) error
+}
+
+// InstanceFilter selects instances in FindInstances. Zero fields match every instance.
+type InstanceFilter struct {
+	Statuses []string        // Any of these statuses
+	Project  string          // Instances of this project (models.Instance.Project)
+	Ref      string          // Instances of this ref
+	Parent   string          // The processes of this multi-process instance
+	TopLevel bool            // Only instances, not the processes of multi-process instances
+	Selector models.Selector // Instances whose labels match this selector
+}
+
+// Matches reports whether inst is selected by the filter.
+func (f InstanceFilter) Matches(inst Instance) bool {
+	if len(f.Statuses) > 0 && !slices.Contains(f.Statuses, inst.Status) {
+		return false
+	}
+	if f.Project != "" && inst.Project != f.Project {
+		return false
+	}
+	if f.Ref != "" && inst.Ref != f.Ref {
+		return false
+	}
+	if f.Parent != "" && inst.Parent != f.Parent {
+		return false
+	}
+	if !f.Selector.Matches(inst.Labels) {
+		return false
+	}
+	return !f.TopLevel || inst.Parent == ""
+}
+
+// Backends the instance store can be kept in.
+const (
+	BackendJSON   = "json"   // One JSON file, rewritten on every change (the default)
+	BackendSQLite = "sqlite" // An SQLite database with indexed lookups
+)
+
+// Location tells where an instance store is kept, so other gitserve processes (supervisor
+// shims) can open the same store.
+type Location struct {
+	Dir     string `json:"dir"`
+	Backend string `json:"backend,omitempty"` // json (the default) or sqlite
+}
+
+// Open opens the instance store at location.
+func Open(location Location, log logger.Service) (InstanceStore, error) {
+	switch location.Backend {
+	case "", BackendJSON:
+		return NewJSONInstanceStore(location.Dir, log)
+	case BackendSQLite:
+		return NewSQLiteInstanceStore(location.Dir, log)
+	}
+	return nil, fmt.Errorf("unknown store backend '%s' (expected %s or %s)", location.Backend, BackendJSON, BackendSQLite)
 }
 
 const instancesFile = "gitserve_instances.json"
 
+// lockFile is locked with flock(2) around every access to instancesFile. It is a separate
+// file because instancesFile is replaced (renamed over) on every write.
+const lockFile = "gitserve_instances.lock"
+
 // jsonInstanceStore is a file-based implementation of InstanceStore using JSON.
+// Several gitserve processes (CLI commands and supervisor shims) use the file at the same
+// time, so nothing is cached: every call locks the file and reads it afresh, and mutations
+// write it back before the lock is released.
 type jsonInstanceStore struct {
-	storagePath    string
-	instances      map[string]Instance
-	instancesMutex sync.RWMutex
+	storagePath string
+	log         logger.Service
 }
 
 // NewJSONInstanceStore creates and initializes a new JSON-based InstanceStore.
-func NewJSONInstanceStore(dataDirPath string) (InstanceStore, error) {
+func NewJSONInstanceStore(dataDirPath string, log logger.Service) (InstanceStore, error) {
 	store := &jsonInstanceStore{
 		storagePath: dataDirPath,
-		instances:   make(map[string]Instance),
+		log:         log,
 	}
 
 	if err := ensureDirExists(store.storagePath); err != nil {
 		return nil, fmt.Errorf("failed to ensure storage directory exists: %w", err)
 	}
 
-	if err := store.loadInstances(); err != nil {
-		// If loading fails (e.g. corrupted file), return the error.
+	// Load once up front, so a corrupted file (or one from a newer gitserve) is reported right
+	// away. The exclusive lock lets a file of an older schema version be migrated on the spot.
+	if err := store.withLock(true, func(*storeState) (bool, error) { return false, nil }); err != nil {
 		// The caller (e.g., CLI command) can then decide how to handle it (e.g., exit, or offer to reset).
 		return nil, fmt.Errorf("failed to load instances: %w", err)
 	}
@@ -67,114 +150,449 @@ func ensureDirExists(path string) error {
 	return nil
 }
 
-// loadInstances reads the instances from the JSON file into memory.
-func (s *jsonInstanceStore) loadInstances() error {
-	s.instancesMutex.Lock()
-	defer s.instancesMutex.Unlock()
+// withLock locks the store (exclusively if exclusive, shared otherwise), loads its contents
+// and calls fn with them. If fn reports a change, the contents are saved before the lock is
+// released, so no other process can have written in between.
+func (s *jsonInstanceStore) withLock(exclusive bool, fn func(state *storeState) (bool, error)) error {
+	lockPath := filepath.Join(s.storagePath, lockFile)
+	lock, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening lock file %s: %w", lockPath, err)
+	}
+	defer lock.Close() // Closing the file releases the lock
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err = syscall.Flock(int(lock.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error locking %s: %w", lockPath, err)
+	}
+
+	state, version, err := s.loadState()
+	if err != nil {
+		return err
+	}
+	if version < currentSchemaVersion && exclusive {
+		if err := s.upgradeFile(state, version); err != nil {
+			return err
+		}
+	}
+	changed, err := fn(state)
+	if err != nil || !changed {
+		return err
+	}
+	return s.saveState(state)
+}
+
+// upgradeFile rewrites a store file of an older schema version with the contents migrated
+// from it, after backing up the old file. The caller holds the exclusive lock.
+func (s *jsonInstanceStore) upgradeFile(state *storeState, version int) error {
+	instancesFilePath := filepath.Join(s.storagePath, instancesFile)
+	data, err := os.ReadFile(instancesFilePath)
+	if err != nil {
+		return fmt.Errorf("error reading instances file %s: %w", instancesFilePath, err)
+	}
+	backupPath, err := backupStoreFile(instancesFilePath, data, version)
+	if err != nil {
+		return fmt.Errorf("error backing up %s before migrating it: %w", instancesFilePath, err)
+	}
+	if err := s.saveState(state); err != nil {
+		return fmt.Errorf("error saving migrated instances (the old file is kept as %s): %w", backupPath, err)
+	}
+	s.log.Info("Migrated %s from schema version %d to %d; the old file is kept as %s.",
+		instancesFilePath, version, currentSchemaVersion, backupPath)
+	return nil
+}
 
+// loadState reads the instances and the run history from the JSON file, migrated to the
+// current schema version, and returns them with the version the file has. The caller holds
+// the lock.
+func (s *jsonInstanceStore) loadState() (*storeState, int, error) {
 	instancesFilePath := filepath.Join(s.storagePath, instancesFile)
 	data, err := os.ReadFile(instancesFilePath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			// File doesn't exist, initialize with an empty map (this is not an error)
-			s.instances = make(map[string]Instance)
-			return nil
+			// File doesn't exist, start empty (this is not an error)
+			return newStoreState(nil, nil), currentSchemaVersion, nil
 		}
-		return fmt.Errorf("error reading instances file %s: %w", instancesFilePath, err)
+		return nil, 0, fmt.Errorf("error reading instances file %s: %w", instancesFilePath, err)
 	}
 
 	if len(data) == 0 {
-		// File is empty, initialize with an empty map
-		s.instances = make(map[string]Instance)
-		return nil
+		// File is empty, start empty
+		return newStoreState(nil, nil), currentSchemaVersion, nil
 	}
-
-	// Attempt to unmarshal. If it fails, reset to an empty map and return the error.
-	if err = json.Unmarshal(data, &s.instances); err != nil {
-		s.instances = make(map[string]Instance) // Reset to a clean state on unmarshal error
-		return fmt.Errorf("error unmarshalling instances data from %s: %w. Store reset to empty.", instancesFilePath, err)
+	file, version, err := decodeStoreFile(instancesFilePath, data)
+	if err != nil {
+		return nil, version, err
 	}
-	return nil
+	return newStoreState(file.Instances, file.History), version, nil
 }
 
-// saveInstances writes the current in-memory instances to the JSON file.
-// It assumes that the caller (AddInstance, UpdateInstance, DeleteInstance)
-// already holds the necessary (write) lock on s.instancesMutex.
-func (s *jsonInstanceStore) saveInstances() error {
+// saveState writes the instances and the run history to the JSON file. The caller holds the
+// exclusive lock. The data goes to a temporary file that is synced and then renamed over the
+// old file, so a crash mid-write leaves either the old or the new contents behind, never a mix.
+func (s *jsonInstanceStore) saveState(state *storeState) error {
 	instancesFilePath := filepath.Join(s.storagePath, instancesFile)
-	fmt.Fprintf(os.Stderr, "[DEBUG] Attempting to save instances to: %s\n", instancesFilePath) // DEBUG PRINT
+	s.log.Debug("Saving %d instances and %d runs to %s", len(state.instances), len(state.runs), instancesFilePath)
 
-	data, err := json.MarshalIndent(s.instances, "", "  ")
+	data, err := json.MarshalIndent(storeFile{
+		SchemaVersion: currentSchemaVersion,
+		Instances:     state.instances,
+		History:       state.runs,
+	}, "", "  ")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "[DEBUG] Error marshalling instances: %v\n", err) // DEBUG PRINT
 		return fmt.Errorf("error marshalling instances: %w", err)
 	}
 
-	fmt.Fprintf(os.Stderr, "[DEBUG] Marshalled data length: %d bytes\n", len(data)) // DEBUG PRINT
-
-	// Direct write for diagnostics
-	if err = os.WriteFile(instancesFilePath, data, 0600); err != nil {
-		fmt.Fprintf(os.Stderr, "[DEBUG] Error writing instances file %s: %v\n", instancesFilePath, err) // DEBUG PRINT
-		return fmt.Errorf("error writing instances file %s: %w", instancesFilePath, err)
+	tmp, err := os.CreateTemp(s.storagePath, "."+instancesFile+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary instances file in %s: %w", s.storagePath, err)
+	}
+	tmpPath := tmp.Name()
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmpPath)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		cleanup()
+		return fmt.Errorf("error writing instances file %s: %w", tmpPath, err)
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		cleanup()
+		return fmt.Errorf("error setting permissions of %s: %w", tmpPath, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		cleanup()
+		return fmt.Errorf("error syncing instances file %s: %w", tmpPath, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error closing instances file %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, instancesFilePath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error replacing instances file %s: %w", instancesFilePath, err)
+	}
+	// Make the rename itself durable.
+	if dir, err := os.Open(s.storagePath); err == nil {
+		if err := dir.Sync(); err != nil {
+			s.log.Debug("Failed to sync directory %s: %v", s.storagePath, err)
+		}
+		dir.Close()
 	}
 
-	fmt.Fprintf(os.Stderr, "[DEBUG] Successfully wrote instances file: %s\n", instancesFilePath) // DEBUG PRINT
+	s.log.Debug("Wrote %d bytes to %s", len(data), instancesFilePath)
 	return nil
 }
 
 // AddInstance adds a new instance to the store.
 func (s *jsonInstanceStore) AddInstance(instance Instance) error {
-	s.instancesMutex.Lock()
-	defer s.instancesMutex.Unlock()
-
-	if _, exists := s.instances[instance.ID]; exists {
-		return fmt.Errorf("instance with ID '%s' already exists", instance.ID)
-	}
-	s.instances[instance.ID] = instance
-	return s.saveInstances()
+	return s.withLock(true, func(state *storeState) (bool, error) {
+		return true, state.addInstance(instance)
+	})
 }
 
 // GetInstanceByID retrieves a specific instance by its ID.
 func (s *jsonInstanceStore) GetInstanceByID(id string) (Instance, bool, error) {
-	s.instancesMutex.RLock()
-	defer s.instancesMutex.RUnlock()
-
-	instance, found := s.instances[id]
-	return instance, found, nil
+	var instance Instance
+	var found bool
+	err := s.withLock(false, func(state *storeState) (bool, error) {
+		instance, found = state.instances[id]
+		return false, nil
+	})
+	return instance, found, err
 }
 
 // GetAllInstances returns a slice of all stored instances.
 func (s *jsonInstanceStore) GetAllInstances() ([]Instance, error) {
-	s.instancesMutex.RLock()
-	defer s.instancesMutex.RUnlock()
+	return s.FindInstances(InstanceFilter{})
+}
 
-	all := make([]Instance, 0, len(s.instances))
-	for _, instance := range s.instances {
-		all = append(all, instance)
-	}
-	return all, nil
+// FindInstances returns the stored instances that match filter.
+func (s *jsonInstanceStore) FindInstances(filter InstanceFilter) ([]Instance, error) {
+	var found []Instance
+	err := s.withLock(false, func(state *storeState) (bool, error) {
+		found = state.findInstances(filter)
+		return false, nil
+	})
+	return found, err
 }
 
 // UpdateInstance modifies an existing instance in the store.
 func (s *jsonInstanceStore) UpdateInstance(id string, updatedInstance Instance) error {
-	s.instancesMutex.Lock()
-	defer s.instancesMutex.Unlock()
+	return s.withLock(true, func(state *storeState) (bool, error) {
+		return true, state.updateInstance(id, updatedInstance)
+	})
+}
 
-	if _, exists := s.instances[id]; !exists {
-		return fmt.Errorf("instance with ID '%s' not found for update", id)
-	}
-	s.instances[id] = updatedInstance
-	return s.saveInstances()
+// ModifyInstance reads, modifies and writes back an instance under a single exclusive lock.
+func (s *jsonInstanceStore) ModifyInstance(id string, modify func(inst *Instance)) (bool, error) {
+	found := false
+	err := s.withLock(true, func(state *storeState) (bool, error) {
+		var changed bool
+		found, changed = state.modifyInstance(id, modify)
+		return changed, nil // Nothing changed, don't rewrite the file
+	})
+	return found, err
 }
 
 // DeleteInstance removes an instance from the store by its ID.
 func (s *jsonInstanceStore) DeleteInstance(id string) error {
-	s.instancesMutex.Lock()
-	defer s.instancesMutex.Unlock()
+	return s.withLock(true, func(state *storeState) (bool, error) {
+		return true, state.deleteInstance(id)
+	})
+}
+
+// AddRun records a run in the run history.
+func (s *jsonInstanceStore) AddRun(run RunRecord) error {
+	return s.withLock(true, func(state *storeState) (bool, error) {
+		return true, state.addRun(run)
+	})
+}
+
+// GetRun returns a run from the run history by its ID.
+func (s *jsonInstanceStore) GetRun(id string) (RunRecord, bool, error) {
+	var run RunRecord
+	var found bool
+	err := s.withLock(false, func(state *storeState) (bool, error) {
+		run, found = state.runs[id]
+		return false, nil
+	})
+	return run, found, err
+}
+
+// FindRuns returns the runs in the history that match filter, oldest first.
+func (s *jsonInstanceStore) FindRuns(filter RunFilter) ([]RunRecord, error) {
+	var found []RunRecord
+	err := s.withLock(false, func(state *storeState) (bool, error) {
+		found = state.findRuns(filter)
+		return false, nil
+	})
+	return found, err
+}
+
+// ModifyRun reads, modifies and writes back a run under a single exclusive lock.
+func (s *jsonInstanceStore) ModifyRun(id string, modify func(run *RunRecord)) (bool, error) {
+	found := false
+	err := s.withLock(true, func(state *storeState) (bool, error) {
+		var changed bool
+		found, changed = state.modifyRun(id, modify)
+		return changed, nil
+	})
+	return found, err
+}
 
-	if _, exists := s.instances[id]; !exists {
+// Transaction runs fn under a single exclusive lock and writes the file once, if fn succeeds
+// and changed anything.
+func (s *jsonInstanceStore) Transaction(fn func(tx InstanceStore) error) error {
+	return s.withLock(true, func(state *storeState) (bool, error) {
+		tx := &jsonTransaction{state: state}
+		if err := fn(tx); err != nil {
+			return false, err // The changes were only made in memory
+		}
+		return tx.changed, nil
+	})
+}
+
+// storeState holds the instances and the run history of a JSON store while it is locked. The
+// store and its transactions share its operations, so both behave alike.
+type storeState struct {
+	instances map[string]Instance
+	runs      map[string]RunRecord
+}
+
+func newStoreState(instances map[string]Instance, runs map[string]RunRecord) *storeState {
+	if instances == nil {
+		instances = make(map[string]Instance)
+	}
+	if runs == nil {
+		runs = make(map[string]RunRecord)
+	}
+	return &storeState{instances: instances, runs: runs}
+}
+
+func (st *storeState) addInstance(instance Instance) error {
+	if _, exists := st.instances[instance.ID]; exists {
+		return fmt.Errorf("instance with ID '%s' already exists", instance.ID)
+	}
+	if instance.Parent == "" && instance.Name != "" {
+		for _, other := range st.instances {
+			if other.Parent == "" && other.Name == instance.Name {
+				return fmt.Errorf("%w: instance '%s' is named '%s'", ErrNameTaken, other.ID, instance.Name)
+			}
+		}
+	}
+	st.instances[instance.ID] = instance
+	st.follow(instance)
+	return nil
+}
+
+func (st *storeState) findInstances(filter InstanceFilter) []Instance {
+	found := make([]Instance, 0, len(st.instances))
+	for _, instance := range st.instances {
+		if filter.Matches(instance) {
+			found = append(found, instance)
+		}
+	}
+	return found
+}
+
+func (st *storeState) updateInstance(id string, updatedInstance Instance) error {
+	if _, exists := st.instances[id]; !exists {
+		return fmt.Errorf("instance with ID '%s' not found for update", id)
+	}
+	st.instances[id] = updatedInstance
+	st.follow(updatedInstance)
+	return nil
+}
+
+// modifyInstance reports whether the instance exists and whether modify changed it.
+func (st *storeState) modifyInstance(id string, modify func(inst *Instance)) (bool, bool) {
+	instance, exists := st.instances[id]
+	if !exists {
+		return false, false
+	}
+	before := instance
+	modify(&instance)
+	if reflect.DeepEqual(before, instance) {
+		return true, false
+	}
+	st.instances[id] = instance
+	st.follow(instance)
+	return true, true
+}
+
+func (st *storeState) deleteInstance(id string) error {
+	if _, exists := st.instances[id]; !exists {
 		return fmt.Errorf("instance with ID '%s' not found for delete", id)
 	}
-	delete(s.instances, id)
-	return s.saveInstances()
+	delete(st.instances, id)
+	return nil
+}
+
+// follow updates the run of a saved instance, if it has one; see followInstance.
+func (st *storeState) follow(instance Instance) {
+	run, exists := st.runs[instance.ID]
+	if exists && instance.Parent == "" && followInstance(&run, instance) {
+		st.runs[instance.ID] = run
+	}
+}
+
+func (st *storeState) addRun(run RunRecord) error {
+	if _, exists := st.runs[run.ID]; exists {
+		return fmt.Errorf("run with ID '%s' already exists", run.ID)
+	}
+	st.runs[run.ID] = run
+	return nil
+}
+
+func (st *storeState) findRuns(filter RunFilter) []RunRecord {
+	found := make([]RunRecord, 0, len(st.runs))
+	for _, run := range st.runs {
+		if filter.Matches(run) {
+			found = append(found, run)
+		}
+	}
+	sortRuns(found)
+	return found
+}
+
+// modifyRun reports whether the run exists and whether modify changed it.
+func (st *storeState) modifyRun(id string, modify func(run *RunRecord)) (bool, bool) {
+	run, exists := st.runs[id]
+	if !exists {
+		return false, false
+	}
+	before := run
+	modify(&run)
+	if reflect.DeepEqual(before, run) {
+		return true, false
+	}
+	st.runs[id] = run
+	return true, true
+}
+
+// jsonTransaction is the view of a JSON store that a transaction works on: the contents loaded
+// under the store's exclusive lock, written back once the transaction succeeds.
+type jsonTransaction struct {
+	state   *storeState
+	changed bool
+}
+
+func (tx *jsonTransaction) AddInstance(instance Instance) error {
+	if err := tx.state.addInstance(instance); err != nil {
+		return err
+	}
+	tx.changed = true
+	return nil
+}
+
+func (tx *jsonTransaction) GetInstanceByID(id string) (Instance, bool, error) {
+	instance, found := tx.state.instances[id]
+	return instance, found, nil
+}
+
+func (tx *jsonTransaction) GetAllInstances() ([]Instance, error) {
+	return tx.state.findInstances(InstanceFilter{}), nil
+}
+
+func (tx *jsonTransaction) FindInstances(filter InstanceFilter) ([]Instance, error) {
+	return tx.state.findInstances(filter), nil
+}
+
+func (tx *jsonTransaction) UpdateInstance(id string, updatedInstance Instance) error {
+	if err := tx.state.updateInstance(id, updatedInstance); err != nil {
+		return err
+	}
+	tx.changed = true
+	return nil
+}
+
+func (tx *jsonTransaction) ModifyInstance(id string, modify func(inst *Instance)) (bool, error) {
+	found, changed := tx.state.modifyInstance(id, modify)
+	tx.changed = tx.changed || changed
+	return found, nil
+}
+
+func (tx *jsonTransaction) DeleteInstance(id string) error {
+	if err := tx.state.deleteInstance(id); err != nil {
+		return err
+	}
+	tx.changed = true
+	return nil
+}
+
+func (tx *jsonTransaction) AddRun(run RunRecord) error {
+	if err := tx.state.addRun(run); err != nil {
+		return err
+	}
+	tx.changed = true
+	return nil
+}
+
+func (tx *jsonTransaction) GetRun(id string) (RunRecord, bool, error) {
+	run, found := tx.state.runs[id]
+	return run, found, nil
+}
+
+func (tx *jsonTransaction) FindRuns(filter RunFilter) ([]RunRecord, error) {
+	return tx.state.findRuns(filter), nil
+}
+
+func (tx *jsonTransaction) ModifyRun(id string, modify func(run *RunRecord)) (bool, error) {
+	found, changed := tx.state.modifyRun(id, modify)
+	tx.changed = tx.changed || changed
+	return found, nil
+}
+
+func (tx *jsonTransaction) Transaction(fn func(tx InstanceStore) error) error {
+	return fn(tx)
 }
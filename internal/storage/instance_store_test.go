@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAddInstanceNames(t *testing.T) {
+	existing := []Instance{
+		{ID: "a1", Name: "web", Processes: []string{"api"}},
+		{ID: "a1/api", Name: "web/api", Parent: "a1", Process: "api"},
+		{ID: "b1", Name: ""}, // Recorded before instances had names
+	}
+	tests := []struct {
+		name      string
+		inst      Instance
+		wantTaken bool
+	}{
+		{name: "new name", inst: Instance{ID: "c1", Name: "main-brave-otter"}},
+		{name: "name of an instance", inst: Instance{ID: "c1", Name: "web"}, wantTaken: true},
+		{name: "name of a process", inst: Instance{ID: "c1", Name: "web/api"}},
+		{name: "process of another instance", inst: Instance{ID: "c1/api", Name: "web/api", Parent: "c1", Process: "api"}},
+		{name: "no name", inst: Instance{ID: "c1"}},
+	}
+	for _, backend := range []string{BackendJSON, BackendSQLite} {
+		t.Run(backend, func(t *testing.T) {
+			for _, tt := range tests {
+				store := openTestStore(t, backend)
+				for _, record := range existing {
+					if err := store.AddInstance(record); err != nil {
+						t.Fatalf("AddInstance(%s) failed: %v", record.ID, err)
+					}
+				}
+				err := store.AddInstance(tt.inst)
+				if tt.wantTaken != errors.Is(err, ErrNameTaken) || (!tt.wantTaken && err != nil) {
+					t.Errorf("%s: AddInstance() = %v, want name taken: %v", tt.name, err, tt.wantTaken)
+				}
+				_, found, _ := store.GetInstanceByID(tt.inst.ID)
+				if found == tt.wantTaken {
+					t.Errorf("%s: instance saved: %v, want %v", tt.name, found, !tt.wantTaken)
+				}
+			}
+		})
+	}
+}
+
+func TestAddInstanceNameTakenInTransaction(t *testing.T) {
+	for _, backend := range []string{BackendJSON, BackendSQLite} {
+		t.Run(backend, func(t *testing.T) {
+			store := openTestStore(t, backend)
+			err := store.Transaction(func(tx InstanceStore) error {
+				if err := tx.AddInstance(Instance{ID: "a1", Name: "web"}); err != nil {
+					return err
+				}
+				return tx.AddInstance(Instance{ID: "b1", Name: "web"})
+			})
+			if !errors.Is(err, ErrNameTaken) {
+				t.Fatalf("Transaction() = %v, want the second name refused", err)
+			}
+			if instances, _ := store.GetAllInstances(); len(instances) != 0 {
+				t.Errorf("store holds %d instances after the failed transaction, want none", len(instances))
+			}
+		})
+	}
+}
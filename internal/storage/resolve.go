@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxAmbiguousShown is how many candidates an ambiguous reference error lists.
+const maxAmbiguousShown = 5
+
+// ResolveInstance finds the instance ref refers to: its ID, its name or a prefix of its ID
+// that no other instance shares, in that order. A process of a multi-process instance is
+// referred to as "<instance>/<process>", where <instance> is any of these. It reports false
+// if nothing matches, and an error if a prefix (or a name) matches several instances.
+func ResolveInstance(store InstanceStore, ref string) (Instance, bool, error) {
+	if ref == "" {
+		return Instance{}, false, nil
+	}
+	if inst, found, err := store.GetInstanceByID(ref); err != nil || found {
+		return inst, found, err
+	}
+	if parentRef, process, isProcess := strings.Cut(ref, "/"); isProcess {
+		parent, found, err := ResolveInstance(store, parentRef)
+		if err != nil || !found {
+			return Instance{}, false, err
+		}
+		return store.GetInstanceByID(parent.ID + "/" + process)
+	}
+
+	instances, err := store.FindInstances(InstanceFilter{TopLevel: true})
+	if err != nil {
+		return Instance{}, false, fmt.Errorf("failed to retrieve instances: %w", err)
+	}
+	var named, prefixed []Instance
+	for _, inst := range instances {
+		if inst.Name == ref {
+			named = append(named, inst)
+		}
+		if strings.HasPrefix(inst.ID, ref) {
+			prefixed = append(prefixed, inst)
+		}
+	}
+	for _, matches := range [][]Instance{named, prefixed} {
+		switch len(matches) {
+		case 0:
+			continue
+		case 1:
+			return matches[0], true, nil
+		}
+		candidates := make([]string, len(matches))
+		for i, inst := range matches {
+			candidates[i] = fmt.Sprintf("%s (%s)", inst.ID, inst.Name)
+		}
+		return Instance{}, false, ambiguousError("instance", ref, candidates)
+	}
+	return Instance{}, false, nil
+}
+
+// ResolveRun finds the run in the run history ref refers to: its ID, the name of its instance
+// (the latest run if an old name was used again) or a prefix of its ID that no other run
+// shares. It reports false if nothing matches, and an error for an ambiguous prefix.
+func ResolveRun(store InstanceStore, ref string) (RunRecord, bool, error) {
+	if ref == "" {
+		return RunRecord{}, false, nil
+	}
+	if run, found, err := store.GetRun(ref); err != nil || found {
+		return run, found, err
+	}
+	runs, err := store.FindRuns(RunFilter{})
+	if err != nil {
+		return RunRecord{}, false, fmt.Errorf("failed to retrieve the run history: %w", err)
+	}
+	for i := len(runs) - 1; i >= 0; i-- {
+		if runs[i].Name == ref {
+			return runs[i], true, nil
+		}
+	}
+	var prefixed []RunRecord
+	for _, run := range runs {
+		if strings.HasPrefix(run.ID, ref) {
+			prefixed = append(prefixed, run)
+		}
+	}
+	switch len(prefixed) {
+	case 0:
+		return RunRecord{}, false, nil
+	case 1:
+		return prefixed[0], true, nil
+	}
+	candidates := make([]string, len(prefixed))
+	for i, run := range prefixed {
+		candidates[i] = fmt.Sprintf("%s (%s, %s)", run.ID, run.Ref, run.StartTime.Local().Format("01-02 15:04"))
+	}
+	return RunRecord{}, false, ambiguousError("run", ref, candidates)
+}
+
+// ambiguousError reports that ref matches several of the candidates, listing a few of them.
+func ambiguousError(kind string, ref string, candidates []string) error {
+	sort.Strings(candidates)
+	shown := candidates
+	if len(shown) > maxAmbiguousShown {
+		shown = shown[:maxAmbiguousShown]
+	}
+	more := ""
+	if len(candidates) > len(shown) {
+		more = fmt.Sprintf(", and %d more", len(candidates)-len(shown))
+	}
+	return fmt.Errorf("'%s' is ambiguous: it matches %d %ss: %s%s; use a longer prefix or the name",
+		ref, len(candidates), kind, strings.Join(shown, ", "), more)
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gitserve/internal/logger"
+)
+
+// openTestStore opens an empty store of the given backend in a temporary directory.
+func openTestStore(t *testing.T, backend string) InstanceStore {
+	t.Helper()
+	store, err := Open(Location{Dir: t.TempDir(), Backend: backend}, logger.NewService(logger.LogLevelError))
+	if err != nil {
+		t.Fatalf("failed to open %s store: %v", backend, err)
+	}
+	return store
+}
+
+func TestResolveInstance(t *testing.T) {
+	records := []Instance{
+		{ID: "3f2c9a1e-0000", Name: "main-brave-otter"},
+		{ID: "3f2d0000-0000", Name: "feature-calm-heron"},
+		{ID: "7a000000-0000", Name: "web", Processes: []string{"api"}},
+		{ID: "7a000000-0000/api", Name: "web/api", Parent: "7a000000-0000", Process: "api"},
+		// A name that is a prefix of another instance's ID: the name wins.
+		{ID: "b0000000-0000", Name: "7a0"},
+	}
+	tests := []struct {
+		ref     string
+		wantID  string // Empty if nothing matches
+		wantErr string // Part of the expected error, if any
+	}{
+		{ref: "3f2c9a1e-0000", wantID: "3f2c9a1e-0000"},
+		{ref: "main-brave-otter", wantID: "3f2c9a1e-0000"},
+		{ref: "3f2c", wantID: "3f2c9a1e-0000"},
+		{ref: "3f2d", wantID: "3f2d0000-0000"},
+		{ref: "3f2", wantErr: "ambiguous"},
+		{ref: "7a0", wantID: "b0000000-0000"},
+		{ref: "web", wantID: "7a000000-0000"},
+		{ref: "web/api", wantID: "7a000000-0000/api"},
+		{ref: "7a/api", wantID: "7a000000-0000/api"},
+		{ref: "7a000000-0000/api", wantID: "7a000000-0000/api"},
+		{ref: "web/worker"},
+		{ref: "3f2/api", wantErr: "ambiguous"},
+		{ref: "nope"},
+		{ref: ""},
+	}
+	for _, backend := range []string{BackendJSON, BackendSQLite} {
+		t.Run(backend, func(t *testing.T) {
+			store := openTestStore(t, backend)
+			for _, record := range records {
+				if err := store.AddInstance(record); err != nil {
+					t.Fatalf("AddInstance(%s) failed: %v", record.ID, err)
+				}
+			}
+			for _, tt := range tests {
+				inst, found, err := ResolveInstance(store, tt.ref)
+				if tt.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Errorf("ResolveInstance(%q) error = %v, want one containing %q", tt.ref, err, tt.wantErr)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("ResolveInstance(%q) returned error: %v", tt.ref, err)
+					continue
+				}
+				if found != (tt.wantID != "") || inst.ID != tt.wantID {
+					t.Errorf("ResolveInstance(%q) = %q (found: %v), want %q", tt.ref, inst.ID, found, tt.wantID)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveRun(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	runs := []RunRecord{
+		{ID: "aa110000", Name: "main-brave-otter", Ref: "main", StartTime: start},
+		{ID: "aa220000", Name: "api", Ref: "main", StartTime: start.Add(time.Minute)},
+		// The name was used again later; the latest run wins.
+		{ID: "bb330000", Name: "api", Ref: "develop", StartTime: start.Add(2 * time.Minute)},
+	}
+	tests := []struct {
+		ref     string
+		wantID  string
+		wantErr string
+	}{
+		{ref: "aa220000", wantID: "aa220000"},
+		{ref: "main-brave-otter", wantID: "aa110000"},
+		{ref: "api", wantID: "bb330000"},
+		{ref: "aa1", wantID: "aa110000"},
+		{ref: "aa", wantErr: "ambiguous"},
+		{ref: "cc"},
+		{ref: ""},
+	}
+	for _, backend := range []string{BackendJSON, BackendSQLite} {
+		t.Run(backend, func(t *testing.T) {
+			store := openTestStore(t, backend)
+			for _, run := range runs {
+				if err := store.AddRun(run); err != nil {
+					t.Fatalf("AddRun(%s) failed: %v", run.ID, err)
+				}
+			}
+			for _, tt := range tests {
+				run, found, err := ResolveRun(store, tt.ref)
+				if tt.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Errorf("ResolveRun(%q) error = %v, want one containing %q", tt.ref, err, tt.wantErr)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("ResolveRun(%q) returned error: %v", tt.ref, err)
+					continue
+				}
+				if found != (tt.wantID != "") || run.ID != tt.wantID {
+					t.Errorf("ResolveRun(%q) = %q (found: %v), want %q", tt.ref, run.ID, found, tt.wantID)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// currentSchemaVersion is the version of the store file this gitserve reads and writes.
+// Bump it together with a migration from the previous version whenever stored data has to be
+// changed for newer code to read it correctly. Fields that are only added need no migration.
+const currentSchemaVersion = 4
+
+// storeFile is the versioned envelope the instances and the run history are stored in. Files
+// written before the envelope existed hold just the instances map; they are schema version 1.
+type storeFile struct {
+	SchemaVersion int                  `json:"schemaVersion"`
+	Instances     map[string]Instance  `json:"instances"`
+	History       map[string]RunRecord `json:"history,omitempty"`
+}
+
+// rawStoreFile is storeFile with the instances left undecoded, for migrations.
+type rawStoreFile struct {
+	SchemaVersion int                  `json:"schemaVersion"`
+	Instances     json.RawMessage      `json:"instances"`
+	History       map[string]RunRecord `json:"history,omitempty"`
+}
+
+// migration upgrades the instances of a store file from schema version From to From+1.
+// Instances are handled as generic JSON objects, so a migration keeps working however the
+// Instance struct changes later on.
+type migration struct {
+	From        int
+	Description string
+	Migrate     func(instances map[string]map[string]any) error
+}
+
+// migrations is the registry of schema upgrades, one per version step.
+var migrations = []migration{
+	{
+		From:        1,
+		Description: "store the instances in a versioned envelope",
+		Migrate:     func(map[string]map[string]any) error { return nil }, // The envelope is added on save
+	},
+	{
+		From:        2,
+		Description: "keep the full restart policy and name instances after their ref",
+		Migrate:     migrateRunDefinition,
+	},
+	{
+		// Older versions would drop the history when rewriting the file, so they must refuse it.
+		From:        3,
+		Description: "add the run history",
+		Migrate:     func(map[string]map[string]any) error { return nil },
+	},
+}
+
+// migrateRunDefinition turns the restart policy name into a restart policy, drops the never
+// used gitserveId and renames instances from "<ref>-<ID prefix>" to their ref, which it also
+// records on its own. The ref is taken from the environment the instance was started with.
+// Names stay unique: of the instances of a ref, the oldest gets the ref as its name and the
+// others keep "<ref>-<ID prefix>". Processes are named after their instance.
+func migrateRunDefinition(instances map[string]map[string]any) error {
+	taken := make(map[string]bool)
+	var named []string // Top-level instances with a ref
+	for id, inst := range instances {
+		if policy, ok := inst["restartPolicy"].(string); ok && policy != "" {
+			inst["restart"] = map[string]any{"policy": policy}
+		}
+		delete(inst, "restartPolicy")
+		delete(inst, "gitserveId")
+
+		env, _ := inst["env"].(map[string]any)
+		ref, _ := env["GITSERVE_REF"].(string) // instance.EnvRef
+		if ref != "" {
+			inst["ref"] = ref
+		}
+		if parent, _ := inst["parent"].(string); parent != "" {
+			continue
+		}
+		if ref == "" {
+			name, _ := inst["name"].(string)
+			taken[name] = true // Keeps its name
+			continue
+		}
+		named = append(named, id)
+	}
+
+	startTime := func(id string) time.Time {
+		value, _ := instances[id]["startTime"].(string)
+		start, _ := time.Parse(time.RFC3339Nano, value)
+		return start
+	}
+	sort.Slice(named, func(i, j int) bool {
+		if iStart, jStart := startTime(named[i]), startTime(named[j]); !iStart.Equal(jStart) {
+			return iStart.Before(jStart)
+		}
+		return named[i] < named[j]
+	})
+	for _, id := range named {
+		inst := instances[id]
+		name := inst["ref"].(string)
+		if taken[name] {
+			name += "-" + id[:min(len(id), 8)]
+		}
+		for suffix := 2; taken[name]; suffix++ {
+			name = fmt.Sprintf("%s-%s-%d", inst["ref"], id[:min(len(id), 8)], suffix)
+		}
+		taken[name] = true
+		inst["name"] = name
+	}
+
+	for _, inst := range instances {
+		parent, _ := inst["parent"].(string)
+		process, _ := inst["process"].(string)
+		if parent == "" || process == "" {
+			continue
+		}
+		if parentName, ok := instances[parent]["name"].(string); ok && parentName != "" {
+			inst["name"] = parentName + "/" + process
+		} else if ref, _ := inst["ref"].(string); ref != "" {
+			inst["name"] = ref + "/" + process
+		}
+	}
+	return nil
+}
+
+// decodeStoreFile returns the contents of a store file, its instances migrated to the current
+// version if the file is older, and the schema version the file has. Files from a newer
+// version are refused: decoding them would silently drop whatever this gitserve doesn't know
+// about.
+func decodeStoreFile(path string, data []byte) (storeFile, int, error) {
+	file, err := splitStoreFile(data)
+	if err != nil {
+		return storeFile{}, 0, fmt.Errorf("error unmarshalling instances data from %s: %w", path, err)
+	}
+	version, rawInstances := file.SchemaVersion, file.Instances
+	if version > currentSchemaVersion {
+		return storeFile{}, version, fmt.Errorf("%s has schema version %d, but this gitserve only supports up to version %d; upgrade gitserve to use it",
+			path, version, currentSchemaVersion)
+	}
+
+	if version < currentSchemaVersion {
+		if rawInstances, err = migrateInstances(rawInstances, version); err != nil {
+			return storeFile{}, version, fmt.Errorf("error migrating %s: %w", path, err)
+		}
+	}
+	instances := make(map[string]Instance)
+	if len(rawInstances) > 0 && !bytes.Equal(rawInstances, []byte("null")) {
+		if err := json.Unmarshal(rawInstances, &instances); err != nil {
+			return storeFile{}, version, fmt.Errorf("error unmarshalling instances data from %s: %w", path, err)
+		}
+	}
+	return storeFile{SchemaVersion: version, Instances: instances, History: file.History}, version, nil
+}
+
+// splitStoreFile decodes the envelope of a store file, leaving its instances undecoded.
+func splitStoreFile(data []byte) (rawStoreFile, error) {
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(data, &top); err != nil {
+		return rawStoreFile{}, err
+	}
+	if _, ok := top["schemaVersion"]; !ok {
+		// No envelope; instance IDs never clash with the envelope's keys
+		return rawStoreFile{SchemaVersion: 1, Instances: data}, nil
+	}
+	var file rawStoreFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return rawStoreFile{}, err
+	}
+	if file.SchemaVersion < 1 {
+		return rawStoreFile{}, fmt.Errorf("invalid schema version %d", file.SchemaVersion)
+	}
+	return file, nil
+}
+
+// migrateInstances runs the registered migrations from version up to currentSchemaVersion.
+func migrateInstances(rawInstances json.RawMessage, version int) (json.RawMessage, error) {
+	instances := make(map[string]map[string]any)
+	decoder := json.NewDecoder(bytes.NewReader(rawInstances))
+	decoder.UseNumber() // Keep large integers (start times in clock ticks) exact
+	if err := decoder.Decode(&instances); err != nil {
+		return nil, err
+	}
+	for ; version < currentSchemaVersion; version++ {
+		step, ok := migrationFrom(version)
+		if !ok {
+			return nil, fmt.Errorf("no migration from schema version %d", version)
+		}
+		if err := step.Migrate(instances); err != nil {
+			return nil, fmt.Errorf("migration from schema version %d (%s): %w", version, step.Description, err)
+		}
+	}
+	return json.Marshal(instances)
+}
+
+// migrationFrom returns the registered migration from version to the next one.
+func migrationFrom(version int) (migration, bool) {
+	for _, m := range migrations {
+		if m.From == version {
+			return m, true
+		}
+	}
+	return migration{}, false
+}
+
+// backupStoreFile copies a store file that is about to be migrated next to it, as
+// <file>.v<version>-<timestamp>.bak, and returns the path of the copy.
+func backupStoreFile(path string, data []byte, version int) (string, error) {
+	backupPath := fmt.Sprintf("%s.v%d-%s.bak", path, version, time.Now().UTC().Format("20060102T150405"))
+	backup, err := os.OpenFile(backupPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := backup.Write(data); err != nil {
+		backup.Close()
+		return "", err
+	}
+	if err := backup.Sync(); err != nil {
+		backup.Close()
+		return "", err
+	}
+	return backupPath, backup.Close()
+}
@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gitserve/internal/logger"
+	"gitserve/internal/models"
+)
+
+// A store file as gitserve wrote it before the envelope: just the instances map.
+const storeFileV1 = `{
+  "3f2c9a1e": {
+    "id": "3f2c9a1e",
+    "name": "main-3f2c9a1e",
+    "gitserveId": "unused",
+    "restartPolicy": "on-failure",
+    "env": {"GITSERVE_REF": "main", "PORT": "4000"},
+    "processStartTime": 18446744073709551615
+  },
+  "7a000000/web": {
+    "id": "7a000000/web",
+    "name": "develop-7a000000/web",
+    "parent": "7a000000",
+    "process": "web",
+    "env": {"GITSERVE_REF": "develop"}
+  },
+  "b0000000": {"id": "b0000000", "name": "no-ref"}
+}`
+
+func TestDecodeStoreFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		wantVersion int
+		want        map[string]Instance
+		wantRuns    int
+		wantErr     string
+	}{
+		{
+			name:        "version 1",
+			data:        storeFileV1,
+			wantVersion: 1,
+			want: map[string]Instance{
+				"3f2c9a1e": {
+					ID: "3f2c9a1e", Name: "main", Ref: "main",
+					Restart:          models.RestartPolicy{Policy: models.RestartOnFailure},
+					Env:              map[string]string{"GITSERVE_REF": "main", "PORT": "4000"},
+					ProcessStartTime: 18446744073709551615,
+				},
+				"7a000000/web": {
+					ID: "7a000000/web", Name: "develop/web", Ref: "develop", Parent: "7a000000", Process: "web",
+					Env: map[string]string{"GITSERVE_REF": "develop"},
+				},
+				// Without the ref in its environment, an instance keeps its name.
+				"b0000000": {ID: "b0000000", Name: "no-ref"},
+			},
+		},
+		{
+			name:        "version 2",
+			data:        `{"schemaVersion": 2, "instances": {"a1": {"id": "a1", "restartPolicy": "always", "env": {"GITSERVE_REF": "v1.0"}}}}`,
+			wantVersion: 2,
+			want: map[string]Instance{
+				"a1": {ID: "a1", Name: "v1.0", Ref: "v1.0", Restart: models.RestartPolicy{Policy: models.RestartAlways}, Env: map[string]string{"GITSERVE_REF": "v1.0"}},
+			},
+		},
+		{
+			// The oldest instance of a ref is named after it, the others keep their ID prefix.
+			name: "version 2 with instances of the same ref",
+			data: `{"schemaVersion": 2, "instances": {
+				"bbbbbbbb-1": {"id": "bbbbbbbb-1", "name": "main-bbbbbbbb", "startTime": "2025-05-01T10:00:00.5Z", "env": {"GITSERVE_REF": "main"}, "processes": ["web"]},
+				"bbbbbbbb-1/web": {"id": "bbbbbbbb-1/web", "name": "main-bbbbbbbb/web", "parent": "bbbbbbbb-1", "process": "web", "env": {"GITSERVE_REF": "main"}},
+				"aaaaaaaa-2": {"id": "aaaaaaaa-2", "name": "main-aaaaaaaa", "startTime": "2025-05-01T10:00:00.25Z", "env": {"GITSERVE_REF": "main"}},
+				"cccccccc-3": {"id": "cccccccc-3", "name": "main-cccccccc", "startTime": "2025-05-02T08:00:00Z", "env": {"GITSERVE_REF": "main"}}
+			}}`,
+			wantVersion: 2,
+			want: map[string]Instance{
+				"aaaaaaaa-2": {ID: "aaaaaaaa-2", Name: "main", Ref: "main", StartTime: time.Date(2025, 5, 1, 10, 0, 0, 250000000, time.UTC), Env: map[string]string{"GITSERVE_REF": "main"}},
+				"bbbbbbbb-1": {ID: "bbbbbbbb-1", Name: "main-bbbbbbbb", Ref: "main", StartTime: time.Date(2025, 5, 1, 10, 0, 0, 500000000, time.UTC), Env: map[string]string{"GITSERVE_REF": "main"}, Processes: []string{"web"}},
+				"bbbbbbbb-1/web": {
+					ID: "bbbbbbbb-1/web", Name: "main-bbbbbbbb/web", Ref: "main", Parent: "bbbbbbbb-1", Process: "web",
+					Env: map[string]string{"GITSERVE_REF": "main"},
+				},
+				"cccccccc-3": {ID: "cccccccc-3", Name: "main-cccccccc", Ref: "main", StartTime: time.Date(2025, 5, 2, 8, 0, 0, 0, time.UTC), Env: map[string]string{"GITSERVE_REF": "main"}},
+			},
+		},
+		{
+			// An instance without a ref keeps its name, even if it is a ref.
+			name: "version 2 with a ref taken as a name",
+			data: `{"schemaVersion": 2, "instances": {
+				"aaaaaaaa-1": {"id": "aaaaaaaa-1", "name": "develop"},
+				"bbbbbbbb-2": {"id": "bbbbbbbb-2", "name": "develop-bbbbbbbb", "env": {"GITSERVE_REF": "develop"}}
+			}}`,
+			wantVersion: 2,
+			want: map[string]Instance{
+				"aaaaaaaa-1": {ID: "aaaaaaaa-1", Name: "develop"},
+				"bbbbbbbb-2": {ID: "bbbbbbbb-2", Name: "develop-bbbbbbbb", Ref: "develop", Env: map[string]string{"GITSERVE_REF": "develop"}},
+			},
+		},
+		{
+			// Version 3 only added the run history; the instances are read as they are.
+			name:        "version 3",
+			data:        `{"schemaVersion": 3, "instances": {"a1": {"id": "a1", "name": "custom", "ref": "main"}}}`,
+			wantVersion: 3,
+			want:        map[string]Instance{"a1": {ID: "a1", Name: "custom", Ref: "main"}},
+		},
+		{
+			name:        "current version",
+			data:        `{"schemaVersion": 4, "instances": {"a1": {"id": "a1", "name": "main", "ref": "main"}}, "history": {"r1": {"id": "r1"}}}`,
+			wantVersion: 4,
+			want:        map[string]Instance{"a1": {ID: "a1", Name: "main", Ref: "main"}},
+			wantRuns:    1,
+		},
+		{
+			name:        "no instances",
+			data:        `{"schemaVersion": 4, "instances": null}`,
+			wantVersion: 4,
+			want:        map[string]Instance{},
+		},
+		{
+			name:        "newer version",
+			data:        `{"schemaVersion": 5, "instances": {}}`,
+			wantVersion: 5,
+			wantErr:     "upgrade gitserve",
+		},
+		{name: "invalid version", data: `{"schemaVersion": 0, "instances": {}}`, wantErr: "invalid schema version"},
+		{name: "not JSON", data: `{"a1": `, wantErr: "error unmarshalling"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, version, err := decodeStoreFile("instances.json", []byte(tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("decodeStoreFile() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				if version != tt.wantVersion {
+					t.Errorf("decodeStoreFile() version = %d, want %d", version, tt.wantVersion)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeStoreFile() returned error: %v", err)
+			}
+			if version != tt.wantVersion {
+				t.Errorf("decodeStoreFile() version = %d, want %d", version, tt.wantVersion)
+			}
+			if len(file.Instances) != len(tt.want) {
+				t.Errorf("decodeStoreFile() returned %d instances, want %d", len(file.Instances), len(tt.want))
+			}
+			for id, want := range tt.want {
+				if got := file.Instances[id]; !equalJSON(t, got, want) {
+					t.Errorf("instance %s = %+v, want %+v", id, got, want)
+				}
+			}
+			if len(file.History) != tt.wantRuns {
+				t.Errorf("decodeStoreFile() returned %d runs, want %d", len(file.History), tt.wantRuns)
+			}
+		})
+	}
+}
+
+func TestJSONStoreUpgradesOlderFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, instancesFile)
+	if err := os.WriteFile(path, []byte(storeFileV1), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Opening the store upgrades the file, after backing it up.
+	store, err := NewJSONInstanceStore(dir, logger.NewService(logger.LogLevelError))
+	if err != nil {
+		t.Fatalf("NewJSONInstanceStore() returned error: %v", err)
+	}
+	backups, _ := filepath.Glob(path + ".v1-*.bak")
+	if len(backups) != 1 {
+		t.Fatalf("found backups %v, want one", backups)
+	}
+	if backup, err := os.ReadFile(backups[0]); err != nil || string(backup) != storeFileV1 {
+		t.Errorf("backup holds %q (%v), want the old file", backup, err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file storeFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatalf("upgraded file is invalid: %v", err)
+	}
+	if file.SchemaVersion != currentSchemaVersion {
+		t.Errorf("upgraded file has schema version %d, want %d", file.SchemaVersion, currentSchemaVersion)
+	}
+	if got := file.Instances["7a000000/web"].Name; got != "develop/web" {
+		t.Errorf("upgraded file names the process %q, want %q", got, "develop/web")
+	}
+	if strings.Contains(string(data), "gitserveId") || strings.Contains(string(data), "restartPolicy") {
+		t.Errorf("upgraded file still has the old fields:\n%s", data)
+	}
+
+	inst, found, err := store.GetInstanceByID("3f2c9a1e")
+	if err != nil || !found || inst.Name != "main" || inst.Restart.Policy != models.RestartOnFailure {
+		t.Errorf("GetInstanceByID() = %+v, %v, %v; want the migrated instance", inst, found, err)
+	}
+}
+
+func TestJSONStoreRefusesNewerFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, instancesFile)
+	newer := `{"schemaVersion": 99, "instances": {"a1": {"id": "a1", "futureField": true}}}`
+	if err := os.WriteFile(path, []byte(newer), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := NewJSONInstanceStore(dir, logger.NewService(logger.LogLevelError))
+	if err == nil || !strings.Contains(err.Error(), "schema version 99") {
+		t.Errorf("NewJSONInstanceStore() error = %v, want the newer schema version refused", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != newer {
+		t.Errorf("newer file was rewritten:\n%s", data)
+	}
+	if backups, _ := filepath.Glob(path + ".*.bak"); len(backups) != 0 {
+		t.Errorf("found backups %v of a newer file", backups)
+	}
+}
+
+// equalJSON reports whether two values encode to the same JSON.
+func equalJSON(t *testing.T, a, b any) bool {
+	t.Helper()
+	aJSON, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bJSON, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(aJSON) == string(bJSON)
+}
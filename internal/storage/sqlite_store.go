@@ -0,0 +1,513 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gitserve/internal/logger"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // Registers the pure Go "sqlite" driver
+)
+
+const databaseFile = "gitserve_instances.db"
+
+// sqliteBusyTimeout is how long a connection waits for another process to finish writing
+// before giving up with SQLITE_BUSY.
+const sqliteBusyTimeout = 10 * time.Second
+
+// sqliteSchema creates the instances and runs tables. Each row holds an instance or a run as
+// JSON, encoded like in the JSON store so the same schema migrations apply, next to indexed
+// copies of the fields they are looked up by. Runs are ordered by their start time, in
+// nanoseconds since the epoch.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS instances (
+	id      TEXT PRIMARY KEY,
+	parent  TEXT NOT NULL DEFAULT '',
+	status  TEXT NOT NULL DEFAULT '',
+	project TEXT NOT NULL DEFAULT '',
+	ref     TEXT NOT NULL DEFAULT '',
+	data    TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS instances_parent ON instances (parent);
+CREATE INDEX IF NOT EXISTS instances_status ON instances (status);
+CREATE INDEX IF NOT EXISTS instances_project ON instances (project);
+CREATE INDEX IF NOT EXISTS instances_ref ON instances (ref);
+CREATE TABLE IF NOT EXISTS runs (
+	id      TEXT PRIMARY KEY,
+	status  TEXT NOT NULL DEFAULT '',
+	project TEXT NOT NULL DEFAULT '',
+	ref     TEXT NOT NULL DEFAULT '',
+	started INTEGER NOT NULL DEFAULT 0,
+	data    TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS runs_status ON runs (status);
+CREATE INDEX IF NOT EXISTS runs_project ON runs (project);
+CREATE INDEX IF NOT EXISTS runs_ref ON runs (ref);
+CREATE INDEX IF NOT EXISTS runs_started ON runs (started);
+`
+
+// sqliteQuerier is what the store needs of a database or a transaction.
+type sqliteQuerier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// sqliteInstanceStore is an InstanceStore kept in an SQLite database. SQLite does the locking
+// between gitserve processes: the database runs in WAL mode, so reads don't wait for writes,
+// and every transaction takes the write lock up front (BEGIN IMMEDIATE).
+type sqliteInstanceStore struct {
+	db  *sql.DB       // nil in the view of a transaction
+	q   sqliteQuerier // db, or the transaction
+	log logger.Service
+}
+
+// NewSQLiteInstanceStore opens (creating it if needed) the SQLite instance store in dataDirPath.
+func NewSQLiteInstanceStore(dataDirPath string, log logger.Service) (InstanceStore, error) {
+	if err := ensureDirExists(dataDirPath); err != nil {
+		return nil, fmt.Errorf("failed to ensure storage directory exists: %w", err)
+	}
+	path := filepath.Join(dataDirPath, databaseFile)
+	// Create the file ourselves, so it isn't readable by others.
+	if file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600); err != nil {
+		return nil, fmt.Errorf("error opening database %s: %w", path, err)
+	} else {
+		file.Close()
+	}
+
+	dsn := fmt.Sprintf("%s?_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)&_txlock=immediate",
+		path, sqliteBusyTimeout.Milliseconds())
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database %s: %w", path, err)
+	}
+	store := &sqliteInstanceStore{db: db, q: db, log: log}
+	if err := store.initSchema(path); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to load instances: %w", err)
+	}
+	return store, nil
+}
+
+// initSchema creates the tables of a new database and migrates the instances of one written
+// by an older gitserve, after backing it up. Databases of newer versions are refused, like
+// store files.
+func (s *sqliteInstanceStore) initSchema(path string) error {
+	version, err := s.schemaVersion()
+	if err != nil {
+		return fmt.Errorf("error reading schema version of %s: %w", path, err)
+	}
+	if version > currentSchemaVersion {
+		return fmt.Errorf("%s has schema version %d, but this gitserve only supports up to version %d; upgrade gitserve to use it",
+			path, version, currentSchemaVersion)
+	}
+	if version == currentSchemaVersion {
+		return nil
+	}
+
+	backupPath := ""
+	if version > 0 {
+		backupPath = fmt.Sprintf("%s.v%d-%s.bak", path, version, time.Now().UTC().Format("20060102T150405"))
+		if _, err := s.db.Exec("VACUUM INTO ?", backupPath); err != nil {
+			return fmt.Errorf("error backing up %s before migrating it: %w", path, err)
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Another process may have set the database up in the meantime.
+	if err := tx.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version == currentSchemaVersion {
+		return nil
+	}
+	if _, err := tx.Exec(sqliteSchema); err != nil {
+		return fmt.Errorf("error creating tables in %s: %w", path, err)
+	}
+	if version > 0 {
+		if err := migrateRows(tx, version); err != nil {
+			return fmt.Errorf("error migrating %s (the old database is kept as %s): %w", path, backupPath, err)
+		}
+	}
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", currentSchemaVersion)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if version > 0 {
+		s.log.Info("Migrated %s from schema version %d to %d; the old database is kept as %s.",
+			path, version, currentSchemaVersion, backupPath)
+	}
+	return nil
+}
+
+// schemaVersion returns the schema version of the database; 0 for a new one.
+func (s *sqliteInstanceStore) schemaVersion() (int, error) {
+	var version int
+	err := s.db.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+// migrateRows runs the registered migrations over every row of a database of an older schema
+// version and writes the rows back.
+func migrateRows(tx *sql.Tx, version int) error {
+	rows, err := tx.Query("SELECT id, data FROM instances")
+	if err != nil {
+		return err
+	}
+	raw := make(map[string]json.RawMessage)
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			rows.Close()
+			return err
+		}
+		raw[id] = json.RawMessage(data)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	migrated, err := migrateInstances(encoded, version)
+	if err != nil {
+		return err
+	}
+	var instances map[string]Instance
+	if err := json.Unmarshal(migrated, &instances); err != nil {
+		return err
+	}
+	view := &sqliteInstanceStore{q: tx}
+	for id, instance := range instances {
+		if err := view.UpdateInstance(id, instance); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddInstance adds a new instance to the store.
+func (s *sqliteInstanceStore) AddInstance(instance Instance) error {
+	data, err := json.Marshal(instance)
+	if err != nil {
+		return fmt.Errorf("error marshalling instance '%s': %w", instance.ID, err)
+	}
+	return s.inTransaction(func(tx *sqliteInstanceStore) error {
+		// The transaction holds the write lock, so no other instance can take the name meanwhile.
+		if instance.Parent == "" && instance.Name != "" {
+			var otherID string
+			err := tx.q.QueryRow(`SELECT id FROM instances WHERE parent = '' AND json_extract(data, '$.name') = ? LIMIT 1`,
+				instance.Name).Scan(&otherID)
+			if err == nil {
+				return fmt.Errorf("%w: instance '%s' is named '%s'", ErrNameTaken, otherID, instance.Name)
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("error checking the name of instance '%s': %w", instance.ID, err)
+			}
+		}
+		result, err := tx.q.Exec(`INSERT INTO instances (id, parent, status, project, ref, data)
+			VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING`,
+			instance.ID, instance.Parent, instance.Status, instance.Project, instance.Ref, string(data))
+		if err != nil {
+			return fmt.Errorf("error adding instance '%s': %w", instance.ID, err)
+		}
+		if added, err := result.RowsAffected(); err == nil && added == 0 {
+			return fmt.Errorf("instance with ID '%s' already exists", instance.ID)
+		}
+		return tx.follow(instance)
+	})
+}
+
+// GetInstanceByID retrieves a specific instance by its ID.
+func (s *sqliteInstanceStore) GetInstanceByID(id string) (Instance, bool, error) {
+	var data string
+	err := s.q.QueryRow("SELECT data FROM instances WHERE id = ?", id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Instance{}, false, nil
+	}
+	if err != nil {
+		return Instance{}, false, fmt.Errorf("error reading instance '%s': %w", id, err)
+	}
+	var instance Instance
+	if err := json.Unmarshal([]byte(data), &instance); err != nil {
+		return Instance{}, false, fmt.Errorf("error unmarshalling instance '%s': %w", id, err)
+	}
+	return instance, true, nil
+}
+
+// GetAllInstances returns a slice of all stored instances.
+func (s *sqliteInstanceStore) GetAllInstances() ([]Instance, error) {
+	return s.FindInstances(InstanceFilter{})
+}
+
+// FindInstances returns the stored instances that match filter, using the indexes.
+func (s *sqliteInstanceStore) FindInstances(filter InstanceFilter) ([]Instance, error) {
+	var conditions []string
+	var args []any
+	if len(filter.Statuses) > 0 {
+		conditions = append(conditions, "status IN (?"+strings.Repeat(", ?", len(filter.Statuses)-1)+")")
+		for _, status := range filter.Statuses {
+			args = append(args, status)
+		}
+	}
+	if filter.Project != "" {
+		conditions = append(conditions, "project = ?")
+		args = append(args, filter.Project)
+	}
+	if filter.Ref != "" {
+		conditions = append(conditions, "ref = ?")
+		args = append(args, filter.Ref)
+	}
+	if filter.Parent != "" {
+		conditions = append(conditions, "parent = ?")
+		args = append(args, filter.Parent)
+	}
+	if filter.TopLevel {
+		conditions = append(conditions, "parent = ''")
+	}
+	query := "SELECT id, data FROM instances"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	rows, err := s.q.Query(query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("error reading instances: %w", err)
+	}
+	defer rows.Close()
+	instances := []Instance{}
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, fmt.Errorf("error reading instances: %w", err)
+		}
+		var instance Instance
+		if err := json.Unmarshal([]byte(data), &instance); err != nil {
+			return nil, fmt.Errorf("error unmarshalling instance '%s': %w", id, err)
+		}
+		// Labels aren't indexed; a selector is applied to the decoded instances.
+		if !filter.Selector.Matches(instance.Labels) {
+			continue
+		}
+		instances = append(instances, instance)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading instances: %w", err)
+	}
+	return instances, nil
+}
+
+// UpdateInstance modifies an existing instance in the store.
+func (s *sqliteInstanceStore) UpdateInstance(id string, updatedInstance Instance) error {
+	data, err := json.Marshal(updatedInstance)
+	if err != nil {
+		return fmt.Errorf("error marshalling instance '%s': %w", id, err)
+	}
+	return s.inTransaction(func(tx *sqliteInstanceStore) error {
+		result, err := tx.q.Exec(`UPDATE instances SET parent = ?, status = ?, project = ?, ref = ?, data = ? WHERE id = ?`,
+			updatedInstance.Parent, updatedInstance.Status, updatedInstance.Project, updatedInstance.Ref, string(data), id)
+		if err != nil {
+			return fmt.Errorf("error updating instance '%s': %w", id, err)
+		}
+		if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+			return fmt.Errorf("instance with ID '%s' not found for update", id)
+		}
+		return tx.follow(updatedInstance)
+	})
+}
+
+// ModifyInstance reads, modifies and writes back an instance in one transaction.
+func (s *sqliteInstanceStore) ModifyInstance(id string, modify func(inst *Instance)) (bool, error) {
+	found := false
+	err := s.inTransaction(func(tx *sqliteInstanceStore) error {
+		instance, exists, err := tx.GetInstanceByID(id)
+		if err != nil || !exists {
+			return err
+		}
+		found = true
+		before := instance
+		modify(&instance)
+		if reflect.DeepEqual(before, instance) {
+			return nil
+		}
+		return tx.UpdateInstance(id, instance)
+	})
+	return found, err
+}
+
+// DeleteInstance removes an instance from the store by its ID.
+func (s *sqliteInstanceStore) DeleteInstance(id string) error {
+	result, err := s.q.Exec("DELETE FROM instances WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("error deleting instance '%s': %w", id, err)
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return fmt.Errorf("instance with ID '%s' not found for delete", id)
+	}
+	return nil
+}
+
+// follow updates the run of a saved instance, if it has one; see followInstance.
+func (s *sqliteInstanceStore) follow(instance Instance) error {
+	if instance.Parent != "" {
+		return nil
+	}
+	run, found, err := s.GetRun(instance.ID)
+	if err != nil || !found || !followInstance(&run, instance) {
+		return err
+	}
+	return s.updateRun(run)
+}
+
+// AddRun records a run in the run history.
+func (s *sqliteInstanceStore) AddRun(run RunRecord) error {
+	data, err := json.Marshal(run)
+	if err != nil {
+		return fmt.Errorf("error marshalling run '%s': %w", run.ID, err)
+	}
+	result, err := s.q.Exec(`INSERT INTO runs (id, status, project, ref, started, data)
+		VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING`,
+		run.ID, run.Status, run.Project, run.Ref, run.StartTime.UnixNano(), string(data))
+	if err != nil {
+		return fmt.Errorf("error adding run '%s': %w", run.ID, err)
+	}
+	if added, err := result.RowsAffected(); err == nil && added == 0 {
+		return fmt.Errorf("run with ID '%s' already exists", run.ID)
+	}
+	return nil
+}
+
+// GetRun returns a run from the run history by its ID.
+func (s *sqliteInstanceStore) GetRun(id string) (RunRecord, bool, error) {
+	var data string
+	err := s.q.QueryRow("SELECT data FROM runs WHERE id = ?", id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RunRecord{}, false, nil
+	}
+	if err != nil {
+		return RunRecord{}, false, fmt.Errorf("error reading run '%s': %w", id, err)
+	}
+	var run RunRecord
+	if err := json.Unmarshal([]byte(data), &run); err != nil {
+		return RunRecord{}, false, fmt.Errorf("error unmarshalling run '%s': %w", id, err)
+	}
+	return run, true, nil
+}
+
+// FindRuns returns the runs in the history that match filter, oldest first, using the indexes.
+func (s *sqliteInstanceStore) FindRuns(filter RunFilter) ([]RunRecord, error) {
+	var conditions []string
+	var args []any
+	if len(filter.Statuses) > 0 {
+		conditions = append(conditions, "status IN (?"+strings.Repeat(", ?", len(filter.Statuses)-1)+")")
+		for _, status := range filter.Statuses {
+			args = append(args, status)
+		}
+	}
+	if filter.Project != "" {
+		conditions = append(conditions, "project = ?")
+		args = append(args, filter.Project)
+	}
+	if filter.Ref != "" {
+		conditions = append(conditions, "ref = ?")
+		args = append(args, filter.Ref)
+	}
+	query := "SELECT id, data FROM runs"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	rows, err := s.q.Query(query+" ORDER BY started, id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("error reading runs: %w", err)
+	}
+	defer rows.Close()
+	runs := []RunRecord{}
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, fmt.Errorf("error reading runs: %w", err)
+		}
+		var run RunRecord
+		if err := json.Unmarshal([]byte(data), &run); err != nil {
+			return nil, fmt.Errorf("error unmarshalling run '%s': %w", id, err)
+		}
+		runs = append(runs, run)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading runs: %w", err)
+	}
+	return runs, nil
+}
+
+// ModifyRun reads, modifies and writes back a run in one transaction.
+func (s *sqliteInstanceStore) ModifyRun(id string, modify func(run *RunRecord)) (bool, error) {
+	found := false
+	err := s.inTransaction(func(tx *sqliteInstanceStore) error {
+		run, exists, err := tx.GetRun(id)
+		if err != nil || !exists {
+			return err
+		}
+		found = true
+		before := run
+		modify(&run)
+		if reflect.DeepEqual(before, run) {
+			return nil
+		}
+		return tx.updateRun(run)
+	})
+	return found, err
+}
+
+func (s *sqliteInstanceStore) updateRun(run RunRecord) error {
+	data, err := json.Marshal(run)
+	if err != nil {
+		return fmt.Errorf("error marshalling run '%s': %w", run.ID, err)
+	}
+	_, err = s.q.Exec(`UPDATE runs SET status = ?, project = ?, ref = ?, started = ?, data = ? WHERE id = ?`,
+		run.Status, run.Project, run.Ref, run.StartTime.UnixNano(), string(data), run.ID)
+	if err != nil {
+		return fmt.Errorf("error updating run '%s': %w", run.ID, err)
+	}
+	return nil
+}
+
+// Transaction runs fn in an SQLite transaction, which holds the write lock from the start.
+func (s *sqliteInstanceStore) Transaction(fn func(tx InstanceStore) error) error {
+	return s.inTransaction(func(tx *sqliteInstanceStore) error { return fn(tx) })
+}
+
+// inTransaction runs fn with a view of the store in a transaction, or in the transaction the
+// store already is a view of.
+func (s *sqliteInstanceStore) inTransaction(fn func(tx *sqliteInstanceStore) error) error {
+	if s.db == nil {
+		return fn(s) // Already in a transaction
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	if err := fn(&sqliteInstanceStore{q: tx, log: s.log}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
@@ -5,9 +5,14 @@ import (
 	"gitserve/internal/models"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 )
 
+// instanceNamePattern is what --instance-name accepts. Names can't contain a slash, which
+// separates an instance from its process in "<instance>/<process>".
+var instanceNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
 // ServiceImpl implements the Validation service interface
 type ServiceImpl struct{}
 
@@ -77,5 +82,31 @@ func (s *ServiceImpl) ValidateRunRequest(request *models.RunRequest) error {
 		return errors.New("unknown git source type")
 	}
 
+	if request.TTY && !request.Detached {
+		return errors.New("a TTY (--tty) is only needed for detached runs; foreground runs already use your terminal")
+	}
+
+	switch request.Sandbox.Network {
+	case "", models.SandboxNetworkLoopback, models.SandboxNetworkHost:
+	default:
+		return errors.New("invalid sandbox network '" + request.Sandbox.Network + "' (expected loopback or host)")
+	}
+	if request.Sandbox.Network != "" && !request.Sandbox.Enabled {
+		return errors.New("--sandbox-network only applies to sandboxed runs (--sandbox)")
+	}
+
+	if request.InstanceName != "" && !instanceNamePattern.MatchString(request.InstanceName) {
+		return errors.New("invalid instance name '" + request.InstanceName + "' (use letters, digits, '.', '_' and '-', starting with a letter or digit)")
+	}
+
+	for key, value := range request.Labels {
+		if models.IsReservedLabel(key) {
+			return errors.New("label '" + key + "' is set by gitserve and can't be given with --label")
+		}
+		if err := models.ValidateLabel(key, value); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }